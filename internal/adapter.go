@@ -153,6 +153,26 @@ func (a *httpRequestAPIAdapter) GetParameters() api.RequestRecord_Request_Parame
 	}
 }
 
+func (a *httpRequestAPIAdapter) GetGraphqlOperationNames() []string {
+	return a.adaptee.Params().GraphQLOperationNames()
+}
+
+func (a *httpRequestAPIAdapter) GetWebsocket() *api.RequestRecord_Request_WebSocket {
+	req, ok := a.adaptee.(types.WebSocketRequestReader)
+	if !ok {
+		return nil
+	}
+	ws := req.WebSocket()
+	return &api.RequestRecord_Request_WebSocket{
+		ConnectionId: ws.ConnectionID,
+		Subprotocol:  ws.Subprotocol,
+		ConnectedAt:  ws.ConnectedAt,
+		MessageType:  ws.MessageType,
+		MessageIndex: ws.MessageIndex,
+		MessageSize:  ws.MessageSize,
+	}
+}
+
 func (a closedHTTPRequestContextEventAPIAdapter) GetRequest() api.RequestRecord_Request {
 	return *api.NewRequestRecord_RequestFromFace(&httpRequestAPIAdapter{
 		adaptee:            a.adaptee.request,
@@ -323,6 +343,40 @@ func (a *closedHTTPRequestContextEventAPIAdapter) GetDataPoints() []*api.Request
 	return nil
 }
 
+func (a *closedHTTPRequestContextEventAPIAdapter) GetTrace() *api.RequestRecord_Observed_Trace {
+	if a.adaptee.events.Trace == nil {
+		return nil
+	}
+	return newAPITrace(a.adaptee.events.Trace)
+}
+
+func newAPITrace(trace *event.Trace) *api.RequestRecord_Observed_Trace {
+	entries, truncated := trace.Entries()
+	t := &api.RequestRecord_Observed_Trace{
+		Id:        trace.ID,
+		Truncated: truncated,
+		Entries:   make([]*api.RequestRecord_Observed_TraceEntry, len(entries)),
+	}
+	for i, e := range entries {
+		entry := &api.RequestRecord_Observed_TraceEntry{
+			Rule:     e.Rule,
+			Callback: e.Callback,
+			Time:     e.Start,
+			Duration: float64(e.Duration.Nanoseconds()) / float64(time.Millisecond),
+			Executed: e.Executed,
+			Error:    e.Error,
+		}
+		if len(e.Values) > 0 {
+			entry.Values = make([]api.RequestRecord_Observed_TraceValue, len(e.Values))
+			for j, v := range e.Values {
+				entry.Values[j] = api.RequestRecord_Observed_TraceValue{Name: v.Name, Value: v.Value}
+			}
+		}
+		t.Entries[i] = entry
+	}
+	return t
+}
+
 func newMetricsAPIAdapter(logger plog.ErrorLogger, readyMetrics map[string]metrics.ReadyStore) []api.MetricsTimeBucket {
 	if len(readyMetrics) == 0 {
 		return nil
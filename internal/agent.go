@@ -29,6 +29,7 @@ import (
 	"github.com/sqreen/go-agent/internal/plog"
 	http_protection_types "github.com/sqreen/go-agent/internal/protection/http/types"
 	"github.com/sqreen/go-agent/internal/rule"
+	"github.com/sqreen/go-agent/internal/rule/callback"
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
 	"github.com/sqreen/go-agent/internal/sqlib/sqsafe"
 	"github.com/sqreen/go-agent/internal/sqlib/sqsanitize"
@@ -183,6 +184,7 @@ type AgentType struct {
 	actors            *actor.Store
 	rules             *rule.Engine
 	piiScrubber       *sqsanitize.Scrubber
+	traces            *traceStore
 	runningAccessLock sync.RWMutex
 	running           bool
 	performanceBudget time.Duration
@@ -222,6 +224,48 @@ func New(cfg *config.Config) *AgentType {
 		return nil
 	}
 	rulesEngine := rule.NewEngine(logger, nil, metrics, publicKey, perfHistogramUnit, perfHistogramBase, perfHistogramPeriod)
+	rulesEngine.SetCircuitBreaker(rule.CircuitBreakerConfig{
+		MaxFailures: cfg.RuleCircuitBreakerMaxFailures(),
+		MaxLatency:  cfg.RuleCircuitBreakerMaxLatency(),
+		CoolDown:    cfg.RuleCircuitBreakerCoolDown(),
+	})
+	rulesEngine.SetAutoRollback(rule.AutoRollbackConfig{
+		Window:        cfg.RulesAutoRollbackWindow(),
+		MaxErrors:     cfg.RulesAutoRollbackMaxErrors(),
+		MaxOverBudget: cfg.RulesAutoRollbackMaxOverBudget(),
+	})
+	if publicKeysFile := cfg.RulesPublicKeysFile(); publicKeysFile != "" {
+		buf, err := ioutil.ReadFile(publicKeysFile)
+		if err == nil {
+			var keys []rule.PublicKey
+			keys, err = rule.NewECDSAPublicKeys(buf)
+			if err == nil {
+				rulesEngine.SetLocalPublicKeys(keys)
+				for _, key := range keys {
+					logger.Infof("agent: trusting the local rule signing public key `%s`", key.ID)
+				}
+			}
+		}
+		if err != nil {
+			logger.Error(sqerrors.Wrap(err, "config: could not read the rules public keys file"))
+		}
+	}
+	if exclusionsFile := cfg.WAFExclusionsFile(); exclusionsFile != "" {
+		buf, err := ioutil.ReadFile(exclusionsFile)
+		if err == nil {
+			var exclusions []callback.WAFExclusion
+			exclusions, err = callback.NewWAFExclusions(buf)
+			if err == nil {
+				rulesEngine.SetWAFExclusions(exclusions)
+				for _, e := range exclusions {
+					logger.Infof("agent: applying the local in-app waf exclusion `%s`", e.Name)
+				}
+			}
+		}
+		if err != nil {
+			logger.Error(sqerrors.Wrap(err, "config: could not read the waf exclusions file"))
+		}
+	}
 
 	// Early health checking
 	if err := rulesEngine.Health(agentVersion); err != nil {
@@ -232,7 +276,7 @@ func New(cfg *config.Config) *AgentType {
 	}
 
 	if waf.Version() == nil {
-		message := "in-app waf disabled: cgo was disabled during the program compilation while required by the in-app waf"
+		message := "in-app waf: cgo was disabled during the program compilation while required by the native in-app waf, falling back to the pure-Go in-app waf"
 		backend.SendAgentMessage(logger, cfg, message)
 		logger.Info("agent: ", message)
 	}
@@ -293,6 +337,7 @@ func New(cfg *config.Config) *AgentType {
 		actors:      actor.NewStore(logger),
 		rules:       rulesEngine,
 		piiScrubber: piiScrubber,
+		traces:      newTraceStore(maxStoredTraces),
 	}
 }
 
@@ -335,6 +380,24 @@ func (a *AgentType) sendClosedHTTPProtectionContext(ctx http_protection_types.Cl
 		}
 	}
 
+	// The attacks of the shadow rules are sent in separate request records, one
+	// per shadow rulespack, so that they are not mixed with the live ones.
+	events, shadowEvents := splitShadowAttacks(events)
+	for packID, events := range shadowEvents {
+		a.eventMng.send(newClosedHTTPRequestContextEvent(packID, start, finish, ctx.Response(), ctx.Request(), events))
+	}
+
+	// Keep the request trace for the trace handler, scrubbed the same way as
+	// request records.
+	if events.Trace != nil {
+		trace := newAPITrace(events.Trace)
+		if _, err := a.piiScrubber.Scrub(trace, nil); err != nil {
+			a.logger.Error(sqerrors.Wrap(err, "could not scrub the request trace"))
+		} else {
+			a.traces.add(trace)
+		}
+	}
+
 	event := newClosedHTTPRequestContextEvent(a.RulespackID(), start, finish, ctx.Response(), ctx.Request(), events)
 	if !event.shouldSend() {
 		return
@@ -369,6 +432,17 @@ type withNotificationError struct {
 
 func (e *withNotificationError) Unwrap() error { return e.error }
 
+// shouldNotify returns true when the logged error must also be sent as an
+// agent message.
+func shouldNotify(err error) bool {
+	if xerrors.As(err, &withNotificationError{}) {
+		return true
+	}
+	// Rules disabled by their circuit breaker
+	var breakerErr *rule.CircuitBreakerError
+	return xerrors.As(err, &breakerErr)
+}
+
 func (a *AgentType) Serve() error {
 	defer func() {
 		// Signal we are done
@@ -464,6 +538,12 @@ func (a *AgentType) Serve() error {
 			a.logger.Debug("successfully logged out")
 			return nil
 
+		case packID := <-a.rules.RollbackRequests():
+			a.autoRollbackRules(packID)
+
+		case <-a.rules.CircuitBreakerChanges():
+			a.rules.ApplyCircuitBreakers()
+
 		case err := <-a.eventMng.errChan:
 			if err == nil {
 				continue
@@ -474,7 +554,7 @@ func (a *AgentType) Serve() error {
 
 		case err := <-a.errLoggerChan:
 			// Logged errors.
-			if xerrors.As(err, &withNotificationError{}) {
+			if shouldNotify(err) {
 				t, ok := sqerrors.Timestamp(err)
 				if !ok {
 					t = time.Now()
@@ -574,6 +654,45 @@ func (a *AgentType) ReloadRules() (string, error) {
 	return rulespack.PackID, nil
 }
 
+// RollbackRules sets the rules of the given previous rulespack, or of the one
+// before the current one when empty, and returns its ID.
+func (a *AgentType) RollbackRules(packID string) (string, error) {
+	return a.rules.Rollback(packID)
+}
+
+// DiffRules returns the difference between the two given previous rulespacks
+// (cf. rule.Engine.Diff()).
+func (a *AgentType) DiffRules(from, to string) (*rule.RulespackDiff, error) {
+	return a.rules.Diff(from, to)
+}
+
+// autoRollbackRules rolls back the given rulespack, when it is still the
+// current one, after a spike of callback errors or over-budget callbacks.
+func (a *AgentType) autoRollbackRules(packID string) {
+	if current := a.RulespackID(); current != packID {
+		a.logger.Debugf("agent: ignoring the automatic rollback of rulespack `%s` already replaced by `%s`", packID, current)
+		return
+	}
+	restored, err := a.rules.Rollback("")
+	if err != nil {
+		a.logger.Error(sqerrors.Wrapf(err, "agent: could not automatically roll back rulespack `%s`", packID))
+		return
+	}
+	a.logger.Error(withNotificationError{sqerrors.Errorf("agent: rulespack `%s` automatically rolled back to `%s` after a spike of callback errors or over-budget callbacks", packID, restored)})
+}
+
+func (a *AgentType) SetShadowRules(rulespack api.RulesPackResponse, sampleRate float64) (string, error) {
+	if err := a.rules.SetShadowRules(rulespack.PackID, rulespack.Rules, sampleRate); err != nil {
+		return "", err
+	}
+	return rulespack.PackID, nil
+}
+
+func (a *AgentType) ClearShadowRules() error {
+	a.rules.ClearShadowRules()
+	return nil
+}
+
 func (a *AgentType) SetPerformanceBudget(budget float64) error {
 	a.performanceBudget = time.Duration(budget * float64(time.Millisecond))
 	return nil
@@ -5,9 +5,14 @@
 package internal
 
 import (
+	"errors"
 	"math"
+	"strconv"
 	"testing"
 
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/rule"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -35,3 +40,30 @@ func Test_overheadRate(t *testing.T) {
 		}
 	})
 }
+
+func Test_traceStore(t *testing.T) {
+	s := newTraceStore(3)
+	for i := 0; i < 5; i++ {
+		s.add(&api.RequestRecord_Observed_Trace{Id: strconv.Itoa(i)})
+	}
+	// Only the last 3 traces are kept
+	require.Nil(t, s.get("0"))
+	require.Nil(t, s.get("1"))
+	for _, id := range []string{"2", "3", "4"} {
+		trace := s.get(id)
+		require.NotNil(t, trace)
+		require.Equal(t, id, trace.Id)
+	}
+
+	// Adding an existing trace replaces it without evicting another one
+	s.add(&api.RequestRecord_Observed_Trace{Id: "3", Truncated: true})
+	require.True(t, s.get("3").Truncated)
+	require.NotNil(t, s.get("2"))
+	require.NotNil(t, s.get("4"))
+}
+
+func Test_shouldNotify(t *testing.T) {
+	require.False(t, shouldNotify(errors.New("oops")))
+	require.True(t, shouldNotify(withNotificationError{errors.New("oops")}))
+	require.True(t, shouldNotify(sqerrors.Wrap(&rule.CircuitBreakerError{Rule: "my rule"}, "oops")))
+}
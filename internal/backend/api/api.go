@@ -216,9 +216,52 @@ type Rule struct {
 	AttackType        string             `json:"attack_type"`
 	Priority          int                `json:"priority"`
 	CallCountInterval int                `json:"call_count_interval"`
-}
-
-type RuleConditions struct{}
+	Sampling          *RuleSampling      `json:"sampling"`
+}
+
+// RuleSampling is the fraction of the requests the rule callbacks are executed
+// in, allowing to reduce the overhead of expensive monitoring rules. Rules in
+// blocking mode are never sampled.
+type RuleSampling struct {
+	// Rate is the fraction of the requests, within ]0, 1], the rule callbacks
+	// are executed in.
+	Rate float64 `json:"rate"`
+	// Adaptive, when non-nil, lowers the rate under load.
+	Adaptive *RuleAdaptiveSampling `json:"adaptive"`
+}
+
+// RuleAdaptiveSampling lowers the sampling rate of a rule, down to MinRate,
+// when the average execution time of its callbacks or the CPU usage of the
+// program exceed their limits, and raises it back up to the static rate
+// otherwise. The rate is adjusted every Period seconds.
+type RuleAdaptiveSampling struct {
+	// MinRate is the lowest sampling rate, within ]0, Rate].
+	MinRate float64 `json:"min_rate"`
+	// MaxLatency is the maximum average execution time of the callbacks, in
+	// milliseconds. Zero disables it.
+	MaxLatency float64 `json:"max_latency"`
+	// MaxCPU is the maximum CPU usage of the program, as a fraction of the
+	// available CPUs within ]0, 1]. Zero disables it.
+	MaxCPU float64 `json:"max_cpu"`
+	// Period is the adjustment period, in seconds.
+	Period int `json:"period"`
+}
+
+// RuleConditions are the conditions under which the rule callbacks are
+// executed, allowing to avoid their execution cost when irrelevant.
+type RuleConditions struct {
+	// Pre is the condition of the pre callbacks.
+	Pre RuleCondition `json:"pre"`
+	// Post is the condition of the post callbacks.
+	Post RuleCondition `json:"post"`
+}
+
+// RuleCondition is a condition expression made of a single operator and its
+// list of operands, such as `{ "%equals": [ "#.Request.Method", "POST" ] }`.
+// String operands starting with `#.` are binding accessor expressions, and
+// the operands of the logical operators `%and`, `%or` and `%not` are nested
+// conditions. An empty condition always holds.
+type RuleCondition map[string][]interface{}
 
 type (
 	RuleCallbacks struct {
@@ -282,6 +325,9 @@ const (
 	RedirectionType     = "redirection"
 	WAFType             = "waf"
 	CustomType          = "custom"
+	SensitiveDataType   = "sensitive_data"
+	GraphQLType         = "graphql"
+	FileUploadType      = "file_upload"
 )
 
 type CustomRuleDataEntry map[string]interface{}
@@ -300,6 +346,47 @@ type WAFRuleDataEntry struct {
 	Timeout          uint64   `json:"max_budget_ms"`
 }
 
+type SensitiveDataRuleDataEntry struct {
+	Patterns []SensitiveDataPattern `json:"patterns"`
+	// Mask enables replacing the sensitive data found by the mask string.
+	Mask       bool   `json:"mask"`
+	MaskString string `json:"mask_string"`
+}
+
+type SensitiveDataPattern struct {
+	Name   string `json:"name"`
+	Regexp string `json:"regexp"`
+	// Luhn enables the Luhn checksum validation of the digits of the match,
+	// allowing to reduce false positives of credit card number patterns.
+	Luhn bool `json:"luhn"`
+}
+
+type GraphQLRuleDataEntry struct {
+	// MaxDepth is the maximum nesting level of the selected fields. Zero
+	// disables the limit.
+	MaxDepth int `json:"max_depth"`
+	// MaxComplexity is the maximum number of selected fields, fragments being
+	// counted every time they are spread. Zero disables the limit. Limits above
+	// 10000 are lowered to it as the analysis of GraphQL operations stops after
+	// 10000 selections.
+	MaxComplexity int `json:"max_complexity"`
+	// BlockIntrospection enables blocking introspection queries.
+	BlockIntrospection bool `json:"block_introspection"`
+}
+
+type FileUploadRuleDataEntry struct {
+	// BlockedExtensions is the list of dangerous file extensions, such as
+	// `.php`. Every extension of the file name is checked so that double
+	// extensions such as `shell.php.jpg` are also detected.
+	BlockedExtensions []string `json:"blocked_extensions"`
+	// MaxSize is the maximum size of uploaded files in bytes. Zero disables the
+	// limit.
+	MaxSize int64 `json:"max_size"`
+	// BlockPolyglots enables blocking files whose content is not what their
+	// declared type or extension claims, such as images embedding scripts.
+	BlockPolyglots bool `json:"block_polyglots"`
+}
+
 type ReflectedCallbackBindingAccessorConfig struct {
 	Capabilities []string `json:"capabilities"`
 }
@@ -395,6 +482,20 @@ type RequestRecord_Request struct {
 	UserAgent  string                           `json:"user_agent"`
 	Referer    string                           `json:"referer"`
 	Parameters RequestRecord_Request_Parameters `json:"parameters"`
+	// Names of the GraphQL operations sent in the request body
+	GraphqlOperationNames []string `json:"graphql_operation_names,omitempty"`
+	// WebSocket connection and message metadata, when the request record is
+	// about a message received over a WebSocket connection
+	Websocket *RequestRecord_Request_WebSocket `json:"websocket,omitempty"`
+}
+
+type RequestRecord_Request_WebSocket struct {
+	ConnectionId string    `json:"connection_id"`
+	Subprotocol  string    `json:"subprotocol,omitempty"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	MessageType  string    `json:"message_type"`
+	MessageIndex uint64    `json:"message_index"`
+	MessageSize  int       `json:"message_size"`
 }
 
 type RequestRecord_Request_Header struct {
@@ -422,6 +523,32 @@ type RequestRecord_Response struct {
 type RequestRecord_Observed struct {
 	Attacks []*RequestRecord_Observed_Attack   `json:"attacks,omitempty"`
 	Sdk     []*RequestRecord_Observed_SDKEvent `json:"sdk,omitempty"`
+	// Execution trace of the rules, when enabled for the request
+	Trace *RequestRecord_Observed_Trace `json:"trace,omitempty"`
+}
+
+type RequestRecord_Observed_Trace struct {
+	Id string `json:"id"`
+	// Truncated is true when the maximum number of trace entries was reached
+	Truncated bool                                 `json:"truncated,omitempty"`
+	Entries   []*RequestRecord_Observed_TraceEntry `json:"entries"`
+}
+
+type RequestRecord_Observed_TraceEntry struct {
+	Rule     string    `json:"rule"`
+	Callback string    `json:"callback"`
+	Time     time.Time `json:"time"`
+	// Duration in milliseconds
+	Duration float64 `json:"duration"`
+	// Executed is false when the callback was skipped
+	Executed bool                                `json:"executed"`
+	Error    string                              `json:"error,omitempty"`
+	Values   []RequestRecord_Observed_TraceValue `json:"values,omitempty"`
+}
+
+type RequestRecord_Observed_TraceValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type RequestRecord_Observed_Attack struct {
@@ -436,6 +563,13 @@ type RequestRecord_Observed_Attack struct {
 
 type WAFAttackInfo struct {
 	WAFData json.RawMessage `json:"waf_data"`
+	// Exclusions are the names of the local WAF exclusions applied to the
+	// matching WAF rule.
+	Exclusions []string `json:"exclusions,omitempty"`
+	// PartialEvaluation are the flags of the request data that may not have
+	// been given to the WAF, such as the request phases whose WAF execution
+	// was skipped by lack of time budget (eg. `bodyWAF/timeout`).
+	PartialEvaluation []string `json:"partial_evaluation,omitempty"`
 }
 
 type WAFInfoFilter struct {
@@ -732,6 +866,8 @@ type RequestRecord_RequestFace interface {
 	GetUserAgent() string
 	GetReferer() string
 	GetParameters() RequestRecord_Request_Parameters
+	GetGraphqlOperationNames() []string
+	GetWebsocket() *RequestRecord_Request_WebSocket
 }
 
 func NewRequestRecord_RequestFromFace(that RequestRecord_RequestFace) *RequestRecord_Request {
@@ -748,6 +884,9 @@ func NewRequestRecord_RequestFromFace(that RequestRecord_RequestFace) *RequestRe
 		UserAgent:  that.GetUserAgent(),
 		Referer:    that.GetReferer(),
 		Parameters: that.GetParameters(),
+
+		GraphqlOperationNames: that.GetGraphqlOperationNames(),
+		Websocket:             that.GetWebsocket(),
 	}
 }
 
@@ -776,12 +915,14 @@ type RequestRecord_ObservedFace interface {
 	GetSqreenExceptions() []*RequestRecord_Observed_Exception
 	GetObservations() []*RequestRecord_Observed_Observation
 	GetDataPoints() []*RequestRecord_Observed_DataPoint
+	GetTrace() *RequestRecord_Observed_Trace
 }
 
 func NewRequestRecord_ObservedFromFace(that RequestRecord_ObservedFace) *RequestRecord_Observed {
 	this := &RequestRecord_Observed{}
 	this.Attacks = that.GetAttacks()
 	this.Sdk = that.GetSdk()
+	this.Trace = that.GetTrace()
 	return this
 }
 
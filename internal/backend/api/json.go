@@ -156,6 +156,12 @@ func (v *RuleDataEntry) UnmarshalJSON(data []byte) error {
 		value = &WAFRuleDataEntry{}
 	case CustomType:
 		value = &CustomRuleDataEntry{}
+	case SensitiveDataType:
+		value = &SensitiveDataRuleDataEntry{}
+	case GraphQLType:
+		value = &GraphQLRuleDataEntry{}
+	case FileUploadType:
+		value = &FileUploadRuleDataEntry{}
 	default:
 		return sqerrors.Errorf("unexpected type of rule data value `%s`", t)
 	}
@@ -109,6 +109,26 @@ func (e *closedHTTPRequestContextEvent) shouldSend() bool {
 	return false
 }
 
+// splitShadowAttacks returns the recorded events without the attacks of the
+// shadow rules, which are returned separately per shadow rulespack ID.
+func splitShadowAttacks(events event.Recorded) (live event.Recorded, shadow map[string]event.Recorded) {
+	live = events
+	live.AttackEvents = nil
+	for _, attack := range events.AttackEvents {
+		if attack.ShadowRulespackID == "" {
+			live.AttackEvents = append(live.AttackEvents, attack)
+			continue
+		}
+		if shadow == nil {
+			shadow = make(map[string]event.Recorded)
+		}
+		recorded := shadow[attack.ShadowRulespackID]
+		recorded.AttackEvents = append(recorded.AttackEvents, attack)
+		shadow[attack.ShadowRulespackID] = recorded
+	}
+	return live, shadow
+}
+
 func newClosedHTTPRequestContextEvent(rulepackID string, start, finish time.Time, response types.ResponseFace, request types.RequestReader, events event.Recorded) *closedHTTPRequestContextEvent {
 	return &closedHTTPRequestContextEvent{
 		start:      start,
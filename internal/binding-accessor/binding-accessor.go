@@ -15,6 +15,7 @@ package bindingaccessor
 
 import (
 	"errors"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -121,7 +122,24 @@ func Compile(expr string) (program BindingAccessorFunc, err error) {
 	}, nil
 }
 
+// compileExpr compiles the given expression made of at most one comparison of
+// operands, each of them possibly having default values with `??`.
 func compileExpr(expr string) (valueFunc, error) {
+	if lhs, op, rhs, ok := splitComparison(expr); ok {
+		if _, _, _, ok := splitComparison(rhs); ok {
+			return nil, sqerrors.Errorf("unexpected comparison chain in `%s`", expr)
+		}
+		return compileComparison(lhs, op, rhs)
+	}
+	if operands := splitOutsideLiterals(expr, "??"); len(operands) > 1 {
+		return compileDefaultValue(operands)
+	}
+	return compilePipelineExpr(expr)
+}
+
+// compilePipelineExpr compiles the given operand expression, possibly followed
+// by a pipeline of transformations.
+func compilePipelineExpr(expr string) (valueFunc, error) {
 	buf := strings.TrimSpace(expr)
 	// Get the first operand
 	valueFn, buf, err := compileOperand(buf)
@@ -161,7 +179,7 @@ const (
 )
 
 func compileTransformations(valueFn valueFunc, buf string) (valueFunc, error) {
-	pipeline := strings.Split(buf, "|")
+	pipeline := splitOutsideLiterals(buf, "|")
 	for _, tr := range pipeline {
 		trFn, err := compileTransformation(tr)
 		if err != nil {
@@ -188,7 +206,7 @@ func compileCall(valueFn valueFunc, buf string) (valueFunc, string, error) {
 	// Compile the list of arguments
 	var args []valueFunc
 	if argList := buf[:close]; len(argList) > 0 {
-		argv := strings.Split(argList, ",")
+		argv := splitOutsideLiterals(argList, ",")
 		args = make([]valueFunc, len(argv))
 		for i, a := range argv {
 			arg, err := compileExpr(a)
@@ -233,6 +251,7 @@ func compileField(valueFn valueFunc, buf string) (valueFunc, string, error) {
 		return nil, buf, sqerrors.New("unexpected empty field name")
 	}
 
+	var cache fieldAccessCache
 	return func(ctx Context, depth int) (value interface{}, err error) {
 		if depth == 0 {
 			return nil, ErrMaxExecutionDepth
@@ -241,6 +260,9 @@ func compileField(valueFn valueFunc, buf string) (valueFunc, string, error) {
 		if err != nil {
 			return nil, err
 		}
+		if access := cache.get(v, field); access != nil {
+			return access(v)
+		}
 		return execFieldAccess(v, field)
 	}, buf, nil
 }
@@ -267,6 +289,13 @@ func compileOperand(buf string) (valueFunc, string, error) {
 }
 
 func parseIdentifier(buf string) (identifier string, newBuf string) {
+	// String literals can contain separators
+	if trimmed := strings.TrimLeft(buf, " "); len(trimmed) > 0 && trimmed[0] == '\'' {
+		if end := strings.IndexByte(trimmed[1:], '\''); end != -1 {
+			end += 2
+			return trimmed[:end], trimmed[end:]
+		}
+	}
 	switch separator := strings.IndexAny(buf, "([.|"); separator {
 	case -1:
 		return buf, buf[:0]
@@ -290,6 +319,13 @@ func compileIdentifier(buf string) (valueFunc, string, error) {
 			}
 			break
 		}
+		// Try parse an integer value
+		if n, err := strconv.Atoi(identifier); err == nil {
+			valueFn = func(ctx Context, depth int) (interface{}, error) {
+				return n, nil
+			}
+			break
+		}
 		return nil, buf, sqerrors.Errorf("unknown identifier `%s`", identifier)
 	case "#":
 		valueFn = func(ctx Context, depth int) (interface{}, error) {
@@ -299,6 +335,11 @@ func compileIdentifier(buf string) (valueFunc, string, error) {
 		valueFn = func(ctx Context, depth int) (interface{}, error) {
 			return nil, nil
 		}
+	case "true", "false":
+		b := identifier == "true"
+		valueFn = func(ctx Context, depth int) (interface{}, error) {
+			return b, nil
+		}
 	}
 
 	return valueFn, buf, nil
@@ -336,12 +377,195 @@ func compileIndex(valueFn valueFunc, buf string) (valueFunc, string, error) {
 
 func compileTransformation(buf string) (transformationFunc, error) {
 	buf = strings.TrimSpace(buf)
-	switch buf {
+	name, args, err := parseTransformationCall(buf)
+	if err != nil {
+		return nil, err
+	}
+	if name != "filter" && args != nil {
+		return nil, sqerrors.Errorf("unexpected arguments of transformation function `%s`", name)
+	}
+
+	switch name {
 	case "flat_values":
 		return execFlatValues, nil
 	case "flat_keys":
 		return execFlatKeys, nil
+	case "lowercase":
+		return execLowercase, nil
+	case "url_decode":
+		return execURLDecode, nil
+	case "base64_decode":
+		return execBase64Decode, nil
+	case "html_entity_decode":
+		return execHTMLEntityDecode, nil
+	case "json_parse":
+		return execJSONParse, nil
+	case "length":
+		return execLength, nil
+	case "unique":
+		return execUnique, nil
+	case "filter":
+		if len(args) != 1 {
+			return nil, sqerrors.Errorf("unexpected number of arguments of transformation function `%s`: expected one regular expression", name)
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "could not compile the regular expression of transformation function `%s`", name)
+		}
+		return newFilterTransformation(re), nil
 	default:
 		return nil, sqerrors.Errorf("unexpected transformation function `%s`", buf)
 	}
 }
+
+// parseTransformationCall parses the transformation function name and its list
+// of string literal arguments, nil when it has none.
+func parseTransformationCall(buf string) (name string, args []string, err error) {
+	open := strings.IndexByte(buf, '(')
+	if open == -1 {
+		return buf, nil, nil
+	}
+	name = strings.TrimSpace(buf[:open])
+	if buf[len(buf)-1] != ')' {
+		return "", nil, sqerrors.Errorf("missing closing bracket `)` in `%s`", buf)
+	}
+	argList := strings.TrimSpace(buf[open+1 : len(buf)-1])
+	args = []string{}
+	if len(argList) == 0 {
+		return name, args, nil
+	}
+	for _, arg := range splitOutsideLiterals(argList, ",") {
+		arg = strings.TrimSpace(arg)
+		if l := len(arg); l < 2 || arg[0] != '\'' || arg[l-1] != '\'' {
+			return "", nil, sqerrors.Errorf("unexpected argument `%s` of transformation function `%s`: expected a string literal", arg, name)
+		}
+		args = append(args, arg[1:len(arg)-1])
+	}
+	return name, args, nil
+}
+
+// comparisonOperators are the comparison operators, the two-character ones
+// first so that they are looked for before their one-character prefixes.
+var comparisonOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// splitComparison splits the expression into the operands of its first
+// comparison operator found outside of the string literals and brackets.
+func splitComparison(expr string) (lhs, op, rhs string, ok bool) {
+	for i := 0; i < len(expr); i++ {
+		i = skipLiteralsAndBrackets(expr, i)
+		if i >= len(expr) {
+			break
+		}
+		for _, op := range comparisonOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				return expr[:i], op, expr[i+len(op):], true
+			}
+		}
+	}
+	return "", "", "", false
+}
+
+// splitOutsideLiterals splits the expression around the separators found
+// outside of the string literals and brackets.
+func splitOutsideLiterals(expr, sep string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(expr); i++ {
+		i = skipLiteralsAndBrackets(expr, i)
+		if i >= len(expr) {
+			break
+		}
+		if strings.HasPrefix(expr[i:], sep) {
+			parts = append(parts, expr[start:i])
+			i += len(sep) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+// skipLiteralsAndBrackets returns the index of the first character of the
+// expression, starting at i, that is not part of a string literal nor of a
+// bracketed sub-expression.
+func skipLiteralsAndBrackets(expr string, i int) int {
+	depth := 0
+	for ; i < len(expr); i++ {
+		switch expr[i] {
+		case '\'':
+			end := strings.IndexByte(expr[i+1:], '\'')
+			if end == -1 {
+				// Unterminated string literal left to the parser
+				return len(expr)
+			}
+			i += end + 1
+			continue
+		case '(', '[':
+			depth++
+			continue
+		case ')', ']':
+			if depth > 0 {
+				depth--
+				continue
+			}
+		}
+		if depth == 0 {
+			return i
+		}
+	}
+	return i
+}
+
+func compileComparison(lhsExpr, op, rhsExpr string) (valueFunc, error) {
+	lhs, err := compileExpr(lhsExpr)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := compileExpr(rhsExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx Context, depth int) (interface{}, error) {
+		if depth == 0 {
+			return nil, ErrMaxExecutionDepth
+		}
+		l, err := lhs(ctx, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		r, err := rhs(ctx, depth-1)
+		if err != nil {
+			return nil, err
+		}
+		return execComparison(op, l, r)
+	}, nil
+}
+
+// compileDefaultValue compiles the list of operands of the default-value
+// operator `??`: the first operand having a non-nil value is returned.
+func compileDefaultValue(operandExprs []string) (valueFunc, error) {
+	operands := make([]valueFunc, len(operandExprs))
+	for i, expr := range operandExprs {
+		operand, err := compilePipelineExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = operand
+	}
+
+	return func(ctx Context, depth int) (interface{}, error) {
+		if depth == 0 {
+			return nil, ErrMaxExecutionDepth
+		}
+		for _, operand := range operands {
+			v, err := operand(ctx, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			if !isNil(v) {
+				return v, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindingaccessor_test
+
+import (
+	"testing"
+
+	bindingaccessor "github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/stretchr/testify/require"
+)
+
+type benchContext struct {
+	Nested *benchNestedContext
+	Values map[string][]string
+	Params map[string]interface{}
+	List   []interface{}
+}
+
+type benchNestedContext struct {
+	Field string
+}
+
+func (c *benchNestedContext) Method() string { return c.Field }
+
+func (c *benchNestedContext) Get(key string) (*string, error) { return &c.Field, nil }
+
+func benchBindingAccessor(b *testing.B, expr string) {
+	ctx := &benchContext{
+		Nested: &benchNestedContext{Field: "value"},
+		Values: map[string][]string{"key": {"value"}},
+		Params: map[string]interface{}{"key": "value"},
+		List:   []interface{}{"value"},
+	}
+
+	ba, err := bindingaccessor.Compile(expr)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if _, err := ba(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBindingAccessor(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		expr string
+	}{
+		{name: "struct field", expr: `#.Nested.Field`},
+		{name: "method", expr: `#.Nested.Method`},
+		{name: "call", expr: `#.Nested.Get('key')`},
+		{name: "map index", expr: `#.Values['key']`},
+		{name: "interface map index", expr: `#.Params['key']`},
+		{name: "slice index", expr: `#.List[0]`},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			benchBindingAccessor(b, bc.expr)
+		})
+	}
+}
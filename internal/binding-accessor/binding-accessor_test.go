@@ -385,6 +385,139 @@ func TestBindingAccessor(t *testing.T) {
 			ExpectedValue: FlattenedResult{1, 2, "Sqreen", 1, "Two", 27, 28},
 		},
 
+		{
+			Title:         "lowercase transformation",
+			Expression:    "#.A | lowercase",
+			Context:       struct{ A string }{A: "SqReen"},
+			ExpectedValue: "sqreen",
+		},
+		{
+			Title:         "lowercase transformation of a list of values",
+			Expression:    "# | flat_values | lowercase",
+			Context:       map[string][]string{"One": {"A", "B"}},
+			ExpectedValue: FlattenedResult{"a", "b"},
+		},
+		{
+			Title:         "url_decode transformation",
+			Expression:    "#.A | url_decode",
+			Context:       struct{ A []string }{A: []string{"a%20b+c", "%zz"}},
+			ExpectedValue: []interface{}{"a b c", "%zz"},
+		},
+		{
+			Title:         "base64_decode transformation",
+			Expression:    "#.A | base64_decode",
+			Context:       struct{ A []string }{A: []string{"c3FyZWVu", "c3E", "not base64"}},
+			ExpectedValue: []interface{}{"sqreen", "sq", "not base64"},
+		},
+		{
+			Title:         "html_entity_decode transformation",
+			Expression:    "#.A | html_entity_decode",
+			Context:       struct{ A []byte }{A: []byte("&lt;script&gt;")},
+			ExpectedValue: "<script>",
+		},
+		{
+			Title:         "json_parse transformation",
+			Expression:    "#.A | json_parse",
+			Context:       struct{ A []string }{A: []string{`{"a":[1,"b"]}`, "oops"}},
+			ExpectedValue: []interface{}{map[string]interface{}{"a": []interface{}{1.0, "b"}}, nil},
+		},
+		{
+			Title:         "length transformation",
+			Expression:    "#.A | length",
+			Context:       struct{ A map[string]int }{A: map[string]int{"a": 1, "b": 2}},
+			ExpectedValue: 2,
+		},
+		{
+			Title:         "length transformation of a nil value",
+			Expression:    "#.A | length",
+			Context:       struct{ A *string }{},
+			ExpectedValue: 0,
+		},
+		{
+			Title:         "unique transformation",
+			Expression:    "#.A | unique",
+			Context:       struct{ A []string }{A: []string{"a", "b", "a", "c", "b"}},
+			ExpectedValue: []interface{}{"a", "b", "c"},
+		},
+		{
+			Title:         "filter transformation",
+			Expression:    "#.A | lowercase | filter('^(a|c)')",
+			Context:       struct{ A []string }{A: []string{"Alpha", "beta", "charlie"}},
+			ExpectedValue: []interface{}{"alpha", "charlie"},
+		},
+		{
+			Title:         "filter transformation of a string value",
+			Expression:    "#.A | filter('<script')",
+			Context:       struct{ A string }{A: "no"},
+			ExpectedValue: nil,
+		},
+		{
+			Title:         "transformation pipeline",
+			Expression:    "#.A | url_decode | html_entity_decode | lowercase",
+			Context:       struct{ A string }{A: "%26LT%3BScript%26GT%3B"},
+			ExpectedValue: "<script>",
+		},
+		{
+			Title:         "transformed values are limited to the maximum number of elements",
+			Expression:    "#.A | lowercase | length",
+			Context:       struct{ A []string }{A: make([]string, bindingaccessor.NewValueMaxElements+10)},
+			ExpectedValue: bindingaccessor.NewValueMaxElements,
+		},
+		{
+			Title:         "string equality",
+			Expression:    "#.A == 'POST'",
+			Context:       struct{ A string }{A: "POST"},
+			ExpectedValue: true,
+		},
+		{
+			Title:         "string literal containing separators",
+			Expression:    "#.A != 'a.b|c == d'",
+			Context:       struct{ A string }{A: "a.b|c == d"},
+			ExpectedValue: false,
+		},
+		{
+			Title:      "number comparison of different types",
+			Expression: "#.A | length >= #.B",
+			Context: struct {
+				A []int
+				B uint8
+			}{A: []int{1, 2, 3}, B: 3},
+			ExpectedValue: true,
+		},
+		{
+			Title:         "number comparison with an integer literal",
+			Expression:    "#.A < -1",
+			Context:       struct{ A float64 }{A: -1.5},
+			ExpectedValue: true,
+		},
+		{
+			Title:         "boolean literal equality",
+			Expression:    "#.A == true",
+			Context:       struct{ A bool }{A: true},
+			ExpectedValue: true,
+		},
+		{
+			Title:      "default value",
+			Expression: "#.A['x'] ?? #.B ?? 'default'",
+			Context: struct {
+				A map[string]string
+				B *int
+			}{A: map[string]string{}},
+			ExpectedValue: "default",
+		},
+		{
+			Title:         "default value not used",
+			Expression:    "#.A['x'] ?? 'default'",
+			Context:       struct{ A map[string]string }{A: map[string]string{"x": "value"}},
+			ExpectedValue: "value",
+		},
+		{
+			Title:         "default value comparison",
+			Expression:    "#.A['x'] ?? 'default' == 'default'",
+			Context:       struct{ A map[string]string }{A: map[string]string{}},
+			ExpectedValue: true,
+		},
+
 		//
 		// Error cases
 		//
@@ -435,6 +568,53 @@ func TestBindingAccessor(t *testing.T) {
 			Expression:               "#.A | ",
 			ExpectedCompilationError: true,
 		},
+		{
+			Title:                    "unknown transformation",
+			Expression:               "#.A | oops",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "transformation without arguments given arguments",
+			Expression:               "#.A | lowercase('a')",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "filter transformation without a string literal argument",
+			Expression:               "#.A | filter(a)",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "filter transformation with an invalid regular expression",
+			Expression:               "#.A | filter('(')",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "comparison chain",
+			Expression:               "#.A == 1 == 2",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "missing comparison operand",
+			Expression:               "#.A ==",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                    "missing default value",
+			Expression:               "#.A ??",
+			ExpectedCompilationError: true,
+		},
+		{
+			Title:                  "ordering comparison of non-ordered values",
+			Expression:             "#.A < 'x'",
+			Context:                struct{ A []int }{A: []int{1}},
+			ExpectedExecutionError: true,
+		},
+		{
+			Title:                  "comparison deeper than max execution depth",
+			Expression:             `#[0][0][0][0][0][0][0][0][0][0] == 33`,
+			Context:                [][][][][][][][][][][]int{{{{{{{{{{{33}}}}}}}}}}},
+			ExpectedExecutionError: bindingaccessor.ErrMaxExecutionDepth,
+		},
 		{
 			Title:                  "field access to nil value",
 			Expression:             "#.Foo",
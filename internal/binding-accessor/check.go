@@ -0,0 +1,338 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindingaccessor
+
+import (
+	"go/ast"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// Checker statically checks binding accessor expressions against the Go types
+// of their context, allowing to report the errors their execution would
+// return, such as misspelled field names, before they are executed.
+//
+// Values whose type isn't statically known, such as empty interface values,
+// cannot be checked and the remainder of the expression accessing them is
+// accepted. Their types can be provided by paths, which are the expression
+// prefixes made of field and index accesses only, such as `#.Func.Args`.
+type Checker struct {
+	// Context is the type of the binding accessor context `#`.
+	Context types.Type
+	// Elements are the types of the elements of the values of the given paths,
+	// such as the types of the function arguments of path `#.Func.Args`.
+	// Indexing these values out of their bounds is reported.
+	Elements map[string][]types.Type
+	// Unavailable are the paths of the values that are nil when executed,
+	// associated to the reason why. Accessing them is reported.
+	Unavailable map[string]string
+}
+
+// Check statically checks the given binding accessor expression and returns
+// the first error found, nil otherwise.
+func (c *Checker) Check(expr string) error {
+	// Compile it first to report the syntax errors
+	if _, err := compileExpr(expr); err != nil {
+		return sqerrors.Wrap(err, "binding accessor compilation error")
+	}
+	if _, err := c.checkExpr(expr); err != nil {
+		return sqerrors.Wrap(err, "binding accessor check error")
+	}
+	return nil
+}
+
+// A checked value is the static type of an expression value, and its path
+// when it has one. The type is nil when it isn't statically known.
+type checked struct {
+	t    types.Type
+	path string
+}
+
+func (c *Checker) checkExpr(expr string) (checked, error) {
+	if lhs, _, rhs, ok := splitComparison(expr); ok {
+		if _, err := c.checkExpr(lhs); err != nil {
+			return checked{}, err
+		}
+		if _, err := c.checkExpr(rhs); err != nil {
+			return checked{}, err
+		}
+		return checked{t: types.Typ[types.Bool]}, nil
+	}
+
+	if operands := splitOutsideLiterals(expr, "??"); len(operands) > 1 {
+		var result checked
+		for i, operand := range operands {
+			v, err := c.checkPipelineExpr(operand)
+			if err != nil {
+				return checked{}, err
+			}
+			if i == 0 {
+				result.t = v.t
+			} else if result.t == nil || v.t == nil || !types.Identical(result.t, v.t) {
+				// The resulting type depends on the values
+				result.t = nil
+			}
+		}
+		return result, nil
+	}
+
+	return c.checkPipelineExpr(expr)
+}
+
+func (c *Checker) checkPipelineExpr(expr string) (v checked, err error) {
+	buf := strings.TrimSpace(expr)
+	identifier, buf := parseIdentifier(buf)
+	v = c.checkIdentifier(strings.TrimSpace(identifier))
+
+	for len(buf) > 0 {
+		switch buf[0] {
+		case '(':
+			close := strings.IndexByte(buf, ')')
+			var args []checked
+			if argList := buf[1:close]; len(argList) > 0 {
+				for _, a := range splitOutsideLiterals(argList, ",") {
+					arg, err := c.checkExpr(a)
+					if err != nil {
+						return checked{}, err
+					}
+					args = append(args, arg)
+				}
+			}
+			buf = buf[close+1:]
+			if v, err = c.checkCall(v, args); err != nil {
+				return checked{}, err
+			}
+
+		case '.':
+			var field string
+			field, buf = parseIdentifier(buf[1:])
+			if v, err = c.checkField(v, strings.TrimRight(field, " ")); err != nil {
+				return checked{}, err
+			}
+
+		case '[':
+			close := strings.IndexByte(buf, ']')
+			index, err := parseIndex(buf[1:close])
+			if err != nil {
+				return checked{}, err
+			}
+			buf = buf[close+1:]
+			if v, err = c.checkIndex(v, index); err != nil {
+				return checked{}, err
+			}
+
+		case '|':
+			// Only the length transformation result has a known type
+			var name string
+			for _, tr := range splitOutsideLiterals(buf[1:], "|") {
+				name, _, _ = parseTransformationCall(strings.TrimSpace(tr))
+			}
+			if name == "length" {
+				return checked{t: types.Typ[types.Int]}, nil
+			}
+			return checked{}, nil
+		}
+	}
+	return v, nil
+}
+
+func (c *Checker) checkIdentifier(identifier string) checked {
+	switch identifier {
+	case "#":
+		return checked{t: c.Context, path: identifier}
+	case "nil", "null":
+		return checked{}
+	case "true", "false":
+		return checked{t: types.Typ[types.Bool]}
+	}
+	if _, err := strconv.Atoi(identifier); err == nil {
+		return checked{t: types.Typ[types.Int]}
+	}
+	return checked{t: types.Typ[types.String]}
+}
+
+func (c *Checker) unavailable(v checked) error {
+	if v.path == "" {
+		return nil
+	}
+	if reason, ok := c.Unavailable[v.path]; ok {
+		return sqerrors.Errorf("`%s` is not available: %s", v.path, reason)
+	}
+	return nil
+}
+
+func (c *Checker) checkField(v checked, field string) (checked, error) {
+	if err := c.unavailable(v); err != nil {
+		return checked{}, err
+	}
+	if !ast.IsExported(field) {
+		return checked{}, sqerrors.Errorf("unexported field or method `%s` cannot be accessed", field)
+	}
+	result := checked{}
+	if v.path != "" {
+		result.path = v.path + "." + field
+	}
+	if v.t == nil {
+		return result, nil
+	}
+
+	obj, _, _ := types.LookupFieldOrMethod(v.t, false, nil, field)
+	if obj == nil {
+		if isInterface(v.t) {
+			// The dynamic value may have it
+			return result, nil
+		}
+		return checked{}, sqerrors.Errorf("no field nor method `%s` found in value of type `%s`", field, v.t)
+	}
+
+	switch actual := obj.(type) {
+	case *types.Var:
+		result.t = actual.Type()
+		return result, nil
+	case *types.Func:
+		sig := actual.Type().(*types.Signature)
+		if sig.Params().Len() != 0 {
+			// The method value is returned
+			result.t = sig
+			return result, nil
+		}
+		// The method without arguments is called
+		t, err := checkResults(sig)
+		if err != nil {
+			return checked{}, sqerrors.Wrapf(err, "method `%s` of type `%s`", field, v.t)
+		}
+		result.t = t
+		return result, nil
+	default:
+		return checked{}, sqerrors.Errorf("unexpected object `%s` of type `%s`", field, v.t)
+	}
+}
+
+func (c *Checker) checkIndex(v checked, index interface{}) (checked, error) {
+	if err := c.unavailable(v); err != nil {
+		return checked{}, err
+	}
+	result := checked{}
+	if v.path != "" {
+		if s, ok := index.(string); ok {
+			result.path = v.path + "['" + s + "']"
+		} else {
+			result.path = v.path + "[" + strconv.Itoa(index.(int)) + "]"
+		}
+	}
+
+	if elements, ok := c.Elements[v.path]; ok && v.path != "" {
+		i, ok := index.(int)
+		if !ok {
+			return checked{}, sqerrors.Errorf("cannot index `%s` with index `%v` of type `%T`", v.path, index, index)
+		}
+		if i < 0 || i >= len(elements) {
+			return checked{}, sqerrors.Errorf("index %d out of range of `%s` of length %d", i, v.path, len(elements))
+		}
+		result.t = elements[i]
+		return result, nil
+	}
+
+	t := v.t
+	for t != nil {
+		switch actual := t.Underlying().(type) {
+		case *types.Pointer:
+			t = actual.Elem()
+			continue
+		case *types.Interface:
+			return result, nil
+		case *types.Signature:
+			// Backward compatible call of functions with the index
+			return c.checkCall(v, []checked{{t: indexType(index)}})
+		case *types.Map:
+			if !types.AssignableTo(indexType(index), actual.Key()) {
+				return checked{}, sqerrors.Errorf("cannot index map of type `%s` with index `%v` of type `%T`", v.t, index, index)
+			}
+			result.t = actual.Elem()
+			return result, nil
+		case *types.Slice:
+			if _, ok := index.(int); !ok {
+				return checked{}, sqerrors.Errorf("cannot index slice of type `%s` with index `%v` of type `%T`", v.t, index, index)
+			}
+			result.t = actual.Elem()
+			return result, nil
+		default:
+			return checked{}, sqerrors.Errorf("cannot index value of type `%s` with index `%v` of type `%T`", v.t, index, index)
+		}
+	}
+	return result, nil
+}
+
+func (c *Checker) checkCall(fn checked, args []checked) (checked, error) {
+	if err := c.unavailable(fn); err != nil {
+		return checked{}, err
+	}
+	if fn.t == nil {
+		return checked{}, nil
+	}
+
+	switch sig := fn.t.Underlying().(type) {
+	case *types.Interface:
+		return checked{}, nil
+	case *types.Signature:
+		params := sig.Params()
+		if n := params.Len(); len(args) != n && !(sig.Variadic() && len(args) >= n-1) {
+			return checked{}, sqerrors.Errorf("unexpected number of arguments of function `%s`: got %d instead of %d", sig, len(args), n)
+		}
+		for i, arg := range args {
+			if arg.t == nil {
+				continue
+			}
+			var param types.Type
+			if sig.Variadic() && i >= params.Len()-1 {
+				param = params.At(params.Len() - 1).Type().(*types.Slice).Elem()
+			} else {
+				param = params.At(i).Type()
+			}
+			if !types.AssignableTo(arg.t, param) {
+				return checked{}, sqerrors.Errorf("cannot use argument %d of type `%s` as type `%s` of function `%s`", i, arg.t, param, sig)
+			}
+		}
+		t, err := checkResults(sig)
+		if err != nil {
+			return checked{}, err
+		}
+		return checked{t: t}, nil
+	default:
+		return checked{}, sqerrors.Errorf("cannot call value of type `%s`", fn.t)
+	}
+}
+
+// checkResults returns the type of the value returned by calls to the
+// function of the given signature.
+func checkResults(sig *types.Signature) (types.Type, error) {
+	results := sig.Results()
+	switch results.Len() {
+	case 1:
+	case 2:
+		errorType := types.Universe.Lookup("error").Type()
+		if !types.AssignableTo(results.At(1).Type(), errorType) {
+			return nil, sqerrors.Errorf("unexpected second function results type of function `%s`: expected `error`", sig)
+		}
+	default:
+		return nil, sqerrors.Errorf("unexpected number of function results of function `%s`", sig)
+	}
+	return results.At(0).Type(), nil
+}
+
+func isInterface(t types.Type) bool {
+	_, ok := t.Underlying().(*types.Interface)
+	return ok
+}
+
+func indexType(index interface{}) types.Type {
+	if _, ok := index.(string); ok {
+		return types.Typ[types.String]
+	}
+	return types.Typ[types.Int]
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindingaccessor_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	bindingaccessor "github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/stretchr/testify/require"
+)
+
+const checkTestSource = `
+package lib
+
+type Context struct {
+	Func    *Func
+	Request *Request
+	Values  map[string][]int
+	Any     interface{}
+	private int
+}
+
+type Func struct {
+	Args []interface{}
+}
+
+type Request struct{}
+
+func (*Request) Method() string                       { return "" }
+func (*Request) Header(string) *string                { return nil }
+func (*Request) Params() (map[string][]string, error) { return nil, nil }
+func (*Request) Invalid() (string, string)            { return "", "" }
+
+type Arg struct {
+	Query string
+}
+`
+
+func TestChecker(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "lib.go", checkTestSource, 0)
+	require.NoError(t, err)
+	pkg, err := (&types.Config{}).Check("lib", fset, []*ast.File{f}, nil)
+	require.NoError(t, err)
+	lookup := func(name string) types.Type {
+		return pkg.Scope().Lookup(name).Type()
+	}
+
+	checker := &bindingaccessor.Checker{
+		Context: types.NewPointer(lookup("Context")),
+		Elements: map[string][]types.Type{
+			"#.Func.Args": {types.Typ[types.String], types.NewPointer(lookup("Arg"))},
+		},
+		Unavailable: map[string]string{
+			"#.Request": "capability `request` is not declared",
+		},
+	}
+
+	for _, tc := range []struct {
+		expr        string
+		expectedErr bool
+	}{
+		{expr: `#.Func.Args[0]`},
+		{expr: `#.Func.Args[1].Query`},
+		{expr: `#.Func.Args[1].Query | lowercase`},
+		{expr: `#.Func.Args[0] == 'select' ?? 'none'`},
+		{expr: `#.Values['key'][0] >= 3`},
+		{expr: `#.Any.Whatever['key']`},
+		{expr: `#.Request`},
+		{expr: `#.Func.Args[2]`, expectedErr: true},
+		{expr: `#.Func.Args['key']`, expectedErr: true},
+		{expr: `#.Func.Args[1].Querry`, expectedErr: true},
+		{expr: `#.Func.Argz`, expectedErr: true},
+		{expr: `#.private`, expectedErr: true},
+		{expr: `#.Values[0]`, expectedErr: true},
+		{expr: `#.Values['key']['key']`, expectedErr: true},
+		{expr: `#.Request.Method`, expectedErr: true},
+		{expr: `#.Func.Args[0](1)`, expectedErr: true},
+		{expr: `#.Func.Args[0] | unknown`, expectedErr: true},
+	} {
+		tc := tc
+		t.Run(tc.expr, func(t *testing.T) {
+			err := checker.Check(tc.expr)
+			if tc.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("methods", func(t *testing.T) {
+		checker := &bindingaccessor.Checker{Context: types.NewPointer(lookup("Request"))}
+		require.NoError(t, checker.Check(`#.Method`))
+		require.NoError(t, checker.Check(`#.Header('Content-Type')`))
+		require.NoError(t, checker.Check(`#.Header['Content-Type']`))
+		require.NoError(t, checker.Check(`#.Params['id'][0]`))
+		require.Error(t, checker.Check(`#.Header(1)`))
+		require.Error(t, checker.Check(`#.Header('a', 'b')`))
+		require.Error(t, checker.Check(`#.Invalid`))
+		require.Error(t, checker.Check(`#.Method.Length`))
+	})
+}
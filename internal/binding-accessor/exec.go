@@ -8,12 +8,39 @@ package bindingaccessor
 
 import (
 	"reflect"
+	"strings"
 	"unicode"
 
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
 )
 
 func execIndexAccess(v interface{}, index interface{}) (interface{}, error) {
+	// Fast paths of the common map and slice types of binding accessor contexts
+	switch actual := v.(type) {
+	case map[string][]interface{}:
+		if key, ok := index.(string); ok {
+			if value, exists := actual[key]; exists {
+				return value, nil
+			}
+			return nil, nil
+		}
+	case map[string][]string:
+		if key, ok := index.(string); ok {
+			if value, exists := actual[key]; exists {
+				return value, nil
+			}
+			return nil, nil
+		}
+	case map[string]interface{}:
+		if key, ok := index.(string); ok {
+			return actual[key], nil
+		}
+	case []interface{}:
+		if i, ok := index.(int); ok {
+			return actual[i], nil
+		}
+	}
+
 	lvalue := reflect.ValueOf(v)
 doExecIndexAccess:
 	switch lvalue.Kind() {
@@ -90,7 +117,23 @@ func tryExecMethodAccess(v reflect.Value, method string) (result interface{}, ok
 }
 
 func execCall(fn interface{}, args ...interface{}) (interface{}, error) {
-	fnValue := reflect.ValueOf(fn)
+	// Fast path of the header accessor methods
+	if header, ok := fn.(func(string) (*string, error)); ok && len(args) == 1 {
+		if name, ok := args[0].(string); ok {
+			value, err := header(name)
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				return nil, nil
+			}
+			return value, nil
+		}
+	}
+	return callValue(reflect.ValueOf(fn), args...)
+}
+
+func callValue(fnValue reflect.Value, args ...interface{}) (interface{}, error) {
 	fnType := fnValue.Type()
 
 	if nbResults := fnType.NumOut(); nbResults != 1 && nbResults != 2 {
@@ -99,7 +142,10 @@ func execCall(fn interface{}, args ...interface{}) (interface{}, error) {
 		return nil, sqerrors.Errorf("unexpected second function results type of function `%s`: expected `error`", fnType)
 	}
 
-	argValues := make([]reflect.Value, len(args))
+	var argValues []reflect.Value
+	if len(args) > 0 {
+		argValues = make([]reflect.Value, len(args))
+	}
 	for i, a := range args {
 		if a != nil {
 			argValues[i] = reflect.ValueOf(a)
@@ -289,3 +335,99 @@ func flatKeys(v reflect.Value, depth int, elements *int) []interface{} {
 	}
 	return values
 }
+
+// execComparison compares the two values with the given comparison operator.
+// Numbers are compared by value whatever their types, strings
+// lexicographically, and other values can only be compared for equality.
+func execComparison(op string, lhs, rhs interface{}) (bool, error) {
+	if l, ok := toFloat(lhs); ok {
+		if r, ok := toFloat(rhs); ok {
+			return compareOrdered(op, compareFloats(l, r))
+		}
+	}
+	if l, ok := toString(lhs); ok {
+		if r, ok := toString(rhs); ok {
+			return compareOrdered(op, strings.Compare(l, r))
+		}
+	}
+
+	switch op {
+	case "==":
+		return reflect.DeepEqual(lhs, rhs), nil
+	case "!=":
+		return !reflect.DeepEqual(lhs, rhs), nil
+	default:
+		return false, sqerrors.Errorf("cannot compare value `%[1]v` of type `%[1]T` with value `%[2]v` of type `%[2]T` using operator `%[3]s`", lhs, rhs, op)
+	}
+}
+
+func compareOrdered(op string, cmp int) (bool, error) {
+	switch op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	default:
+		return false, sqerrors.Errorf("unexpected comparison operator `%s`", op)
+	}
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func toString(v interface{}) (string, bool) {
+	switch actual := v.(type) {
+	case string:
+		return actual, true
+	case []byte:
+		return string(actual), true
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		return rv.String(), true
+	}
+	return "", false
+}
+
+// isNil returns true when the value is nil or a nil pointer, map, slice,
+// function, channel or interface value.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package bindingaccessor
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// FieldFunc returns the value of a field or method of a value of the type it
+// was registered for (cf. RegisterFieldFunc()).
+type FieldFunc func(v interface{}) (interface{}, error)
+
+// fieldFuncs are the registered field functions per type and field name. It is
+// only written during the program initialization and can therefore be read
+// concurrently without locking.
+var fieldFuncs = map[reflect.Type]map[string]FieldFunc{}
+
+// RegisterFieldFunc registers the function returning the value of the field
+// or method `field` of the values having the type of `v`. It is used instead of
+// reflect in order to provide fast paths to the commonly used fields of
+// binding accessor contexts. It must be called during the program
+// initialization, such as in `init()` functions.
+func RegisterFieldFunc(v interface{}, field string, fn FieldFunc) {
+	t := reflect.TypeOf(v)
+	fields := fieldFuncs[t]
+	if fields == nil {
+		fields = make(map[string]FieldFunc)
+		fieldFuncs[t] = fields
+	}
+	fields[field] = fn
+}
+
+// fieldAccessCache is the cache of the field access resolved for the last
+// value type the field was accessed with. Binding accessor expressions are
+// usually executed with values of the same types, so that remembering the last
+// one is enough to avoid resolving the field access again with reflect.
+type fieldAccessCache struct {
+	last atomic.Value // *fieldAccess
+}
+
+// fieldAccess is the resolved field access of a given value type.
+type fieldAccess struct {
+	t      reflect.Type
+	access FieldFunc
+}
+
+// get returns the field access of the given value, resolving it when its type
+// is not the cached one. The returned function is nil when the access cannot
+// be resolved statically from the value type, for example when the field is
+// looked up in a pointer to an interface value.
+func (c *fieldAccessCache) get(v interface{}, field string) FieldFunc {
+	t := reflect.TypeOf(v)
+	if last, _ := c.last.Load().(*fieldAccess); last != nil && last.t == t {
+		return last.access
+	}
+	access := resolveFieldAccess(t, field)
+	c.last.Store(&fieldAccess{t: t, access: access})
+	return access
+}
+
+// resolveFieldAccess returns the field access of the values of type t. It
+// follows the same lookup order as execFieldAccess(): the registered field
+// functions first, then the methods of pointer types before the fields of the
+// structures they point to, and finally the methods of non-pointer types.
+func resolveFieldAccess(t reflect.Type, field string) FieldFunc {
+	if t == nil {
+		return nil
+	}
+	if fn := fieldFuncs[t][field]; fn != nil {
+		return fn
+	}
+
+	derefs := 0
+	for vt := t; ; {
+		switch vt.Kind() {
+		case reflect.Interface:
+			// The field depends on the dynamic value
+			return nil
+
+		case reflect.Ptr:
+			if m, ok := vt.MethodByName(field); ok {
+				return methodAccess(derefs, m)
+			}
+			vt = vt.Elem()
+			derefs++
+			continue
+
+		case reflect.Struct:
+			if f, ok := vt.FieldByName(field); ok {
+				return structFieldAccess(derefs, f.Index)
+			}
+			fallthrough
+
+		default:
+			if m, ok := vt.MethodByName(field); ok {
+				return methodAccess(derefs, m)
+			}
+			return func(v interface{}) (interface{}, error) {
+				return nil, sqerrors.Errorf("no field nor method `%s` found in value of type `%T`", field, v)
+			}
+		}
+	}
+}
+
+// indirect dereferences the given pointer value n times.
+func indirect(v interface{}, n int) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for ; n > 0; n-- {
+		if rv.IsNil() {
+			return rv, sqerrors.Errorf("nil pointer dereference of value of type `%T`", v)
+		}
+		rv = rv.Elem()
+	}
+	return rv, nil
+}
+
+func structFieldAccess(derefs int, index []int) FieldFunc {
+	return func(v interface{}) (interface{}, error) {
+		rv, err := indirect(v, derefs)
+		if err != nil {
+			return nil, err
+		}
+		return rv.FieldByIndex(index).Interface(), nil
+	}
+}
+
+func methodAccess(derefs int, m reflect.Method) FieldFunc {
+	// The method type includes the receiver
+	if m.Type.NumIn() != 1 {
+		// Return the method value
+		return func(v interface{}) (interface{}, error) {
+			rv, err := indirect(v, derefs)
+			if err != nil {
+				return nil, err
+			}
+			return rv.Method(m.Index).Interface(), nil
+		}
+	}
+
+	return func(v interface{}) (interface{}, error) {
+		rv, err := indirect(v, derefs)
+		if err != nil {
+			return nil, err
+		}
+		return callValue(rv.Method(m.Index))
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindingaccessor_test
+
+import (
+	"errors"
+	"testing"
+
+	bindingaccessor "github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/stretchr/testify/require"
+)
+
+type registeredFieldContext struct {
+	A string
+}
+
+func init() {
+	bindingaccessor.RegisterFieldFunc(&registeredFieldContext{}, "A", func(v interface{}) (interface{}, error) {
+		return "registered " + v.(*registeredFieldContext).A, nil
+	})
+	bindingaccessor.RegisterFieldFunc(&registeredFieldContext{}, "Err", func(v interface{}) (interface{}, error) {
+		return nil, errors.New("registered error")
+	})
+}
+
+type embeddedFieldContext struct {
+	*registeredFieldContext
+	B int
+}
+
+type methodFieldContext struct {
+	B int
+}
+
+func (c methodFieldContext) A() string { return "method" }
+
+func TestFieldAccessCache(t *testing.T) {
+	t.Run("registered field functions", func(t *testing.T) {
+		ba, err := bindingaccessor.Compile(`#.A`)
+		require.NoError(t, err)
+		v, err := ba(&registeredFieldContext{A: "value"})
+		require.NoError(t, err)
+		require.Equal(t, "registered value", v)
+
+		ba, err = bindingaccessor.Compile(`#.Err`)
+		require.NoError(t, err)
+		_, err = ba(&registeredFieldContext{})
+		require.Error(t, err)
+	})
+
+	t.Run("polymorphic field access", func(t *testing.T) {
+		ba, err := bindingaccessor.Compile(`#.A`)
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			for _, tc := range []struct {
+				ctx      interface{}
+				expected interface{}
+			}{
+				{ctx: struct{ A int }{A: 33}, expected: 33},
+				{ctx: &struct{ A int }{A: 34}, expected: 34},
+				{ctx: methodFieldContext{}, expected: "method"},
+				{ctx: &methodFieldContext{}, expected: "method"},
+				{ctx: embeddedFieldContext{registeredFieldContext: &registeredFieldContext{A: "embedded"}}, expected: "embedded"},
+				{ctx: map[string]int{}, expected: nil},
+				{ctx: nil, expected: nil},
+			} {
+				v, err := ba(tc.ctx)
+				if tc.expected == nil {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+				require.Equal(t, tc.expected, v)
+			}
+		}
+	})
+
+	t.Run("nil pointers", func(t *testing.T) {
+		ba, err := bindingaccessor.Compile(`#.B`)
+		require.NoError(t, err)
+
+		_, err = ba((*methodFieldContext)(nil))
+		require.Error(t, err)
+
+		_, err = ba(embeddedFieldContext{B: 33})
+		require.NoError(t, err)
+
+		ba, err = bindingaccessor.Compile(`#.A`)
+		require.NoError(t, err)
+		_, err = ba(embeddedFieldContext{})
+		require.Error(t, err)
+	})
+}
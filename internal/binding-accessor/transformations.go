@@ -0,0 +1,270 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package bindingaccessor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// The decoding and normalization transformations apply to string values, and
+// to the string values of arrays and slices, such as the list of values
+// returned by `flat_values`. Other values are left unchanged. A value that
+// cannot be decoded is left unchanged too so that the original value is still
+// inspected.
+
+func execLowercase(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	return mapStringValues(v, maxDepth, maxElements, func(s string, _ int, _ *int) interface{} {
+		return strings.ToLower(s)
+	})
+}
+
+func execURLDecode(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	return mapStringValues(v, maxDepth, maxElements, func(s string, _ int, _ *int) interface{} {
+		decoded, err := url.QueryUnescape(s)
+		if err != nil {
+			return s
+		}
+		return decoded
+	})
+}
+
+// base64Encodings are the base64 encodings tried in order to decode a value.
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+func execBase64Decode(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	return mapStringValues(v, maxDepth, maxElements, func(s string, _ int, _ *int) interface{} {
+		for _, enc := range base64Encodings {
+			if decoded, err := enc.DecodeString(s); err == nil {
+				return string(decoded)
+			}
+		}
+		return s
+	})
+}
+
+func execHTMLEntityDecode(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	return mapStringValues(v, maxDepth, maxElements, func(s string, _ int, _ *int) interface{} {
+		return html.UnescapeString(s)
+	})
+}
+
+// execJSONParse parses JSON string values. The parsed values are truncated to
+// the remaining depth and number of elements, and invalid JSON values are
+// replaced by nil.
+func execJSONParse(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	return mapStringValues(v, maxDepth, maxElements, func(s string, depth int, elements *int) interface{} {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(s), &parsed); err != nil {
+			return nil
+		}
+		return truncateJSONValue(parsed, depth, elements)
+	})
+}
+
+func truncateJSONValue(v interface{}, depth int, elements *int) interface{} {
+	switch actual := v.(type) {
+	case map[string]interface{}:
+		if depth == 0 {
+			return nil
+		}
+		m := make(map[string]interface{}, len(actual))
+		for k, e := range actual {
+			if *elements <= 0 {
+				break
+			}
+			*elements -= 1
+			m[k] = truncateJSONValue(e, depth-1, elements)
+		}
+		return m
+
+	case []interface{}:
+		if depth == 0 {
+			return nil
+		}
+		values := make([]interface{}, 0, len(actual))
+		for _, e := range actual {
+			if *elements <= 0 {
+				break
+			}
+			*elements -= 1
+			values = append(values, truncateJSONValue(e, depth-1, elements))
+		}
+		return values
+
+	default:
+		return v
+	}
+}
+
+// execLength returns the length of strings, arrays, slices and maps, zero for
+// nil values and one for any other value.
+func execLength(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return 0
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+		return rv.Len()
+	default:
+		return 1
+	}
+}
+
+// execUnique returns the list of unique values of arrays and slices, in order
+// of appearance. Other values are left unchanged.
+func execUnique(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+	rv, ok := listValue(v)
+	if !ok {
+		return v
+	}
+	l := rv.Len()
+	seen := make(map[interface{}]struct{}, l)
+	values := make([]interface{}, 0, l)
+	for i := 0; i < l && len(values) < maxElements; i++ {
+		e := rv.Index(i)
+		if !e.CanInterface() {
+			continue
+		}
+		value := e.Interface()
+		if value != nil && !reflect.TypeOf(value).Comparable() {
+			// Non-comparable values cannot be map keys
+			values = append(values, value)
+			continue
+		}
+		if _, exists := seen[value]; exists {
+			continue
+		}
+		seen[value] = struct{}{}
+		values = append(values, value)
+	}
+	return values
+}
+
+// newFilterTransformation returns the transformation keeping the string values
+// matching the given regular expression. Applied to a string value, it returns
+// the value when it matches, nil otherwise. Applied to an array or slice, it
+// returns the list of its matching string values.
+func newFilterTransformation(re *regexp.Regexp) transformationFunc {
+	return func(ctx Context, v interface{}, maxDepth, maxElements int) interface{} {
+		if s, ok := toString(v); ok {
+			if re.MatchString(s) {
+				return v
+			}
+			return nil
+		}
+
+		rv, ok := listValue(v)
+		if !ok {
+			return nil
+		}
+		var values []interface{}
+		for i := 0; i < rv.Len() && len(values) < maxElements; i++ {
+			e := rv.Index(i)
+			if !e.CanInterface() {
+				continue
+			}
+			value := e.Interface()
+			if s, ok := toString(value); ok && re.MatchString(s) {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+}
+
+// listValue returns the array or slice value of v, byte slices excepted.
+func listValue(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return rv, false
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv, false
+		}
+		return rv, true
+	case reflect.Array:
+		return rv, true
+	default:
+		return rv, false
+	}
+}
+
+// stringValueFunc is a transformation of string values. It is given the
+// remaining depth and number of elements the resulting value can have.
+type stringValueFunc func(s string, depth int, elements *int) interface{}
+
+// mapStringValues applies fn to the string value v, or to the string values of
+// the array or slice v. The resulting list of values cannot be deeper than
+// maxDepth nor have more than maxElements.
+func mapStringValues(v interface{}, maxDepth, maxElements int, fn stringValueFunc) interface{} {
+	if v == nil {
+		return nil
+	}
+	return mapStrings(reflect.ValueOf(v), maxDepth, &maxElements, fn)
+}
+
+func mapStrings(v reflect.Value, depth int, elements *int, fn stringValueFunc) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// do not count this step as a deeper level
+		return mapStrings(v.Elem(), depth, elements, fn)
+
+	case reflect.String:
+		*elements -= 1
+		return fn(v.String(), depth, elements)
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			*elements -= 1
+			return fn(string(v.Bytes()), depth, elements)
+		}
+		fallthrough
+	case reflect.Array:
+		if depth == 0 {
+			// do not traverse this value
+			return nil
+		}
+		l := v.Len()
+		values := make([]interface{}, 0, l)
+		for i := 0; i < l && *elements > 0; i++ {
+			values = append(values, mapStrings(v.Index(i), depth-1, elements, fn))
+		}
+		return values
+
+	default:
+		if !v.IsValid() || !v.CanInterface() {
+			return nil
+		}
+		*elements -= 1
+		return v.Interface()
+	}
+}
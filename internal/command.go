@@ -8,6 +8,7 @@ import (
 	"github.com/sqreen/go-agent/internal/backend/api"
 	"github.com/sqreen/go-agent/internal/config"
 	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule"
 )
 
 type CommandManager struct {
@@ -29,6 +30,10 @@ type CommandManagerAgent interface {
 	SetCIDRIPPasslist([]string) error
 	SetPathPasslist([]string) error
 	ReloadRules() (rulespackID string, err error)
+	RollbackRules(rulespackID string) (restoredRulespackID string, err error)
+	DiffRules(from, to string) (*rule.RulespackDiff, error)
+	SetShadowRules(rulespack api.RulesPackResponse, sampleRate float64) (rulespackID string, err error)
+	ClearShadowRules() error
 	SendAppBundle() error
 	SetPerformanceBudget(budget float64) error
 }
@@ -46,6 +51,10 @@ func NewCommandManager(agent CommandManagerAgent, logger plog.DebugLevelLogger)
 		"actions_reload":         mng.ReloadActons,
 		"ips_whitelist":          mng.SetCIDRIPPasslist,
 		"rules_reload":           mng.ReloadRules,
+		"rules_rollback":         mng.RollbackRules,
+		"rules_diff":             mng.DiffRules,
+		"shadow_rules_set":       mng.SetShadowRules,
+		"shadow_rules_clear":     mng.ClearShadowRules,
 		"get_bundle":             mng.GetBundle,
 		"paths_whitelist":        mng.SetPathPasslist,
 		"performance_budget":     mng.SetPerformanceBudget,
@@ -145,6 +154,72 @@ func (m *CommandManager) ReloadRules([]json.RawMessage) (string, error) {
 	return m.agent.ReloadRules()
 }
 
+// RollbackRules optionally expects the ID of the rulespack to roll back to,
+// and returns the ID of the restored rulespack. The rulespack before the
+// current one is restored when no ID is given.
+func (m *CommandManager) RollbackRules(args []json.RawMessage) (string, error) {
+	var packID string
+	switch argc := len(args); argc {
+	case 0:
+	case 1:
+		if err := json.Unmarshal(args[0], &packID); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unexpected number of arguments: expected at most 1 argument but got %d", argc)
+	}
+	return m.agent.RollbackRules(packID)
+}
+
+// DiffRules optionally expects the IDs of the two rulespacks to compare, and
+// returns their difference in JSON. The current rulespack is compared to the
+// previous one when no IDs are given.
+func (m *CommandManager) DiffRules(args []json.RawMessage) (string, error) {
+	var from, to string
+	switch argc := len(args); argc {
+	case 0:
+	case 2:
+		if err := json.Unmarshal(args[0], &from); err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(args[1], &to); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unexpected number of arguments: expected 0 or 2 arguments but got %d", argc)
+	}
+	diff, err := m.agent.DiffRules(from, to)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(diff)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// SetShadowRules expects the shadow rulespack and its sample rate as
+// arguments, and returns the shadow rulespack ID.
+func (m *CommandManager) SetShadowRules(args []json.RawMessage) (string, error) {
+	if argc := len(args); argc != 2 {
+		return "", fmt.Errorf("unexpected number of arguments: expected 2 arguments but got %d", argc)
+	}
+	var rulespack api.RulesPackResponse
+	if err := json.Unmarshal(args[0], &rulespack); err != nil {
+		return "", err
+	}
+	var sampleRate float64
+	if err := json.Unmarshal(args[1], &sampleRate); err != nil {
+		return "", err
+	}
+	return m.agent.SetShadowRules(rulespack, sampleRate)
+}
+
+func (m *CommandManager) ClearShadowRules([]json.RawMessage) (string, error) {
+	return "", m.agent.ClearShadowRules()
+}
+
 func (m *CommandManager) GetBundle([]json.RawMessage) (string, error) {
 	return "", m.agent.SendAppBundle()
 }
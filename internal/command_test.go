@@ -14,6 +14,7 @@ import (
 	"github.com/sqreen/go-agent/internal/backend/api"
 	"github.com/sqreen/go-agent/internal/config"
 	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule"
 	"github.com/sqreen/go-agent/tools/testlib"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -103,6 +104,57 @@ func TestCommandManager(t *testing.T) {
 			AgentCallReturnError:   []interface{}{"", nil},
 			ExpectedOutput:         "my pack id",
 		},
+		{
+			Command:                "rules_rollback",
+			ExpectedAgentCall:      agent.ExpectRollbackRules,
+			Args:                   []json.RawMessage{json.RawMessage(`"my old pack id"`)},
+			ExpectedArgs:           []interface{}{"my old pack id"},
+			AgentCallReturnNoError: []interface{}{"my old pack id", nil},
+			AgentCallReturnError:   []interface{}{"", nil},
+			ExpectedOutput:         "my old pack id",
+			BadArgs: [][]json.RawMessage{
+				{json.RawMessage(`33`)},
+				{json.RawMessage(`"my old pack id"`), json.RawMessage(`"wrong count"`)},
+			},
+		},
+		{
+			Command:                "rules_diff",
+			ExpectedAgentCall:      agent.ExpectDiffRules,
+			Args:                   []json.RawMessage{json.RawMessage(`"my old pack id"`), json.RawMessage(`"my pack id"`)},
+			ExpectedArgs:           []interface{}{"my old pack id", "my pack id"},
+			AgentCallReturnNoError: []interface{}{&rule.RulespackDiff{From: "my old pack id", To: "my pack id", AddedRules: []string{"my rule"}}, nil},
+			AgentCallReturnError:   []interface{}{nil, nil},
+			ExpectedOutput:         `{"from":"my old pack id","to":"my pack id","added_rules":["my rule"]}`,
+			BadArgs: [][]json.RawMessage{
+				{json.RawMessage(`"my old pack id"`)},
+				{json.RawMessage(`33`), json.RawMessage(`"my pack id"`)},
+				{json.RawMessage(`"my old pack id"`), json.RawMessage(`33`)},
+			},
+		},
+		{
+			Command:           "shadow_rules_set",
+			ExpectedAgentCall: agent.ExpectSetShadowRules,
+			Args: []json.RawMessage{
+				json.RawMessage(`{"pack_id":"my shadow pack id","rules":[]}`),
+				json.RawMessage(`0.25`),
+			},
+			ExpectedArgs: []interface{}{
+				api.RulesPackResponse{PackID: "my shadow pack id", Rules: []api.Rule{}},
+				0.25,
+			},
+			AgentCallReturnNoError: []interface{}{"my shadow pack id", nil},
+			AgentCallReturnError:   []interface{}{"", nil},
+			ExpectedOutput:         "my shadow pack id",
+			BadArgs: [][]json.RawMessage{
+				{json.RawMessage(`{"pack_id":"my shadow pack id","rules":[]}`)},
+				{json.RawMessage(`"wrong type"`), json.RawMessage(`0.25`)},
+				{json.RawMessage(`{"pack_id":"my shadow pack id","rules":[]}`), json.RawMessage(`"wrong type"`)},
+			},
+		},
+		{
+			Command:           "shadow_rules_clear",
+			ExpectedAgentCall: agent.ExpectClearShadowRules,
+		},
 		{
 			Command:           "get_bundle",
 			ExpectedAgentCall: agent.ExpectSendAppBundle,
@@ -355,6 +407,35 @@ func (a *agentMockup) ReloadRules() (string, error) {
 	return ret.String(0), ret.Error(1)
 }
 
+func (a *agentMockup) RollbackRules(packID string) (string, error) {
+	ret := a.Called(packID)
+	return ret.String(0), ret.Error(1)
+}
+
+func (a *agentMockup) ExpectRollbackRules(args ...interface{}) *mock.Call {
+	return a.On("RollbackRules", args...)
+}
+
+func (a *agentMockup) DiffRules(from, to string) (*rule.RulespackDiff, error) {
+	ret := a.Called(from, to)
+	diff, _ := ret.Get(0).(*rule.RulespackDiff)
+	return diff, ret.Error(1)
+}
+
+func (a *agentMockup) ExpectDiffRules(args ...interface{}) *mock.Call {
+	return a.On("DiffRules", args...)
+}
+
+func (a *agentMockup) SetShadowRules(rulespack api.RulesPackResponse, sampleRate float64) (string, error) {
+	ret := a.Called(rulespack, sampleRate)
+	return ret.String(0), ret.Error(1)
+}
+
+func (a *agentMockup) ClearShadowRules() error {
+	ret := a.Called()
+	return ret.Error(0)
+}
+
 func (a *agentMockup) SendAppBundle() error {
 	ret := a.Called()
 	return ret.Error(0)
@@ -395,3 +476,11 @@ func (a *agentMockup) ExpectSetPathPasslist(args ...interface{}) *mock.Call {
 func (a *agentMockup) ExpectReloadRules(...interface{}) *mock.Call {
 	return a.On("ReloadRules")
 }
+
+func (a *agentMockup) ExpectSetShadowRules(args ...interface{}) *mock.Call {
+	return a.On("SetShadowRules", args...)
+}
+
+func (a *agentMockup) ExpectClearShadowRules(...interface{}) *mock.Call {
+	return a.On("ClearShadowRules")
+}
@@ -226,11 +226,22 @@ const (
 	configKeyDisable                        = `disable`
 	configKeyStripHTTPReferer               = `strip_http_referer`
 	configKeyRules                          = `rules`
+	configKeyRulesPublicKeys                = `rules_public_keys`
 	configKeySDKMetricsPeriod               = `sdk_metrics_period`
 	configKeyMaxMetricsStoreLength          = `max_metrics_store_length`
 	configKeyDisableSignalBackend           = `disable_signal_backend`
 	configKeyStripSensitiveKeyRegexp        = `strip_sensitive_key_regexp`
 	configKeyStripSensitiveValueRegexp      = `strip_sensitive_value_regexp`
+	configKeyHTTPResponseBodyMaxSize        = `response_body_inspection_max_size`
+	configKeyHTTPResponseBodyContentTypes   = `response_body_inspection_content_types`
+	configKeyRuleTraceSecret                = `rule_trace_secret`
+	configKeyRuleCircuitBreakerMaxFailures  = `rule_circuit_breaker_max_failures`
+	configKeyRuleCircuitBreakerMaxLatency   = `rule_circuit_breaker_max_latency`
+	configKeyRuleCircuitBreakerCoolDown     = `rule_circuit_breaker_cool_down`
+	configKeyRulesAutoRollbackWindow        = `rules_auto_rollback_window`
+	configKeyRulesAutoRollbackMaxErrors     = `rules_auto_rollback_max_errors`
+	configKeyRulesAutoRollbackMaxOverBudget = `rules_auto_rollback_max_overbudget`
+	configKeyWAFExclusions                  = `waf_exclusions`
 )
 
 // User configuration's default values.
@@ -242,6 +253,13 @@ const (
 	configDefaultSDKMetricsPeriod      = 60
 	configDefaultMaxMetricsStoreLength = 100 * 1024 * 1024
 
+	configDefaultRuleCircuitBreakerMaxFailures = 0
+	configDefaultRuleCircuitBreakerCoolDown    = 60
+
+	configDefaultRulesAutoRollbackWindow        = 0
+	configDefaultRulesAutoRollbackMaxErrors     = 100
+	configDefaultRulesAutoRollbackMaxOverBudget = 1000
+
 	// configDefaultStripSensitiveKeyRegexp is the scrubber key regular expression (cf. scrubber doc
 	// for usage). It is a case-insensitive regexp matching passwd, password,
 	// passphrase, secret, authorization, api_key, apikey, accesstoken,
@@ -252,6 +270,11 @@ const (
 	// number separators.
 	configDefaultStripSensitiveValueRegexp = `(?:\d[ -]*?){13,16}`
 	ScrubberRedactedString                 = `<Redacted by Sqreen>`
+
+	// configDefaultHTTPResponseBodyContentTypes is the comma-separated list of
+	// response content types whose body is inspected when the response body
+	// inspection is enabled.
+	configDefaultHTTPResponseBodyContentTypes = `text/html,text/plain,application/json,application/xml,text/xml`
 )
 
 func New(logger *plog.Logger) (*Config, error) {
@@ -278,11 +301,22 @@ func New(logger *plog.Logger) (*Config, error) {
 		{key: configKeyDisable, defaultValue: ""},
 		{key: configKeyStripHTTPReferer, defaultValue: ""},
 		{key: configKeyRules, defaultValue: "", hidden: true},
+		{key: configKeyRulesPublicKeys, defaultValue: "", hidden: true},
 		{key: configKeySDKMetricsPeriod, defaultValue: configDefaultSDKMetricsPeriod, hidden: true},
 		{key: configKeyMaxMetricsStoreLength, defaultValue: configDefaultMaxMetricsStoreLength, hidden: true},
 		{key: configKeyDisableSignalBackend, defaultValue: "", hidden: true},
 		{key: configKeyStripSensitiveKeyRegexp, defaultValue: configDefaultStripSensitiveKeyRegexp},
 		{key: configKeyStripSensitiveValueRegexp, defaultValue: configDefaultStripSensitiveValueRegexp},
+		{key: configKeyHTTPResponseBodyMaxSize, defaultValue: 0},
+		{key: configKeyHTTPResponseBodyContentTypes, defaultValue: configDefaultHTTPResponseBodyContentTypes},
+		{key: configKeyRuleTraceSecret, defaultValue: ""},
+		{key: configKeyRuleCircuitBreakerMaxFailures, defaultValue: configDefaultRuleCircuitBreakerMaxFailures},
+		{key: configKeyRuleCircuitBreakerMaxLatency, defaultValue: 0},
+		{key: configKeyRuleCircuitBreakerCoolDown, defaultValue: configDefaultRuleCircuitBreakerCoolDown},
+		{key: configKeyRulesAutoRollbackWindow, defaultValue: configDefaultRulesAutoRollbackWindow},
+		{key: configKeyRulesAutoRollbackMaxErrors, defaultValue: configDefaultRulesAutoRollbackMaxErrors},
+		{key: configKeyRulesAutoRollbackMaxOverBudget, defaultValue: configDefaultRulesAutoRollbackMaxOverBudget},
+		{key: configKeyWAFExclusions, defaultValue: ""},
 	}
 	for _, p := range parameters {
 		manager.SetDefault(p.key, p.defaultValue)
@@ -403,6 +437,13 @@ func (c *Config) LocalRulesFile() string {
 	return sanitizeString(c.GetString(configKeyRules))
 }
 
+// RulesPublicKeysFile returns a PEM file containing additional ECDSA public keys
+// trusted to verify the rule signatures, so that local rules can be signed
+// with private keys other than Sqreen's.
+func (c *Config) RulesPublicKeysFile() string {
+	return sanitizeString(c.GetString(configKeyRulesPublicKeys))
+}
+
 // SDKMetricsPeriod returns the period to use for the SDK metric stores.
 // This is temporary until the SDK rules are implemented and required for
 // integration tests which require a shorter time.
@@ -468,6 +509,111 @@ func (c *Config) stripSensitiveValueRegexp() (*regexp.Regexp, error) {
 	return regexp.Compile(expr)
 }
 
+// HTTPResponseBodyMaxSize returns the maximum size of the HTTP response bodies
+// that can be buffered in order to be inspected by the protections before
+// being sent. Response bodies larger than this size are not inspected. The
+// response body inspection is disabled when zero, which is the default.
+func (c *Config) HTTPResponseBodyMaxSize() int {
+	n := c.GetInt(configKeyHTTPResponseBodyMaxSize)
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// HTTPResponseBodyContentTypes returns the list of HTTP response content types
+// whose body can be inspected.
+func (c *Config) HTTPResponseBodyContentTypes() []string {
+	var contentTypes []string
+	for _, ct := range strings.Split(c.GetString(configKeyHTTPResponseBodyContentTypes), ",") {
+		if ct = sanitizeString(ct); ct != "" {
+			contentTypes = append(contentTypes, ct)
+		}
+	}
+	return contentTypes
+}
+
+// RuleTraceSecret returns the secret key of the signed HTTP request header
+// enabling the execution trace of the rules in the request. The header is
+// ignored when empty, which is the default.
+func (c *Config) RuleTraceSecret() string {
+	return sanitizeString(c.GetString(configKeyRuleTraceSecret))
+}
+
+// RuleCircuitBreakerMaxFailures returns the number of consecutive failures of
+// the callbacks of a rule after which they are disabled for the circuit
+// breaker cool-down. Circuit breakers are disabled when zero, which is the
+// default.
+func (c *Config) RuleCircuitBreakerMaxFailures() int {
+	n := c.GetInt(configKeyRuleCircuitBreakerMaxFailures)
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// RuleCircuitBreakerMaxLatency returns the execution time of a rule callback,
+// in milliseconds, above which the call is considered as failed by the circuit
+// breaker. It is ignored when zero, which is the default.
+func (c *Config) RuleCircuitBreakerMaxLatency() time.Duration {
+	ms := c.GetFloat64(configKeyRuleCircuitBreakerMaxLatency)
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// RuleCircuitBreakerCoolDown returns the duration, in seconds, during which
+// the callbacks of a rule are disabled by its circuit breaker before being
+// retried.
+func (c *Config) RuleCircuitBreakerCoolDown() time.Duration {
+	s := c.GetInt(configKeyRuleCircuitBreakerCoolDown)
+	if s <= 0 {
+		s = configDefaultRuleCircuitBreakerCoolDown
+	}
+	return time.Duration(s) * time.Second
+}
+
+// RulesAutoRollbackWindow returns the duration, in seconds, during which a new
+// rulespack is automatically rolled back to the previous one when it causes a
+// spike of callback errors or over-budget callbacks. The automatic rollback is
+// disabled when zero, which is the default.
+func (c *Config) RulesAutoRollbackWindow() time.Duration {
+	s := c.GetInt(configKeyRulesAutoRollbackWindow)
+	if s < 0 {
+		s = 0
+	}
+	return time.Duration(s) * time.Second
+}
+
+// RulesAutoRollbackMaxErrors returns the number of callback errors of a new
+// rulespack triggering its automatic rollback. It is ignored when zero.
+func (c *Config) RulesAutoRollbackMaxErrors() uint64 {
+	n := c.GetInt(configKeyRulesAutoRollbackMaxErrors)
+	if n < 0 {
+		n = 0
+	}
+	return uint64(n)
+}
+
+// RulesAutoRollbackMaxOverBudget returns the number of over-budget callbacks of
+// a new rulespack triggering its automatic rollback. It is ignored when zero.
+func (c *Config) RulesAutoRollbackMaxOverBudget() uint64 {
+	n := c.GetInt(configKeyRulesAutoRollbackMaxOverBudget)
+	if n < 0 {
+		n = 0
+	}
+	return uint64(n)
+}
+
+// WAFExclusionsFile returns a JSON file containing the array of local
+// exclusions of the in-app WAF rules, allowing to suppress their false
+// positives by disabling rules, switching them to monitoring, or excluding
+// request parameters, headers or paths from them.
+func (c *Config) WAFExclusionsFile() string {
+	return sanitizeString(c.GetString(configKeyWAFExclusions))
+}
+
 func sanitizeString(s string) string {
 	return strings.TrimSpace(s)
 }
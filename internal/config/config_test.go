@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sqreen/go-agent/internal/plog"
 	"github.com/sqreen/go-agent/internal/sqlib/sqsanitize"
@@ -61,6 +62,18 @@ func TestUserConfig(t *testing.T) {
 			ConfigKey:   configKeyBackendHTTPAPIProxy,
 			SomeValue:   testlib.RandUTF8String(2, 30),
 		},
+		{
+			Name:        "Rule Trace Secret",
+			GetCfgValue: cfg.RuleTraceSecret,
+			ConfigKey:   configKeyRuleTraceSecret,
+			SomeValue:   testlib.RandUTF8String(2, 30),
+		},
+		{
+			Name:        "WAF Exclusions File",
+			GetCfgValue: cfg.WAFExclusionsFile,
+			ConfigKey:   configKeyWAFExclusions,
+			SomeValue:   testlib.RandUTF8String(2, 30),
+		},
 	}
 	for _, tc := range stringValueTests {
 		testStringValue(t, cfg, tc.Name, tc.GetCfgValue, tc.ConfigKey, tc.DefaultValue, tc.SomeValue)
@@ -97,6 +110,117 @@ func TestUserConfig(t *testing.T) {
 	}
 }
 
+func TestHTTPResponseBodyConfig(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	cfg, unset := newTestConfig(t, logger)
+	defer unset()
+
+	t.Run("Default values", func(t *testing.T) {
+		require.Equal(t, 0, cfg.HTTPResponseBodyMaxSize())
+		require.Equal(t, []string{"text/html", "text/plain", "application/json", "application/xml", "text/xml"}, cfg.HTTPResponseBodyContentTypes())
+	})
+
+	t.Run("Set through environment variables", func(t *testing.T) {
+		maxSizeEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyHTTPResponseBodyMaxSize)
+		os.Setenv(maxSizeEnvVar, "65536")
+		defer os.Unsetenv(maxSizeEnvVar)
+		contentTypesEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyHTTPResponseBodyContentTypes)
+		os.Setenv(contentTypesEnvVar, " text/html, ,application/json ")
+		defer os.Unsetenv(contentTypesEnvVar)
+
+		require.Equal(t, 65536, cfg.HTTPResponseBodyMaxSize())
+		require.Equal(t, []string{"text/html", "application/json"}, cfg.HTTPResponseBodyContentTypes())
+	})
+
+	t.Run("Negative max size", func(t *testing.T) {
+		maxSizeEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyHTTPResponseBodyMaxSize)
+		os.Setenv(maxSizeEnvVar, "-1")
+		defer os.Unsetenv(maxSizeEnvVar)
+		require.Equal(t, 0, cfg.HTTPResponseBodyMaxSize())
+	})
+}
+
+func TestRuleCircuitBreakerConfig(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	cfg, unset := newTestConfig(t, logger)
+	defer unset()
+
+	maxFailuresEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRuleCircuitBreakerMaxFailures)
+	maxLatencyEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRuleCircuitBreakerMaxLatency)
+	coolDownEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRuleCircuitBreakerCoolDown)
+
+	t.Run("Default values", func(t *testing.T) {
+		require.Equal(t, 0, cfg.RuleCircuitBreakerMaxFailures())
+		require.Equal(t, time.Duration(0), cfg.RuleCircuitBreakerMaxLatency())
+		require.Equal(t, time.Minute, cfg.RuleCircuitBreakerCoolDown())
+	})
+
+	t.Run("Set through environment variables", func(t *testing.T) {
+		os.Setenv(maxFailuresEnvVar, "3")
+		defer os.Unsetenv(maxFailuresEnvVar)
+		os.Setenv(maxLatencyEnvVar, "2.5")
+		defer os.Unsetenv(maxLatencyEnvVar)
+		os.Setenv(coolDownEnvVar, "5")
+		defer os.Unsetenv(coolDownEnvVar)
+
+		require.Equal(t, 3, cfg.RuleCircuitBreakerMaxFailures())
+		require.Equal(t, 2500*time.Microsecond, cfg.RuleCircuitBreakerMaxLatency())
+		require.Equal(t, 5*time.Second, cfg.RuleCircuitBreakerCoolDown())
+	})
+
+	t.Run("Negative values", func(t *testing.T) {
+		os.Setenv(maxFailuresEnvVar, "-1")
+		defer os.Unsetenv(maxFailuresEnvVar)
+		os.Setenv(maxLatencyEnvVar, "-1")
+		defer os.Unsetenv(maxLatencyEnvVar)
+		os.Setenv(coolDownEnvVar, "-1")
+		defer os.Unsetenv(coolDownEnvVar)
+
+		require.Equal(t, 0, cfg.RuleCircuitBreakerMaxFailures())
+		require.Equal(t, time.Duration(0), cfg.RuleCircuitBreakerMaxLatency())
+		require.Equal(t, time.Minute, cfg.RuleCircuitBreakerCoolDown())
+	})
+}
+
+func TestRulesAutoRollbackConfig(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	cfg, unset := newTestConfig(t, logger)
+	defer unset()
+
+	windowEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRulesAutoRollbackWindow)
+	maxErrorsEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRulesAutoRollbackMaxErrors)
+	maxOverBudgetEnvVar := strings.ToUpper(configEnvPrefix) + "_" + strings.ToUpper(configKeyRulesAutoRollbackMaxOverBudget)
+
+	t.Run("Default values", func(t *testing.T) {
+		require.Equal(t, time.Duration(0), cfg.RulesAutoRollbackWindow())
+		require.Equal(t, uint64(100), cfg.RulesAutoRollbackMaxErrors())
+		require.Equal(t, uint64(1000), cfg.RulesAutoRollbackMaxOverBudget())
+	})
+
+	t.Run("Set through environment variables", func(t *testing.T) {
+		os.Setenv(windowEnvVar, "60")
+		defer os.Unsetenv(windowEnvVar)
+		os.Setenv(maxErrorsEnvVar, "10")
+		defer os.Unsetenv(maxErrorsEnvVar)
+		os.Setenv(maxOverBudgetEnvVar, "0")
+		defer os.Unsetenv(maxOverBudgetEnvVar)
+
+		require.Equal(t, time.Minute, cfg.RulesAutoRollbackWindow())
+		require.Equal(t, uint64(10), cfg.RulesAutoRollbackMaxErrors())
+		require.Equal(t, uint64(0), cfg.RulesAutoRollbackMaxOverBudget())
+	})
+
+	t.Run("Negative values", func(t *testing.T) {
+		os.Setenv(windowEnvVar, "-1")
+		defer os.Unsetenv(windowEnvVar)
+		os.Setenv(maxErrorsEnvVar, "-1")
+		defer os.Unsetenv(maxErrorsEnvVar)
+
+		require.Equal(t, time.Duration(0), cfg.RulesAutoRollbackWindow())
+		require.Equal(t, uint64(0), cfg.RulesAutoRollbackMaxErrors())
+	})
+}
+
 func TestConfigValidation(t *testing.T) {
 	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
 
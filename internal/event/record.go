@@ -26,6 +26,11 @@ type Record struct {
 
 	// A user id has been globally associated using `Identify()`
 	identifiedUser bool
+
+	// trace is the execution trace of the rule callbacks, nil when tracing is
+	// disabled.
+	traceLock sync.Mutex
+	trace     *Trace
 }
 
 type PropertyMap = map[string]string
@@ -48,6 +53,9 @@ type AttackEvent struct {
 	Info       interface{}
 	StackTrace []uintptr
 	AttackType string
+	// ShadowRulespackID is the ID of the shadow rulespack of the rule, empty
+	// when the rule is live.
+	ShadowRulespackID string
 }
 
 func (r *Record) AddAttackEvent(attack *AttackEvent) {
@@ -164,10 +172,32 @@ func (e *CustomEvent) WithUserIdentifiers(id UserIdentifierMap) {
 	e.UserID = id
 }
 
+// EnableTrace enables the execution trace of the rule callbacks with the given
+// trace ID. The current trace is returned when already enabled.
+func (r *Record) EnableTrace(id string) *Trace {
+	r.traceLock.Lock()
+	defer r.traceLock.Unlock()
+	if r.trace == nil {
+		r.trace = NewTrace(id)
+	}
+	return r.trace
+}
+
+// Trace returns the execution trace of the rule callbacks, nil when tracing is
+// disabled.
+func (r *Record) Trace() *Trace {
+	r.traceLock.Lock()
+	defer r.traceLock.Unlock()
+	return r.trace
+}
+
 type Recorded struct {
 	AttackEvents []*AttackEvent
 	CustomEvents []*CustomEvent
 	UserEvents   []UserEventFace
+	// Trace is the execution trace of the rule callbacks, nil when tracing was
+	// disabled.
+	Trace *Trace
 }
 
 func (r *Record) CloseRecord() Recorded {
@@ -175,9 +205,18 @@ func (r *Record) CloseRecord() Recorded {
 		AttackEvents: r.flushAttackEvents(),
 		CustomEvents: r.flushCustomEvents(),
 		UserEvents:   r.flushUserEvents(),
+		Trace:        r.flushTrace(),
 	}
 }
 
+func (r *Record) flushTrace() *Trace {
+	r.traceLock.Lock()
+	defer r.traceLock.Unlock()
+	trace := r.trace
+	r.trace = nil
+	return trace
+}
+
 func (r *Record) flushUserEvents() []UserEventFace {
 	r.userEventsLock.Lock()
 	defer r.userEventsLock.Unlock()
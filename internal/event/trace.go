@@ -0,0 +1,101 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package event
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limits of a trace so that tracing a request cannot use an unbounded amount
+// of memory.
+const (
+	MaxTraceEntries    = 1000
+	MaxTraceValues     = 100
+	MaxTraceValueBytes = 1024
+)
+
+// Trace is the execution trace of the rule callbacks in a request, in the
+// order they were called.
+type Trace struct {
+	// ID is the unique ID of the trace.
+	ID string
+
+	lock    sync.Mutex
+	entries []*TraceEntry
+	// truncated is true when the trace reached MaxTraceEntries.
+	truncated bool
+}
+
+// TraceEntry is the execution trace of a rule callback.
+type TraceEntry struct {
+	Rule string
+	// Callback is either `pre` or `post`.
+	Callback string
+	Start    time.Time
+	// Duration is the execution time of the callback along with its
+	// middlewares.
+	Duration time.Duration
+	// Executed is false when the callback was skipped by a middleware, such as
+	// the rule condition, sampling or performance cap.
+	Executed bool
+	Error    string
+	// Values are the values seen by the callback, such as its binding accessor
+	// values, in the order they were computed.
+	Values []TraceValue
+}
+
+// TraceValue is a named value seen by a rule callback.
+type TraceValue struct {
+	Name string
+	// Value is the string representation of the value, truncated to
+	// MaxTraceValueBytes.
+	Value string
+}
+
+func NewTrace(id string) *Trace {
+	return &Trace{ID: id}
+}
+
+// Start adds a new trace entry for the given rule callback. It returns nil
+// when the trace is full.
+func (t *Trace) Start(rule, callback string) *TraceEntry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.entries) >= MaxTraceEntries {
+		t.truncated = true
+		return nil
+	}
+	e := &TraceEntry{
+		Rule:     rule,
+		Callback: callback,
+		Start:    time.Now(),
+	}
+	t.entries = append(t.entries, e)
+	return e
+}
+
+// Entries returns the trace entries and whether it was truncated.
+func (t *Trace) Entries() (entries []*TraceEntry, truncated bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.entries, t.truncated
+}
+
+// AddValue adds the given value to the trace entry. Values above
+// MaxTraceValues are ignored.
+func (e *TraceEntry) AddValue(name string, v interface{}) {
+	if len(e.Values) >= MaxTraceValues {
+		return
+	}
+	s := fmt.Sprintf("%v", v)
+	if len(s) > MaxTraceValueBytes {
+		s = s[:MaxTraceValueBytes]
+	}
+	e.Values = append(e.Values, TraceValue{Name: name, Value: s})
+}
@@ -0,0 +1,405 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package lint statically checks the binding accessor expressions of a
+// rulespack against the capabilities the rules declare and the Go types of the
+// functions they hook, in order to report misspelled fields and wrong argument
+// indexes before the rules are deployed. The Go types are read from the source
+// code of the packages, as found from a directory of a Go module requiring the
+// agent.
+package lint
+
+import (
+	"fmt"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// Problem is an issue found in a rule.
+type Problem struct {
+	Rule string `json:"rule"`
+	// Location is the rule entry where the problem was found, such as
+	// `callbacks.pre`.
+	Location string `json:"location"`
+	// Expression is the binding accessor expression having the problem, if
+	// any.
+	Expression string `json:"expression,omitempty"`
+	Message    string `json:"message"`
+	// Warning is true when the problem limits the checks but isn't an error of
+	// the rule, such as a hooked function whose signature cannot be found.
+	Warning bool `json:"warning"`
+}
+
+// Linter checks the rules using the Go types imported from the source code of
+// the packages found from a given directory.
+type Linter struct {
+	dir      string
+	importer types.ImporterFrom
+	contexts *contextTypes
+	funcs    map[string]hookedFuncLookup
+}
+
+// NewLinter returns a linter importing the Go packages from the directory dir,
+// which must belong to a Go module requiring the agent.
+func NewLinter(dir string) *Linter {
+	return newLinter(dir, importer.ForCompiler(token.NewFileSet(), "source", nil).(types.ImporterFrom))
+}
+
+func newLinter(dir string, importer types.ImporterFrom) *Linter {
+	return &Linter{
+		dir:      dir,
+		importer: importer,
+		funcs:    make(map[string]hookedFuncLookup),
+	}
+}
+
+// contextTypes are the types of the binding accessor contexts the agent
+// executes the binding accessor expressions with.
+type contextTypes struct {
+	// reflected is the context type of the reflected callbacks.
+	reflected types.Type
+	// waf is the context type of the WAF binding accessors.
+	waf types.Type
+	// condition is the context type of the rule conditions.
+	condition types.Type
+}
+
+// Context types of the agent, whose Go types are imported from the source code
+// of their package.
+var (
+	reflectedContextType = reflect.TypeOf(callback.BindingAccessorContextType{})
+	wafContextType       = reflect.TypeOf(callback.WAFBindingAccessorContextType{})
+	conditionContextType = reflect.TypeOf(callback.HTTPRequestBindingAccessorContext{})
+)
+
+// capabilityPaths are the binding accessor paths of the reflected callback
+// context values enabled by the rule capabilities.
+var capabilityPaths = map[string]string{
+	"rule":    "#.Rule",
+	"sql":     "#.SQL",
+	"func":    "#.Func",
+	"request": "#.Request",
+	"lib":     "#.Lib",
+	"cache":   "",
+}
+
+// Lint checks the given rules and returns the list of problems found. An
+// error is returned when the agent types cannot be imported.
+func (l *Linter) Lint(rules []api.Rule) ([]Problem, error) {
+	if l.contexts == nil {
+		contexts, err := l.importContextTypes()
+		if err != nil {
+			return nil, err
+		}
+		l.contexts = contexts
+	}
+
+	var problems []Problem
+	for i := range rules {
+		problems = append(problems, l.lintRule(&rules[i])...)
+	}
+	return problems, nil
+}
+
+func (l *Linter) importContextTypes() (*contextTypes, error) {
+	pkgPath := reflectedContextType.PkgPath()
+	pkg, err := l.importer.ImportFrom(pkgPath, l.dir, 0)
+	if err != nil {
+		return nil, sqerrors.Wrapf(err, "could not import the agent package `%s` from directory `%s`", pkgPath, l.dir)
+	}
+	lookup := func(t reflect.Type) (types.Type, error) {
+		obj, ok := pkg.Scope().Lookup(t.Name()).(*types.TypeName)
+		if !ok {
+			return nil, sqerrors.Errorf("could not find type `%s` in package `%s`", t.Name(), pkgPath)
+		}
+		return obj.Type(), nil
+	}
+
+	reflected, err := lookup(reflectedContextType)
+	if err != nil {
+		return nil, err
+	}
+	waf, err := lookup(wafContextType)
+	if err != nil {
+		return nil, err
+	}
+	condition, err := lookup(conditionContextType)
+	if err != nil {
+		return nil, err
+	}
+	return &contextTypes{
+		reflected: types.NewPointer(reflected),
+		waf:       waf,
+		condition: types.NewPointer(condition),
+	}, nil
+}
+
+// ruleLinter gathers the problems found in a rule.
+type ruleLinter struct {
+	rule     *api.Rule
+	problems []Problem
+}
+
+func (r *ruleLinter) errorf(location, expr, format string, args ...interface{}) {
+	r.problems = append(r.problems, Problem{
+		Rule:       r.rule.Name,
+		Location:   location,
+		Expression: expr,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+func (r *ruleLinter) check(checker *bindingaccessor.Checker, location string, exprs ...string) {
+	for _, expr := range exprs {
+		if err := checker.Check(expr); err != nil {
+			r.problems = append(r.problems, Problem{
+				Rule:       r.rule.Name,
+				Location:   location,
+				Expression: expr,
+				Message:    err.Error(),
+			})
+		}
+	}
+}
+
+func (l *Linter) lintRule(rule *api.Rule) []Problem {
+	r := &ruleLinter{rule: rule}
+
+	conditionChecker := &bindingaccessor.Checker{Context: l.contexts.condition}
+	r.check(conditionChecker, "conditions.pre", conditionExpressions(rule.Conditions.Pre, nil)...)
+	r.check(conditionChecker, "conditions.post", conditionExpressions(rule.Conditions.Post, nil)...)
+
+	wafChecker := &bindingaccessor.Checker{Context: l.contexts.waf}
+	for _, entry := range rule.Data.Values {
+		if waf, ok := entry.Value.(*api.WAFRuleDataEntry); ok {
+			r.check(wafChecker, "data.values.binding_accessors", waf.BindingAccessors...)
+		}
+	}
+
+	if rule.Hookpoint.Strategy == "reflected" {
+		l.lintReflectedCallbacks(r)
+	}
+	return r.problems
+}
+
+func (l *Linter) lintReflectedCallbacks(r *ruleLinter) {
+	var pre, post []string
+	switch callbacks := r.rule.Callbacks.RuleCallbacksNode.(type) {
+	case *api.RuleJSCallbacks:
+		// The last entry is the javascript function
+		if l := len(callbacks.Pre); l > 0 {
+			pre = callbacks.Pre[:l-1]
+		}
+		if l := len(callbacks.Post); l > 0 {
+			post = callbacks.Post[:l-1]
+		}
+	case *api.RuleFunctionWAFCallbacks:
+		pre, post = functionWAFExpressions(callbacks.Pre), functionWAFExpressions(callbacks.Post)
+	}
+	if len(pre) == 0 && len(post) == 0 {
+		return
+	}
+
+	var capabilities []string
+	if cfg := r.rule.Hookpoint.Config; cfg != nil {
+		capabilities = cfg.BindingAccessor.Capabilities
+	}
+	unavailable := make(map[string]string, len(capabilityPaths))
+	for capability, path := range capabilityPaths {
+		if path != "" {
+			unavailable[path] = "capability `" + capability + "` is not declared"
+		}
+	}
+	funcCapability := false
+	for _, capability := range capabilities {
+		path, ok := capabilityPaths[capability]
+		if !ok {
+			r.errorf("hookpoint.arguments_options.binding_accessor.capabilities", "", "unknown binding accessor capability `%s`", capability)
+			continue
+		}
+		delete(unavailable, path)
+		funcCapability = funcCapability || capability == "func"
+	}
+
+	elements := map[string][]types.Type{}
+	if funcCapability {
+		symbol := r.rule.Hookpoint.Method
+		fn, err := l.hookedFunc(symbol)
+		if err != nil {
+			r.problems = append(r.problems, Problem{
+				Rule:     r.rule.Name,
+				Location: "hookpoint.method",
+				Message:  sqerrors.Wrap(err, "the function arguments and results cannot be checked").Error(),
+				Warning:  true,
+			})
+		} else {
+			elements["#.Func.Args"] = fn.args
+			elements["#.Func.Rets"] = fn.rets
+		}
+	}
+
+	postChecker := &bindingaccessor.Checker{
+		Context:     l.contexts.reflected,
+		Elements:    elements,
+		Unavailable: unavailable,
+	}
+	r.check(postChecker, "callbacks.post", post...)
+
+	// The function results are not available yet before the call
+	preUnavailable := make(map[string]string, len(unavailable)+1)
+	for path, reason := range unavailable {
+		preUnavailable[path] = reason
+	}
+	preUnavailable["#.Func.Rets"] = "the function results are only available in post callbacks"
+	preChecker := &bindingaccessor.Checker{
+		Context:     l.contexts.reflected,
+		Elements:    elements,
+		Unavailable: preUnavailable,
+	}
+	r.check(preChecker, "callbacks.pre", pre...)
+}
+
+// functionWAFExpressions returns the binding accessor expressions of the
+// function WAF callbacks, ie. both the keys and values of the map, in a
+// deterministic order.
+func functionWAFExpressions(bas map[string]string) []string {
+	keys := make([]string, 0, len(bas))
+	for k := range bas {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	exprs := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		exprs = append(exprs, k, bas[k])
+	}
+	return exprs
+}
+
+// conditionExpressions appends the binding accessor expressions of the rule
+// condition operands to exprs.
+func conditionExpressions(v interface{}, exprs []string) []string {
+	switch actual := v.(type) {
+	case api.RuleCondition:
+		ops := make([]string, 0, len(actual))
+		for op := range actual {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			exprs = conditionExpressions(actual[op], exprs)
+		}
+	case map[string]interface{}:
+		ops := make([]string, 0, len(actual))
+		for op := range actual {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			exprs = conditionExpressions(actual[op], exprs)
+		}
+	case []interface{}:
+		for _, operand := range actual {
+			exprs = conditionExpressions(operand, exprs)
+		}
+	case string:
+		if strings.HasPrefix(actual, "#.") {
+			exprs = append(exprs, actual)
+		}
+	}
+	return exprs
+}
+
+// hookedFunc is the list of argument and result types of a hooked function.
+// The receiver of a method is its first argument.
+type hookedFunc struct {
+	args, rets []types.Type
+}
+
+type hookedFuncLookup struct {
+	fn  *hookedFunc
+	err error
+}
+
+// hookedFunc returns the argument and result types of the function of the
+// given symbol, as returned by the Go runtime. The result is cached.
+func (l *Linter) hookedFunc(symbol string) (*hookedFunc, error) {
+	lookup, exists := l.funcs[symbol]
+	if !exists {
+		lookup.fn, lookup.err = l.lookupFunc(symbol)
+		l.funcs[symbol] = lookup
+	}
+	return lookup.fn, lookup.err
+}
+
+func (l *Linter) lookupFunc(symbol string) (*hookedFunc, error) {
+	pkgPath, recv, name := splitSymbol(symbol)
+	if pkgPath == "" {
+		return nil, sqerrors.Errorf("unexpected function symbol `%s`", symbol)
+	}
+	pkg, err := l.importer.ImportFrom(pkgPath, l.dir, 0)
+	if err != nil {
+		return nil, sqerrors.Wrapf(err, "could not import the package `%s` of function `%s`", pkgPath, symbol)
+	}
+
+	var (
+		fn  = &hookedFunc{}
+		obj types.Object
+	)
+	if recv == "" {
+		obj = pkg.Scope().Lookup(name)
+	} else {
+		typeName, ok := pkg.Scope().Lookup(strings.TrimPrefix(recv, "*")).(*types.TypeName)
+		if !ok {
+			return nil, sqerrors.Errorf("could not find the receiver type of function `%s`", symbol)
+		}
+		recvType := typeName.Type()
+		if strings.HasPrefix(recv, "*") {
+			recvType = types.NewPointer(recvType)
+		}
+		obj, _, _ = types.LookupFieldOrMethod(recvType, false, pkg, name)
+		fn.args = append(fn.args, recvType)
+	}
+	f, ok := obj.(*types.Func)
+	if !ok {
+		return nil, sqerrors.Errorf("could not find the function `%s`", symbol)
+	}
+
+	sig := f.Type().(*types.Signature)
+	for i := 0; i < sig.Params().Len(); i++ {
+		fn.args = append(fn.args, sig.Params().At(i).Type())
+	}
+	for i := 0; i < sig.Results().Len(); i++ {
+		fn.rets = append(fn.rets, sig.Results().At(i).Type())
+	}
+	return fn, nil
+}
+
+// splitSymbol splits the function symbol, as returned by the Go runtime, into
+// its package path, method receiver and name. For example,
+// `database/sql.(*DB).Query` is split into `database/sql`, `*DB` and `Query`.
+func splitSymbol(symbol string) (pkgPath, recv, name string) {
+	slash := strings.LastIndexByte(symbol, '/') + 1
+	dot := strings.IndexByte(symbol[slash:], '.')
+	if dot == -1 {
+		return "", "", ""
+	}
+	dot += slash
+	// The dots of the last path element are escaped by the runtime
+	pkgPath = strings.Replace(symbol[:dot], "%2e", ".", -1)
+	name = symbol[dot+1:]
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		recv, name = name[:i], name[i+1:]
+		recv = strings.TrimSuffix(strings.TrimPrefix(recv, "("), ")")
+	}
+	return pkgPath, recv, name
+}
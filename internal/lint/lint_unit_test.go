@@ -0,0 +1,220 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package lint
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/stretchr/testify/require"
+)
+
+// Stub of the agent package providing the binding accessor context types.
+const callbackStubSource = `
+package callback
+
+type BindingAccessorContextType struct {
+	Func *FuncCallBindingAccessorContextType
+	Rule *RuleBindingAccessorContextType
+	*HTTPRequestBindingAccessorContext
+}
+
+type FuncCallBindingAccessorContextType struct {
+	Args []interface{}
+	Rets []interface{}
+}
+
+type RuleBindingAccessorContextType struct {
+	Data struct{ Values interface{} }
+}
+
+type WAFBindingAccessorContextType struct {
+	HTTPRequestBindingAccessorContext
+}
+
+type HTTPRequestBindingAccessorContext struct {
+	Request *RequestBindingAccessorContext
+}
+
+type RequestBindingAccessorContext struct{}
+
+func (*RequestBindingAccessorContext) Method() string              { return "" }
+func (*RequestBindingAccessorContext) Header(string) *string       { return nil }
+func (*RequestBindingAccessorContext) FilteredParams() interface{} { return nil }
+`
+
+// Stub of a package whose functions are hooked by the rules.
+const libStubSource = `
+package lib
+
+type DB struct{}
+
+type Rows struct{}
+
+func (*DB) Query(query string, args ...interface{}) (*Rows, error) { return nil, nil }
+
+type Options struct {
+	Name string
+}
+
+func Open(opts *Options) error { return nil }
+`
+
+// stubImporter imports the packages type-checked from their source code.
+type stubImporter map[string]*types.Package
+
+func newStubImporter(t *testing.T, sources map[string]string) stubImporter {
+	importer := make(stubImporter)
+	for path, src := range sources {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path+".go", src, 0)
+		require.NoError(t, err)
+		pkg, err := (&types.Config{}).Check(path, fset, []*ast.File{f}, nil)
+		require.NoError(t, err)
+		importer[path] = pkg
+	}
+	return importer
+}
+
+func (i stubImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i stubImporter) ImportFrom(path, _ string, _ types.ImportMode) (*types.Package, error) {
+	pkg, exists := i[path]
+	if !exists {
+		return nil, sqerrors.Errorf("package `%s` not found", path)
+	}
+	return pkg, nil
+}
+
+func TestLinter(t *testing.T) {
+	importer := newStubImporter(t, map[string]string{
+		reflectedContextType.PkgPath(): callbackStubSource,
+		"example.com/lib":              libStubSource,
+	})
+
+	lint := func(t *testing.T, rule string) []Problem {
+		var r api.Rule
+		require.NoError(t, json.Unmarshal([]byte(rule), &r))
+		problems, err := newLinter(".", importer).Lint([]api.Rule{r})
+		require.NoError(t, err)
+		return problems
+	}
+
+	t.Run("valid rule", func(t *testing.T) {
+		problems := lint(t, `{
+			"name": "my rule",
+			"hookpoint": {
+				"strategy": "reflected",
+				"method": "example.com/lib.(*DB).Query",
+				"callback_class": "JSExec",
+				"arguments_options": { "binding_accessor": { "capabilities": [ "func", "request" ] } }
+			},
+			"conditions": { "pre": { "%and": [ { "%equals": [ "#.Request.Method", "POST" ] } ] } },
+			"callbacks": {
+				"pre": [ "#.Func.Args[1]", "#.Func.Args[2]|flat_values", "#.Request.Header('Content-Type')", "function pre() {}" ],
+				"post": [ "#.Func.Rets[1] != nil", "function post() {}" ]
+			}
+		}`)
+		require.Empty(t, problems)
+	})
+
+	t.Run("invalid expressions", func(t *testing.T) {
+		problems := lint(t, `{
+			"name": "my rule",
+			"hookpoint": {
+				"strategy": "reflected",
+				"method": "example.com/lib.Open",
+				"callback_class": "JSExec",
+				"arguments_options": { "binding_accessor": { "capabilities": [ "func", "cached" ] } }
+			},
+			"conditions": { "pre": { "%exists": [ "#.Request.Headers" ] } },
+			"callbacks": {
+				"pre": [ "#.Func.Args[0].Name", "#.Func.Args[0].Nmae", "#.Func.Args[1]", "#.Func.Rets[0]", "#.Request.Method", "function pre() {}" ],
+				"post": [ "#.Func.Rets[0]", "#.Func.Rets[1]", "function post() {}" ]
+			}
+		}`)
+
+		var exprs []string
+		for _, p := range problems {
+			require.Equal(t, "my rule", p.Rule)
+			require.False(t, p.Warning)
+			exprs = append(exprs, p.Expression)
+		}
+		require.Equal(t, []string{
+			"#.Request.Headers",
+			"", // unknown capability
+			"#.Func.Rets[1]",
+			"#.Func.Args[0].Nmae",
+			"#.Func.Args[1]",
+			"#.Func.Rets[0]",
+			"#.Request.Method",
+		}, exprs)
+	})
+
+	t.Run("function waf callbacks", func(t *testing.T) {
+		problems := lint(t, `{
+			"name": "my rule",
+			"hookpoint": {
+				"strategy": "reflected",
+				"method": "example.com/lib.Open",
+				"callback_class": "FunctionWAF",
+				"arguments_options": { "binding_accessor": { "capabilities": [ "func" ] } }
+			},
+			"data": { "values": [ { "type": "waf", "binding_accessors": [ "#.Request.Method", "#.Request.Path" ] } ] },
+			"callbacks": { "type": "function_waf", "pre": [ { "name": "'name'", "value": "#.Func.Args[0].Name" }, { "name": "'other'", "value": "#.Func.Args[0].Other" } ] }
+		}`)
+		require.Len(t, problems, 2)
+		require.Equal(t, "#.Request.Path", problems[0].Expression)
+		require.Equal(t, "#.Func.Args[0].Other", problems[1].Expression)
+	})
+
+	t.Run("unknown hooked function", func(t *testing.T) {
+		problems := lint(t, `{
+			"name": "my rule",
+			"hookpoint": {
+				"strategy": "reflected",
+				"method": "example.com/other.Func",
+				"callback_class": "JSExec",
+				"arguments_options": { "binding_accessor": { "capabilities": [ "func" ] } }
+			},
+			"callbacks": { "pre": [ "#.Func.Args[3].Whatever", "#.Func.Argz", "function pre() {}" ] }
+		}`)
+		require.Len(t, problems, 2)
+		require.True(t, problems[0].Warning)
+		require.Equal(t, "hookpoint.method", problems[0].Location)
+		require.Equal(t, "#.Func.Argz", problems[1].Expression)
+	})
+
+	t.Run("missing agent package", func(t *testing.T) {
+		_, err := newLinter(".", stubImporter{}).Lint(nil)
+		require.Error(t, err)
+	})
+}
+
+func TestSplitSymbol(t *testing.T) {
+	for _, tc := range []struct {
+		symbol, pkgPath, recv, name string
+	}{
+		{symbol: "database/sql.(*DB).Query", pkgPath: "database/sql", recv: "*DB", name: "Query"},
+		{symbol: "net/http.HandlerFunc.ServeHTTP", pkgPath: "net/http", recv: "HandlerFunc", name: "ServeHTTP"},
+		{symbol: "os/exec.Command", pkgPath: "os/exec", name: "Command"},
+		{symbol: "main.main", pkgPath: "main", name: "main"},
+		{symbol: "gopkg.in/yaml%2ev2.Unmarshal", pkgPath: "gopkg.in/yaml.v2", name: "Unmarshal"},
+		{symbol: "nosymbol"},
+	} {
+		pkgPath, recv, name := splitSymbol(tc.symbol)
+		require.Equal(t, tc.pkgPath, pkgPath, tc.symbol)
+		require.Equal(t, tc.recv, recv, tc.symbol)
+		require.Equal(t, tc.name, name, tc.symbol)
+	}
+}
@@ -42,6 +42,13 @@ type (
 		IdentifyUser(id map[string]string) error
 	}
 
+	// Tracer is the interface of the protection contexts able to trace the
+	// execution of the rules in the request.
+	Tracer interface {
+		// EnableTrace enables the trace and returns its ID.
+		EnableTrace() string
+	}
+
 	CustomEvent interface {
 		WithTimestamp(t time.Time)
 		WithProperties(props EventProperties)
@@ -7,6 +7,9 @@
 package http
 
 import (
+	"net/http"
+
+	"github.com/sqreen/go-agent/internal/binding-accessor"
 	"github.com/sqreen/go-agent/internal/protection/http/types"
 )
 
@@ -39,6 +42,40 @@ func NewRequestBindingAccessorContext(r types.RequestReader) *RequestBindingAcce
 	return &RequestBindingAccessorContext{RequestReader: r}
 }
 
+// Fast paths of the request fields commonly used by binding accessor
+// expressions, avoiding the cost of their reflect-based access.
+func init() {
+	fields := map[string]func(r *RequestBindingAccessorContext) interface{}{
+		"Method":         func(r *RequestBindingAccessorContext) interface{} { return r.Method() },
+		"Host":           func(r *RequestBindingAccessorContext) interface{} { return r.Host() },
+		"RequestURI":     func(r *RequestBindingAccessorContext) interface{} { return r.RequestURI() },
+		"RemoteAddr":     func(r *RequestBindingAccessorContext) interface{} { return r.RemoteAddr() },
+		"UserAgent":      func(r *RequestBindingAccessorContext) interface{} { return r.UserAgent() },
+		"Referer":        func(r *RequestBindingAccessorContext) interface{} { return r.Referer() },
+		"IsTLS":          func(r *RequestBindingAccessorContext) interface{} { return r.IsTLS() },
+		"ClientIP":       func(r *RequestBindingAccessorContext) interface{} { return r.ClientIP() },
+		"Headers":        func(r *RequestBindingAccessorContext) interface{} { return r.Headers() },
+		"QueryForm":      func(r *RequestBindingAccessorContext) interface{} { return r.QueryForm() },
+		"PostForm":       func(r *RequestBindingAccessorContext) interface{} { return r.PostForm() },
+		"FilteredParams": func(r *RequestBindingAccessorContext) interface{} { return r.FilteredParams() },
+		"Params":         func(r *RequestBindingAccessorContext) interface{} { return r.Params() },
+		"Body":           func(r *RequestBindingAccessorContext) interface{} { return r.Body() },
+		"Header":         func(r *RequestBindingAccessorContext) interface{} { return r.Header },
+		"URL": func(r *RequestBindingAccessorContext) interface{} {
+			if u := r.URL(); u != nil {
+				return u
+			}
+			return nil
+		},
+	}
+	for field, get := range fields {
+		get := get
+		bindingaccessor.RegisterFieldFunc((*RequestBindingAccessorContext)(nil), field, func(v interface{}) (interface{}, error) {
+			return get(v.(*RequestBindingAccessorContext)), nil
+		})
+	}
+}
+
 //func (r *RequestBindingAccessorContext) FromContext(v interface{}) (*RequestBindingAccessorContext, error) {
 //	if r.RequestReader != nil {
 //		return r, nil
@@ -92,3 +129,78 @@ type RequestBodyBindingAccessorContext []byte
 
 func (b RequestBodyBindingAccessorContext) String() string { return string(b) }
 func (b RequestBodyBindingAccessorContext) Bytes() []byte  { return b }
+
+// ResponseBindingAccessorContext is the wrapper type of the response providing
+// the binding accessor interface expected by rules:
+// - `.Header` returns the response header value.
+// - `.Body` returns the response body when it was buffered by the response
+//   body inspection, nil otherwise.
+type ResponseBindingAccessorContext struct {
+	header http.Header
+	body   []byte
+}
+
+func NewResponseBindingAccessorContext(p *ProtectionContext) *ResponseBindingAccessorContext {
+	var header http.Header
+	if p.ResponseWriter != nil {
+		header = p.ResponseWriter.Header()
+	}
+	return &ResponseBindingAccessorContext{
+		header: header,
+		body:   p.responseBody,
+	}
+}
+
+func (r *ResponseBindingAccessorContext) Header(h string) (*string, error) {
+	v := r.header.Get(h)
+	if v == "" {
+		return nil, nil
+	}
+	return &v, nil
+}
+
+func (r *ResponseBindingAccessorContext) Body() ResponseBodyBindingAccessorContext {
+	return r.body
+}
+
+type ResponseBodyBindingAccessorContext []byte
+
+func (b ResponseBodyBindingAccessorContext) String() string { return string(b) }
+func (b ResponseBodyBindingAccessorContext) Bytes() []byte  { return b }
+
+// WebSocketBindingAccessorContext is the wrapper type of WebSocket connections
+// providing the binding accessor interface expected by rules:
+// - `.ID` returns the connection identifier.
+// - `.Subprotocol` returns the connection subprotocol.
+// - `.Message` returns the message currently inspected.
+type WebSocketBindingAccessorContext struct {
+	ID          string
+	Subprotocol string
+	Message     *WebSocketMessageBindingAccessorContext
+}
+
+// WebSocketMessageBindingAccessorContext is the wrapper type of WebSocket
+// messages providing the binding accessor interface expected by rules:
+// - `.Type` returns the message type, either `text` or `binary`.
+// - `.Data` returns the message data.
+// - `.Index` returns the position of the message in the connection.
+type WebSocketMessageBindingAccessorContext struct {
+	Type  string
+	Data  string
+	Index uint64
+}
+
+func NewWebSocketBindingAccessorContext(c *WebSocketProtectionContext) *WebSocketBindingAccessorContext {
+	ctx := &WebSocketBindingAccessorContext{
+		ID:          c.id,
+		Subprotocol: c.subprotocol,
+	}
+	if m := c.message; m != nil {
+		ctx.Message = &WebSocketMessageBindingAccessorContext{
+			Type:  m.Type.String(),
+			Data:  string(m.Data),
+			Index: m.Index,
+		}
+	}
+	return ctx
+}
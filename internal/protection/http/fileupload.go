@@ -0,0 +1,186 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+)
+
+// FileUploadPrefixSize is the maximum size of the file content prefix, which
+// is also the maximum number of bytes considered by `http.DetectContentType()`.
+const FileUploadPrefixSize = 512
+
+// FileUploadMaxContentSize is the maximum size of the file content kept in
+// memory and given to the file upload scanner. The size of larger files is
+// still the actual one.
+const FileUploadMaxContentSize = 4 << 20
+
+// FileUpload is a file uploaded in a multipart/form-data request body.
+type FileUpload struct {
+	sdk_types.FileUpload
+	content []byte
+}
+
+// Content returns a reader of the file content, up to FileUploadMaxContentSize
+// bytes.
+func (f *FileUpload) Content() io.Reader {
+	return bytes.NewReader(f.content)
+}
+
+// param returns the request parameter value of the file upload. Only bare Go
+// types are used for the JS conversion.
+func (f *FileUpload) param() map[string]interface{} {
+	return map[string]interface{}{
+		"field_name":           f.FieldName,
+		"filename":             f.Filename,
+		"content_type":         f.ContentType,
+		"sniffed_content_type": f.SniffedContentType,
+		"size":                 f.Size,
+	}
+}
+
+// FileUploads returns the files uploaded in the request body, once it was
+// entirely read by the request handler.
+func (p *ProtectionContext) FileUploads() []*FileUpload {
+	return p.fileUploads
+}
+
+// scanFileUploads parses the files uploaded in the request body, adds them to
+// the request parameters and runs the file upload protections. The request
+// body must be entirely read, either until EOF or until the closing delimiter
+// of the multipart body. The parsing is otherwise retried with the next reads
+// when it did not reach the closing delimiter, so that files are not skipped
+// because of the delimiter bytes found in a part content.
+func (p *ProtectionContext) scanFileUploads(eof bool) error {
+	if p.fileUploadsParsed {
+		return nil
+	}
+
+	uploads, complete := parseFileUploads(p.RequestReader.Header("Content-Type"), p.requestReader.Body())
+	if !complete && !eof {
+		return nil
+	}
+	p.fileUploadsParsed = true
+
+	if len(uploads) == 0 {
+		return nil
+	}
+	p.fileUploads = uploads
+
+	for _, f := range uploads {
+		p.AddRequestParam(types.FileUploadRequestParamName, f.param())
+	}
+
+	for _, f := range uploads {
+		if err := p.fileUploadProtection(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//go:noinline
+func (p *ProtectionContext) fileUploadProtection(f *FileUpload) error {
+	/* dynamically instrumented */ return nil
+}
+
+// parseFileUploads returns the files found in the given multipart/form-data
+// request body. Form fields without file name are not file uploads and are
+// skipped. Parsing stops at the first malformed part, keeping the files parsed
+// so far. It is complete when the closing delimiter of the body was reached.
+func parseFileUploads(contentType *string, body []byte) (uploads []*FileUpload, complete bool) {
+	if contentType == nil || len(body) == 0 {
+		return nil, false
+	}
+	mt, params, err := mime.ParseMediaType(*contentType)
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" {
+		return nil, false
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return uploads, err == io.EOF
+		}
+
+		// The file name is taken from the content disposition parameters as is,
+		// while `part.FileName()` only returns its base name.
+		_, disposition, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if err != nil {
+			return uploads, false
+		}
+		filename, isFile := disposition["filename"]
+		if !isFile {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(part, FileUploadMaxContentSize))
+		if err != nil {
+			return uploads, false
+		}
+		// Count the remaining bytes of larger files without buffering them
+		remaining, err := io.Copy(ioutil.Discard, part)
+		if err != nil {
+			return uploads, false
+		}
+		f := newFileUpload(disposition["name"], filename, part.Header.Get("Content-Type"), content)
+		f.Size += remaining
+		uploads = append(uploads, f)
+	}
+}
+
+func newFileUpload(fieldName, filename, contentType string, content []byte) *FileUpload {
+	prefix := content
+	if len(prefix) > FileUploadPrefixSize {
+		prefix = prefix[:FileUploadPrefixSize]
+	}
+	return &FileUpload{
+		FileUpload: sdk_types.FileUpload{
+			FieldName:          fieldName,
+			Filename:           filename,
+			ContentType:        contentType,
+			SniffedContentType: http.DetectContentType(prefix),
+			Size:               int64(len(content)),
+			Prefix:             prefix,
+		},
+		content: content,
+	}
+}
+
+func NewTestFileUpload(fieldName, filename, contentType string, content []byte) *FileUpload {
+	return newFileUpload(fieldName, filename, contentType, content)
+}
+
+// fileUploadScanner is the file upload scanner set by the application. The
+// atomic value always stores a fileUploadScannerValue so that the stored
+// concrete type doesn't change.
+var fileUploadScanner atomic.Value
+
+type fileUploadScannerValue struct {
+	scanner sdk_types.FileUploadScanner
+}
+
+// SetFileUploadScanner sets the scanner called by the file upload protection.
+// A nil scanner removes the current one.
+func SetFileUploadScanner(scanner sdk_types.FileUploadScanner) {
+	fileUploadScanner.Store(fileUploadScannerValue{scanner: scanner})
+}
+
+// FileUploadScanner returns the file upload scanner set by the application,
+// nil otherwise.
+func FileUploadScanner() sdk_types.FileUploadScanner {
+	v, _ := fileUploadScanner.Load().(fileUploadScannerValue)
+	return v.scanner
+}
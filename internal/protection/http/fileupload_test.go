@@ -0,0 +1,221 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+	"github.com/stretchr/testify/require"
+)
+
+func newMultipartBody(t *testing.T, files map[string]string) (contentType string, body []byte) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	require.NoError(t, w.WriteField("field", "value"))
+	for filename, content := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+		h.Set("Content-Type", "image/png")
+		part, err := w.CreatePart(h)
+		require.NoError(t, err)
+		_, err = io.WriteString(part, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func TestParseFileUploads(t *testing.T) {
+	t.Run("multipart form data", func(t *testing.T) {
+		content := "\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("A", FileUploadPrefixSize)
+		contentType, body := newMultipartBody(t, map[string]string{"../../image.png": content})
+
+		uploads, complete := parseFileUploads(&contentType, body)
+		require.True(t, complete)
+		require.Len(t, uploads, 1)
+		f := uploads[0]
+		require.Equal(t, "file", f.FieldName)
+		require.Equal(t, "../../image.png", f.Filename)
+		require.Equal(t, "image/png", f.ContentType)
+		require.Equal(t, "image/png", f.SniffedContentType)
+		require.Equal(t, int64(len(content)), f.Size)
+		require.Equal(t, []byte(content[:FileUploadPrefixSize]), f.Prefix)
+		actual, err := ioutil.ReadAll(f.Content())
+		require.NoError(t, err)
+		require.Equal(t, content, string(actual))
+	})
+
+	t.Run("large file", func(t *testing.T) {
+		content := strings.Repeat("A", FileUploadMaxContentSize+10)
+		contentType, body := newMultipartBody(t, map[string]string{"large.txt": content})
+
+		uploads, complete := parseFileUploads(&contentType, body)
+		require.True(t, complete)
+		require.Len(t, uploads, 1)
+		f := uploads[0]
+		require.Equal(t, int64(len(content)), f.Size)
+		actual, err := ioutil.ReadAll(f.Content())
+		require.NoError(t, err)
+		require.Len(t, actual, FileUploadMaxContentSize)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		contentType, body := newMultipartBody(t, map[string]string{"a.txt": "a"})
+		uploads, complete := parseFileUploads(&contentType, body[:len(body)/2])
+		require.False(t, complete)
+		require.Empty(t, uploads)
+	})
+
+	for _, contentType := range []string{
+		"application/x-www-form-urlencoded",
+		"multipart/form-data",
+		"multipart/form-data; boundary=",
+		"",
+	} {
+		contentType := contentType
+		t.Run(contentType, func(t *testing.T) {
+			_, body := newMultipartBody(t, map[string]string{"a.txt": "a"})
+			uploads, _ := parseFileUploads(&contentType, body)
+			require.Empty(t, uploads)
+		})
+	}
+
+	t.Run("no content type", func(t *testing.T) {
+		_, body := newMultipartBody(t, map[string]string{"a.txt": "a"})
+		uploads, _ := parseFileUploads(nil, body)
+		require.Empty(t, uploads)
+	})
+}
+
+func TestFileUploadRequestParams(t *testing.T) {
+	contentType, body := newMultipartBody(t, map[string]string{"doc.pdf": "%PDF-1.4"})
+	req := &http_protection_mockups.RequestReaderMockup{}
+	defer req.AssertExpectations(t)
+	// Once per body parser and once for the multipart closing delimiter
+	req.ExpectHeader("Content-Type").Return(&contentType).Times(3)
+	req.ExpectParams().Return(nil)
+
+	p := NewTestProtectionContext(nil, nil, nil, req)
+	r := p.wrapBody(ioutil.NopCloser(bytes.NewReader(body)))
+
+	// Reading the body until EOF, twice, parses it once
+	_, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+
+	require.Len(t, p.FileUploads(), 1)
+	require.Equal(t, types.RequestParamValueSlice{
+		map[string]interface{}{
+			"field_name":           "file",
+			"filename":             "doc.pdf",
+			"content_type":         "image/png",
+			"sniffed_content_type": "application/pdf",
+			"size":                 int64(8),
+		},
+	}, p.RequestReader.Params()[types.FileUploadRequestParamName])
+}
+
+func TestFileUploadFakeClosingDelimiter(t *testing.T) {
+	const boundary = "B"
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	require.NoError(t, w.SetBoundary(boundary))
+	for _, file := range []struct{ name, content string }{
+		// The closing delimiter bytes in a part content, not following a CRLF
+		{name: "a.txt", content: "a--" + boundary + "--"},
+		{name: "b.txt", content: "b"},
+	} {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+file.name+`"`)
+		part, err := w.CreatePart(h)
+		require.NoError(t, err)
+		_, err = io.WriteString(part, file.content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	contentType := w.FormDataContentType()
+
+	req := &http_protection_mockups.RequestReaderMockup{}
+	defer req.AssertExpectations(t)
+	req.ExpectHeader("Content-Type").Return(&contentType)
+
+	p := NewTestProtectionContext(nil, nil, nil, req)
+	r := p.wrapBody(ioutil.NopCloser(errAfterReader{iotest.OneByteReader(bytes.NewReader(buf.Bytes()))}))
+
+	// Read byte per byte until the closing delimiter, without reaching EOF
+	for i := 0; i < buf.Len(); i++ {
+		_, err := r.Read(make([]byte, 1))
+		require.NoError(t, err)
+	}
+
+	require.Len(t, p.FileUploads(), 2)
+	require.Equal(t, "a.txt", p.FileUploads()[0].Filename)
+	require.Equal(t, "b.txt", p.FileUploads()[1].Filename)
+}
+
+func TestFileUploadScanner(t *testing.T) {
+	defer SetFileUploadScanner(nil)
+	require.Nil(t, FileUploadScanner())
+
+	scanner := sdk_types.FileUploadScannerFunc(func(context.Context, *sdk_types.FileUpload, io.Reader) error { return nil })
+	SetFileUploadScanner(scanner)
+	require.NotNil(t, FileUploadScanner())
+
+	SetFileUploadScanner(nil)
+	require.Nil(t, FileUploadScanner())
+}
+
+// errAfterReader returns the data of its reader and then an error instead of
+// io.EOF, so that reading past the data can be noticed.
+type errAfterReader struct {
+	io.Reader
+}
+
+func (r errAfterReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("unexpected read after the end of the body")
+	}
+	return n, err
+}
+
+func TestFileUploadFormFile(t *testing.T) {
+	// The body is larger than the read buffer of the multipart reader
+	content := strings.Repeat("A", 64*1024)
+	contentType, body := newMultipartBody(t, map[string]string{"a.txt": content})
+	req := &http_protection_mockups.RequestReaderMockup{}
+	defer req.AssertExpectations(t)
+	req.ExpectHeader("Content-Type").Return(&contentType)
+
+	p := NewTestProtectionContext(nil, nil, nil, req)
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", contentType)
+	r.Body = p.wrapBody(ioutil.NopCloser(errAfterReader{bytes.NewReader(body)}))
+
+	// The multipart reader stops reading at the closing delimiter, without
+	// reaching the end of the body.
+	f, h, err := r.FormFile("file")
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, "a.txt", h.Filename)
+
+	require.Len(t, p.FileUploads(), 1)
+	require.Equal(t, int64(len(content)), p.FileUploads()[0].Size)
+}
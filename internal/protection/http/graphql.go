@@ -0,0 +1,154 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/sqreen/go-agent/internal/sqlib/sqgraphql"
+)
+
+// GraphQLRequest is a GraphQL operation sent in the request body.
+type GraphQLRequest struct {
+	// Document is the parsed GraphQL document of the request.
+	Document *sqgraphql.Document
+	// Operation is the operation of the document to execute.
+	Operation *sqgraphql.Operation
+	// Variables are the operation variable values sent along with the document.
+	Variables map[string]interface{}
+}
+
+// OperationName returns the name of the operation to execute, or an empty
+// string when it is anonymous.
+func (r *GraphQLRequest) OperationName() string {
+	return r.Operation.Name
+}
+
+// param returns the request parameter value of the GraphQL request. Only bare
+// Go types are used for the JS conversion.
+func (r *GraphQLRequest) param() map[string]interface{} {
+	return map[string]interface{}{
+		types.GraphQLOperationNameParamKey: r.OperationName(),
+		"operation_type":                   string(r.Operation.Type),
+		"variables":                        r.Variables,
+		"arguments":                        r.Document.Arguments(r.Operation),
+	}
+}
+
+// GraphQLRequests returns the GraphQL operations parsed from the request body,
+// once it was entirely read by the request handler.
+func (p *ProtectionContext) GraphQLRequests() []*GraphQLRequest {
+	return p.graphQLRequests
+}
+
+// graphQL parses the GraphQL operations of the request body, adds them to the
+// request parameters and runs the GraphQL protections. The request body must
+// be entirely read.
+func (p *ProtectionContext) graphQL() error {
+	if p.graphQLParsed {
+		return nil
+	}
+	p.graphQLParsed = true
+
+	requests := parseGraphQLRequests(p.RequestReader.Header("Content-Type"), p.requestReader.Body())
+	if len(requests) == 0 {
+		return nil
+	}
+	p.graphQLRequests = requests
+
+	for _, r := range requests {
+		p.AddRequestParam(types.GraphQLRequestParamName, r.param())
+	}
+
+	for _, r := range requests {
+		if err := p.graphQLProtection(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//go:noinline
+func (p *ProtectionContext) graphQLProtection(r *GraphQLRequest) error {
+	/* dynamically instrumented */ return nil
+}
+
+// parseGraphQLRequests returns the GraphQL operations found in the request
+// body. The body can be either a GraphQL document when its content type is
+// `application/graphql`, or a JSON object with a `query` string field and
+// optional `operationName` and `variables` fields, or an array of such
+// objects for batched operations. Invalid GraphQL operations are ignored as
+// they are rejected by GraphQL servers.
+func parseGraphQLRequests(contentType *string, body []byte) []*GraphQLRequest {
+	if contentType == nil || len(body) == 0 {
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(*contentType)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case mt == "application/graphql":
+		if r := newGraphQLRequest(string(body), "", nil); r != nil {
+			return []*GraphQLRequest{r}
+		}
+		return nil
+
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil
+		}
+		switch actual := v.(type) {
+		case map[string]interface{}:
+			if r := newGraphQLRequestFromJSON(actual); r != nil {
+				return []*GraphQLRequest{r}
+			}
+		case []interface{}:
+			var requests []*GraphQLRequest
+			for _, elt := range actual {
+				obj, ok := elt.(map[string]interface{})
+				if !ok {
+					return nil
+				}
+				if r := newGraphQLRequestFromJSON(obj); r != nil {
+					requests = append(requests, r)
+				}
+			}
+			return requests
+		}
+	}
+	return nil
+}
+
+func newGraphQLRequestFromJSON(obj map[string]interface{}) *GraphQLRequest {
+	query, ok := obj["query"].(string)
+	if !ok {
+		return nil
+	}
+	operationName, _ := obj["operationName"].(string)
+	variables, _ := obj["variables"].(map[string]interface{})
+	return newGraphQLRequest(query, operationName, variables)
+}
+
+func newGraphQLRequest(query, operationName string, variables map[string]interface{}) *GraphQLRequest {
+	doc, err := sqgraphql.Parse(query)
+	if err != nil {
+		return nil
+	}
+	op, err := doc.Operation(operationName)
+	if err != nil {
+		return nil
+	}
+	return &GraphQLRequest{
+		Document:  doc,
+		Operation: op,
+		Variables: variables,
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGraphQLRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		contentType        string
+		body               string
+		expectedOperations []string
+	}{
+		{
+			name:               "graphql document",
+			contentType:        "application/graphql",
+			body:               `query Me { me { name } }`,
+			expectedOperations: []string{"Me"},
+		},
+		{
+			name:               "json object",
+			contentType:        "application/json; charset=utf-8",
+			body:               `{"query":"query A { a } query B { b }","operationName":"B","variables":{"id":1}}`,
+			expectedOperations: []string{"B"},
+		},
+		{
+			name:               "json batch",
+			contentType:        "application/json",
+			body:               `[{"query":"query A { a }"},{"query":"{ b }"},{"query":"invalid {"}]`,
+			expectedOperations: []string{"A", ""},
+		},
+		{
+			name:        "unknown operation name",
+			contentType: "application/json",
+			body:        `{"query":"query A { a }","operationName":"B"}`,
+		},
+		{
+			name:        "json without query",
+			contentType: "application/json",
+			body:        `{"q":"query A { a }"}`,
+		},
+		{
+			name:        "invalid json",
+			contentType: "application/json",
+			body:        `{"query":`,
+		},
+		{
+			name:        "other content type",
+			contentType: "application/x-www-form-urlencoded",
+			body:        `query=query+A+%7B+a+%7D`,
+		},
+		{
+			name: "no content type",
+			body: `{"query":"query A { a }"}`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var contentType *string
+			if tc.contentType != "" {
+				contentType = &tc.contentType
+			}
+			requests := parseGraphQLRequests(contentType, []byte(tc.body))
+			var operations []string
+			for _, r := range requests {
+				operations = append(operations, r.OperationName())
+			}
+			require.Equal(t, tc.expectedOperations, operations)
+		})
+	}
+}
+
+func TestGraphQLRequestParams(t *testing.T) {
+	contentType := "application/json"
+	req := &http_protection_mockups.RequestReaderMockup{}
+	defer req.AssertExpectations(t)
+	// Once per body parser and once for the multipart closing delimiter
+	req.ExpectHeader("Content-Type").Return(&contentType).Times(3)
+	req.ExpectParams().Return(nil)
+
+	p := NewTestProtectionContext(nil, nil, nil, req)
+	body := p.wrapBody(ioutil.NopCloser(strings.NewReader(`{"query":"query User($id: ID) { user(id: $id) { posts(first: 10) { title } } }","variables":{"id":"' OR 1=1--"}}`)))
+
+	// Reading the body until EOF, twice, parses it once
+	_, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(body)
+	require.NoError(t, err)
+
+	require.Len(t, p.GraphQLRequests(), 1)
+	params := p.RequestReader.Params()
+	require.Equal(t, types.RequestParamValueSlice{
+		map[string]interface{}{
+			types.GraphQLOperationNameParamKey: "User",
+			"operation_type":                   "query",
+			"variables":                        map[string]interface{}{"id": "' OR 1=1--"},
+			"arguments": map[string]interface{}{
+				"user":       map[string]interface{}{"id": nil},
+				"user.posts": map[string]interface{}{"first": int64(10)},
+			},
+		},
+	}, params[types.GraphQLRequestParamName])
+	require.Equal(t, []string{"User"}, params.GraphQLOperationNames())
+}
@@ -29,6 +29,31 @@ type ProtectionContext struct {
 
 	requestReader *requestReader
 	start         time.Time
+
+	// responseBody is the response body buffered by the response writer in
+	// order to be inspected, when the response body inspection is enabled.
+	responseBody []byte
+
+	// templates is the stack of templates currently being executed by the
+	// request handler so that response writes can be attributed to them.
+	templates []string
+
+	// graphQLRequests are the GraphQL operations parsed from the request body.
+	graphQLRequests []*GraphQLRequest
+	// graphQLParsed is true once the request body was parsed for GraphQL
+	// operations, so that it is done only once.
+	graphQLParsed bool
+
+	// fileUploads are the files parsed from the multipart/form-data request
+	// body.
+	fileUploads []*FileUpload
+	// fileUploadsParsed is true once the request body was parsed for file
+	// uploads, so that it is done only once.
+	fileUploadsParsed bool
+
+	// callbackStates are the states of the rule callbacks kept along the
+	// request phases (cf. CallbackState()).
+	callbackStates map[interface{}]interface{}
 }
 
 type SecurityResponseStore interface {
@@ -64,6 +89,7 @@ func NewProtectionContext(ctx types.RootProtectionContext, w types.ResponseWrite
 		RequestReader:         rr,
 		requestReader:         rr,
 	}
+	p.enableTraceFromHeader(cfg.RuleTraceSecret())
 	return p
 }
 
@@ -101,10 +127,23 @@ type (
 	IdentifyUserPrologCallbackType = func(**ProtectionContext, *map[string]string) (BlockingEpilogCallbackType, error)
 
 	ResponseMonitoringPrologCallbackType = func(**ProtectionContext, *types.ResponseFace) (NonBlockingEpilogCallbackType, error)
+
+	ResponseWritePrologCallbackType = func(**ProtectionContext, *[]byte) (BlockingEpilogCallbackType, error)
+
+	ResponseBodyWAFPrologCallbackType = WAFPrologCallbackType
+	ResponseBodyWAFEpilogCallbackType = WAFEpilogCallbackType
+
+	ResponseBodyFilterPrologCallbackType = func(**ProtectionContext, *[]byte) (ResponseBodyFilterEpilogCallbackType, error)
+	ResponseBodyFilterEpilogCallbackType = func(*[]byte, *error)
+
+	GraphQLPrologCallbackType = func(**ProtectionContext, **GraphQLRequest) (BlockingEpilogCallbackType, error)
+
+	FileUploadPrologCallbackType = func(**ProtectionContext, **FileUpload) (BlockingEpilogCallbackType, error)
 )
 
 // Static assert that ProtectionContext implements the expected interfaces.
 var _ protection_context.EventRecorder = (*ProtectionContext)(nil)
+var _ protection_context.Tracer = (*ProtectionContext)(nil)
 
 func (p *ProtectionContext) TrackEvent(event string) protection_context.CustomEvent {
 	return p.events.AddCustomEvent(event)
@@ -231,6 +270,63 @@ func (p *ProtectionContext) monitorObservedResponse(response types.ResponseFace)
 	/* dynamically instrumented */
 }
 
+// ObserveResponseWrite is called by the response writer before writing the
+// given response body chunk. When a non-nil error is returned, the chunk must
+// not be written and the error must be returned to the writer caller.
+//go:noinline
+func (p *ProtectionContext) ObserveResponseWrite(body []byte) error {
+	/* dynamically instrumented */ return nil
+}
+
+// InspectResponseBody runs the protections of the given complete response
+// body, buffered by the response writer before being sent. It returns the
+// response body to send, possibly modified by the protections (eg. masked
+// sensitive data). When a non-nil error is returned, the response was blocked
+// and the buffered response body must not be sent.
+func (p *ProtectionContext) InspectResponseBody(body []byte) ([]byte, error) {
+	p.responseBody = body
+	if err := p.responseBodyWAF(); err != nil {
+		return nil, err
+	}
+	body, err := p.filterResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+	p.responseBody = body
+	return body, nil
+}
+
+//go:noinline
+func (p *ProtectionContext) responseBodyWAF() error { /* dynamically instrumented */ return nil }
+
+//go:noinline
+func (p *ProtectionContext) filterResponseBody(body []byte) ([]byte, error) {
+	/* dynamically instrumented */ return body, nil
+}
+
+// PushTemplate marks the beginning of the execution of the given template.
+// Response writes are attributed to the current template until the matching
+// call to PopTemplate.
+func (p *ProtectionContext) PushTemplate(name string) {
+	p.templates = append(p.templates, name)
+}
+
+// PopTemplate marks the end of the execution of the current template.
+func (p *ProtectionContext) PopTemplate() {
+	if l := len(p.templates); l > 0 {
+		p.templates = p.templates[:l-1]
+	}
+}
+
+// CurrentTemplate returns the name of the template currently being executed,
+// or an empty string when none.
+func (p *ProtectionContext) CurrentTemplate() string {
+	if l := len(p.templates); l > 0 {
+		return p.templates[l-1]
+	}
+	return ""
+}
+
 // WrapRequest is a helper method to prepare an http.Request with its
 // new context, the protection context, and a body buffer.
 func (p *ProtectionContext) WrapRequest(r *http.Request) *http.Request {
@@ -243,8 +339,9 @@ func (p *ProtectionContext) WrapRequest(r *http.Request) *http.Request {
 
 func (p *ProtectionContext) wrapBody(body io.ReadCloser) io.ReadCloser {
 	return rawBodyWAF{
-		ReadCloser: body,
-		c:          p,
+		ReadCloser:   body,
+		c:            p,
+		multipartEnd: multipartEnd(p.RequestReader.Header("Content-Type")),
 	}
 }
 
@@ -268,3 +365,19 @@ func (p *ProtectionContext) AddRequestParam(name string, param interface{}) {
 func (p *ProtectionContext) ClientIP() net.IP {
 	return p.requestReader.clientIP
 }
+
+// CallbackState returns the request state of the rule callbacks stored under
+// the given key, created using newState the first time it is requested. It
+// allows callbacks to keep data along the request phases, such as the WAF
+// inputs already evaluated. The key must be comparable.
+func (p *ProtectionContext) CallbackState(key interface{}, newState func() interface{}) interface{} {
+	if state, exists := p.callbackStates[key]; exists {
+		return state
+	}
+	if p.callbackStates == nil {
+		p.callbackStates = make(map[interface{}]interface{})
+	}
+	state := newState()
+	p.callbackStates[key] = state
+	return state
+}
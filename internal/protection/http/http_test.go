@@ -152,6 +152,27 @@ func TestProtectionAPI(t *testing.T) {
 	})
 }
 
+func TestCallbackState(t *testing.T) {
+	p := NewTestProtectionContext(nil, nil, nil, &http_protection_mockups.RequestReaderMockup{})
+
+	type keyA struct{}
+	type keyB struct{}
+	calls := 0
+	newState := func() interface{} {
+		calls++
+		return &calls
+	}
+
+	// The state is created once per key
+	a := p.CallbackState(keyA{}, newState)
+	require.Equal(t, 1, calls)
+	require.Equal(t, a, p.CallbackState(keyA{}, newState))
+	require.Equal(t, 1, calls)
+
+	p.CallbackState(keyB{}, newState)
+	require.Equal(t, 2, calls)
+}
+
 func TestParseClientIPHeaderHeaderValue(t *testing.T) {
 	// Tests with malformed values
 	// A buffer of random bytes.
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/textproto"
@@ -66,17 +67,35 @@ func (r *requestReader) Params() types.RequestParamMap {
 type rawBodyWAF struct {
 	io.ReadCloser
 	c *ProtectionContext
+	// multipartEnd is the closing delimiter of multipart bodies, along with its
+	// leading CRLF, nil otherwise.
+	multipartEnd []byte
 }
 
-// Read buffers what has been read and ultimately calls the WAF on EOF.
+// Read buffers what has been read and ultimately parses the GraphQL operations
+// and the file uploads, and calls the WAF on EOF. Multipart bodies are also
+// handled once their closing delimiter is read since multipart readers, such
+// as the one of `http.Request.ParseMultipartForm()`, stop reading there.
 func (t rawBodyWAF) Read(p []byte) (n int, err error) {
 	n, err = t.ReadCloser.Read(p)
 	if n > 0 {
 		t.c.requestReader.bodyReadBuffer.Write(p[:n])
 	}
 
-	if err == io.EOF {
-		if wafErr := t.c.bodyWAF(); wafErr != nil {
+	eof := err == io.EOF
+	if eof || n > 0 && t.readMultipartEnd(n) {
+		var wafErr error
+		if eof {
+			// GraphQL operations are not multipart bodies
+			wafErr = t.c.graphQL()
+		}
+		if wafErr == nil {
+			wafErr = t.c.scanFileUploads(eof)
+		}
+		if wafErr == nil {
+			wafErr = t.c.bodyWAF()
+		}
+		if wafErr != nil {
 			// Return 0 and the sqreen error so that the caller doesn't take anything
 			// into account.
 			n = 0
@@ -86,6 +105,38 @@ func (t rawBodyWAF) Read(p []byte) (n int, err error) {
 	return
 }
 
+// readMultipartEnd returns true when the closing delimiter of the multipart
+// body was read by the last n bytes read. Only the end of the body buffer,
+// where the delimiter can be, is searched for it. The delimiter must follow a
+// CRLF, or start the body when it has no parts, so that the same bytes in the
+// part contents do not match.
+func (t rawBodyWAF) readMultipartEnd(n int) bool {
+	if t.multipartEnd == nil {
+		return false
+	}
+	body := t.c.requestReader.Body()
+	if noParts := t.multipartEnd[2:]; len(body)-n < len(noParts) && bytes.HasPrefix(body, noParts) {
+		return true
+	}
+	if start := len(body) - n - len(t.multipartEnd) + 1; start > 0 {
+		body = body[start:]
+	}
+	return bytes.Contains(body, t.multipartEnd)
+}
+
+// multipartEnd returns the closing delimiter of the multipart body of the
+// given content type, along with its leading CRLF, nil when not multipart.
+func multipartEnd(contentType *string) []byte {
+	if contentType == nil {
+		return nil
+	}
+	mt, params, err := mime.ParseMediaType(*contentType)
+	if err != nil || !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+		return nil
+	}
+	return []byte("\r\n--" + params["boundary"] + "--")
+}
+
 func ClientIP(remoteAddr string, headers http.Header, prioritizedIPHeader string, prioritizedIPHeaderFormat string) net.IP {
 	var privateIP net.IP
 	check := func(value string) net.IP {
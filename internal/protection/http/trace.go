@@ -0,0 +1,120 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/event"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+const (
+	// TraceHeader is the signed request header enabling the execution trace of
+	// the rules in the request. Its value is `<timestamp>:<signature>` where the
+	// timestamp is the number of seconds since the Unix epoch and the signature
+	// is the hexadecimal HMAC-SHA256 of `<timestamp>:<method> <path>` with the
+	// rule trace secret (cf. SignTraceHeader()).
+	TraceHeader = "X-Sqreen-Trace"
+	// TraceIDHeader is the response header of traced requests providing the
+	// trace ID.
+	TraceIDHeader = "X-Sqreen-Trace-Id"
+
+	// traceHeaderValidity is the maximum difference between the trace header
+	// timestamp and the current time.
+	traceHeaderValidity = 5 * time.Minute
+)
+
+// SignTraceHeader returns the value of the trace header of a request with the
+// given method and path, signed with the given secret at the given time.
+func SignTraceHeader(secret, method, path string, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return timestamp + ":" + hex.EncodeToString(traceHeaderMAC(secret, timestamp, method, path))
+}
+
+// VerifyTraceHeader returns a non-nil error when the value of the trace header
+// of a request with the given method and path is not signed with the given
+// secret or has expired.
+func VerifyTraceHeader(secret, value, method, path string, now time.Time) error {
+	i := strings.IndexByte(value, ':')
+	if i == -1 {
+		return sqerrors.New("unexpected trace header format")
+	}
+	timestamp, signature := value[:i], value[i+1:]
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return sqerrors.Wrap(err, "trace header timestamp")
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > traceHeaderValidity || d < -traceHeaderValidity {
+		return sqerrors.New("expired trace header")
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil {
+		return sqerrors.Wrap(err, "trace header signature")
+	}
+	if !hmac.Equal(mac, traceHeaderMAC(secret, timestamp, method, path)) {
+		return sqerrors.New("invalid trace header signature")
+	}
+	return nil
+}
+
+func traceHeaderMAC(secret, timestamp, method, path string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + ":" + method + " " + path))
+	return h.Sum(nil)
+}
+
+// EnableTrace enables the execution trace of the rule callbacks in the request
+// and returns its ID, which is also set in the response header TraceIDHeader
+// when the response headers were not written yet. The trace is attached to the
+// request record.
+func (p *ProtectionContext) EnableTrace() string {
+	if trace := p.events.Trace(); trace != nil {
+		return trace.ID
+	}
+	trace := p.events.EnableTrace(newTraceID())
+	if p.ResponseWriter != nil {
+		p.ResponseWriter.Header().Set(TraceIDHeader, trace.ID)
+	}
+	return trace.ID
+}
+
+// Trace returns the execution trace of the rule callbacks in the request, nil
+// when it is not traced.
+func (p *ProtectionContext) Trace() *event.Trace {
+	return p.events.Trace()
+}
+
+// enableTraceFromHeader enables the trace when the request has a valid trace
+// header.
+func (p *ProtectionContext) enableTraceFromHeader(secret string) {
+	if secret == "" {
+		return
+	}
+	value := p.RequestReader.Header(TraceHeader)
+	if value == nil {
+		return
+	}
+	if err := VerifyTraceHeader(secret, *value, p.RequestReader.Method(), p.RequestReader.URL().Path, time.Now()); err != nil {
+		return
+	}
+	p.EnableTrace()
+}
+
+func newTraceID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		// Fallback to the current time which is unique enough for a debugging
+		// trace.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceHeader(t *testing.T) {
+	now := time.Now()
+	value := SignTraceHeader("my secret", "GET", "/foo", now)
+
+	for _, tc := range []struct {
+		name           string
+		secret, value  string
+		method, path   string
+		now            time.Time
+		expectedFailed bool
+	}{
+		{name: "valid", secret: "my secret", value: value, method: "GET", path: "/foo", now: now},
+		{name: "valid with clock skew", secret: "my secret", value: value, method: "GET", path: "/foo", now: now.Add(-time.Minute)},
+		{name: "wrong secret", secret: "other secret", value: value, method: "GET", path: "/foo", now: now, expectedFailed: true},
+		{name: "wrong method", secret: "my secret", value: value, method: "POST", path: "/foo", now: now, expectedFailed: true},
+		{name: "wrong path", secret: "my secret", value: value, method: "GET", path: "/bar", now: now, expectedFailed: true},
+		{name: "expired", secret: "my secret", value: value, method: "GET", path: "/foo", now: now.Add(traceHeaderValidity + time.Second), expectedFailed: true},
+		{name: "bad format", secret: "my secret", value: "oops", method: "GET", path: "/foo", now: now, expectedFailed: true},
+		{name: "bad timestamp", secret: "my secret", value: "oops:abcd", method: "GET", path: "/foo", now: now, expectedFailed: true},
+		{name: "bad signature", secret: "my secret", value: value + "z", method: "GET", path: "/foo", now: now, expectedFailed: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyTraceHeader(tc.secret, tc.value, tc.method, tc.path, tc.now)
+			if tc.expectedFailed {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEnableTrace(t *testing.T) {
+	newProtectionContext := func(t *testing.T, header *string) (*ProtectionContext, http.Header) {
+		u, err := url.Parse("https://sqreen.com/foo")
+		require.NoError(t, err)
+		req := &http_protection_mockups.RequestReaderMockup{}
+		req.ExpectHeader(TraceHeader).Return(header).Maybe()
+		req.ExpectMethod().Return("GET").Maybe()
+		req.ExpectURL().Return(u).Maybe()
+
+		headers := http.Header{}
+		w := &http_protection_mockups.ResponseWriterMockup{}
+		w.ExpectHeader().Return(headers).Maybe()
+
+		return &ProtectionContext{RequestReader: req, ResponseWriter: w}, headers
+	}
+
+	t.Run("sdk", func(t *testing.T) {
+		p, headers := newProtectionContext(t, nil)
+		require.Nil(t, p.Trace())
+
+		id := p.EnableTrace()
+		require.NotEmpty(t, id)
+		require.Equal(t, id, headers.Get(TraceIDHeader))
+		require.NotNil(t, p.Trace())
+		require.Equal(t, id, p.Trace().ID)
+
+		// Enabling it again keeps the same trace
+		require.Equal(t, id, p.EnableTrace())
+	})
+
+	t.Run("signed header", func(t *testing.T) {
+		value := SignTraceHeader("my secret", "GET", "/foo", time.Now())
+		p, headers := newProtectionContext(t, &value)
+		p.enableTraceFromHeader("my secret")
+		require.NotNil(t, p.Trace())
+		require.Equal(t, p.Trace().ID, headers.Get(TraceIDHeader))
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		value := SignTraceHeader("other secret", "GET", "/foo", time.Now())
+		p, headers := newProtectionContext(t, &value)
+		p.enableTraceFromHeader("my secret")
+		require.Nil(t, p.Trace())
+		require.Empty(t, headers.Get(TraceIDHeader))
+	})
+
+	t.Run("no secret", func(t *testing.T) {
+		value := SignTraceHeader("", "GET", "/foo", time.Now())
+		p, _ := newProtectionContext(t, &value)
+		p.enableTraceFromHeader("")
+		require.Nil(t, p.Trace())
+	})
+}
@@ -32,6 +32,9 @@ type RootProtectionContext interface {
 type ConfigReader interface {
 	HTTPClientIPHeader() string
 	HTTPClientIPHeaderFormat() string
+	HTTPResponseBodyMaxSize() int
+	HTTPResponseBodyContentTypes() []string
+	RuleTraceSecret() string
 }
 
 // RequestReader is the read-only interface to the request.
@@ -78,6 +81,53 @@ func (m *RequestParamMap) Add(key string, value interface{}) {
 	(*m)[key] = append(params, value)
 }
 
+const (
+	// GraphQLRequestParamName is the name of the request parameter of the
+	// GraphQL operations parsed from the request body.
+	GraphQLRequestParamName = "GraphQL"
+	// GraphQLOperationNameParamKey is the key of the operation name in the
+	// GraphQL request parameter values.
+	GraphQLOperationNameParamKey = "operation_name"
+)
+
+// GraphQLOperationNames returns the names of the GraphQL operations found in
+// the request parameters. Anonymous operations are skipped.
+func (m RequestParamMap) GraphQLOperationNames() (names []string) {
+	for _, v := range m[GraphQLRequestParamName] {
+		param, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, _ := param[GraphQLOperationNameParamKey].(string); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+const (
+	// FileUploadRequestParamName is the name of the request parameter of the
+	// files uploaded in multipart/form-data request bodies.
+	FileUploadRequestParamName = "FileUpload"
+)
+
+// WebSocketRequestReader is the request reader of the messages received over
+// a WebSocket connection: the HTTP upgrade request of the connection along
+// with the metadata of the connection and of the message.
+type WebSocketRequestReader interface {
+	RequestReader
+	WebSocket() WebSocketMessageMetadata
+}
+
+type WebSocketMessageMetadata struct {
+	ConnectionID string
+	Subprotocol  string
+	ConnectedAt  time.Time
+	MessageType  string
+	MessageIndex uint64
+	MessageSize  int
+}
+
 // ResponseWriter is the response writer interface.
 type ResponseWriter interface {
 	http.ResponseWriter
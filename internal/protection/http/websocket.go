@@ -0,0 +1,224 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sqreen/go-agent/internal/event"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqgls"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+)
+
+// WebSocketMessageType is the type of WebSocket data messages. The values are
+// the opcodes defined by RFC 6455, also used by most Go WebSocket libraries.
+type WebSocketMessageType int
+
+const (
+	WebSocketTextMessage   WebSocketMessageType = 1
+	WebSocketBinaryMessage WebSocketMessageType = 2
+)
+
+func (t WebSocketMessageType) String() string {
+	switch t {
+	case WebSocketTextMessage:
+		return "text"
+	case WebSocketBinaryMessage:
+		return "binary"
+	default:
+		return "unknown"
+	}
+}
+
+// WebSocketPolicyViolationStatus is the close status code defined by RFC 6455
+// used to close connections whose messages got blocked.
+const WebSocketPolicyViolationStatus = 1008
+
+// WebSocketCloseFunc closes the WebSocket connection with the given close
+// status code and reason.
+type WebSocketCloseFunc func(code int, reason string) error
+
+// WebSocketMessage is an inbound WebSocket message.
+type WebSocketMessage struct {
+	Type WebSocketMessageType
+	Data []byte
+	// Index is the position of the message in the connection, starting at 1.
+	Index uint64
+}
+
+// WebSocketProtectionContext is the protection context of a WebSocket
+// connection, derived from the protection context of its HTTP upgrade request.
+// It lives for the connection lifetime and runs the protections of every
+// inbound message. Every message has its own performance budget, and its
+// attacks are reported along with the connection metadata. Blocking a message
+// closes the connection.
+// Note that it is not safe for concurrent use, just like WebSocket connections
+// which support a single concurrent reader.
+type WebSocketProtectionContext struct {
+	p *ProtectionContext
+
+	// request is a copy of the upgrade request, as the connection can outlive
+	// the request handler.
+	request     types.RequestReader
+	id          string
+	subprotocol string
+	start       time.Time
+	close       WebSocketCloseFunc
+	closed      bool
+
+	messageCount uint64
+	// The following fields are about the message currently inspected.
+	message         *WebSocketMessage
+	messageEvents   event.Record
+	messageBaseTime time.Duration
+}
+
+// Static assert that webSocketMessageRequest implements the expected
+// interface.
+var _ types.WebSocketRequestReader = (*webSocketMessageRequest)(nil)
+
+// NewWebSocketProtectionContext returns the protection context of the
+// WebSocket connection upgraded from the request of this protection context.
+// The close function is used to close the connection when a message gets
+// blocked.
+func (p *ProtectionContext) NewWebSocketProtectionContext(subprotocol string, close WebSocketCloseFunc) (*WebSocketProtectionContext, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "could not generate the websocket connection id")
+	}
+	return &WebSocketProtectionContext{
+		p:           p,
+		request:     copyRequest(p.RequestReader),
+		id:          id.String(),
+		subprotocol: subprotocol,
+		start:       time.Now(),
+		close:       close,
+	}, nil
+}
+
+// ID returns the unique identifier of the connection.
+func (c *WebSocketProtectionContext) ID() string { return c.id }
+
+// Message returns the message currently inspected, nil otherwise.
+func (c *WebSocketProtectionContext) Message() *WebSocketMessage { return c.message }
+
+// Request returns the HTTP upgrade request of the connection.
+func (c *WebSocketProtectionContext) Request() types.RequestReader { return c.request }
+
+func (c *WebSocketProtectionContext) ClientIP() net.IP { return c.p.ClientIP() }
+
+// AddRequestParam ignores the parameter as the upgrade request can no longer
+// be modified once the connection is established.
+func (c *WebSocketProtectionContext) AddRequestParam(string, interface{}) {}
+
+func (c *WebSocketProtectionContext) SqreenTime() *sqtime.SharedStopWatch {
+	return c.p.SqreenTime()
+}
+
+// DeadlineExceeded checks the performance budget of the current message. The
+// budget of the root protection context being per request, the sqreen time
+// spent before the current message is deduced from its computation.
+func (c *WebSocketProtectionContext) DeadlineExceeded(needed time.Duration) (exceeded bool) {
+	return c.p.DeadlineExceeded(needed - c.messageBaseTime)
+}
+
+// HandleAttack records the attack of the current message. Blocking it is done
+// by the caller by closing the connection.
+func (c *WebSocketProtectionContext) HandleAttack(block bool, attack *event.AttackEvent) (blocked bool) {
+	if attack != nil {
+		c.messageEvents.AddAttackEvent(attack)
+	}
+	return block
+}
+
+// InspectMessage runs the protections of the given inbound message. When a
+// non-nil error is returned, the message was blocked and the connection was
+// closed: the message must be dropped and the error returned to the reader.
+func (c *WebSocketProtectionContext) InspectMessage(messageType WebSocketMessageType, data []byte) error {
+	if c.closed {
+		return sqerrors.New("websocket connection closed by a security protection")
+	}
+
+	c.messageCount++
+	c.message = &WebSocketMessage{
+		Type:  messageType,
+		Data:  data,
+		Index: c.messageCount,
+	}
+	start := time.Now()
+	c.messageBaseTime = c.SqreenTime().Duration()
+
+	// The message can be read from another goroutine than the request handler
+	// one: set the goroutine local storage to this context during the
+	// inspection so that the protections can retrieve it.
+	prev := sqgls.Get()
+	sqgls.Set(c)
+	err := c.p.webSocketMessageWAF()
+	sqgls.Set(prev)
+
+	c.closeMessage(start)
+	c.message = nil
+
+	if err != nil {
+		c.closed = true
+		// The close error is ignored as the message is blocked anyway, and the
+		// connection can be already broken.
+		_ = c.close(WebSocketPolicyViolationStatus, http.StatusText(http.StatusForbidden))
+		return err
+	}
+	return nil
+}
+
+//go:noinline
+func (p *ProtectionContext) webSocketMessageWAF() error { /* dynamically instrumented */ return nil }
+
+// closeMessage reports the attacks of the current message, if any, as a
+// closed protection context of the upgrade request, along with the connection
+// and message metadata.
+func (c *WebSocketProtectionContext) closeMessage(start time.Time) {
+	events := c.messageEvents.CloseRecord()
+	if len(events.AttackEvents) == 0 {
+		return
+	}
+
+	c.p.RootProtectionContext.Close(&closedProtectionContext{
+		response: webSocketUpgradeResponse{},
+		request: &webSocketMessageRequest{
+			RequestReader: c.request,
+			metadata: types.WebSocketMessageMetadata{
+				ConnectionID: c.id,
+				Subprotocol:  c.subprotocol,
+				ConnectedAt:  c.start,
+				MessageType:  c.message.Type.String(),
+				MessageIndex: c.message.Index,
+				MessageSize:  len(c.message.Data),
+			},
+		},
+		events:     events,
+		start:      start,
+		duration:   time.Since(start),
+		sqreenTime: c.SqreenTime().Duration() - c.messageBaseTime,
+	})
+}
+
+type webSocketMessageRequest struct {
+	types.RequestReader
+	metadata types.WebSocketMessageMetadata
+}
+
+func (r *webSocketMessageRequest) WebSocket() types.WebSocketMessageMetadata { return r.metadata }
+
+// webSocketUpgradeResponse is the response of WebSocket messages, which is
+// the upgrade response of the connection.
+type webSocketUpgradeResponse struct{}
+
+func (webSocketUpgradeResponse) Status() int          { return http.StatusSwitchingProtocols }
+func (webSocketUpgradeResponse) ContentType() string  { return "" }
+func (webSocketUpgradeResponse) ContentLength() int64 { return 0 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+	middleware_mockups "github.com/sqreen/go-agent/sdk/middleware/_testlib/mockups"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketProtectionContext(t *testing.T) {
+	newWebSocketProtectionContext := func(t *testing.T, root types.RootProtectionContext, close WebSocketCloseFunc) *WebSocketProtectionContext {
+		u, err := url.Parse("http://test.com/ws")
+		require.NoError(t, err)
+		req := &http_protection_mockups.RequestReaderMockup{}
+		req.ExpectHeaders().Return(http.Header{"Upgrade": []string{"websocket"}})
+		req.ExpectMethod().Return("GET")
+		req.ExpectURL().Return(u)
+		req.ExpectRequestURI().Return(u.RequestURI())
+		req.ExpectHost().Return(u.Host)
+		req.ExpectRemoteAddr().Return("1.2.3.4:5678")
+		req.ExpectIsTLS().Return(false)
+		req.ExpectUserAgent().Return("ua")
+		req.ExpectReferer().Return("")
+		req.ExpectQueryForm().Return(nil)
+		req.ExpectPostForm().Return(nil)
+		req.ExpectParams().Return(nil)
+
+		p := NewTestProtectionContext(root, nil, nil, req)
+		c, err := p.NewWebSocketProtectionContext("chat", close)
+		require.NoError(t, err)
+		require.NotEmpty(t, c.ID())
+		require.Equal(t, u, c.Request().URL())
+		return c
+	}
+
+	noClose := func(t *testing.T) WebSocketCloseFunc {
+		return func(int, string) error {
+			t.Fatal("unexpected connection close")
+			return nil
+		}
+	}
+
+	t.Run("message without attacks", func(t *testing.T) {
+		root := &middleware_mockups.RootHTTPProtectionContextMockup{}
+		defer root.AssertExpectations(t)
+		root.ExpectSqreenTime().Return(sqtime.NewSharedStopWatch())
+
+		c := newWebSocketProtectionContext(t, root, noClose(t))
+		require.NoError(t, c.InspectMessage(WebSocketTextMessage, []byte("hello")))
+		require.Nil(t, c.Message())
+		require.Equal(t, uint64(1), c.messageCount)
+	})
+
+	t.Run("message attacks are reported with the connection metadata", func(t *testing.T) {
+		root := &middleware_mockups.RootHTTPProtectionContextMockup{}
+		defer root.AssertExpectations(t)
+		root.ExpectClose(mock.MatchedBy(func(closed types.ClosedProtectionContextFace) bool {
+			require.Equal(t, http.StatusSwitchingProtocols, closed.Response().Status())
+			require.Len(t, closed.Events().AttackEvents, 1)
+			req, ok := closed.Request().(types.WebSocketRequestReader)
+			require.True(t, ok)
+			require.Equal(t, "/ws", req.URL().Path)
+			ws := req.WebSocket()
+			require.NotEmpty(t, ws.ConnectionID)
+			require.Equal(t, "chat", ws.Subprotocol)
+			require.Equal(t, "binary", ws.MessageType)
+			require.Equal(t, uint64(3), ws.MessageIndex)
+			require.Equal(t, 4, ws.MessageSize)
+			return true
+		}))
+
+		c := newWebSocketProtectionContext(t, root, noClose(t))
+		c.message = &WebSocketMessage{Type: WebSocketBinaryMessage, Data: []byte("oops"), Index: 3}
+		blocked := c.HandleAttack(false, &event.AttackEvent{Rule: "rule"})
+		require.False(t, blocked)
+		c.closeMessage(time.Now())
+	})
+
+	t.Run("per-message performance budget", func(t *testing.T) {
+		root := &middleware_mockups.RootHTTPProtectionContextMockup{}
+		defer root.AssertExpectations(t)
+		root.On("DeadlineExceeded", time.Millisecond).Return(true).Once()
+
+		c := newWebSocketProtectionContext(t, root, noClose(t))
+		// 2ms were spent by the protections before the current message
+		c.messageBaseTime = 2 * time.Millisecond
+		require.True(t, c.DeadlineExceeded(3*time.Millisecond))
+	})
+
+	t.Run("closed connection", func(t *testing.T) {
+		c := newWebSocketProtectionContext(t, nil, noClose(t))
+		c.closed = true
+		require.Error(t, c.InspectMessage(WebSocketTextMessage, []byte("hello")))
+	})
+}
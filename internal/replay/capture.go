@@ -0,0 +1,145 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// Request is a recorded HTTP request to replay.
+type Request struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Headers are the request headers. The Host header is taken from the URL
+	// when not present.
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+	// RemoteAddr is the network address of the client, in the `ip:port`
+	// format. The client IP address is computed out of it and the headers.
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// ReadCapture reads the recorded requests from the given capture, which can be
+// either a HAR file or a sequence of JSON Request objects such as JSON lines.
+func ReadCapture(r io.Reader) ([]*Request, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "could not read the capture")
+	}
+
+	var har harFile
+	if err := json.Unmarshal(buf, &har); err == nil && har.Log != nil {
+		return har.requests()
+	}
+
+	var requests []*Request
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	for n := 1; ; n++ {
+		var req Request
+		if err := dec.Decode(&req); err == io.EOF {
+			return requests, nil
+		} else if err != nil {
+			return nil, sqerrors.Wrapf(err, "capture request %d: json decoding", n)
+		}
+		if err := req.validate(); err != nil {
+			return nil, sqerrors.Wrapf(err, "capture request %d", n)
+		}
+		requests = append(requests, &req)
+	}
+}
+
+func (r *Request) validate() error {
+	if r.Method == "" {
+		return sqerrors.New("unexpected empty method")
+	}
+	if r.URL == "" {
+		return sqerrors.New("unexpected empty url")
+	}
+	return nil
+}
+
+// harFile is the subset of the HTTP Archive format needed to replay requests.
+// Cf. http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log *struct {
+		Entries []struct {
+			Request struct {
+				Method   string         `json:"method"`
+				URL      string         `json:"url"`
+				Headers  []harNameValue `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (f *harFile) requests() ([]*Request, error) {
+	requests := make([]*Request, 0, len(f.Log.Entries))
+	for i, entry := range f.Log.Entries {
+		req := &Request{
+			Method:  entry.Request.Method,
+			URL:     entry.Request.URL,
+			Headers: make(http.Header, len(entry.Request.Headers)),
+		}
+		for _, h := range entry.Request.Headers {
+			// HTTP/2 pseudo-headers are not request headers
+			if strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			req.Headers.Add(h.Name, h.Value)
+		}
+		if data := entry.Request.PostData; data != nil {
+			req.Body = data.Text
+			if req.Headers.Get("Content-Type") == "" && data.MimeType != "" {
+				req.Headers.Set("Content-Type", data.MimeType)
+			}
+		}
+		if err := req.validate(); err != nil {
+			return nil, sqerrors.Wrapf(err, "har entry %d", i+1)
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// ReadRulesPack reads the rulespack to replay, which can be either a rulespack
+// object as returned by the backend or a JSON array of rules such as local
+// rules files.
+func ReadRulesPack(r io.Reader) (*api.RulesPackResponse, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "could not read the rulespack")
+	}
+
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		var rules []api.Rule
+		if err := json.Unmarshal(buf, &rules); err != nil {
+			return nil, sqerrors.Wrap(err, "rules: json decoding")
+		}
+		return &api.RulesPackResponse{Rules: rules}, nil
+	}
+
+	var rulespack api.RulesPackResponse
+	if err := json.Unmarshal(buf, &rulespack); err != nil {
+		return nil, sqerrors.Wrap(err, "rulespack: json decoding")
+	}
+	return &rulespack, nil
+}
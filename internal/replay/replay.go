@@ -0,0 +1,333 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package replay runs a rulespack against recorded HTTP requests, without any
+// backend nor actual HTTP server, in order to regression-test rule changes.
+// The requests go through the same HTTP protection as the HTTP middlewares and
+// the rules are attached to the actual hooks, which requires the program to be
+// compiled with the instrumentation tool.
+package replay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/actor"
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	"github.com/sqreen/go-agent/internal/metrics"
+	"github.com/sqreen/go-agent/internal/plog"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/sqreen/go-agent/internal/rule"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+	"github.com/sqreen/go-agent/internal/version"
+)
+
+// Performance histogram settings of the rules. The period is the smallest
+// possible so that the histograms are always ready to be read after a replay.
+const (
+	perfHistogramUnit   = 0.1
+	perfHistogramBase   = 2.0
+	perfHistogramPeriod = time.Nanosecond
+)
+
+// Default remote address of the requests without any.
+const defaultRemoteAddr = "127.0.0.1:0"
+
+// Replayer replays recorded requests against a rulespack.
+type Replayer struct {
+	rules   *rule.Engine
+	metrics *metrics.Engine
+	// Names of the rules of the rulespack.
+	ruleNames []string
+}
+
+// NewReplayer returns a replayer of the given rulespack, whose rules must be
+// signed by the given public key or one of the local public keys. An error is
+// returned when the program is not instrumented.
+func NewReplayer(logger plog.DebugLevelLogger, rulespack *api.RulesPackResponse, publicKey *ecdsa.PublicKey, localPublicKeys []rule.PublicKey) (*Replayer, error) {
+	metricsEngine := metrics.NewEngine()
+	rules := rule.NewEngine(logger, nil, metricsEngine, publicKey, perfHistogramUnit, perfHistogramBase, perfHistogramPeriod)
+	if err := rules.Health(version.Version()); err != nil {
+		return nil, err
+	}
+	rules.SetLocalPublicKeys(localPublicKeys)
+
+	rules.SetRules(rulespack.PackID, rulespack.Rules)
+	rules.Enable()
+
+	names := make([]string, 0, len(rulespack.Rules))
+	seen := make(map[string]struct{}, len(rulespack.Rules))
+	for _, r := range rulespack.Rules {
+		if _, exists := seen[r.Name]; exists {
+			continue
+		}
+		seen[r.Name] = struct{}{}
+		names = append(names, r.Name)
+	}
+
+	return &Replayer{
+		rules:     rules,
+		metrics:   metricsEngine,
+		ruleNames: names,
+	}, nil
+}
+
+// Close disables the rules.
+func (r *Replayer) Close() {
+	r.rules.Disable()
+}
+
+// Result is the result of the replay of a request.
+type Result struct {
+	Request *Request `json:"request"`
+	// Blocked is true when the request was blocked.
+	Blocked bool `json:"blocked"`
+	// Status is the response status code.
+	Status  int       `json:"status"`
+	Attacks []*Attack `json:"attacks,omitempty"`
+	// SqreenTime is the execution time of the rules.
+	SqreenTime time.Duration `json:"sqreen_time"`
+}
+
+// Attack is an attack detected by a rule.
+type Attack struct {
+	Rule       string      `json:"rule"`
+	AttackType string      `json:"attack_type"`
+	Test       bool        `json:"test"`
+	Blocked    bool        `json:"blocked"`
+	Info       interface{} `json:"info,omitempty"`
+}
+
+// Replay replays the given request. The request handler reads the entire
+// request body and responds with an empty 200 response.
+func (r *Replayer) Replay(req *Request) (*Result, error) {
+	httpReq, err := newHTTPRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	root := newRootProtectionContext()
+	defer root.CancelContext()
+
+	w := httptest.NewRecorder()
+	reader := &requestReader{Request: httpReq}
+	p := http_protection.NewProtectionContext(root, w, reader)
+	if p == nil {
+		return nil, sqerrors.New("unexpected nil protection context")
+	}
+	reader.Request = p.WrapRequest(reader.Request)
+
+	if err := p.Before(); err == nil {
+		if err := handler(reader.Request); err == nil {
+			_ = p.After()
+		}
+	}
+	p.Close(&response{recorder: w})
+
+	closed := root.closed
+	if closed == nil {
+		return nil, sqerrors.New("the protection context was not closed")
+	}
+
+	result := &Result{
+		Request:    req,
+		Status:     w.Code,
+		SqreenTime: closed.SqreenTime(),
+	}
+	for _, attack := range closed.Events().AttackEvents {
+		result.Attacks = append(result.Attacks, newAttack(attack))
+		if attack.Blocked {
+			result.Blocked = true
+		}
+	}
+	return result, nil
+}
+
+func newAttack(attack *event.AttackEvent) *Attack {
+	return &Attack{
+		Rule:       attack.Rule,
+		AttackType: attack.AttackType,
+		Test:       attack.Test,
+		Blocked:    attack.Blocked,
+		Info:       attack.Info,
+	}
+}
+
+// handler is the replayed request handler, parsing the request form and
+// reading the rest of the body so that the body protections are performed.
+func handler(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if r.Body == nil {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, r.Body)
+	return err
+}
+
+func newHTTPRequest(req *Request) (*http.Request, error) {
+	var body io.Reader
+	if req.Body != "" {
+		body = strings.NewReader(req.Body)
+	}
+	r, err := http.NewRequest(req.Method, req.URL, body)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "could not create the http request")
+	}
+	for h, values := range req.Headers {
+		for _, v := range values {
+			r.Header.Add(h, v)
+		}
+	}
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.RemoteAddr = req.RemoteAddr
+	if r.RemoteAddr == "" {
+		r.RemoteAddr = defaultRemoteAddr
+	}
+	return r, nil
+}
+
+// RuleTiming is the execution time of a rule callback.
+type RuleTiming struct {
+	Rule string `json:"rule"`
+	// Callback is either `pre` or `post`.
+	Callback string `json:"callback"`
+	Calls    uint64 `json:"calls"`
+	// Max is the maximum execution time of the callback.
+	Max time.Duration `json:"max"`
+}
+
+// RuleTimings returns the execution times of the rule callbacks called so far,
+// sorted by rule name. Rule callbacks are counted only once so that calling it
+// again only returns the execution times since the last call.
+func (r *Replayer) RuleTimings() ([]RuleTiming, error) {
+	var timings []RuleTiming
+	for _, name := range r.ruleNames {
+		for _, cb := range []string{"pre", "post"} {
+			hist, err := r.metrics.PerfHistogram("sq."+name+"."+cb, perfHistogramUnit, perfHistogramBase, perfHistogramPeriod)
+			if err != nil {
+				return nil, sqerrors.Wrapf(err, "rule `%s`: could not get the performance histogram", name)
+			}
+			timing := RuleTiming{Rule: name, Callback: cb}
+			for _, ready := range hist.Flush() {
+				ready, ok := ready.(*metrics.ReadyPerfHistogram)
+				if !ok {
+					continue
+				}
+				for _, calls := range ready.Metrics() {
+					timing.Calls += calls
+				}
+				// Performance values are in milliseconds
+				if max := time.Duration(ready.Max() * float64(time.Millisecond)); max > timing.Max {
+					timing.Max = max
+				}
+			}
+			if timing.Calls > 0 {
+				timings = append(timings, timing)
+			}
+		}
+	}
+	sort.SliceStable(timings, func(i, j int) bool {
+		return timings[i].Rule < timings[j].Rule
+	})
+	return timings, nil
+}
+
+// rootProtectionContext is the root protection context of a replayed request,
+// without performance budget, passlists nor security actions.
+type rootProtectionContext struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	sqreenTime *sqtime.SharedStopWatch
+	closed     types.ClosedProtectionContextFace
+}
+
+var _ types.RootProtectionContext = (*rootProtectionContext)(nil)
+
+func newRootProtectionContext() *rootProtectionContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rootProtectionContext{
+		ctx:        ctx,
+		cancel:     cancel,
+		sqreenTime: sqtime.NewSharedStopWatch(),
+	}
+}
+
+func (p *rootProtectionContext) Context() context.Context                  { return p.ctx }
+func (p *rootProtectionContext) CancelContext()                            { p.cancel() }
+func (p *rootProtectionContext) SqreenTime() *sqtime.SharedStopWatch       { return p.sqreenTime }
+func (p *rootProtectionContext) DeadlineExceeded(time.Duration) bool       { return false }
+func (p *rootProtectionContext) IsIPAllowed(net.IP) bool                   { return false }
+func (p *rootProtectionContext) IsPathAllowed(string) bool                 { return false }
+func (p *rootProtectionContext) Config() types.ConfigReader                { return config{} }
+func (p *rootProtectionContext) Close(c types.ClosedProtectionContextFace) { p.closed = c }
+
+func (p *rootProtectionContext) FindActionByIP(net.IP) (action actor.Action, exists bool, err error) {
+	return nil, false, nil
+}
+
+func (p *rootProtectionContext) FindActionByUserID(map[string]string) (action actor.Action, exists bool) {
+	return nil, false
+}
+
+// config is the default agent configuration of the HTTP protection.
+type config struct{}
+
+func (config) HTTPClientIPHeader() string             { return "" }
+func (config) HTTPClientIPHeaderFormat() string       { return "" }
+func (config) HTTPResponseBodyMaxSize() int           { return 0 }
+func (config) HTTPResponseBodyContentTypes() []string { return nil }
+func (config) RuleTraceSecret() string                { return "" }
+
+type requestReader struct {
+	*http.Request
+}
+
+var _ types.RequestReader = (*requestReader)(nil)
+
+func (r *requestReader) Header(h string) *string {
+	v, exists := r.Request.Header[http.CanonicalHeaderKey(h)]
+	if !exists || len(v) == 0 {
+		return nil
+	}
+	return &v[0]
+}
+
+func (r *requestReader) Headers() http.Header          { return r.Request.Header }
+func (r *requestReader) Method() string                { return r.Request.Method }
+func (r *requestReader) URL() *url.URL                 { return r.Request.URL }
+func (r *requestReader) RequestURI() string            { return r.Request.RequestURI }
+func (r *requestReader) Host() string                  { return r.Request.Host }
+func (r *requestReader) RemoteAddr() string            { return r.Request.RemoteAddr }
+func (r *requestReader) IsTLS() bool                   { return r.Request.URL.Scheme == "https" }
+func (r *requestReader) QueryForm() url.Values         { return r.Request.URL.Query() }
+func (r *requestReader) PostForm() url.Values          { return r.Request.PostForm }
+func (r *requestReader) ClientIP() net.IP              { return nil } // Computed by the protection context
+func (r *requestReader) Params() types.RequestParamMap { return nil }
+func (r *requestReader) Body() []byte                  { return nil }
+
+// response is the response written by the handler or the protection.
+type response struct {
+	recorder *httptest.ResponseRecorder
+}
+
+func (r *response) Status() int          { return r.recorder.Code }
+func (r *response) ContentType() string  { return r.recorder.Header().Get("Content-Type") }
+func (r *response) ContentLength() int64 { return int64(r.recorder.Body.Len()) }
@@ -0,0 +1,116 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package replay
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCapture(t *testing.T) {
+	t.Run("json lines", func(t *testing.T) {
+		requests, err := ReadCapture(strings.NewReader(`
+{"method":"GET","url":"http://sqreen.com/?q=1","headers":{"User-Agent":["curl"]}}
+{"method":"POST","url":"http://sqreen.com/login","body":"user=root","remote_addr":"1.2.3.4:5678"}
+`))
+		require.NoError(t, err)
+		require.Equal(t, []*Request{
+			{Method: "GET", URL: "http://sqreen.com/?q=1", Headers: http.Header{"User-Agent": {"curl"}}},
+			{Method: "POST", URL: "http://sqreen.com/login", Body: "user=root", RemoteAddr: "1.2.3.4:5678"},
+		}, requests)
+	})
+
+	t.Run("har", func(t *testing.T) {
+		requests, err := ReadCapture(strings.NewReader(`{
+  "log": {
+    "entries": [
+      {
+        "request": {
+          "method": "POST",
+          "url": "https://sqreen.com/login",
+          "headers": [
+            { "name": ":authority", "value": "sqreen.com" },
+            { "name": "Accept", "value": "*/*" }
+          ],
+          "postData": { "mimeType": "application/x-www-form-urlencoded", "text": "user=root" }
+        }
+      }
+    ]
+  }
+}`))
+		require.NoError(t, err)
+		require.Equal(t, []*Request{
+			{
+				Method: "POST",
+				URL:    "https://sqreen.com/login",
+				Headers: http.Header{
+					"Accept":       {"*/*"},
+					"Content-Type": {"application/x-www-form-urlencoded"},
+				},
+				Body: "user=root",
+			},
+		}, requests)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, capture := range []string{
+			`{"method":"GET","url":"http://sqreen.com"} {`,
+			`{"method":"GET"}`,
+			`{"url":"http://sqreen.com"}`,
+			`{"log":{"entries":[{"request":{"method":"GET"}}]}}`,
+		} {
+			_, err := ReadCapture(strings.NewReader(capture))
+			require.Error(t, err, capture)
+		}
+	})
+}
+
+func TestReadRulesPack(t *testing.T) {
+	rulespack, err := ReadRulesPack(strings.NewReader(`{"pack_id":"my pack id","rules":[{"name":"my rule"}]}`))
+	require.NoError(t, err)
+	require.Equal(t, "my pack id", rulespack.PackID)
+	require.Len(t, rulespack.Rules, 1)
+	require.Equal(t, "my rule", rulespack.Rules[0].Name)
+
+	rulespack, err = ReadRulesPack(strings.NewReader(` [{"name":"my rule"}]`))
+	require.NoError(t, err)
+	require.Empty(t, rulespack.PackID)
+	require.Len(t, rulespack.Rules, 1)
+
+	_, err = ReadRulesPack(strings.NewReader(`{`))
+	require.Error(t, err)
+}
+
+func TestNewReplayer(t *testing.T) {
+	// The test program is not instrumented
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	r, err := NewReplayer(logger, &api.RulesPackResponse{}, nil, nil)
+	require.Error(t, err)
+	require.Nil(t, r)
+}
+
+func TestNewHTTPRequest(t *testing.T) {
+	r, err := newHTTPRequest(&Request{
+		Method:  "POST",
+		URL:     "http://sqreen.com/login?a=b",
+		Headers: http.Header{"Host": {"sqreen.io"}, "Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:    "user=root",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "sqreen.io", r.Host)
+	require.Equal(t, "/login?a=b", r.RequestURI)
+	require.Equal(t, defaultRemoteAddr, r.RemoteAddr)
+	require.NoError(t, handler(r))
+	require.Equal(t, "root", r.PostForm.Get("user"))
+
+	_, err = newHTTPRequest(&Request{Method: "GET", URL: "://oops"})
+	require.Error(t, err)
+}
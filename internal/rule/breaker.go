@@ -0,0 +1,235 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+)
+
+// DefaultCircuitBreakerCoolDown is the default cool-down of the rule circuit
+// breakers. Circuit breakers are otherwise disabled by default.
+const DefaultCircuitBreakerCoolDown = time.Minute
+
+// CircuitBreakerConfig is the configuration of the rule circuit breakers,
+// detaching the callbacks of a rule failing too many times in a row from their
+// hook. Blocking rules never have circuit breakers so that failures triggered
+// on purpose cannot disable a protection.
+type CircuitBreakerConfig struct {
+	// MaxFailures is the number of consecutive callback failures opening the
+	// circuit breaker. Circuit breakers are disabled when zero, which is the
+	// default.
+	MaxFailures int
+	// MaxLatency is the callback execution time above which a call is
+	// considered as failed. The latency is ignored when zero.
+	MaxLatency time.Duration
+	// CoolDown is the duration during which the callbacks are disabled before
+	// being retried.
+	CoolDown time.Duration
+}
+
+// CircuitBreakerError is the error logged when the circuit breaker of a rule
+// opens and disables its callbacks.
+type CircuitBreakerError struct {
+	Rule     string
+	Failures int
+	CoolDown time.Duration
+	// Err is the error of the last failed call, nil when it was too slow.
+	Err error
+	// Latency is the execution time of the last failed call.
+	Latency time.Duration
+}
+
+func (e *CircuitBreakerError) Error() string {
+	reason := fmt.Sprintf("last call took %s", e.Latency)
+	if e.Err != nil {
+		reason = fmt.Sprintf("last error: %v", e.Err)
+	}
+	return fmt.Sprintf("security rules: rule `%s`: callbacks disabled for %s after %d consecutive failures (%s)", e.Rule, e.CoolDown, e.Failures, reason)
+}
+
+func (e *CircuitBreakerError) Unwrap() error { return e.Err }
+
+// Circuit breaker states.
+const (
+	// The callbacks are called.
+	breakerClosed uint32 = iota
+	// The callbacks are disabled until the end of the cool-down.
+	breakerOpen
+	// A single call is retrying the callbacks after the cool-down.
+	breakerHalfOpen
+)
+
+// circuitBreaker disables the callbacks of a rule after too many consecutive
+// failures, and retries them after a cool-down. The callbacks are detached from
+// their hook while it is open, and attached back at the end of the cool-down
+// (cf. Engine.ApplyCircuitBreakers()). Until then, they are skipped by the
+// circuit breaker middleware. Failures are either errors,
+// including the panics recovered by withSafeCall(), or calls longer than the
+// maximum latency. The errors caused by the performance budget, such as WAF
+// timeouts or interrupted JS executions, are not failures of the callbacks and
+// are ignored.
+type circuitBreaker struct {
+	rule   string
+	cfg    CircuitBreakerConfig
+	logger plog.DebugLevelLogger
+	// changes is signaled when the callbacks must be detached from or attached
+	// back to their hook (cf. detached()). Nil when they stay attached.
+	changes chan<- struct{}
+
+	// state and failures are atomically accessed so that closed circuit
+	// breakers don't need to lock.
+	state    uint32
+	failures uint32
+
+	// lock protects the state transitions.
+	lock    sync.Mutex
+	retryAt time.Time
+}
+
+// newCircuitBreaker returns the circuit breaker of the given rule, or nil when
+// circuit breakers are disabled.
+func newCircuitBreaker(rule string, cfg CircuitBreakerConfig, changes chan<- struct{}, logger plog.DebugLevelLogger) *circuitBreaker {
+	if cfg.MaxFailures <= 0 {
+		return nil
+	}
+	if cfg.CoolDown <= 0 {
+		cfg.CoolDown = DefaultCircuitBreakerCoolDown
+	}
+	return &circuitBreaker{
+		rule:    rule,
+		cfg:     cfg,
+		logger:  logger,
+		changes: changes,
+	}
+}
+
+// detached returns true while the circuit breaker is open and the callbacks
+// must be detached from their hook. They are attached back at the end of the
+// cool-down so that a single call can retry them.
+func (b *circuitBreaker) detached(now time.Time) bool {
+	if atomic.LoadUint32(&b.state) != breakerOpen {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state == breakerOpen && now.Before(b.retryAt)
+}
+
+// notifyChange signals that the callbacks must be detached from or attached
+// back to their hook. Pending signals are merged.
+func (b *circuitBreaker) notifyChange() {
+	select {
+	case b.changes <- struct{}{}:
+	default:
+	}
+}
+
+// allow returns true when the callbacks can be called.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if atomic.LoadUint32(&b.state) == breakerClosed {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.retryAt) {
+			return false
+		}
+		// Let a single call retry the callbacks
+		atomic.StoreUint32(&b.state, breakerHalfOpen)
+		b.logger.Debugf("security rules: rule `%s`: retrying the callbacks after the circuit breaker cool-down", b.rule)
+		return true
+	case breakerHalfOpen:
+		// The retry is ongoing
+		return false
+	default:
+		return true
+	}
+}
+
+// report records the result of a call allowed by the circuit breaker.
+func (b *circuitBreaker) report(err error, latency time.Duration, now time.Time) {
+	if err != nil && callback.IsOverBudgetError(err) {
+		// Neither a failure nor a success, except for the retry which
+		// otherwise never ends.
+		if atomic.LoadUint32(&b.state) == breakerHalfOpen {
+			b.close()
+		}
+		return
+	}
+
+	failed := err != nil || (b.cfg.MaxLatency > 0 && latency > b.cfg.MaxLatency)
+	if !failed {
+		if atomic.LoadUint32(&b.state) == breakerHalfOpen {
+			b.close()
+		} else if atomic.LoadUint32(&b.failures) != 0 {
+			atomic.StoreUint32(&b.failures, 0)
+		}
+		return
+	}
+
+	failures := atomic.AddUint32(&b.failures, 1)
+	if atomic.LoadUint32(&b.state) == breakerClosed && failures < uint32(b.cfg.MaxFailures) {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == breakerOpen {
+		// Already opened by a concurrent call
+		return
+	}
+	atomic.StoreUint32(&b.state, breakerOpen)
+	b.retryAt = now.Add(b.cfg.CoolDown)
+	b.logger.Error(&CircuitBreakerError{
+		Rule:     b.rule,
+		Failures: int(failures),
+		CoolDown: b.cfg.CoolDown,
+		Err:      err,
+		Latency:  latency,
+	})
+	if b.changes != nil {
+		b.notifyChange()
+		time.AfterFunc(b.cfg.CoolDown, b.notifyChange)
+	}
+}
+
+func (b *circuitBreaker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state != breakerHalfOpen {
+		return
+	}
+	atomic.StoreUint32(&b.failures, 0)
+	atomic.StoreUint32(&b.state, breakerClosed)
+	b.logger.Infof("security rules: rule `%s`: callbacks enabled again after a successful retry", b.rule)
+}
+
+// withCircuitBreaker returns the callback middleware skipping the callback
+// while the circuit breaker is open, until it is detached from its hook, and
+// reporting the result of the calls otherwise.
+func withCircuitBreaker(b *circuitBreaker) NativeCallbackMiddlewareFunc {
+	return func(cb NativeCallbackFunc) NativeCallbackFunc {
+		return func(c callback.CallbackContext) error {
+			if !b.allow(time.Now()) {
+				callback.TraceValue(c, "circuit breaker open", true)
+				return nil
+			}
+			start := time.Now()
+			err := cb(c)
+			now := time.Now()
+			b.report(err, now.Sub(start), now)
+			return err
+		}
+	}
+}
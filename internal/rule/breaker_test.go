@@ -0,0 +1,179 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	newBreaker := func(cfg CircuitBreakerConfig) (*circuitBreaker, chan error) {
+		errs := make(chan error, 10)
+		logger := plog.NewLogger(plog.Debug, os.Stderr, errs)
+		return newCircuitBreaker("my rule", cfg, nil, logger), errs
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		b, _ := newBreaker(CircuitBreakerConfig{})
+		require.Nil(t, b)
+	})
+
+	t.Run("consecutive errors", func(t *testing.T) {
+		b, errs := newBreaker(CircuitBreakerConfig{MaxFailures: 3, CoolDown: time.Minute})
+		errOops := errors.New("oops")
+		now := time.Now()
+
+		// Successful calls reset the count of consecutive failures
+		b.report(errOops, 0, now)
+		b.report(errOops, 0, now)
+		b.report(nil, 0, now)
+		b.report(errOops, 0, now)
+		b.report(errOops, 0, now)
+		require.True(t, b.allow(now))
+		require.Empty(t, errs)
+
+		// Third consecutive failure
+		b.report(errOops, 0, now)
+		require.False(t, b.allow(now))
+		require.False(t, b.allow(now.Add(59*time.Second)))
+
+		require.Len(t, errs, 1)
+		var breakerErr *CircuitBreakerError
+		require.True(t, xerrors.As(<-errs, &breakerErr))
+		require.Equal(t, "my rule", breakerErr.Rule)
+		require.Equal(t, 3, breakerErr.Failures)
+		require.Equal(t, errOops, breakerErr.Err)
+
+		// A single call retries the callbacks after the cool-down
+		now = now.Add(time.Minute)
+		require.True(t, b.allow(now))
+		require.False(t, b.allow(now))
+
+		// The failed retry opens it again
+		b.report(errOops, 0, now)
+		require.False(t, b.allow(now))
+		require.Len(t, errs, 1)
+		<-errs
+
+		// The successful retry closes it
+		now = now.Add(time.Minute)
+		require.True(t, b.allow(now))
+		b.report(nil, 0, now)
+		require.True(t, b.allow(now))
+		require.True(t, b.allow(now))
+
+		// The count of failures starts over
+		b.report(errOops, 0, now)
+		b.report(errOops, 0, now)
+		require.True(t, b.allow(now))
+	})
+
+	t.Run("over-budget errors", func(t *testing.T) {
+		b, errs := newBreaker(CircuitBreakerConfig{MaxFailures: 2, CoolDown: time.Minute})
+		now := time.Now()
+		errTimeout := sqerrors.Wrap(callback.NewOverBudgetError(errors.New("timeout")), "callback error")
+		for i := 0; i < 10; i++ {
+			b.report(errTimeout, 0, now)
+		}
+		require.True(t, b.allow(now))
+		require.Empty(t, errs)
+
+		// Nor do they reset the count of consecutive failures
+		b.report(errors.New("oops"), 0, now)
+		b.report(errTimeout, 0, now)
+		b.report(errors.New("oops"), 0, now)
+		require.False(t, b.allow(now))
+	})
+
+	t.Run("excessive latency", func(t *testing.T) {
+		b, errs := newBreaker(CircuitBreakerConfig{MaxFailures: 2, MaxLatency: time.Millisecond, CoolDown: time.Minute})
+		now := time.Now()
+		b.report(nil, time.Millisecond, now)
+		b.report(nil, 2*time.Millisecond, now)
+		require.True(t, b.allow(now))
+		b.report(nil, 2*time.Millisecond, now)
+		require.False(t, b.allow(now))
+
+		var breakerErr *CircuitBreakerError
+		require.True(t, xerrors.As(<-errs, &breakerErr))
+		require.NoError(t, breakerErr.Err)
+		require.Equal(t, 2*time.Millisecond, breakerErr.Latency)
+	})
+
+	t.Run("detached callbacks", func(t *testing.T) {
+		changes := make(chan struct{}, 1)
+		logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+		b := newCircuitBreaker("rule 2", CircuitBreakerConfig{MaxFailures: 1, CoolDown: time.Minute}, changes, logger)
+		m := hookDescriptorMap{}
+		hook := hookMockup{}
+		m.Add(hook, "rule 1", 1, 1)
+		m.Add(hook, "rule 2", 2, 1)
+		m.addCircuitBreaker(hook, "rule 2", b)
+		d := m[hook]
+
+		now := time.Now()
+		require.Equal(t, []sqhook.PrologCallback{1, 2}, d.attached(now).callbacks)
+		require.Empty(t, changes)
+
+		// Opening the circuit breaker signals its callbacks must be detached
+		b.report(errors.New("oops"), 0, now)
+		require.Len(t, changes, 1)
+		<-changes
+		require.Equal(t, []sqhook.PrologCallback{1}, d.attached(now).callbacks)
+		require.Equal(t, []sqhook.PrologCallback{1, 2}, d.callbacks)
+
+		// They are attached back at the end of the cool-down
+		require.Equal(t, []sqhook.PrologCallback{1, 2}, d.attached(now.Add(time.Minute)).callbacks)
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		b, errs := newBreaker(CircuitBreakerConfig{MaxFailures: 2, CoolDown: time.Minute})
+		var called int
+		cb := wrapCallback(func(callback.CallbackContext) error {
+			called++
+			panic("oops")
+		}, []NativeCallbackMiddlewareFunc{withCircuitBreaker(b), withSafeCall()})
+
+		require.Error(t, cb(&mockups.CallbackContextMockup{}))
+		require.Error(t, cb(&mockups.CallbackContextMockup{}))
+		// Now skipped
+		require.NoError(t, cb(&mockups.CallbackContextMockup{}))
+		require.Equal(t, 2, called)
+		require.Len(t, errs, 1)
+	})
+
+	t.Run("rule context", func(t *testing.T) {
+		logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+		opts := newTestRuleContextOptions(logger, time.Minute)
+		opts.circuitBreaker = CircuitBreakerConfig{MaxFailures: 2, CoolDown: time.Minute}
+		r, err := newNativeRuleContext(&api.Rule{Name: "my rule"}, opts)
+		require.NoError(t, err)
+		require.NotNil(t, r.breaker)
+
+		// Circuit breaker and safe call middlewares
+		require.Len(t, buildMiddlewares(r, "pre", nil, nil, nil, nil, nil), 2)
+
+		// Critical rules are never disabled
+		r.SetCritical(true)
+		require.Len(t, buildMiddlewares(r, "pre", nil, nil, nil, nil, nil), 1)
+
+		// Blocking rules never have circuit breakers
+		r, err = newNativeRuleContext(&api.Rule{Name: "my rule", Block: true}, opts)
+		require.NoError(t, err)
+		require.Nil(t, r.breaker)
+	})
+}
@@ -8,6 +8,7 @@ package rule
 
 import (
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/dop251/goja"
@@ -37,6 +38,7 @@ func FromGLS() ProtectionContext {
 // Static assert that protection contexts correctly implement the
 // ProtectionContext interface
 var _ ProtectionContext = (*http_protection.ProtectionContext)(nil)
+var _ ProtectionContext = (*http_protection.WebSocketProtectionContext)(nil)
 
 type nativeRuleContext struct {
 	name         string
@@ -47,10 +49,36 @@ type nativeRuleContext struct {
 	attackType   string
 	rulepackID   string
 	logger       plog.DebugLevelLogger
+	// shadow is non-nil when the rule belongs to a shadow rulespack.
+	shadow *shadowMode
 
 	pre  []NativeCallbackMiddlewareFunc
 	post []NativeCallbackMiddlewareFunc
 
+	// preCondition and postCondition are the compiled rule conditions of the
+	// pre and post callbacks, nil when they always hold.
+	preCondition  ruleCondition
+	postCondition ruleCondition
+
+	// sampler is the rule sampler, nil when the rule is always executed.
+	sampler *ruleSampler
+
+	// breaker is the circuit breaker of the rule, nil when disabled.
+	breaker *circuitBreaker
+
+	// health is the health monitor of the rulespack, nil when it is not watched
+	// for an automatic rollback.
+	health *rulespackHealth
+
+	// wafExclusions are the local exclusions of the in-app WAF rules.
+	wafExclusions []callback.WAFExclusion
+
+	// phase is the request phase of the rule, which is the name of its
+	// hookpoint function.
+	phase string
+	// wafSkipsStore is the metrics store of the skipped in-app WAF executions.
+	wafSkipsStore *metrics.TimeHistogram
+
 	metricsEngine       *metrics.Engine
 	metricsStores       map[string]*metrics.TimeHistogram
 	defaultMetricsStore *metrics.TimeHistogram
@@ -67,7 +95,31 @@ type (
 	NativeCallbackMiddlewareFunc = func(cb NativeCallbackFunc) NativeCallbackFunc
 )
 
-func newNativeRuleContext(rule *api.Rule, rulepackID string, metricsEngine *metrics.Engine, logger plog.DebugLevelLogger, perfHistogramUnit, perfHistogramBase float64, perfHistogramPeriod time.Duration) (*nativeRuleContext, error) {
+// nativeRuleContextOptions are the options of the rule contexts, shared by the
+// rules of a rulespack.
+type nativeRuleContextOptions struct {
+	rulepackID string
+	// shadow is the shadow mode of the rules when non-nil.
+	shadow *shadowMode
+	// health is the health monitor of the rulespack when non-nil.
+	health         *rulespackHealth
+	circuitBreaker CircuitBreakerConfig
+	// circuitBreakerChanges is signaled by the circuit breakers when the
+	// callbacks must be detached from or attached back to their hook.
+	circuitBreakerChanges                chan<- struct{}
+	metricsEngine                        *metrics.Engine
+	logger                               plog.DebugLevelLogger
+	perfHistogramUnit, perfHistogramBase float64
+	perfHistogramPeriod                  time.Duration
+}
+
+func newNativeRuleContext(rule *api.Rule, opts nativeRuleContextOptions) (*nativeRuleContext, error) {
+	var (
+		shadow        = opts.shadow
+		metricsEngine = opts.metricsEngine
+		logger        = opts.logger
+	)
+
 	var (
 		metricsStores       map[string]*metrics.TimeHistogram
 		defaultMetricsStore *metrics.TimeHistogram
@@ -75,24 +127,57 @@ func newNativeRuleContext(rule *api.Rule, rulepackID string, metricsEngine *metr
 	if len(rule.Metrics) > 0 {
 		metricsStores = make(map[string]*metrics.TimeHistogram)
 		for _, m := range rule.Metrics {
-			metricsStores[m.Name] = metricsEngine.TimeHistogram(m.Name, time.Second*time.Duration(m.Period), 10000)
+			metricsStores[m.Name] = metricsEngine.TimeHistogram(shadow.metricsName(m.Name), time.Second*time.Duration(m.Period), 10000)
 		}
 		defaultMetricsStore = metricsStores[rule.Metrics[0].Name]
 	}
 
+	preCondition, err := compileRuleCondition(rule.Conditions.Pre)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "pre condition")
+	}
+	postCondition, err := compileRuleCondition(rule.Conditions.Post)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "post condition")
+	}
+
+	sampler, err := newRuleSampler(rule.Name, rule.Sampling, logger)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "sampling")
+	}
+	if sampler != nil && rule.Block && !rule.Test {
+		logger.Debugf("security rules: rule `%s`: ignoring the sampling of the rule in blocking mode", rule.Name)
+		sampler = nil
+	}
+
+	// Blocking rules are never disabled by a circuit breaker, whose failures
+	// could otherwise be triggered on purpose.
+	var breaker *circuitBreaker
+	if !rule.Block {
+		breaker = newCircuitBreaker(rule.Name, opts.circuitBreaker, opts.circuitBreakerChanges, logger)
+	}
+
 	r := &nativeRuleContext{
 		name:                rule.Name,
 		testMode:            rule.Test,
 		blockingMode:        rule.Block,
 		attackType:          rule.AttackType,
-		rulepackID:          rulepackID,
+		rulepackID:          opts.rulepackID,
+		shadow:              shadow,
 		logger:              plog.WithStrictBackoff(logger),
 		metricsEngine:       metricsEngine,
 		metricsStores:       metricsStores,
 		defaultMetricsStore: defaultMetricsStore,
-		perfHistogramPeriod: perfHistogramPeriod,
-		perfHistogramUnit:   perfHistogramUnit,
-		perfHistogramBase:   perfHistogramBase,
+		preCondition:        preCondition,
+		postCondition:       postCondition,
+		sampler:             sampler,
+		breaker:             breaker,
+		health:              opts.health,
+		phase:               hookpointPhase(rule.Hookpoint.Method),
+		wafSkipsStore:       metricsEngine.TimeHistogram(shadow.metricsName("waf_skips"), opts.perfHistogramPeriod, 1000),
+		perfHistogramPeriod: opts.perfHistogramPeriod,
+		perfHistogramUnit:   opts.perfHistogramUnit,
+		perfHistogramBase:   opts.perfHistogramBase,
 	}
 
 	r.buildMiddlewares()
@@ -110,7 +195,10 @@ type (
 	}
 )
 
-func withPerformanceCap(rule string, overBudgetHistogram timeHistogram) NativeCallbackMiddlewareFunc {
+// withPerformanceCap returns the callback middleware skipping the callback when
+// the time budget of the request is exhausted. Shadow rules are capped by their
+// own budget when non-nil (cf. shadowMode.deadlineExceeded()).
+func withPerformanceCap(rule string, overBudgetHistogram timeHistogram, health *rulespackHealth, shadow *shadowMode) NativeCallbackMiddlewareFunc {
 	var (
 		before = rule + "/before"
 		after  = rule + "/after"
@@ -118,26 +206,27 @@ func withPerformanceCap(rule string, overBudgetHistogram timeHistogram) NativeCa
 
 	return func(cb NativeCallbackFunc) NativeCallbackFunc {
 		return func(c callback.CallbackContext) error {
-			p := c.ProtectionContext()
-
 			// Check if the sqreen time deadline is exceeded before calling the
 			// callback
-			if p.DeadlineExceeded(0) {
+			if shadow.deadlineExceeded(c) {
 				if err := overBudgetHistogram.Add(before, 1); err != nil {
 					type errKey struct{}
 					c.Logger().Error(sqerrors.WithKey(err, errKey{}))
 				}
+				health.addOverBudget()
+				callback.TraceValue(c, "over budget", true)
 				return nil
 			}
 
 			// Check if the sqreen time deadline is exceeded after calling the
 			// callback
 			defer func() {
-				if p.DeadlineExceeded(0) {
+				if shadow.deadlineExceeded(c) {
 					if err := overBudgetHistogram.Add(after, 1); err != nil {
 						type errKey struct{}
 						c.Logger().Error(sqerrors.WithKey(err, errKey{}))
 					}
+					health.addOverBudget()
 				}
 			}()
 
@@ -146,10 +235,14 @@ func withPerformanceCap(rule string, overBudgetHistogram timeHistogram) NativeCa
 	}
 }
 
-func withPerformanceMonitoring(perfHistogram performanceHistogram) NativeCallbackMiddlewareFunc {
+// withPerformanceMonitoring returns the callback middleware measuring the
+// execution time of the callback, charged to the request time budget. Shadow
+// rules are charged to their own budget when non-nil (cf.
+// shadowMode.sqreenTime()).
+func withPerformanceMonitoring(perfHistogram performanceHistogram, shadow *shadowMode) NativeCallbackMiddlewareFunc {
 	return func(cb NativeCallbackFunc) NativeCallbackFunc {
 		return func(c callback.CallbackContext) error {
-			sq := c.ProtectionContext().SqreenTime()
+			sq := shadow.sqreenTime(c)
 			sw := sq.Start()
 			defer func() {
 				duration := sw.Stop()
@@ -190,76 +283,183 @@ func withCallCount(rulepackID, rule, cb string, store timeHistogram) NativeCallb
 }
 
 func (r *nativeRuleContext) Pre(pre NativeCallbackFunc) {
-	r.call(pre, r.pre)
+	r.call("pre", pre, r.pre)
 }
 
 func (r *nativeRuleContext) Post(post func(c callback.CallbackContext) error) {
-	r.call(post, r.post)
+	r.call("post", post, r.post)
 }
 
-func (r *nativeRuleContext) call(cb NativeCallbackFunc, m []NativeCallbackMiddlewareFunc) {
+func (r *nativeRuleContext) call(name string, cb NativeCallbackFunc, m []NativeCallbackMiddlewareFunc) {
 	c, ok := makeCallbackContext(r)
 	if !ok {
 		return
 	}
-	cb = wrapCallback(cb, m)
+	if entry := startTraceEntry(c.p, r.name, name); entry != nil {
+		cb = wrapTracedCallback(cb, m, entry)
+	} else {
+		cb = wrapCallback(cb, m)
+	}
 	if err := cb(c); err != nil {
+		if callback.IsOverBudgetError(err) {
+			r.health.addOverBudget()
+		} else {
+			r.health.addError()
+		}
 		// TODO: add rule info
 		r.logger.Error(err)
 	}
 }
 
+// tracedProtectionContext is the interface of the protection contexts
+// possibly tracing the execution of the rule callbacks.
+type tracedProtectionContext interface {
+	Trace() *event.Trace
+}
+
+// startTraceEntry returns a new trace entry of the given rule callback when the
+// protection context is traced, nil otherwise.
+func startTraceEntry(p ProtectionContext, rule, cb string) *event.TraceEntry {
+	traced, ok := p.(tracedProtectionContext)
+	if !ok {
+		return nil
+	}
+	trace := traced.Trace()
+	if trace == nil {
+		return nil
+	}
+	return trace.Start(rule, cb)
+}
+
 func (r *nativeRuleContext) SetCritical(critical bool) {
 	r.critical = critical
 	r.buildMiddlewares()
 }
 
+// Name returns the name of the rule.
+func (r *nativeRuleContext) Name() string {
+	return r.name
+}
+
+// RulespackID returns the ID of the rulespack the rule belongs to.
+func (r *nativeRuleContext) RulespackID() string {
+	return r.rulepackID
+}
+
+// WAFExclusions returns the local exclusions of the in-app WAF rules.
+func (r *nativeRuleContext) WAFExclusions() []callback.WAFExclusion {
+	return r.wafExclusions
+}
+
+// Phase returns the request phase of the rule, which is the name of its
+// hookpoint function, such as `bodyWAF` for the request body WAF.
+func (r *nativeRuleContext) Phase() string {
+	return r.phase
+}
+
+// AddWAFSkip adds a skipped in-app WAF execution of the rule to the WAF skips
+// metrics, per rule, request phase and skip reason.
+func (r *nativeRuleContext) AddWAFSkip(reason string) {
+	if err := r.wafSkipsStore.Add(r.name+"/"+r.phase+"/"+reason, 1); err != nil {
+		type errKey struct{}
+		r.logger.Error(sqerrors.WithKey(err, errKey{}))
+	}
+}
+
+// hookpointPhase returns the function name of the given hookpoint symbol, such
+// as `bodyWAF` for `github.com/sqreen/go-agent/internal/protection/http.(*ProtectionContext).bodyWAF`.
+func hookpointPhase(symbol string) string {
+	if i := strings.LastIndexByte(symbol, '.'); i >= 0 {
+		return symbol[i+1:]
+	}
+	return symbol
+}
+
 func (r *nativeRuleContext) buildMiddlewares() {
 	r.buildPreMiddlewares()
 	r.buildPostMiddlewares()
 }
 
 func (r *nativeRuleContext) buildPreMiddlewares() {
-	perfHist, err := r.metricsEngine.PerfHistogram("sq."+r.name+".pre", r.perfHistogramUnit, r.perfHistogramBase, r.perfHistogramPeriod)
+	perfHist, err := r.metricsEngine.PerfHistogram(r.shadow.metricsName("sq."+r.name+".pre"), r.perfHistogramUnit, r.perfHistogramBase, r.perfHistogramPeriod)
 	if err != nil {
 		r.logger.Error(sqerrors.Wrap(err, "could not create the performance metrics for the pre callback"))
 	}
 
 	var overBudgetHist *metrics.TimeHistogram
 	if !r.critical {
-		overBudgetHist = r.metricsEngine.TimeHistogram("request_overbudget_cb", r.perfHistogramPeriod, 1000)
+		overBudgetHist = r.metricsEngine.TimeHistogram(r.shadow.metricsName("request_overbudget_cb"), r.perfHistogramPeriod, 1000)
 	}
 
 	callCountHist := r.metricsEngine.TimeHistogram("sqreen_call_counts", r.perfHistogramPeriod, 1000)
 
-	r.pre = buildMiddlewares(r, "pre", overBudgetHist, perfHist, callCountHist)
+	samplingHist := r.samplingHistogram()
+
+	r.pre = buildMiddlewares(r, "pre", samplingHist, overBudgetHist, perfHist, r.preCondition, callCountHist)
 }
 
 func (r *nativeRuleContext) buildPostMiddlewares() {
-	perfHist, err := r.metricsEngine.PerfHistogram("sq."+r.name+".post", r.perfHistogramUnit, r.perfHistogramBase, r.perfHistogramPeriod)
+	perfHist, err := r.metricsEngine.PerfHistogram(r.shadow.metricsName("sq."+r.name+".post"), r.perfHistogramUnit, r.perfHistogramBase, r.perfHistogramPeriod)
 	if err != nil {
 		r.logger.Error(sqerrors.Wrap(err, "could not create the performance metrics for the pre callback"))
 	}
 
 	var overBudgetHist *metrics.TimeHistogram
 	if r.critical {
-		overBudgetHist = r.metricsEngine.TimeHistogram("request_overbudget_cb", r.perfHistogramPeriod, 1000)
+		overBudgetHist = r.metricsEngine.TimeHistogram(r.shadow.metricsName("request_overbudget_cb"), r.perfHistogramPeriod, 1000)
 	}
 
 	callCountHist := r.metricsEngine.TimeHistogram("sqreen_call_counts", r.perfHistogramPeriod, 1000)
 
-	r.post = buildMiddlewares(r, "post", overBudgetHist, perfHist, callCountHist)
+	samplingHist := r.samplingHistogram()
+
+	r.post = buildMiddlewares(r, "post", samplingHist, overBudgetHist, perfHist, r.postCondition, callCountHist)
 }
 
-func buildMiddlewares(r *nativeRuleContext, cb string, overBudgetHist *metrics.TimeHistogram, perfHist *metrics.PerfHistogram, callCountHist *metrics.TimeHistogram) (m []NativeCallbackMiddlewareFunc) {
+// samplingHistogram returns the metrics store of the sampling decisions, nil
+// when the rule is not sampled. Critical rules, such as security responses, are
+// never sampled as they are required by the protection.
+func (r *nativeRuleContext) samplingHistogram() *metrics.TimeHistogram {
+	if r.sampler == nil || r.critical {
+		return nil
+	}
+	return r.metricsEngine.TimeHistogram("rule_sampling", r.perfHistogramPeriod, 1000)
+}
+
+func buildMiddlewares(r *nativeRuleContext, cb string, samplingHist, overBudgetHist *metrics.TimeHistogram, perfHist *metrics.PerfHistogram, cond ruleCondition, callCountHist *metrics.TimeHistogram) (m []NativeCallbackMiddlewareFunc) {
+	// Shadow rules are sampled first so that protection contexts out of the
+	// sample don't pay for them at all.
+	if r.shadow != nil && r.shadow.sampleRate < 1 {
+		m = append(m, withSampling(r.shadow.sampleRate))
+	}
+
+	// Rule sampling is also performed before the other middlewares so that
+	// skipped callbacks are not measured.
+	if samplingHist != nil {
+		m = append(m, withRuleSampling(r.rulepackID, r.name, cb, r.sampler, samplingHist))
+	}
+
+	// The circuit breaker is outside of the safe call in order to see the
+	// recovered panics. Critical rules are never disabled as they are required by
+	// the protection.
+	if r.breaker != nil && !r.critical {
+		m = append(m, withCircuitBreaker(r.breaker))
+	}
+
 	m = append(m, withSafeCall())
 
 	if overBudgetHist != nil {
-		m = append(m, withPerformanceCap(r.name, overBudgetHist))
+		m = append(m, withPerformanceCap(r.name, overBudgetHist, r.health, r.shadow))
 	}
 
 	if perfHist != nil {
-		m = append(m, withPerformanceMonitoring(perfHist))
+		m = append(m, withPerformanceMonitoring(perfHist, r.shadow))
+	}
+
+	// The condition is evaluated within the performance monitoring and cap, and
+	// only the callbacks actually called are counted.
+	if cond != nil {
+		m = append(m, withCondition(cond))
 	}
 
 	if callCountHist != nil {
@@ -276,6 +476,34 @@ func wrapCallback(cb NativeCallbackFunc, middlewares []NativeCallbackMiddlewareF
 	return cb
 }
 
+// wrapTracedCallback wraps the callback with its middlewares like
+// wrapCallback() while recording its execution in the given trace entry. The
+// callback context passed to the middlewares and the callback allows them to
+// add the values they see to the trace entry (cf. callback.TraceValue()).
+func wrapTracedCallback(cb NativeCallbackFunc, middlewares []NativeCallbackMiddlewareFunc, entry *event.TraceEntry) NativeCallbackFunc {
+	wrapped := wrapCallback(func(c callback.CallbackContext) error {
+		entry.Executed = true
+		return cb(c)
+	}, middlewares)
+	return func(c callback.CallbackContext) error {
+		err := wrapped(tracedCallbackContext{CallbackContext: c, entry: entry})
+		entry.Duration = time.Since(entry.Start)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		return err
+	}
+}
+
+type tracedCallbackContext struct {
+	callback.CallbackContext
+	entry *event.TraceEntry
+}
+
+func (c tracedCallbackContext) TraceValue(name string, v interface{}) {
+	c.entry.AddValue(name, v)
+}
+
 type (
 	callbackContext struct {
 		r *nativeRuleContext
@@ -325,6 +553,9 @@ func (c callbackContext) HandleAttack(shouldBlock bool, opts ...event.AttackEven
 		AttackType: c.r.attackType,
 		Timestamp:  time.Now(),
 	}
+	if c.r.shadow != nil {
+		attack.ShadowRulespackID = c.r.rulepackID
+	}
 
 	// Apply the attack options
 	for _, opt := range opts {
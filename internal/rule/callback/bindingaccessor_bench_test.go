@@ -0,0 +1,85 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback_test
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/binding-accessor"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/protection/http/types"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/stretchr/testify/require"
+)
+
+// benchRequestReader is a request reader without the overhead of mockups.
+type benchRequestReader struct {
+	types.RequestReader
+	headers   http.Header
+	url       *url.URL
+	queryForm url.Values
+	clientIP  net.IP
+}
+
+func (r benchRequestReader) Header(header string) *string {
+	v := r.headers.Get(header)
+	return &v
+}
+func (r benchRequestReader) Headers() http.Header          { return r.headers }
+func (r benchRequestReader) Method() string                { return "GET" }
+func (r benchRequestReader) URL() *url.URL                 { return r.url }
+func (r benchRequestReader) RequestURI() string            { return r.url.RequestURI() }
+func (r benchRequestReader) UserAgent() string             { return r.headers.Get("User-Agent") }
+func (r benchRequestReader) QueryForm() url.Values         { return r.queryForm }
+func (r benchRequestReader) PostForm() url.Values          { return nil }
+func (r benchRequestReader) ClientIP() net.IP              { return r.clientIP }
+func (r benchRequestReader) Params() types.RequestParamMap { return nil }
+
+func BenchmarkWAFBindingAccessor(b *testing.B) {
+	u, err := url.Parse("http://sqreen.com/admin?user=uid&password=pwd")
+	require.NoError(b, err)
+	rr := benchRequestReader{
+		headers:   http.Header{"User-Agent": []string{"sqreen"}},
+		url:       u,
+		queryForm: u.Query(),
+		clientIP:  net.IPv4(1, 2, 3, 4),
+	}
+
+	for _, bc := range []struct {
+		name string
+		expr string
+	}{
+		{name: "method", expr: `#.Request.Method`},
+		{name: "user agent", expr: `#.Request.UserAgent`},
+		{name: "client ip", expr: `#.Request.ClientIP`},
+		{name: "header", expr: `#.Request.Header('user-agent')`},
+		{name: "query form", expr: `#.Request.QueryForm['user']`},
+		{name: "request uri", expr: `#.Request.URL.RequestURI`},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := callback.WAFBindingAccessorContextType{
+				HTTPRequestBindingAccessorContext: callback.HTTPRequestBindingAccessorContext{
+					Request: http_protection.NewRequestBindingAccessorContext(rr),
+				},
+			}
+
+			ba, err := bindingaccessor.Compile(bc.expr)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				if _, err := ba(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -9,11 +9,17 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
+	"net"
+	"net/http"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sqreen/go-agent/internal/binding-accessor"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
 	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
 	"github.com/stretchr/testify/require"
 )
 
@@ -176,6 +182,248 @@ func TestBindingAccessor(t *testing.T) {
 				},
 			},
 
+			{
+				Name:         "String Library",
+				Capabilities: []string{"lib", "rule"},
+				NewContextArgs: NewContextArgs{
+					Values: struct {
+						StringValue string
+						IntValue    int
+					}{
+						StringValue: " a,b,c ",
+						IntValue:    1,
+					},
+				},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.String.Split(#.Rule.Data.Values.StringValue, ',')",
+						ExpectedValue: []string{" a", "b", "c "},
+					},
+					{
+						Expr:          "#.Lib.String.Split('', ',')",
+						ExpectedValue: []string{""},
+					},
+					{
+						Expr:          "#.Lib.String.Contains(#.Rule.Data.Values.StringValue, 'b,c')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.String.Contains(#.Rule.Data.Values.StringValue, 'd')",
+						ExpectedValue: false,
+					},
+					{
+						Expr:          "#.Lib.String.HasPrefix(#.Rule.Data.Values.StringValue, ' a')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.String.HasSuffix(#.Rule.Data.Values.StringValue, 'c')",
+						ExpectedValue: false,
+					},
+					{
+						Expr:          "#.Lib.String.Trim(#.Rule.Data.Values.StringValue, ' ac')",
+						ExpectedValue: ",b,",
+					},
+					{
+						Expr:          "#.Lib.String.TrimSpace(#.Rule.Data.Values.StringValue)",
+						ExpectedValue: "a,b,c",
+					},
+					{
+						Expr:          "#.Lib.String.ToUpper(#.Rule.Data.Values.StringValue) == ' A,B,C '",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.String.ToLower('A')",
+						ExpectedValue: "a",
+					},
+					{
+						Expr:          "#.Lib.String.Contains(#.Rule.Data.Values.IntValue, 'a')",
+						ExpectedError: true,
+					},
+				},
+			},
+
+			{
+				Name:         "IP Library",
+				Capabilities: []string{"lib", "rule"},
+				NewContextArgs: NewContextArgs{
+					Values: struct {
+						IP      net.IP
+						IPv6    net.IP
+						Invalid int
+					}{
+						IP:      net.IPv4(192, 168, 1, 2),
+						IPv6:    net.ParseIP("2001:db8::1"),
+						Invalid: 33,
+					},
+				},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.IP.InCIDR(#.Rule.Data.Values.IP, '192.168.0.0/16')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.IP.InCIDR('10.1.2.3', '192.168.0.0/16')",
+						ExpectedValue: false,
+					},
+					{
+						Expr:          "#.Lib.IP.InCIDR(#.Rule.Data.Values.IPv6, '2001:db8::/32')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.IP.InCIDR(#.Rule.Data.Values.IP, 'oops')",
+						ExpectedError: true,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate(#.Rule.Data.Values.IP)",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate('127.0.0.1')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate('64.81.32.89')",
+						ExpectedValue: false,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate('::1')",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate('oops')",
+						ExpectedError: true,
+					},
+					{
+						Expr:          "#.Lib.IP.IsPrivate(#.Rule.Data.Values.Invalid)",
+						ExpectedError: true,
+					},
+					{
+						Expr:          "#.Lib.IP.Parse('1.2.3.4')",
+						ExpectedValue: net.IPv4(1, 2, 3, 4),
+					},
+				},
+			},
+
+			{
+				Name:         "URL Library",
+				Capabilities: []string{"lib"},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.URL.Parse('https://sqreen.com:443/a/b?c=d').Hostname",
+						ExpectedValue: "sqreen.com",
+					},
+					{
+						Expr:          "#.Lib.URL.Parse('https://sqreen.com:443/a/b?c=d').Path",
+						ExpectedValue: "/a/b",
+					},
+					{
+						Expr:          "#.Lib.URL.Parse('https://sqreen.com:443/a/b?c=d').Query['c']",
+						ExpectedValue: []string{"d"},
+					},
+					{
+						Expr:          "#.Lib.URL.Parse(':oops')",
+						ExpectedError: true,
+					},
+					{
+						Expr:          "#.Lib.URL.ParseQuery('a=1&a=2&b=3')['a']",
+						ExpectedValue: []string{"1", "2"},
+					},
+				},
+			},
+
+			{
+				Name:         "SQL Library",
+				Capabilities: []string{"lib"},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.SQL.Fingerprint('select * from t where id = 1', '')",
+						ExpectedValue: "Eoknkno1",
+					},
+					{
+						Expr:          `#.Lib.SQL.Fingerprint('select "id" from t', 'mysql')`,
+						ExpectedValue: "Eskn",
+					},
+					{
+						Expr:          `#.Lib.SQL.Fingerprint('select "id" from t', 'postgresql')`,
+						ExpectedValue: "Enkn",
+					},
+					{
+						Expr:          "#.Lib.SQL.Tokenize('select [id] from t', 'mssql')[1].Value",
+						ExpectedValue: "[id]",
+					},
+					{
+						Expr:          "#.Lib.SQL.Tokenize('select 1', 'oops')",
+						ExpectedError: true,
+					},
+				},
+			},
+
+			{
+				Name:         "Hash Library",
+				Capabilities: []string{"lib", "rule"},
+				NewContextArgs: NewContextArgs{
+					Values: struct {
+						Bytes   http_protection.RequestBodyBindingAccessorContext
+						Invalid int
+					}{
+						Bytes:   http_protection.RequestBodyBindingAccessorContext("sqreen"),
+						Invalid: 33,
+					},
+				},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.Hash.MD5('sqreen')",
+						ExpectedValue: "de7d7c41fd67f193d7bc00cade311cfa",
+					},
+					{
+						Expr:          "#.Lib.Hash.SHA1(#.Rule.Data.Values.Bytes)",
+						ExpectedValue: "414c6bbbdaa3d1082ab14bbdd537c8a1578f31af",
+					},
+					{
+						Expr:          "#.Lib.Hash.SHA256('')",
+						ExpectedValue: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+					},
+					{
+						Expr:          "#.Lib.Hash.SHA256(#.Rule.Data.Values.Invalid)",
+						ExpectedError: true,
+					},
+				},
+			},
+
+			{
+				Name:         "Time Library",
+				Capabilities: []string{"lib", "rule"},
+				NewContextArgs: NewContextArgs{
+					Values: struct {
+						Time time.Time
+					}{
+						Time: time.Date(2020, 10, 18, 0, 0, 0, 0, time.UTC),
+					},
+				},
+				TestCases: []TestCase{
+					{
+						Expr:          "#.Lib.Time.Parse('2006-01-02', '2020-10-18').Year",
+						ExpectedValue: 2020,
+					},
+					{
+						Expr:          "#.Lib.Time.Unix > 1600000000",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.Time.Since(#.Rule.Data.Values.Time) > 0",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.Time.Now.Year >= 2020",
+						ExpectedValue: true,
+					},
+					{
+						Expr:          "#.Lib.Time.Parse('2006-01-02', 'oops')",
+						ExpectedError: true,
+					},
+				},
+			},
+
 			{
 				Name:         "Result Caching",
 				Capabilities: []string{"cache", "rule"},
@@ -332,3 +580,45 @@ func (c *MyCachedValueType) F() (int, error) {
 	c.i += 1
 	return c.i, nil
 }
+
+func TestWAFBindingAccessorContext(t *testing.T) {
+	w := &http_protection_mockups.ResponseWriterMockup{}
+	w.ExpectHeader().Return(http.Header{"Content-Type": []string{"text/plain"}})
+	p := http_protection.NewTestProtectionContext(nil, nil, w, &http_protection_mockups.RequestReaderMockup{})
+
+	c := &mockups.CallbackContextMockup{}
+	c.ExpectProtectionContext().Return(p)
+
+	t.Run("without response body", func(t *testing.T) {
+		ctx, err := callback.MakeWAFCallbackBindingAccessorContext(c)
+		require.NoError(t, err)
+
+		ba, err := bindingaccessor.Compile("#.Response.Body.String")
+		require.NoError(t, err)
+		v, err := ba(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "", v)
+	})
+
+	t.Run("with response body", func(t *testing.T) {
+		body, err := p.InspectResponseBody([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), body)
+
+		ctx, err := callback.MakeWAFCallbackBindingAccessorContext(c)
+		require.NoError(t, err)
+
+		ba, err := bindingaccessor.Compile("#.Response.Body.String")
+		require.NoError(t, err)
+		v, err := ba(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "hello", v)
+
+		ba, err = bindingaccessor.Compile("#.Response.Header('Content-Type')")
+		require.NoError(t, err)
+		v, err = ba(ctx)
+		require.NoError(t, err)
+		ct := "text/plain"
+		require.Equal(t, &ct, v)
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/config"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqwaf"
+)
+
+// Bounds of the library functions whose results grow with their inputs.
+const (
+	// Maximum number of elements returned by `#.Lib.String.Split`. The last
+	// element is the unsplit remainder of the string.
+	maxLibSplitElements = 1024
+	// Maximum number of tokens returned by `#.Lib.SQL.Tokenize`.
+	maxLibSQLTokens = 1024
+)
+
+// StringLibraryBindingAccessorContextType is the `#.Lib.String` namespace of
+// string helpers.
+type StringLibraryBindingAccessorContextType struct{}
+
+// Split slices s into the substrings separated by sep.
+func (StringLibraryBindingAccessorContextType) Split(s, sep string) []string {
+	return strings.SplitN(s, sep, maxLibSplitElements)
+}
+
+// Contains returns true when substr is within s.
+func (StringLibraryBindingAccessorContextType) Contains(s, substr string) bool {
+	return strings.Contains(s, substr)
+}
+
+// HasPrefix returns true when s begins with prefix.
+func (StringLibraryBindingAccessorContextType) HasPrefix(s, prefix string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// HasSuffix returns true when s ends with suffix.
+func (StringLibraryBindingAccessorContextType) HasSuffix(s, suffix string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+// Trim returns s without the leading and trailing characters of cutset.
+func (StringLibraryBindingAccessorContextType) Trim(s, cutset string) string {
+	return strings.Trim(s, cutset)
+}
+
+// TrimSpace returns s without its leading and trailing whitespaces.
+func (StringLibraryBindingAccessorContextType) TrimSpace(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// ToLower returns s with all its letters mapped to their lower case.
+func (StringLibraryBindingAccessorContextType) ToLower(s string) string {
+	return strings.ToLower(s)
+}
+
+// ToUpper returns s with all its letters mapped to their upper case.
+func (StringLibraryBindingAccessorContextType) ToUpper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// IPLibraryBindingAccessorContextType is the `#.Lib.IP` namespace of IP
+// address helpers. IP addresses can be given either as `net.IP` values, such
+// as `#.Request.ClientIP`, or as strings.
+type IPLibraryBindingAccessorContextType struct{}
+
+// Parse returns the IP address of the given value.
+func (IPLibraryBindingAccessorContextType) Parse(ip interface{}) (net.IP, error) {
+	return libIP(ip)
+}
+
+// InCIDR returns true when the IP address belongs to the network of the given
+// CIDR notation, such as `192.168.0.0/16`.
+func (IPLibraryBindingAccessorContextType) InCIDR(ip interface{}, cidr string) (bool, error) {
+	addr, err := libIP(ip)
+	if err != nil {
+		return false, err
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false, sqerrors.Wrapf(err, "could not parse the cidr `%s`", cidr)
+	}
+	return network.Contains(addr), nil
+}
+
+// IsPrivate returns true when the IP address belongs to a private or reserved
+// network, such as `10.0.0.0/8` or the loopback addresses.
+func (IPLibraryBindingAccessorContextType) IsPrivate(ip interface{}) (bool, error) {
+	addr, err := libIP(ip)
+	if err != nil {
+		return false, err
+	}
+	networks := config.IPv6PrivateNetworks
+	if ipv4 := addr.To4(); ipv4 != nil {
+		addr = ipv4
+		networks = config.IPv4PrivateNetworks
+	}
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func libIP(v interface{}) (net.IP, error) {
+	switch actual := v.(type) {
+	case net.IP:
+		if actual == nil {
+			return nil, sqerrors.New("unexpected nil ip address")
+		}
+		return actual, nil
+	case string:
+		ip := net.ParseIP(actual)
+		if ip == nil {
+			return nil, sqerrors.Errorf("could not parse the ip address `%s`", actual)
+		}
+		return ip, nil
+	default:
+		return nil, sqerrors.Errorf("unexpected ip address type `%T`", v)
+	}
+}
+
+// URLLibraryBindingAccessorContextType is the `#.Lib.URL` namespace of URL
+// helpers.
+type URLLibraryBindingAccessorContextType struct{}
+
+// Parse parses the URL so that its parts can be accessed, such as
+// `#.Lib.URL.Parse(#.Rule.Data.Values.url).Hostname`.
+func (URLLibraryBindingAccessorContextType) Parse(rawurl string) (*url.URL, error) {
+	return url.Parse(rawurl)
+}
+
+// ParseQuery parses the URL-encoded query string into its values.
+func (URLLibraryBindingAccessorContextType) ParseQuery(query string) (url.Values, error) {
+	return url.ParseQuery(query)
+}
+
+// SQLLibraryBindingAccessorContextType is the `#.Lib.SQL` namespace of SQL
+// helpers. The SQL dialect of a database connection can be detected with
+// `#.SQL.Dialect` of the `sql` capability.
+type SQLLibraryBindingAccessorContextType struct{}
+
+// Tokenize returns the tokens of the SQL query according to the syntax of the
+// given SQL dialect: `mysql`, `postgresql`, `sqlite`, `mssql` or the empty
+// string for a generic SQL dialect.
+func (SQLLibraryBindingAccessorContextType) Tokenize(query, dialect string) ([]sqwaf.SQLToken, error) {
+	return sqwaf.TokenizeSQL(query, dialect, maxLibSQLTokens)
+}
+
+// Fingerprint returns the token types of the SQL query, such as `Eoknkno1` for
+// `select * from t where id = 1`, according to the syntax of the given SQL
+// dialect.
+func (SQLLibraryBindingAccessorContextType) Fingerprint(query, dialect string) (string, error) {
+	tokens, err := sqwaf.TokenizeSQL(query, dialect, maxLibSQLTokens)
+	if err != nil {
+		return "", err
+	}
+	var fingerprint strings.Builder
+	for _, tok := range tokens {
+		fingerprint.WriteString(tok.Type)
+	}
+	return fingerprint.String(), nil
+}
+
+// HashLibraryBindingAccessorContextType is the `#.Lib.Hash` namespace of
+// hashing functions returning hexadecimal digests. They accept strings and byte
+// slices, such as `#.Request.Body`.
+type HashLibraryBindingAccessorContextType struct{}
+
+// MD5 returns the MD5 digest of the value.
+func (HashLibraryBindingAccessorContextType) MD5(v interface{}) (string, error) {
+	return libHash(md5.New(), v)
+}
+
+// SHA1 returns the SHA-1 digest of the value.
+func (HashLibraryBindingAccessorContextType) SHA1(v interface{}) (string, error) {
+	return libHash(sha1.New(), v)
+}
+
+// SHA256 returns the SHA-256 digest of the value.
+func (HashLibraryBindingAccessorContextType) SHA256(v interface{}) (string, error) {
+	return libHash(sha256.New(), v)
+}
+
+func libHash(h hash.Hash, v interface{}) (string, error) {
+	switch actual := v.(type) {
+	case string:
+		_, _ = h.Write([]byte(actual))
+	case []byte:
+		_, _ = h.Write(actual)
+	default:
+		// Types defined from strings or byte slices
+		rv := reflect.ValueOf(v)
+		switch {
+		case rv.Kind() == reflect.String:
+			_, _ = h.Write([]byte(rv.String()))
+		case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+			_, _ = h.Write(rv.Bytes())
+		default:
+			return "", sqerrors.Errorf("unexpected value type `%T` to hash", v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TimeLibraryBindingAccessorContextType is the `#.Lib.Time` namespace of time
+// functions.
+type TimeLibraryBindingAccessorContextType struct{}
+
+// Now returns the current time.
+func (TimeLibraryBindingAccessorContextType) Now() time.Time {
+	return time.Now()
+}
+
+// Unix returns the current time as a number of seconds elapsed since January
+// 1, 1970 UTC.
+func (TimeLibraryBindingAccessorContextType) Unix() int64 {
+	return time.Now().Unix()
+}
+
+// Since returns the time elapsed since t.
+func (TimeLibraryBindingAccessorContextType) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// Parse parses the time value according to the layout, as defined by Go's
+// time.Parse(), such as `2006-01-02T15:04:05Z07:00`.
+func (TimeLibraryBindingAccessorContextType) Parse(layout, value string) (time.Time, error) {
+	return time.Parse(layout, value)
+}
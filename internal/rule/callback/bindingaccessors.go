@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"strings"
 
+	"github.com/sqreen/go-agent/internal/binding-accessor"
 	http_protection "github.com/sqreen/go-agent/internal/protection/http"
 	http_protection_types "github.com/sqreen/go-agent/internal/protection/http/types"
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
@@ -147,22 +148,65 @@ type BindingAccessorContextType struct {
 
 type WAFBindingAccessorContextType struct {
 	HTTPRequestBindingAccessorContext
+	HTTPResponseBindingAccessorContext
+	HTTPWebSocketBindingAccessorContext
 	BindingAccessorResultCache
 }
 
+// Fast paths of the binding accessor context fields, avoiding the cost of their
+// reflect-based access.
+func init() {
+	bindingaccessor.RegisterFieldFunc((*BindingAccessorContextType)(nil), "Request", func(v interface{}) (interface{}, error) {
+		ctx := v.(*BindingAccessorContextType)
+		if ctx.HTTPRequestBindingAccessorContext == nil {
+			return nil, sqerrors.New("unexpected access to the request of a binding accessor context without the `request` capability")
+		}
+		return ctx.Request, nil
+	})
+	bindingaccessor.RegisterFieldFunc((*BindingAccessorContextType)(nil), "Func", func(v interface{}) (interface{}, error) {
+		return v.(*BindingAccessorContextType).Func, nil
+	})
+	bindingaccessor.RegisterFieldFunc((*BindingAccessorContextType)(nil), "Rule", func(v interface{}) (interface{}, error) {
+		return v.(*BindingAccessorContextType).Rule, nil
+	})
+	bindingaccessor.RegisterFieldFunc((*HTTPRequestBindingAccessorContext)(nil), "Request", func(v interface{}) (interface{}, error) {
+		return v.(*HTTPRequestBindingAccessorContext).Request, nil
+	})
+	bindingaccessor.RegisterFieldFunc(WAFBindingAccessorContextType{}, "Request", func(v interface{}) (interface{}, error) {
+		return v.(WAFBindingAccessorContextType).Request, nil
+	})
+	bindingaccessor.RegisterFieldFunc(WAFBindingAccessorContextType{}, "Response", func(v interface{}) (interface{}, error) {
+		return v.(WAFBindingAccessorContextType).Response, nil
+	})
+	bindingaccessor.RegisterFieldFunc(WAFBindingAccessorContextType{}, "WebSocket", func(v interface{}) (interface{}, error) {
+		return v.(WAFBindingAccessorContextType).WebSocket, nil
+	})
+}
+
 func MakeWAFCallbackBindingAccessorContext(c CallbackContext) (WAFBindingAccessorContextType, error) {
 	switch protCtx := c.ProtectionContext().(type) {
 	case *http_protection.ProtectionContext:
-		return makeHTTPWAFCallbackBindingAccessorContext(protCtx.RequestReader), nil
+		return makeHTTPWAFCallbackBindingAccessorContext(protCtx), nil
+	case *http_protection.WebSocketProtectionContext:
+		return makeWebSocketWAFCallbackBindingAccessorContext(protCtx), nil
 	default:
 		return WAFBindingAccessorContextType{}, sqerrors.Errorf("unexpected protection context type `%T`", protCtx)
 	}
 }
 
-func makeHTTPWAFCallbackBindingAccessorContext(request http_protection_types.RequestReader) WAFBindingAccessorContextType {
+func makeHTTPWAFCallbackBindingAccessorContext(p *http_protection.ProtectionContext) WAFBindingAccessorContextType {
 	return WAFBindingAccessorContextType{
-		HTTPRequestBindingAccessorContext: MakeHTTPRequestBindingAccessorContext(request),
-		BindingAccessorResultCache:        MakeBindingAccessorResultCache(),
+		HTTPRequestBindingAccessorContext:  MakeHTTPRequestBindingAccessorContext(p.RequestReader),
+		HTTPResponseBindingAccessorContext: MakeHTTPResponseBindingAccessorContext(p),
+		BindingAccessorResultCache:         MakeBindingAccessorResultCache(),
+	}
+}
+
+func makeWebSocketWAFCallbackBindingAccessorContext(c *http_protection.WebSocketProtectionContext) WAFBindingAccessorContextType {
+	return WAFBindingAccessorContextType{
+		HTTPRequestBindingAccessorContext:   MakeHTTPRequestBindingAccessorContext(c.Request()),
+		HTTPWebSocketBindingAccessorContext: MakeHTTPWebSocketBindingAccessorContext(c),
+		BindingAccessorResultCache:          MakeBindingAccessorResultCache(),
 	}
 }
 
@@ -177,6 +221,14 @@ type HTTPRequestBindingAccessorContext struct {
 	Request *http_protection.RequestBindingAccessorContext
 }
 
+type HTTPResponseBindingAccessorContext struct {
+	Response *http_protection.ResponseBindingAccessorContext
+}
+
+type HTTPWebSocketBindingAccessorContext struct {
+	WebSocket *http_protection.WebSocketBindingAccessorContext
+}
+
 // BindingAccessorResultCache is a simple result cache. There is no result
 // invalidation here as this first iteration is about caching results per
 // call site, meaning that a new cache should be used every time a new
@@ -211,6 +263,9 @@ func NewRequestBindingAccessorContext(p ProtectionContext) (*HTTPRequestBindingA
 
 	case *http_protection.ProtectionContext:
 		return NewHTTPRequestBindingAccessorContext(actual.RequestReader), nil
+
+	case *http_protection.WebSocketProtectionContext:
+		return NewHTTPRequestBindingAccessorContext(actual.Request()), nil
 	}
 }
 
@@ -225,10 +280,39 @@ func MakeHTTPRequestBindingAccessorContext(request http_protection_types.Request
 	}
 }
 
-// Library of functions accessible to binding accessor expressions
+func MakeHTTPResponseBindingAccessorContext(p *http_protection.ProtectionContext) HTTPResponseBindingAccessorContext {
+	return HTTPResponseBindingAccessorContext{
+		Response: http_protection.NewResponseBindingAccessorContext(p),
+	}
+}
+
+func MakeHTTPWebSocketBindingAccessorContext(c *http_protection.WebSocketProtectionContext) HTTPWebSocketBindingAccessorContext {
+	return HTTPWebSocketBindingAccessorContext{
+		WebSocket: http_protection.NewWebSocketBindingAccessorContext(c),
+	}
+}
+
+// Library of functions accessible to binding accessor expressions of rules
+// having the `lib` capability, under the following namespaces:
+//   - `#.Lib.Array`: slice helpers.
+//   - `#.Lib.String`: string helpers, such as `Split`, `Contains` or `Trim`.
+//   - `#.Lib.IP`: IP address helpers, such as `InCIDR` or `IsPrivate`.
+//   - `#.Lib.URL`: URL parsing.
+//   - `#.Lib.SQL`: SQL dialect-aware tokenization.
+//   - `#.Lib.Hash`: MD5, SHA-1 and SHA-256 hashing.
+//   - `#.Lib.Time`: current time and time parsing.
+//
+// The library functions have no side effects and their cost is bounded by the
+// size of their arguments.
 type (
 	LibraryBindingAccessorContextType struct {
-		Array ArrayLibraryBindingAccessorContextType
+		Array  ArrayLibraryBindingAccessorContextType
+		String StringLibraryBindingAccessorContextType
+		IP     IPLibraryBindingAccessorContextType
+		URL    URLLibraryBindingAccessorContextType
+		SQL    SQLLibraryBindingAccessorContextType
+		Hash   HashLibraryBindingAccessorContextType
+		Time   TimeLibraryBindingAccessorContextType
 	}
 
 	ArrayLibraryBindingAccessorContextType struct{}
@@ -11,6 +11,7 @@ import (
 	"github.com/sqreen/go-agent/internal/event"
 	"github.com/sqreen/go-agent/internal/plog"
 	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+	"golang.org/x/xerrors"
 )
 
 type (
@@ -39,3 +40,68 @@ type Logger interface {
 	plog.DebugLogger
 	plog.ErrorLogger
 }
+
+// valueTracer is the interface of the callback contexts of traced requests.
+type valueTracer interface {
+	TraceValue(name string, v interface{})
+}
+
+// TraceValue adds the given value seen by the callback, such as a binding
+// accessor value, to the execution trace of the request when it is traced.
+func TraceValue(c CallbackContext, name string, v interface{}) {
+	if t, ok := c.(valueTracer); ok {
+		t.TraceValue(name, v)
+	}
+}
+
+// callbackStateStore is the interface of the protection contexts keeping the
+// callback states along the request phases.
+type callbackStateStore interface {
+	CallbackState(key interface{}, newState func() interface{}) interface{}
+}
+
+// CallbackState returns the request state of the given key, created using
+// newState the first time it is requested. A new state is returned every time
+// when the protection context doesn't keep callback states.
+func CallbackState(c CallbackContext, key interface{}, newState func() interface{}) interface{} {
+	if s, ok := c.ProtectionContext().(callbackStateStore); ok {
+		return s.CallbackState(key, newState)
+	}
+	return newState()
+}
+
+// overBudgetError is the error of the callback executions stopped because of
+// the performance budget, such as interrupted JS executions. They are not
+// failures of the callbacks themselves.
+type overBudgetError struct {
+	error
+}
+
+func (e overBudgetError) Unwrap() error { return e.error }
+
+// NewOverBudgetError returns the given callback error marked as caused by the
+// performance budget.
+func NewOverBudgetError(err error) error {
+	return overBudgetError{err}
+}
+
+// IsOverBudgetError returns true when the callback error was caused by the
+// performance budget.
+func IsOverBudgetError(err error) bool {
+	var e overBudgetError
+	return xerrors.As(err, &e)
+}
+
+// namedRule is the interface of the rule contexts knowing their rule name.
+type namedRule interface {
+	Name() string
+}
+
+// ruleName returns the name of the rule, or an empty string when the rule
+// context doesn't provide it.
+func ruleName(r RuleContext) string {
+	if n, ok := r.(namedRule); ok {
+		return n.Name()
+	}
+	return ""
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/sqlib/sqassert"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+)
+
+// NewFileUploadCallback returns the native prolog callback of the file upload
+// protection checking the files uploaded in multipart/form-data request
+// bodies against dangerous extensions, size limits and polyglot contents,
+// and calling the file upload scanner set by the application, if any.
+func NewFileUploadCallback(r RuleContext, cfg NativeCallbackConfig) (sqhook.PrologCallback, error) {
+	sqassert.NotNil(r)
+	sqassert.NotNil(cfg)
+
+	data, ok := cfg.Data().(*api.FileUploadRuleDataEntry)
+	if !ok {
+		return nil, sqerrors.Errorf("unexpected callback data type: got `%T` instead of `%T`", cfg.Data(), data)
+	}
+	if data.MaxSize < 0 {
+		return nil, sqerrors.Errorf("unexpected negative file upload max size %d", data.MaxSize)
+	}
+
+	limits := fileUploadLimits{
+		blockedExtensions: make(map[string]struct{}, len(data.BlockedExtensions)),
+		maxSize:           data.MaxSize,
+		blockPolyglots:    data.BlockPolyglots,
+	}
+	for _, ext := range data.BlockedExtensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || ext == "." {
+			return nil, sqerrors.Errorf("unexpected empty file extension in `%v`", data.BlockedExtensions)
+		}
+		if ext[0] != '.' {
+			ext = "." + ext
+		}
+		limits.blockedExtensions[ext] = struct{}{}
+	}
+
+	return newFileUploadPrologCallback(r, limits), nil
+}
+
+var ErrFileUploadProtection = errors.New("file upload protection triggered")
+
+const (
+	FileUploadDangerousExtensionReason = "dangerous_extension"
+	FileUploadMaxSizeReason            = "max_size"
+	FileUploadPolyglotReason           = "polyglot"
+	FileUploadScannerReason            = "scanner"
+)
+
+type FileUploadAttackInfo struct {
+	FieldName          string `json:"field_name"`
+	Filename           string `json:"filename"`
+	ContentType        string `json:"content_type,omitempty"`
+	SniffedContentType string `json:"sniffed_content_type"`
+	Size               int64  `json:"size"`
+	// Reason is the protection that got triggered.
+	Reason string `json:"reason"`
+	// Detail is the blocked extension, the polyglot description or the scanner
+	// error message.
+	Detail string `json:"detail,omitempty"`
+}
+
+type fileUploadLimits struct {
+	blockedExtensions map[string]struct{}
+	maxSize           int64
+	blockPolyglots    bool
+}
+
+func newFileUploadPrologCallback(r RuleContext, limits fileUploadLimits) http_protection.FileUploadPrologCallbackType {
+	return func(p **http_protection.ProtectionContext, f **http_protection.FileUpload) (epilog http_protection.BlockingEpilogCallbackType, prologErr error) {
+		r.Pre(func(c CallbackContext) error {
+			block := func(info FileUploadAttackInfo) bool {
+				if blocked := c.HandleAttack(true, event.WithAttackInfo(info)); blocked {
+					// Return the epilog and abort the call.
+					epilog = func(err *error) {
+						*err = sdk_types.SqreenError{Err: ErrFileUploadProtection}
+					}
+					prologErr = sqhook.AbortError
+					return true
+				}
+				return false
+			}
+
+			for _, info := range checkFileUpload(*f, limits) {
+				if block(info) {
+					return nil
+				}
+			}
+
+			// The scanner is called last as it can be expensive and useless when the
+			// file was already blocked.
+			if scanner := http_protection.FileUploadScanner(); scanner != nil {
+				if err := scanner.ScanFileUpload(fileUploadContext(p), &(*f).FileUpload, (*f).Content()); err != nil {
+					block(newFileUploadAttackInfo(*f, FileUploadScannerReason, err.Error()))
+				}
+			}
+			return nil
+		})
+		return
+	}
+}
+
+// fileUploadContext returns the request context of the protection context,
+// or the background context when there is none.
+func fileUploadContext(p **http_protection.ProtectionContext) context.Context {
+	if p == nil || *p == nil || (*p).RootProtectionContext == nil {
+		return context.Background()
+	}
+	return (*p).Context()
+}
+
+func newFileUploadAttackInfo(f *http_protection.FileUpload, reason, detail string) FileUploadAttackInfo {
+	return FileUploadAttackInfo{
+		FieldName:          f.FieldName,
+		Filename:           f.Filename,
+		ContentType:        f.ContentType,
+		SniffedContentType: f.SniffedContentType,
+		Size:               f.Size,
+		Reason:             reason,
+		Detail:             detail,
+	}
+}
+
+// checkFileUpload returns the attack info of every limit the uploaded file
+// exceeds.
+func checkFileUpload(f *http_protection.FileUpload, limits fileUploadLimits) (attacks []FileUploadAttackInfo) {
+	for _, ext := range fileUploadExtensions(f.Filename) {
+		if _, blocked := limits.blockedExtensions[ext]; blocked {
+			attacks = append(attacks, newFileUploadAttackInfo(f, FileUploadDangerousExtensionReason, ext))
+			break
+		}
+	}
+
+	if limits.maxSize > 0 && f.Size > limits.maxSize {
+		attacks = append(attacks, newFileUploadAttackInfo(f, FileUploadMaxSizeReason, fmt.Sprintf("%d bytes > %d bytes", f.Size, limits.maxSize)))
+	}
+
+	if limits.blockPolyglots {
+		if detail, polyglot := detectPolyglotFileUpload(f); polyglot {
+			attacks = append(attacks, newFileUploadAttackInfo(f, FileUploadPolyglotReason, detail))
+		}
+	}
+
+	return attacks
+}
+
+// fileUploadExtensions returns every lowercase extension of the file name,
+// so that double extensions such as `shell.php.jpg` can be detected. The
+// client path is removed, and trailing dots and spaces are ignored as they
+// are by Windows.
+func fileUploadExtensions(filename string) []string {
+	if i := strings.LastIndexAny(filename, `/\`); i != -1 {
+		filename = filename[i+1:]
+	}
+	filename = strings.TrimRight(filename, ". ")
+	parts := strings.Split(strings.ToLower(filename), ".")
+	exts := make([]string, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		exts = append(exts, "."+strings.TrimSpace(part))
+	}
+	return exts
+}
+
+// fileUploadScriptMarkers are the lowercase markers of server and client-side
+// scripts that are not expected in the content of binary files.
+var fileUploadScriptMarkers = [][]byte{
+	[]byte("<?php"),
+	[]byte("<?="),
+	[]byte("<%"),
+	[]byte("<script"),
+}
+
+// detectPolyglotFileUpload returns true along with its description when the
+// file content is not what it claims to be: either a binary file embedding
+// scripts in its content prefix, or a markup file disguised as a binary file
+// by its declared content type or extension.
+func detectPolyglotFileUpload(f *http_protection.FileUpload) (detail string, polyglot bool) {
+	sniffed := baseMediaType(f.SniffedContentType)
+
+	if isBinaryMediaType(sniffed) {
+		prefix := bytes.ToLower(f.Prefix)
+		for _, marker := range fileUploadScriptMarkers {
+			if bytes.Contains(prefix, marker) {
+				return fmt.Sprintf("%s embedding `%s`", sniffed, marker), true
+			}
+		}
+		return "", false
+	}
+
+	if sniffed == "text/html" || sniffed == "text/xml" {
+		claimed := baseMediaType(f.ContentType)
+		if claimed == "" || claimed == "application/octet-stream" {
+			claimed = baseMediaType(mime.TypeByExtension(path.Ext(strings.ToLower(f.Filename))))
+		}
+		if isBinaryMediaType(claimed) {
+			return fmt.Sprintf("%s disguised as %s", sniffed, claimed), true
+		}
+	}
+
+	return "", false
+}
+
+func baseMediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// isBinaryMediaType returns true for the media types of binary formats, which
+// are not expected to contain scripts. XML-based formats such as SVG are
+// therefore not considered binary.
+func isBinaryMediaType(mt string) bool {
+	switch {
+	case mt == "", mt == "application/octet-stream":
+		return false
+	case strings.HasPrefix(mt, "text/"), strings.Contains(mt, "xml"), strings.Contains(mt, "json"), strings.Contains(mt, "javascript"):
+		return false
+	default:
+		return true
+	}
+}
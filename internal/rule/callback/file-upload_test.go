@@ -0,0 +1,204 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestFileUploadCallback(t *testing.T) {
+	newFileUpload := func(filename, contentType, content string) *http_protection.FileUpload {
+		return http_protection.NewTestFileUpload("file", filename, contentType, []byte(content))
+	}
+
+	t.Run("configuration", func(t *testing.T) {
+		for _, tc := range []struct {
+			name        string
+			data        interface{}
+			expectedErr bool
+		}{
+			{name: "limits", data: &api.FileUploadRuleDataEntry{BlockedExtensions: []string{".php", "JSP"}, MaxSize: 1024, BlockPolyglots: true}},
+			{name: "no data", data: nil, expectedErr: true},
+			{name: "bad data type", data: 33, expectedErr: true},
+			{name: "negative max size", data: &api.FileUploadRuleDataEntry{MaxSize: -1}, expectedErr: true},
+			{name: "empty extension", data: &api.FileUploadRuleDataEntry{BlockedExtensions: []string{"."}}, expectedErr: true},
+		} {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				cfg := &mockups.NativeCallbackConfigMockup{}
+				cfg.ExpectData().Return(tc.data)
+
+				cb, err := callback.NewFileUploadCallback(&mockups.NativeRuleContextMockup{}, cfg)
+				if tc.expectedErr {
+					require.Error(t, err)
+					require.Nil(t, cb)
+					return
+				}
+				require.NoError(t, err)
+				_, ok := cb.(http_protection.FileUploadPrologCallbackType)
+				require.True(t, ok)
+			})
+		}
+	})
+
+	limits := &api.FileUploadRuleDataEntry{
+		BlockedExtensions: []string{"php", ".JSP"},
+		MaxSize:           64,
+		BlockPolyglots:    true,
+	}
+	gif := "GIF89a\x01\x00\x01\x00"
+
+	for _, tc := range []struct {
+		name     string
+		upload   *http_protection.FileUpload
+		expected []callback.FileUploadAttackInfo
+	}{
+		{
+			name:   "image",
+			upload: newFileUpload("image.gif", "image/gif", gif),
+		},
+		{
+			name:   "svg image",
+			upload: newFileUpload("image.svg", "image/svg+xml", `<?xml version="1.0"?><svg></svg>`),
+		},
+		{
+			name:   "dangerous extension",
+			upload: newFileUpload(`C:\shell.PHP`, "application/x-php", "<?php"),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadDangerousExtensionReason, Detail: ".php"},
+			},
+		},
+		{
+			name:   "double extension",
+			upload: newFileUpload("shell.jsp.gif. ", "image/gif", gif),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadDangerousExtensionReason, Detail: ".jsp"},
+			},
+		},
+		{
+			name:   "too large",
+			upload: newFileUpload("image.gif", "image/gif", gif+string(make([]byte, 64))),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadMaxSizeReason, Detail: "74 bytes > 64 bytes"},
+			},
+		},
+		{
+			name:   "image embedding a script",
+			upload: newFileUpload("image.gif", "image/gif", gif+"<?PHP system($_GET['c']);"),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadPolyglotReason, Detail: "image/gif embedding `<?php`"},
+			},
+		},
+		{
+			name:   "html disguised as an image by its content type",
+			upload: newFileUpload("image", "image/png", "<html><script>alert(1)</script>"),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadPolyglotReason, Detail: "text/html disguised as image/png"},
+			},
+		},
+		{
+			name:   "html disguised as an image by its extension",
+			upload: newFileUpload("image.png", "application/octet-stream", "<html><script>alert(1)</script>"),
+			expected: []callback.FileUploadAttackInfo{
+				{Reason: callback.FileUploadPolyglotReason, Detail: "text/html disguised as image/png"},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &mockups.NativeCallbackConfigMockup{}
+			cfg.ExpectData().Return(limits)
+
+			var attacks []callback.FileUploadAttackInfo
+			r := &mockups.NativeRuleContextMockup{}
+			defer r.AssertExpectations(t)
+			r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+				c := &mockups.CallbackContextMockup{}
+				defer c.AssertExpectations(t)
+				if len(tc.expected) > 0 {
+					c.ExpectHandleAttack(true, mock.Anything).Run(func(args mock.Arguments) {
+						attack := &event.AttackEvent{}
+						for _, opt := range args.Get(1).([]event.AttackEventOption) {
+							opt(attack)
+						}
+						info := attack.Info.(callback.FileUploadAttackInfo)
+						require.Equal(t, tc.upload.Filename, info.Filename)
+						require.Equal(t, tc.upload.Size, info.Size)
+						attacks = append(attacks, callback.FileUploadAttackInfo{Reason: info.Reason, Detail: info.Detail})
+					}).Return(false).Times(len(tc.expected))
+				}
+				require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+			}).Once()
+
+			cb, err := callback.NewFileUploadCallback(r, cfg)
+			require.NoError(t, err)
+			prolog := cb.(http_protection.FileUploadPrologCallbackType)
+
+			epilog, err := prolog(nil, &tc.upload)
+			require.NoError(t, err)
+			require.Nil(t, epilog)
+			require.Equal(t, tc.expected, attacks)
+		})
+	}
+
+	t.Run("scanner", func(t *testing.T) {
+		defer http_protection.SetFileUploadScanner(nil)
+		http_protection.SetFileUploadScanner(sdk_types.FileUploadScannerFunc(func(ctx context.Context, upload *sdk_types.FileUpload, content io.Reader) error {
+			require.NotNil(t, ctx)
+			require.Equal(t, "eicar.txt", upload.Filename)
+			data, err := ioutil.ReadAll(content)
+			require.NoError(t, err)
+			require.Equal(t, "EICAR", string(data))
+			return errors.New("eicar test file")
+		}))
+
+		cfg := &mockups.NativeCallbackConfigMockup{}
+		cfg.ExpectData().Return(&api.FileUploadRuleDataEntry{})
+
+		r := &mockups.NativeRuleContextMockup{}
+		defer r.AssertExpectations(t)
+		r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+			c := &mockups.CallbackContextMockup{}
+			defer c.AssertExpectations(t)
+			c.ExpectHandleAttack(true, mock.Anything).Run(func(args mock.Arguments) {
+				attack := &event.AttackEvent{}
+				for _, opt := range args.Get(1).([]event.AttackEventOption) {
+					opt(attack)
+				}
+				info := attack.Info.(callback.FileUploadAttackInfo)
+				require.Equal(t, callback.FileUploadScannerReason, info.Reason)
+				require.Equal(t, "eicar test file", info.Detail)
+			}).Return(true).Once()
+			require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+		}).Once()
+
+		cb, err := callback.NewFileUploadCallback(r, cfg)
+		require.NoError(t, err)
+		prolog := cb.(http_protection.FileUploadPrologCallbackType)
+
+		upload := newFileUpload("eicar.txt", "text/plain", "EICAR")
+		epilog, err := prolog(nil, &upload)
+		require.Equal(t, sqhook.AbortError, err)
+		require.NotNil(t, epilog)
+
+		epilog(&err)
+		require.True(t, xerrors.As(err, &sdk_types.SqreenError{}))
+	})
+}
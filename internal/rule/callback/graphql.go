@@ -0,0 +1,117 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"errors"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/sqlib/sqassert"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqgraphql"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+)
+
+// NewGraphQLCallback returns the native prolog callback of the GraphQL
+// protection limiting the depth and complexity of GraphQL operations, and
+// optionally blocking introspection queries.
+func NewGraphQLCallback(r RuleContext, cfg NativeCallbackConfig) (sqhook.PrologCallback, error) {
+	sqassert.NotNil(r)
+	sqassert.NotNil(cfg)
+
+	data, ok := cfg.Data().(*api.GraphQLRuleDataEntry)
+	if !ok {
+		return nil, sqerrors.Errorf("unexpected callback data type: got `%T` instead of `%T`", cfg.Data(), data)
+	}
+	if data.MaxDepth < 0 || data.MaxComplexity < 0 {
+		return nil, sqerrors.Errorf("unexpected negative graphql limits: max depth %d, max complexity %d", data.MaxDepth, data.MaxComplexity)
+	}
+
+	limits := *data
+	if limits.MaxComplexity > sqgraphql.MaxWalkedSelections {
+		// Complexities above it cannot be computed.
+		limits.MaxComplexity = sqgraphql.MaxWalkedSelections
+	}
+	return newGraphQLPrologCallback(r, limits), nil
+}
+
+var ErrGraphQLProtection = errors.New("graphql protection triggered")
+
+const (
+	GraphQLIntrospectionReason = "introspection"
+	GraphQLMaxDepthReason      = "max_depth"
+	GraphQLMaxComplexityReason = "max_complexity"
+)
+
+type GraphQLAttackInfo struct {
+	OperationName string `json:"operation_name,omitempty"`
+	// Reason is the protection that got triggered.
+	Reason string `json:"reason"`
+	// Value and Limit are the depth or complexity of the operation, along with
+	// the configured limit that was exceeded.
+	Value int `json:"value,omitempty"`
+	Limit int `json:"limit,omitempty"`
+}
+
+func newGraphQLPrologCallback(r RuleContext, limits api.GraphQLRuleDataEntry) http_protection.GraphQLPrologCallbackType {
+	return func(_ **http_protection.ProtectionContext, gql **http_protection.GraphQLRequest) (epilog http_protection.BlockingEpilogCallbackType, prologErr error) {
+		r.Pre(func(c CallbackContext) error {
+			for _, info := range checkGraphQLRequest(*gql, limits) {
+				if blocked := c.HandleAttack(true, event.WithAttackInfo(info)); blocked {
+					// Return the epilog and abort the call.
+					epilog = func(err *error) {
+						*err = sdk_types.SqreenError{Err: ErrGraphQLProtection}
+					}
+					prologErr = sqhook.AbortError
+					return nil
+				}
+			}
+			return nil
+		})
+		return
+	}
+}
+
+// checkGraphQLRequest returns the attack info of every limit the GraphQL
+// request exceeds.
+func checkGraphQLRequest(r *http_protection.GraphQLRequest, limits api.GraphQLRuleDataEntry) (attacks []GraphQLAttackInfo) {
+	operationName := r.OperationName()
+
+	if limits.BlockIntrospection && r.Document.HasIntrospection(r.Operation) {
+		attacks = append(attacks, GraphQLAttackInfo{
+			OperationName: operationName,
+			Reason:        GraphQLIntrospectionReason,
+		})
+	}
+
+	if limits.MaxDepth > 0 {
+		if depth := r.Document.Depth(r.Operation); depth > limits.MaxDepth {
+			attacks = append(attacks, GraphQLAttackInfo{
+				OperationName: operationName,
+				Reason:        GraphQLMaxDepthReason,
+				Value:         depth,
+				Limit:         limits.MaxDepth,
+			})
+		}
+	}
+
+	if limits.MaxComplexity > 0 {
+		if complexity := r.Document.Complexity(r.Operation); complexity > limits.MaxComplexity {
+			attacks = append(attacks, GraphQLAttackInfo{
+				OperationName: operationName,
+				Reason:        GraphQLMaxComplexityReason,
+				Value:         complexity,
+				Limit:         limits.MaxComplexity,
+			})
+		}
+	}
+
+	return attacks
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback_test
+
+import (
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/sqlib/sqgraphql"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestGraphQLCallback(t *testing.T) {
+	newGraphQLRequest := func(t *testing.T, query string) *http_protection.GraphQLRequest {
+		doc, err := sqgraphql.Parse(query)
+		require.NoError(t, err)
+		return &http_protection.GraphQLRequest{Document: doc, Operation: doc.Operations[0]}
+	}
+
+	t.Run("configuration", func(t *testing.T) {
+		for _, tc := range []struct {
+			name        string
+			data        interface{}
+			expectedErr bool
+		}{
+			{name: "limits", data: &api.GraphQLRuleDataEntry{MaxDepth: 10, MaxComplexity: 100, BlockIntrospection: true}},
+			{name: "no data", data: nil, expectedErr: true},
+			{name: "bad data type", data: 33, expectedErr: true},
+			{name: "negative limit", data: &api.GraphQLRuleDataEntry{MaxDepth: -1}, expectedErr: true},
+		} {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				cfg := &mockups.NativeCallbackConfigMockup{}
+				cfg.ExpectData().Return(tc.data)
+
+				cb, err := callback.NewGraphQLCallback(&mockups.NativeRuleContextMockup{}, cfg)
+				if tc.expectedErr {
+					require.Error(t, err)
+					require.Nil(t, cb)
+					return
+				}
+				require.NoError(t, err)
+				_, ok := cb.(http_protection.GraphQLPrologCallbackType)
+				require.True(t, ok)
+			})
+		}
+	})
+
+	limits := &api.GraphQLRuleDataEntry{MaxDepth: 3, MaxComplexity: 5, BlockIntrospection: true}
+
+	for _, tc := range []struct {
+		name     string
+		query    string
+		expected []callback.GraphQLAttackInfo
+	}{
+		{
+			name:  "within limits",
+			query: `query Me { me { name friends { name } } }`,
+		},
+		{
+			name:  "typename meta-field",
+			query: `{ me { __typename } }`,
+		},
+		{
+			name:  "introspection",
+			query: `query IntrospectionQuery { __schema { queryType { name } } }`,
+			expected: []callback.GraphQLAttackInfo{
+				{OperationName: "IntrospectionQuery", Reason: callback.GraphQLIntrospectionReason},
+			},
+		},
+		{
+			name:  "too deep",
+			query: `query Deep { a { b { c { d } } } }`,
+			expected: []callback.GraphQLAttackInfo{
+				{OperationName: "Deep", Reason: callback.GraphQLMaxDepthReason, Value: 4, Limit: 3},
+			},
+		},
+		{
+			name:  "too complex",
+			query: `{ a b c ...F } fragment F on Query { d e f }`,
+			expected: []callback.GraphQLAttackInfo{
+				{Reason: callback.GraphQLMaxComplexityReason, Value: 6, Limit: 5},
+			},
+		},
+		{
+			name:  "every limit",
+			query: `query Q { __type(name: "User") { fields { type { ofType { name kind } } } } }`,
+			expected: []callback.GraphQLAttackInfo{
+				{OperationName: "Q", Reason: callback.GraphQLIntrospectionReason},
+				{OperationName: "Q", Reason: callback.GraphQLMaxDepthReason, Value: 5, Limit: 3},
+				{OperationName: "Q", Reason: callback.GraphQLMaxComplexityReason, Value: 6, Limit: 5},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &mockups.NativeCallbackConfigMockup{}
+			cfg.ExpectData().Return(limits)
+
+			var attacks []callback.GraphQLAttackInfo
+			r := &mockups.NativeRuleContextMockup{}
+			defer r.AssertExpectations(t)
+			r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+				c := &mockups.CallbackContextMockup{}
+				defer c.AssertExpectations(t)
+				if len(tc.expected) > 0 {
+					c.ExpectHandleAttack(true, mock.Anything).Run(func(args mock.Arguments) {
+						attack := &event.AttackEvent{}
+						for _, opt := range args.Get(1).([]event.AttackEventOption) {
+							opt(attack)
+						}
+						attacks = append(attacks, attack.Info.(callback.GraphQLAttackInfo))
+					}).Return(false).Times(len(tc.expected))
+				}
+				require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+			}).Once()
+
+			cb, err := callback.NewGraphQLCallback(r, cfg)
+			require.NoError(t, err)
+			prolog := cb.(http_protection.GraphQLPrologCallbackType)
+
+			gql := newGraphQLRequest(t, tc.query)
+			epilog, err := prolog(nil, &gql)
+			require.NoError(t, err)
+			require.Nil(t, epilog)
+			require.Equal(t, tc.expected, attacks)
+		})
+	}
+
+	t.Run("blocking", func(t *testing.T) {
+		cfg := &mockups.NativeCallbackConfigMockup{}
+		cfg.ExpectData().Return(limits)
+
+		r := &mockups.NativeRuleContextMockup{}
+		defer r.AssertExpectations(t)
+		r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+			c := &mockups.CallbackContextMockup{}
+			defer c.AssertExpectations(t)
+			// Only the first attack is handled once blocked
+			c.ExpectHandleAttack(true, mock.Anything).Return(true).Once()
+			require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+		}).Once()
+
+		cb, err := callback.NewGraphQLCallback(r, cfg)
+		require.NoError(t, err)
+		prolog := cb.(http_protection.GraphQLPrologCallbackType)
+
+		gql := newGraphQLRequest(t, `{ __schema { types { fields { name } } } }`)
+		epilog, err := prolog(nil, &gql)
+		require.Equal(t, sqhook.AbortError, err)
+		require.NotNil(t, epilog)
+
+		epilog(&err)
+		require.True(t, xerrors.As(err, &sdk_types.SqreenError{}))
+	})
+}
@@ -92,6 +92,8 @@ func newIPDenyListPrologCallback(r RuleContext, denylist *actor.CIDRIPListStore)
 				c.Logger().Debug(err.Error())
 				*e = err
 			}
+			// Skip the callbacks of lower priority
+			prologErr = sqhook.AbortError
 			return nil
 		})
 		return
@@ -8,7 +8,8 @@ package callback
 
 import (
 	"reflect"
-	"sync"
+	"strconv"
+	"time"
 
 	"github.com/dop251/goja"
 	"github.com/sqreen/go-agent/internal/binding-accessor"
@@ -24,14 +25,12 @@ func NewJSExecCallback(r RuleContext, cfg JSReflectedCallbackConfig) (sqhook.Ref
 	sqassert.NotNil(pool)
 	strategy := cfg.Strategy()
 	sqassert.NotNil(strategy)
+	rule := ruleName(r)
 
 	return func(params []reflect.Value) (epilogFunc sqhook.ReflectedEpilogCallback, prologErr error) {
-		vm := pool.get()
-		defer pool.put(vm)
-
 		var blocked bool
 
-		if vm.hasPre() {
+		if pool.hasPre() {
 			r.Pre(func(c CallbackContext) error {
 				baCtx, err := NewReflectedCallbackBindingAccessorContext(strategy.BindingAccessor.Capabilities, c.ProtectionContext(), params, nil, cfg.Data())
 				if err != nil {
@@ -39,8 +38,8 @@ func NewJSExecCallback(r RuleContext, cfg JSReflectedCallbackConfig) (sqhook.Ref
 					return sqerrors.WithKey(err, errKey{})
 				}
 
-				result, err := vm.callPre(baCtx)
-				if err != nil {
+				result, err := pool.callPre(c, rule, baCtx)
+				if err != nil || result == nil {
 					return err
 				}
 
@@ -68,7 +67,7 @@ func NewJSExecCallback(r RuleContext, cfg JSReflectedCallbackConfig) (sqhook.Ref
 			return
 		}
 
-		if vm.hasPost() {
+		if pool.hasPost() {
 			epilogFunc = func(results []reflect.Value) {
 				r.Post(func(c CallbackContext) error {
 					baCtx, err := NewReflectedCallbackBindingAccessorContext(strategy.BindingAccessor.Capabilities, c.ProtectionContext(), params, results, cfg.Data())
@@ -77,8 +76,8 @@ func NewJSExecCallback(r RuleContext, cfg JSReflectedCallbackConfig) (sqhook.Ref
 						return sqerrors.WithKey(err, errKey{})
 					}
 
-					result, err := vm.callPost(baCtx)
-					if err != nil {
+					result, err := pool.callPost(c, rule, baCtx)
+					if err != nil || result == nil {
 						return err
 					}
 
@@ -105,7 +104,35 @@ func NewJSExecCallback(r RuleContext, cfg JSReflectedCallbackConfig) (sqhook.Ref
 	}, nil
 }
 
-type vmPool sync.Pool
+const (
+	// defaultMaxJSExecutionTime is the maximum execution time of a JS callback
+	// when the request has a time budget, used as is when the remaining budget is
+	// larger.
+	defaultMaxJSExecutionTime = 5 * time.Millisecond
+	// jsExecutionTimePrecision is the precision of the remaining request time
+	// budget given to a JS callback.
+	jsExecutionTimePrecision = 50 * time.Microsecond
+	// jsUnlimitedBudget is the request time budget above which it is considered
+	// unlimited, time budgets being in the order of milliseconds.
+	jsUnlimitedBudget = time.Hour
+	// maxJSVMs is the maximum number of live VMs of a JS callback. VMs are
+	// created on demand when none is idle, up to this limit. Otherwise, the
+	// execution waits for a VM to be put back into the pool.
+	maxJSVMs = 16
+	// maxJSCallStackSize is the maximum call stack depth of a JS callback.
+	maxJSCallStackSize = 256
+)
+
+// vmPool is a bounded pool of the VMs of a JS callback. The call stack depth of
+// the VMs is limited by maxJSCallStackSize while their memory allocations are
+// only bounded by the execution time limit, goja having no memory limits.
+type vmPool struct {
+	idle chan *runtime
+	// live holds a token per live VM, idle or not.
+	live      chan struct{}
+	newVM     func() (*runtime, error)
+	pre, post bool
+}
 
 type runtime struct {
 	vm        *goja.Runtime
@@ -133,19 +160,25 @@ func newVMPool(cfg JSReflectedCallbackConfig) *vmPool {
 	postFuncDecl, postFuncCallParams := cfg.Post()
 	sqassert.True(preFuncDecl != nil || postFuncDecl != nil)
 
-	return (*vmPool)(&sync.Pool{
-		New: func() interface{} {
+	return &vmPool{
+		idle: make(chan *runtime, maxJSVMs),
+		live: make(chan struct{}, maxJSVMs),
+		pre:  preFuncDecl != nil,
+		post: postFuncDecl != nil,
+		newVM: func() (*runtime, error) {
 			vm := goja.New()
 			vm.SetFieldNameMapper(fileNameMapper{goja.TagFieldNameMapper("goja", false)})
+			vm.SetMaxCallStackSize(maxJSCallStackSize)
 
 			var pre, post *jsCallbackFunc
 
 			if preFuncDecl != nil {
-				_, err := vm.RunProgram(preFuncDecl)
-				sqassert.NoError(err)
+				if _, err := vm.RunProgram(preFuncDecl); err != nil {
+					return nil, sqerrors.Wrap(err, "running the `pre` function declaration")
+				}
 				var fn goja.Callable
 				if err := vm.ExportTo(vm.Get("pre"), &fn); err != nil {
-					return sqerrors.Wrap(err, "retrieving `pre` function")
+					return nil, sqerrors.Wrap(err, "retrieving `pre` function")
 				}
 
 				pre = &jsCallbackFunc{
@@ -155,11 +188,12 @@ func newVMPool(cfg JSReflectedCallbackConfig) *vmPool {
 			}
 
 			if postFuncDecl != nil {
-				_, err := vm.RunProgram(postFuncDecl)
-				sqassert.NoError(err)
+				if _, err := vm.RunProgram(postFuncDecl); err != nil {
+					return nil, sqerrors.Wrap(err, "running the `post` function declaration")
+				}
 				var fn goja.Callable
 				if err := vm.ExportTo(vm.Get("post"), &fn); err != nil {
-					return sqerrors.Wrap(err, "retrieving `post` function")
+					return nil, sqerrors.Wrap(err, "retrieving `post` function")
 				}
 
 				post = &jsCallbackFunc{
@@ -172,29 +206,61 @@ func newVMPool(cfg JSReflectedCallbackConfig) *vmPool {
 				vm:   vm,
 				pre:  pre,
 				post: post,
-			}
+			}, nil
 		},
-	})
+	}
 }
 
-func (vm *vmPool) unwrap() *sync.Pool {
-	return (*sync.Pool)(vm)
+// get returns an idle VM of the pool, or a new one when none is idle and the
+// number of live VMs allows it. Otherwise, it waits for a VM to be put back or
+// dropped, for at most the given timeout when not zero. A nil VM and error are
+// returned when the timeout expired.
+func (p *vmPool) get(timeout time.Duration) (*runtime, error) {
+	select {
+	case vm := <-p.idle:
+		return vm, nil
+	default:
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case vm := <-p.idle:
+		return vm, nil
+	case p.live <- struct{}{}:
+		vm, err := p.newVM()
+		if err != nil {
+			<-p.live
+			return nil, err
+		}
+		return vm, nil
+	case <-expired:
+		return nil, nil
+	}
 }
 
-func (vm *vmPool) get() *runtime {
-	return vm.unwrap().Get().(*runtime)
+// put returns the VM to the pool. It never blocks as the pool can hold every
+// live VM.
+func (p *vmPool) put(vm *runtime) {
+	p.idle <- vm
 }
 
-func (vm *vmPool) put(r *runtime) {
-	vm.unwrap().Put(r)
+// drop removes the VM from the pool so that a new one can be created.
+func (p *vmPool) drop(*runtime) {
+	<-p.live
 }
 
-func (r *runtime) hasPre() bool {
-	return r.pre != nil
+func (p *vmPool) hasPre() bool {
+	return p.pre
 }
 
-func (r *runtime) hasPost() bool {
-	return r.post != nil
+func (p *vmPool) hasPost() bool {
+	return p.post
 }
 
 type jsCallbackResult struct {
@@ -202,25 +268,124 @@ type jsCallbackResult struct {
 	Record map[string]interface{} `goja:"record"`
 }
 
-func (r *runtime) callPre(baCtx bindingaccessor.Context) (*jsCallbackResult, error) {
-	sqassert.True(r.hasPre())
+// callPre calls the `pre` function with a VM of the pool. A nil result and
+// error are returned when the request time budget is already exhausted.
+func (p *vmPool) callPre(c CallbackContext, rule string, baCtx bindingaccessor.Context) (*jsCallbackResult, error) {
+	sqassert.True(p.hasPre())
+	return p.call(c, rule, baCtx, func(r *runtime) *jsCallbackFunc { return r.pre })
+}
+
+// callPost calls the `post` function with a VM of the pool. A nil result and
+// error are returned when the request time budget is already exhausted.
+func (p *vmPool) callPost(c CallbackContext, rule string, baCtx bindingaccessor.Context) (*jsCallbackResult, error) {
+	sqassert.True(p.hasPost())
+	return p.call(c, rule, baCtx, func(r *runtime) *jsCallbackFunc { return r.post })
+}
+
+func (p *vmPool) call(c CallbackContext, rule string, baCtx bindingaccessor.Context, fn func(*runtime) *jsCallbackFunc) (*jsCallbackResult, error) {
+	timeout, exceeded := jsExecutionTimeout(c.ProtectionContext(), defaultMaxJSExecutionTime)
+	if exceeded {
+		TraceValue(c, "over budget", true)
+		return nil, nil
+	}
+
+	start := time.Now()
+	r, err := p.get(timeout)
+	if err != nil {
+		type errKey struct{}
+		return nil, sqerrors.WithKey(sqerrors.Wrap(err, "could not create a javascript vm"), errKey{})
+	}
+	if r == nil {
+		TraceValue(c, "over budget", true)
+		return nil, nil
+	}
+
 	result := &jsCallbackResult{}
-	if err := call(r.vm, r.pre, baCtx, result); err != nil {
+	if timeout == 0 {
+		// No request time budget
+		err = call(c, r.vm, fn(r), baCtx, result)
+		p.put(r)
+	} else {
+		// The time spent waiting for the VM is part of the budget.
+		timeout -= time.Since(start)
+		if timeout <= 0 {
+			p.put(r)
+			TraceValue(c, "over budget", true)
+			return nil, nil
+		}
+		// Interrupt the execution once the time budget is exhausted. The VM is
+		// dropped when the timer fired as its interrupt flag may still be set.
+		timer := time.AfterFunc(timeout, func() {
+			r.vm.Interrupt(jsInterrupt{timeout: timeout})
+		})
+		err = call(c, r.vm, fn(r), baCtx, result)
+		if timer.Stop() {
+			p.put(r)
+		} else {
+			p.drop(r)
+		}
+	}
+	if err != nil {
+		if interrupted, ok := err.(*goja.InterruptedError); ok {
+			return nil, newJSInterruptedError(rule, timeout, interrupted)
+		}
 		return nil, err
 	}
 	return result, nil
 }
 
-func (r *runtime) callPost(baCtx bindingaccessor.Context) (*jsCallbackResult, error) {
-	sqassert.True(r.hasPost())
-	result := &jsCallbackResult{}
-	if err := call(r.vm, r.post, baCtx, result); err != nil {
-		return nil, err
+// jsExecutionTimeout returns the maximum execution time of a JS callback given
+// the remaining request time budget, or zero when the request has no time
+// budget. The protection context only telling if a given duration exceeds the
+// budget, the remaining time is searched by dichotomy. exceeded is true when
+// the budget is already exhausted.
+func jsExecutionTimeout(p ProtectionContext, max time.Duration) (timeout time.Duration, exceeded bool) {
+	if !p.DeadlineExceeded(jsUnlimitedBudget) {
+		return 0, false
 	}
-	return result, nil
+	if !p.DeadlineExceeded(max) {
+		return max, false
+	}
+	if p.DeadlineExceeded(0) {
+		return 0, true
+	}
+	// Invariant: the budget is not exceeded by lo but it is by hi.
+	lo, hi := time.Duration(0), max
+	for hi-lo > jsExecutionTimePrecision {
+		mid := lo + (hi-lo)/2
+		if p.DeadlineExceeded(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	if lo == 0 {
+		return 0, true
+	}
+	return lo, false
+}
+
+// jsInterrupt is the value of the VM interruptions.
+type jsInterrupt struct {
+	timeout time.Duration
+}
+
+type jsInterruptedErrorInfo struct {
+	Rule    string
+	Timeout time.Duration
 }
 
-func call(vm *goja.Runtime, descr *jsCallbackFunc, baCtx bindingaccessor.Context, result interface{}) error {
+// newJSInterruptedError returns the over-budget error of the JS callback
+// execution of the given rule interrupted after the given timeout.
+func newJSInterruptedError(rule string, timeout time.Duration, err error) error {
+	type errKey struct{}
+	return NewOverBudgetError(sqerrors.WithKey(sqerrors.WithInfo(sqerrors.Wrapf(err, "rule `%s`: javascript execution interrupted after %s", rule, timeout), jsInterruptedErrorInfo{
+		Rule:    rule,
+		Timeout: timeout,
+	}), errKey{}))
+}
+
+func call(c CallbackContext, vm *goja.Runtime, descr *jsCallbackFunc, baCtx bindingaccessor.Context, result interface{}) error {
 	jsParams := make([]goja.Value, len(descr.funcCallParams))
 	for i, ba := range descr.funcCallParams {
 		v, err := ba(baCtx)
@@ -228,6 +393,7 @@ func call(vm *goja.Runtime, descr *jsCallbackFunc, baCtx bindingaccessor.Context
 			type errKey int
 			return sqerrors.WithKey(err, errKey(i))
 		}
+		TraceValue(c, "argument "+strconv.Itoa(i), v)
 
 		var jsVal goja.Value
 		if v == nil {
@@ -241,6 +407,9 @@ func call(vm *goja.Runtime, descr *jsCallbackFunc, baCtx bindingaccessor.Context
 
 	v, err := descr.callback(goja.Undefined(), jsParams...)
 	if err != nil {
+		if interrupted, ok := err.(*goja.InterruptedError); ok {
+			return interrupted
+		}
 		type errKey struct{}
 		return sqerrors.WithKey(err, errKey{})
 	}
@@ -0,0 +1,184 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestJSExecutionTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		budget           time.Duration
+		expectedTimeout  time.Duration
+		expectedExceeded bool
+	}{
+		{name: "unlimited budget", budget: 0, expectedTimeout: 0},
+		{name: "very large budget", budget: 2 * jsUnlimitedBudget, expectedTimeout: 0},
+		{name: "larger budget", budget: time.Second, expectedTimeout: defaultMaxJSExecutionTime},
+		{name: "smaller budget", budget: time.Millisecond, expectedTimeout: time.Millisecond},
+		{name: "exhausted budget", budget: -1, expectedExceeded: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			timeout, exceeded := jsExecutionTimeout(jsBudgetProtectionContext(tc.budget), defaultMaxJSExecutionTime)
+			require.Equal(t, tc.expectedExceeded, exceeded)
+			if exceeded || tc.expectedTimeout == 0 {
+				require.Equal(t, time.Duration(0), timeout)
+				return
+			}
+			require.True(t, timeout <= tc.expectedTimeout)
+			require.True(t, timeout > tc.expectedTimeout-jsExecutionTimePrecision)
+		})
+	}
+}
+
+func TestJSVMPool(t *testing.T) {
+	newPool := func(t *testing.T, src string) *vmPool {
+		program, err := goja.Compile("test", src, true)
+		require.NoError(t, err)
+		return newVMPool(&jsCallbackConfigStub{pre: program})
+	}
+
+	t.Run("limited number of vms", func(t *testing.T) {
+		pool := newPool(t, `function pre() { return { status: "" } }`)
+
+		vms := make([]*runtime, maxJSVMs)
+		for i := range vms {
+			vm, err := pool.get(0)
+			require.NoError(t, err)
+			require.NotNil(t, vm)
+			vms[i] = vm
+		}
+
+		// No more vms can be created
+		vm, err := pool.get(time.Millisecond)
+		require.NoError(t, err)
+		require.Nil(t, vm)
+
+		// An idle vm is reused
+		pool.put(vms[0])
+		vm, err = pool.get(time.Millisecond)
+		require.NoError(t, err)
+		require.Equal(t, vms[0], vm)
+
+		// A dropped vm can be replaced by a new one
+		pool.drop(vms[1])
+		vm, err = pool.get(time.Millisecond)
+		require.NoError(t, err)
+		require.NotNil(t, vm)
+		require.NotEqual(t, vms[1], vm)
+
+		// A waiting execution gets the vm put back
+		go pool.put(vms[2])
+		vm, err = pool.get(0)
+		require.NoError(t, err)
+		require.Equal(t, vms[2], vm)
+	})
+
+	t.Run("limited call stack size", func(t *testing.T) {
+		pool := newPool(t, `function pre() { function f() { return f() + 1 } return f() }`)
+		c := jsCallbackContextStub{p: jsBudgetProtectionContext(0)}
+
+		result, err := pool.callPre(c, "my rule", nil)
+		require.Error(t, err)
+		require.Nil(t, result)
+		require.True(t, xerrors.As(err, new(*goja.StackOverflowError)))
+		// The vm is put back into the pool
+		require.Len(t, pool.idle, 1)
+	})
+
+	t.Run("interrupted execution", func(t *testing.T) {
+		pool := newPool(t, `function pre() { for (;;) {} }`)
+		// Create the vm beforehand so that its creation time, which is part of the
+		// budget, doesn't exhaust it before the execution starts. The larger budget
+		// still interrupts the loop after defaultMaxJSExecutionTime.
+		vm, err := pool.get(0)
+		require.NoError(t, err)
+		pool.put(vm)
+		c := jsCallbackContextStub{p: jsBudgetProtectionContext(time.Second)}
+
+		result, err := pool.callPre(c, "my rule", nil)
+		require.Error(t, err)
+		require.Nil(t, result)
+		require.Contains(t, err.Error(), "my rule")
+		info, ok := sqerrors.Info(err).(jsInterruptedErrorInfo)
+		require.True(t, ok)
+		require.Equal(t, "my rule", info.Rule)
+		// The interrupted vm is dropped
+		require.Len(t, pool.idle, 0)
+		require.Len(t, pool.live, 0)
+	})
+
+	t.Run("exhausted budget", func(t *testing.T) {
+		pool := newPool(t, `function pre() { for (;;) {} }`)
+		c := jsCallbackContextStub{p: jsBudgetProtectionContext(-1)}
+
+		result, err := pool.callPre(c, "my rule", nil)
+		require.NoError(t, err)
+		require.Nil(t, result)
+	})
+
+	t.Run("regular execution", func(t *testing.T) {
+		pool := newPool(t, `function pre() { return { status: "raise" } }`)
+		c := jsCallbackContextStub{p: jsBudgetProtectionContext(0)}
+
+		result, err := pool.callPre(c, "my rule", nil)
+		require.NoError(t, err)
+		require.Equal(t, "raise", result.Status)
+		require.Len(t, pool.idle, 1)
+	})
+}
+
+type jsCallbackConfigStub struct {
+	pre *goja.Program
+}
+
+func (jsCallbackConfigStub) BlockingMode() bool                     { return false }
+func (jsCallbackConfigStub) Data() interface{}                      { return nil }
+func (jsCallbackConfigStub) Strategy() *api.ReflectedCallbackConfig { return nil }
+func (c jsCallbackConfigStub) Pre() (*goja.Program, []bindingaccessor.BindingAccessorFunc) {
+	return c.pre, nil
+}
+func (jsCallbackConfigStub) Post() (*goja.Program, []bindingaccessor.BindingAccessorFunc) {
+	return nil, nil
+}
+
+type jsCallbackContextStub struct {
+	CallbackContext
+	p ProtectionContext
+}
+
+func (c jsCallbackContextStub) ProtectionContext() ProtectionContext { return c.p }
+
+// jsBudgetProtectionContext is a protection context having the given remaining
+// time budget. The budget is unlimited when zero, and exhausted when negative.
+type jsBudgetProtectionContext time.Duration
+
+func (jsBudgetProtectionContext) AddRequestParam(string, interface{}) {}
+func (jsBudgetProtectionContext) ClientIP() net.IP                    { return nil }
+func (jsBudgetProtectionContext) SqreenTime() *sqtime.SharedStopWatch {
+	return sqtime.NewSharedStopWatch()
+}
+func (b jsBudgetProtectionContext) DeadlineExceeded(needed time.Duration) bool {
+	switch {
+	case b == 0:
+		return false
+	case b < 0:
+		return true
+	default:
+		return needed >= time.Duration(b)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+
+	"github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+)
+
+// NewReflectedXSSCallback returns the native prolog callback of the response
+// writes detecting request parameter values reflected unescaped into HTML
+// responses.
+func NewReflectedXSSCallback(r RuleContext, _ NativeCallbackConfig) (sqhook.PrologCallback, error) {
+	return newReflectedXSSPrologCallback(r), nil
+}
+
+// NewReflectedXSSTemplateCallback returns the native prolog callback of the
+// template execution functions, such as `html/template.(*Template).Execute`
+// and `html/template.(*Template).ExecuteTemplate`, allowing to attribute
+// reflected XSS attacks to the template that wrote them.
+func NewReflectedXSSTemplateCallback(r RuleContext, _ NativeCallbackConfig) (sqhook.PrologCallback, error) {
+	return newReflectedXSSTemplatePrologCallback(r), nil
+}
+
+var ErrReflectedXSSProtection = errors.New("reflected xss protection triggered")
+
+type ReflectedXSSAttackInfo struct {
+	// Parameter is the name of the request parameter reflected into the
+	// response, prefixed by its source (eg. `QueryForm.q`).
+	Parameter string `json:"parameter"`
+	// Value is the request parameter value found in the response.
+	Value string `json:"value"`
+	// Template is the name of the template being executed when the value was
+	// written, if any.
+	Template string `json:"template,omitempty"`
+}
+
+// xssPayloadRegexp matches request parameter values able to inject HTML
+// markup or script when written unescaped into an HTML document.
+var xssPayloadRegexp = regexp.MustCompile(`(?i)<[a-z!/?]|\bon[a-z]+\s*=|javascript:`)
+
+func newReflectedXSSPrologCallback(r RuleContext) http_protection.ResponseWritePrologCallbackType {
+	stateKey := reflectedXSSStateKey{rule: r}
+	return func(p **http_protection.ProtectionContext, body *[]byte) (epilog http_protection.BlockingEpilogCallbackType, prologErr error) {
+		// The response writes are counted even when the callback is skipped so
+		// that the detection knows when it missed some of them.
+		state := (*p).CallbackState(stateKey, newReflectedXSSState).(*reflectedXSSState)
+		pos := state.written
+		state.written += len(*body)
+
+		r.Pre(func(c CallbackContext) error {
+			info, found := state.find(*p, *body, pos)
+			if !found {
+				return nil
+			}
+
+			if blocked := c.HandleAttack(true, event.WithAttackInfo(info)); blocked {
+				// Return the epilog and abort the write call.
+				epilog = func(err *error) {
+					*err = sdk_types.SqreenError{Err: ErrReflectedXSSProtection}
+				}
+				prologErr = sqhook.AbortError
+			}
+			return nil
+		})
+		return
+	}
+}
+
+func newReflectedXSSTemplatePrologCallback(r RuleContext) sqhook.ReflectedPrologCallback {
+	return func(params []reflect.Value) (epilog sqhook.ReflectedEpilogCallback, prologErr error) {
+		r.Pre(func(c CallbackContext) error {
+			p, ok := c.ProtectionContext().(*http_protection.ProtectionContext)
+			if !ok {
+				return nil
+			}
+			p.PushTemplate(executedTemplateName(params))
+			epilog = func([]reflect.Value) {
+				p.PopTemplate()
+			}
+			return nil
+		})
+		return
+	}
+}
+
+// executedTemplateName returns the name of the template being executed out of
+// the arguments of the template execution methods. It is either the explicit
+// template name argument of `ExecuteTemplate()`, or the template receiver name.
+func executedTemplateName(params []reflect.Value) string {
+	// ExecuteTemplate(wr io.Writer, name string, data interface{})
+	if len(params) == 4 {
+		if name, ok := params[2].Elem().Interface().(string); ok {
+			return name
+		}
+	}
+	if len(params) > 0 {
+		if t, ok := params[0].Elem().Interface().(interface{ Name() string }); ok {
+			return t.Name()
+		}
+	}
+	return ""
+}
+
+// reflectedXSSStateKey is the key of the response state of a reflected XSS
+// callback (cf. CallbackState()).
+type reflectedXSSStateKey struct {
+	rule RuleContext
+}
+
+// reflectedXSSState is the response state of the reflected XSS detection. The
+// request parameters are only walked once per request, and the end of the
+// response body written so far is kept so that values split across several
+// response writes are also found.
+type reflectedXSSState struct {
+	// initialized is true once the first response body chunk was seen.
+	initialized bool
+	// candidates are the request parameter values possibly carrying an XSS
+	// payload, nil when the response is not an HTML response.
+	candidates []reflectedXSSCandidate
+	maxLen     int
+	// written is the number of response body bytes written so far.
+	written int
+	// tail is the end of the response body, up to maxLen-1 bytes, ending at
+	// the response body position tailEnd.
+	tail    []byte
+	tailEnd int
+}
+
+type reflectedXSSCandidate struct {
+	name  string
+	value []byte
+}
+
+func newReflectedXSSState() interface{} {
+	return &reflectedXSSState{}
+}
+
+// find looks for request parameter values possibly carrying an XSS payload and
+// written as-is into an HTML response body, given the response body chunk
+// written at the given position. Escaped values, as done by `html/template`,
+// do not match.
+func (s *reflectedXSSState) find(p *http_protection.ProtectionContext, body []byte, pos int) (info ReflectedXSSAttackInfo, found bool) {
+	if len(body) == 0 {
+		return info, false
+	}
+	if !s.initialized {
+		s.initialized = true
+		if isHTMLResponse(p.ResponseWriter.Header(), body) {
+			s.candidates, s.maxLen = reflectedXSSCandidates(p)
+		}
+	}
+	if len(s.candidates) == 0 {
+		return info, false
+	}
+
+	if s.tailEnd != pos {
+		// Some response body chunks were not seen
+		s.tail = s.tail[:0]
+	}
+	defer s.keepTail(body, pos)
+
+	for _, candidate := range s.candidates {
+		if !containsAcross(s.tail, body, candidate.value) {
+			continue
+		}
+		return ReflectedXSSAttackInfo{
+			Parameter: candidate.name,
+			Value:     string(candidate.value),
+			Template:  p.CurrentTemplate(),
+		}, true
+	}
+	return info, false
+}
+
+// keepTail keeps the end of the response body written so far, long enough to
+// find the values starting before the next response body chunk.
+func (s *reflectedXSSState) keepTail(body []byte, pos int) {
+	n := s.maxLen - 1
+	if len(body) >= n {
+		s.tail = append(s.tail[:0], body[len(body)-n:]...)
+	} else {
+		s.tail = append(s.tail, body...)
+		if extra := len(s.tail) - n; extra > 0 {
+			s.tail = s.tail[:copy(s.tail, s.tail[extra:])]
+		}
+	}
+	s.tailEnd = pos + len(body)
+}
+
+// containsAcross returns true when the value is in the body, or starts in the
+// tail preceding the body and ends in the body. Values entirely in the tail
+// were already found in the previous body chunks.
+func containsAcross(tail, body, value []byte) bool {
+	if bytes.Contains(body, value) {
+		return true
+	}
+	if n := len(value) - 1; len(tail) > n {
+		tail = tail[len(tail)-n:]
+	}
+	if len(tail) == 0 {
+		return false
+	}
+	head := body
+	if n := len(value) - 1; len(head) > n {
+		head = head[:n]
+	}
+	joined := make([]byte, 0, len(tail)+len(head))
+	joined = append(append(joined, tail...), head...)
+	return bytes.Contains(joined, value)
+}
+
+// reflectedXSSCandidates returns the request parameter values possibly
+// carrying an XSS payload, along with the length of the longest one.
+func reflectedXSSCandidates(p *http_protection.ProtectionContext) (candidates []reflectedXSSCandidate, maxLen int) {
+	params := http_protection.NewRequestBindingAccessorContext(p.RequestReader).FilteredParams()
+	for source, values := range params {
+		walkRequestParamValue(source, reflect.ValueOf(values), 0, func(name, value string) bool {
+			if xssPayloadRegexp.MatchString(value) {
+				candidates = append(candidates, reflectedXSSCandidate{name: name, value: []byte(value)})
+				if len(value) > maxLen {
+					maxLen = len(value)
+				}
+			}
+			return true
+		})
+	}
+	return candidates, maxLen
+}
+
+func isHTMLResponse(header http.Header, body []byte) bool {
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		// Same as net/http when no content-type was set
+		ct = http.DetectContentType(body)
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return mt == "text/html" || mt == "application/xhtml+xml"
+}
+
+// walkRequestParamValue calls fn with every string value found in the given
+// request parameter value, along with its name made of its path in the value.
+// It stops as soon as fn returns false.
+func walkRequestParamValue(name string, v reflect.Value, depth int, fn func(name, value string) bool) (cont bool) {
+	if depth > bindingaccessor.MaxExecutionDepth {
+		return true
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return fn(name, v.String())
+
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return true
+		}
+		return walkRequestParamValue(name, v.Elem(), depth+1, fn)
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !walkRequestParamValue(name, v.Index(i), depth+1, fn) {
+				return false
+			}
+		}
+
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			if k.Kind() != reflect.String {
+				continue
+			}
+			if !walkRequestParamValue(name+"."+k.String(), v.MapIndex(k), depth+1, fn) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback_test
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestReflectedXSSCallback(t *testing.T) {
+	const payload = `<script>alert(1)</script>`
+
+	newProtectionContext := func(t *testing.T, contentType string) *http_protection.ProtectionContext {
+		w := &http_protection_mockups.ResponseWriterMockup{}
+		header := http.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		w.ExpectHeader().Return(header)
+
+		r := &http_protection_mockups.RequestReaderMockup{}
+		r.ExpectQueryForm().Return(url.Values{"q": []string{payload}})
+		r.ExpectPostForm().Return(url.Values(nil))
+		r.ExpectParams().Return(nil)
+
+		return http_protection.NewTestProtectionContext(nil, nil, w, r)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		template    string
+		expected    *callback.ReflectedXSSAttackInfo
+	}{
+		{
+			name: "unescaped value in an html response",
+			body: `<html><body>` + payload + `</body></html>`,
+			expected: &callback.ReflectedXSSAttackInfo{
+				Parameter: "QueryForm.q",
+				Value:     payload,
+			},
+		},
+		{
+			name:     "unescaped value in an html template",
+			body:     `<html><body>` + payload + `</body></html>`,
+			template: "index.html",
+			expected: &callback.ReflectedXSSAttackInfo{
+				Parameter: "QueryForm.q",
+				Value:     payload,
+				Template:  "index.html",
+			},
+		},
+		{
+			name: "escaped value in an html response",
+			body: `<html><body>` + template.HTMLEscapeString(payload) + `</body></html>`,
+		},
+		{
+			name:        "unescaped value in a non-html response",
+			contentType: "application/json",
+			body:        `{"q":"` + payload + `"}`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := &mockups.NativeRuleContextMockup{}
+			defer r.AssertExpectations(t)
+			r.ExpectPre(mock.Anything).Once()
+
+			cb, err := callback.NewReflectedXSSCallback(r, nil)
+			require.NoError(t, err)
+			prolog, ok := cb.(http_protection.ResponseWritePrologCallbackType)
+			require.True(t, ok)
+
+			p := newProtectionContext(t, tc.contentType)
+			if tc.template != "" {
+				p.PushTemplate(tc.template)
+			}
+			body := []byte(tc.body)
+			epilog, err := prolog(&p, &body)
+			require.NoError(t, err)
+			require.Nil(t, epilog)
+
+			r.AssertCalled(t, "Pre", mock.MatchedBy(func(cb func(callback.CallbackContext) error) bool {
+				c := &mockups.CallbackContextMockup{}
+				defer c.AssertExpectations(t)
+				if tc.expected != nil {
+					c.ExpectHandleAttack(true, mock.MatchedBy(func(opts []event.AttackEventOption) bool {
+						attack := &event.AttackEvent{}
+						for _, opt := range opts {
+							opt(attack)
+						}
+						return assert.Equal(t, &event.AttackEvent{Info: *tc.expected}, attack)
+					})).Return(false).Once()
+				}
+				require.NoError(t, cb(c))
+				return true
+			}))
+		})
+	}
+
+	t.Run("value split across response writes", func(t *testing.T) {
+		r := &mockups.NativeRuleContextMockup{}
+		defer r.AssertExpectations(t)
+		var attacks int
+		r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+			c := &mockups.CallbackContextMockup{}
+			c.ExpectHandleAttack(true, mock.Anything).Run(func(mock.Arguments) { attacks++ }).Return(false).Maybe()
+			require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+		}).Times(4)
+
+		cb, err := callback.NewReflectedXSSCallback(r, nil)
+		require.NoError(t, err)
+		prolog := cb.(http_protection.ResponseWritePrologCallbackType)
+
+		w := &http_protection_mockups.ResponseWriterMockup{}
+		w.ExpectHeader().Return(http.Header{"Content-Type": []string{"text/html"}})
+		req := &http_protection_mockups.RequestReaderMockup{}
+		defer req.AssertExpectations(t)
+		// The request parameters are only walked once per request
+		req.ExpectQueryForm().Return(url.Values{"q": []string{payload}}).Once()
+		req.ExpectPostForm().Return(url.Values(nil)).Once()
+		req.ExpectParams().Return(nil).Once()
+		p := http_protection.NewTestProtectionContext(nil, nil, w, req)
+
+		for _, chunk := range []string{`<html><body><scr`, `ipt>alert(1)</scr`, `ipt></body>`, `</html>`} {
+			body := []byte(chunk)
+			epilog, err := prolog(&p, &body)
+			require.NoError(t, err)
+			require.Nil(t, epilog)
+		}
+		// Only found once, when written entirely
+		require.Equal(t, 1, attacks)
+	})
+
+	t.Run("blocking", func(t *testing.T) {
+		r := &mockups.NativeRuleContextMockup{}
+		defer r.AssertExpectations(t)
+		r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+			c := &mockups.CallbackContextMockup{}
+			c.ExpectHandleAttack(true, mock.Anything).Return(true).Once()
+			require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+		}).Once()
+
+		cb, err := callback.NewReflectedXSSCallback(r, nil)
+		require.NoError(t, err)
+		prolog := cb.(http_protection.ResponseWritePrologCallbackType)
+
+		p := newProtectionContext(t, "text/html; charset=utf-8")
+		body := []byte(payload)
+		epilog, err := prolog(&p, &body)
+		require.Equal(t, sqhook.AbortError, err)
+		require.NotNil(t, epilog)
+
+		epilog(&err)
+		require.True(t, xerrors.As(err, &sdk_types.SqreenError{}))
+	})
+}
+
+func TestReflectedXSSTemplateCallback(t *testing.T) {
+	tmpl := template.Must(template.New("index.html").Parse(`{{.}}`))
+
+	for _, tc := range []struct {
+		name     string
+		params   []reflect.Value
+		expected string
+	}{
+		{
+			name: "Execute",
+			params: []reflect.Value{
+				reflect.ValueOf(&tmpl),
+				reflect.ValueOf(new(interface{})),
+				reflect.ValueOf(new(interface{})),
+			},
+			expected: "index.html",
+		},
+		{
+			name: "ExecuteTemplate",
+			params: func() []reflect.Value {
+				name := "layout.html"
+				return []reflect.Value{
+					reflect.ValueOf(&tmpl),
+					reflect.ValueOf(new(interface{})),
+					reflect.ValueOf(&name),
+					reflect.ValueOf(new(interface{})),
+				}
+			}(),
+			expected: "layout.html",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			p := http_protection.NewTestProtectionContext(nil, nil, nil, nil)
+
+			r := &mockups.NativeRuleContextMockup{}
+			defer r.AssertExpectations(t)
+			r.ExpectPre(mock.Anything).Run(func(args mock.Arguments) {
+				c := &mockups.CallbackContextMockup{}
+				c.ExpectProtectionContext().Return(p).Once()
+				require.NoError(t, args.Get(0).(func(callback.CallbackContext) error)(c))
+			}).Once()
+
+			cb, err := callback.NewReflectedXSSTemplateCallback(r, nil)
+			require.NoError(t, err)
+			prolog, ok := cb.(sqhook.ReflectedPrologCallback)
+			require.True(t, ok)
+
+			epilog, err := prolog(tc.params)
+			require.NoError(t, err)
+			require.NotNil(t, epilog)
+			require.Equal(t, tc.expected, p.CurrentTemplate())
+
+			epilog(nil)
+			require.Equal(t, "", p.CurrentTemplate())
+		})
+	}
+}
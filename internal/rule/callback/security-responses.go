@@ -58,7 +58,8 @@ func newIPSecurityResponsePrologCallback(r RuleContext) http_protection.Blocking
 			epilog = func(e *error) {
 				*e = types.SqreenError{Err: securityResponseError{}}
 			}
-			prologErr = nil
+			// Skip the callbacks of lower priority
+			prologErr = sqhook.AbortError
 			return nil
 		})
 
@@ -105,7 +106,8 @@ func newUserSecurityResponsePrologCallback(r RuleContext) http_protection.Identi
 			epilog = func(e *error) {
 				*e = types.SqreenError{Err: securityResponseError{}}
 			}
-			prologErr = nil
+			// Skip the callbacks of lower priority
+			prologErr = sqhook.AbortError
 			return nil
 		})
 
@@ -14,6 +14,7 @@ import (
 	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
 	"github.com/sqreen/go-agent/internal/rule/callback"
 	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
 	middleware_mockups "github.com/sqreen/go-agent/sdk/middleware/_testlib/mockups"
 	"github.com/sqreen/go-agent/sdk/types"
 	"github.com/stretchr/testify/mock"
@@ -115,7 +116,7 @@ func TestIPSecurityResponseCallback(t *testing.T) {
 
 			prolog := v.(http_protection.BlockingPrologCallbackType)
 			epilog, err := prolog(&p)
-			require.NoError(t, err)
+			require.Equal(t, sqhook.AbortError, err)
 			require.NotNil(t, epilog)
 
 			epilog(&err)
@@ -162,7 +163,7 @@ func TestIPSecurityResponseCallback(t *testing.T) {
 
 			prolog := v.(http_protection.BlockingPrologCallbackType)
 			epilog, err := prolog(&p)
-			require.NoError(t, err)
+			require.Equal(t, sqhook.AbortError, err)
 			require.NotNil(t, epilog)
 
 			require.Equal(t, expectedLocation, headers.Get("Location"))
@@ -282,7 +283,7 @@ func TestUserSecurityResponseCallback(t *testing.T) {
 
 			prolog := v.(http_protection.IdentifyUserPrologCallbackType)
 			epilog, err := prolog(&p, &userID)
-			require.NoError(t, err)
+			require.Equal(t, sqhook.AbortError, err)
 			require.NotNil(t, epilog)
 
 			epilog(&err)
@@ -332,7 +333,7 @@ func TestUserSecurityResponseCallback(t *testing.T) {
 
 			prolog := v.(http_protection.IdentifyUserPrologCallbackType)
 			epilog, err := prolog(&p, &userID)
-			require.NoError(t, err)
+			require.Equal(t, sqhook.AbortError, err)
 			require.NotNil(t, epilog)
 
 			require.Equal(t, expectedLocation, headers.Get("Location"))
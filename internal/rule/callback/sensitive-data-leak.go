@@ -0,0 +1,194 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/config"
+	"github.com/sqreen/go-agent/internal/event"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/sqlib/sqassert"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	sdk_types "github.com/sqreen/go-agent/sdk/types"
+)
+
+// NewSensitiveDataLeakCallback returns the native prolog callback of the
+// response body filter detecting sensitive data leaking out in response
+// bodies, such as stack traces, SQL error messages, credit card numbers or
+// secrets. The leaked data can be masked when the rule data enables it,
+// otherwise the response is blocked in blocking mode.
+func NewSensitiveDataLeakCallback(r RuleContext, cfg NativeCallbackConfig) (sqhook.PrologCallback, error) {
+	sqassert.NotNil(r)
+	sqassert.NotNil(cfg)
+
+	var data *api.SensitiveDataRuleDataEntry
+	if v := cfg.Data(); v != nil {
+		var ok bool
+		data, ok = v.(*api.SensitiveDataRuleDataEntry)
+		if !ok {
+			return nil, sqerrors.Errorf("unexpected callback data type: got `%T` instead of `%T`", v, data)
+		}
+	} else {
+		data = &api.SensitiveDataRuleDataEntry{}
+	}
+
+	patterns := data.Patterns
+	if len(patterns) == 0 {
+		patterns = defaultSensitiveDataPatterns
+	}
+	compiled, err := compileSensitiveDataPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var mask []byte
+	if data.Mask {
+		maskString := data.MaskString
+		if maskString == "" {
+			maskString = config.ScrubberRedactedString
+		}
+		mask = []byte(maskString)
+	}
+
+	return newSensitiveDataLeakPrologCallback(r, compiled, mask), nil
+}
+
+var ErrSensitiveDataLeakProtection = errors.New("sensitive data leak protection triggered")
+
+type SensitiveDataLeakAttackInfo struct {
+	// Patterns is the list of pattern names found in the response body. The
+	// sensitive data found is intentionally not part of the attack info.
+	Patterns []string `json:"patterns"`
+	// Masked is true when the sensitive data found was masked.
+	Masked bool `json:"masked"`
+}
+
+var defaultSensitiveDataPatterns = []api.SensitiveDataPattern{
+	{
+		Name:   "stack_trace",
+		Regexp: `(?m)^goroutine \d+ \[[^\]]+\]:$|Traceback \(most recent call last\)|\bat [\w$.]+\(\w+\.java:\d+\)`,
+	},
+	{
+		Name:   "sql_error",
+		Regexp: `(?i)you have an error in your sql syntax|unclosed quotation mark after the character string|pq: syntax error at or near|\bORA-\d{5}\b|SQLSTATE\[\w+\]|near "[^"]*": syntax error`,
+	},
+	{
+		Name:   "credit_card",
+		Regexp: `\b(?:\d[ -]?){12,18}\d\b`,
+		Luhn:   true,
+	},
+	{
+		Name:   "secret",
+		Regexp: `-----BEGIN (?:RSA |EC |DSA |OPENSSH )?PRIVATE KEY-----|\bAKIA[0-9A-Z]{16}\b|\bxox[abprs]-[0-9A-Za-z-]{10,}`,
+	},
+}
+
+type sensitiveDataPattern struct {
+	name string
+	re   *regexp.Regexp
+	luhn bool
+}
+
+func compileSensitiveDataPatterns(patterns []api.SensitiveDataPattern) ([]sensitiveDataPattern, error) {
+	compiled := make([]sensitiveDataPattern, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "could not compile the regular expression `%s` of pattern `%s`", p.Regexp, p.Name)
+		}
+		compiled[i] = sensitiveDataPattern{
+			name: p.Name,
+			re:   re,
+			luhn: p.Luhn,
+		}
+	}
+	return compiled, nil
+}
+
+func newSensitiveDataLeakPrologCallback(r RuleContext, patterns []sensitiveDataPattern, mask []byte) http_protection.ResponseBodyFilterPrologCallbackType {
+	return func(_ **http_protection.ProtectionContext, body *[]byte) (epilog http_protection.ResponseBodyFilterEpilogCallbackType, prologErr error) {
+		r.Pre(func(c CallbackContext) error {
+			found, masked := findSensitiveData(*body, patterns, mask)
+			if len(found) == 0 {
+				return nil
+			}
+
+			info := SensitiveDataLeakAttackInfo{
+				Patterns: found,
+				Masked:   mask != nil,
+			}
+			if blocked := c.HandleAttack(mask == nil, event.WithAttackInfo(info)); blocked {
+				// Return the epilog and abort the call.
+				epilog = func(_ *[]byte, err *error) {
+					*err = sdk_types.SqreenError{Err: ErrSensitiveDataLeakProtection}
+				}
+				prologErr = sqhook.AbortError
+				return nil
+			}
+
+			if mask != nil {
+				*body = masked
+			}
+			return nil
+		})
+		return
+	}
+}
+
+// findSensitiveData returns the names of the patterns found in the body, along
+// with the body where their matches are replaced by the mask when not nil.
+func findSensitiveData(body []byte, patterns []sensitiveDataPattern, mask []byte) (found []string, masked []byte) {
+	masked = body
+	for _, p := range patterns {
+		matched := false
+		masked = p.re.ReplaceAllFunc(masked, func(match []byte) []byte {
+			if p.luhn && !isLuhnValid(match) {
+				return match
+			}
+			matched = true
+			if mask == nil {
+				return match
+			}
+			return mask
+		})
+		if matched {
+			found = append(found, p.name)
+		}
+	}
+	return found, masked
+}
+
+// isLuhnValid returns true when the digits of the given number pass the Luhn
+// checksum. Non-digit characters are ignored.
+func isLuhnValid(number []byte) bool {
+	var (
+		sum    int
+		n      int
+		double bool
+	)
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
@@ -0,0 +1,531 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package callback
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	waf_types "github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// WAFExclusion is a local exclusion of in-app WAF rules allowing to suppress
+// their false positives. It applies to the WAF rules of the given IDs, or to
+// every WAF rule when none is given, and is applied to the WAF rulesets of the
+// rulespack when the WAF callbacks are created.
+type WAFExclusion struct {
+	// Name of the exclusion reported in the attacks and request traces.
+	Name string `json:"name"`
+	// RuleIDs are the IDs of the WAF rules the exclusion applies to.
+	RuleIDs []string `json:"rule_ids"`
+	// Disabled disables the rules.
+	Disabled bool `json:"disabled"`
+	// MonitorOnly switches the rules to monitoring so that their matches are
+	// reported but never block.
+	MonitorOnly bool `json:"monitor_only"`
+	// Params are the names of the request parameters removed from the values
+	// given to the rules, at any depth. The request headers are not concerned.
+	Params []string `json:"params"`
+	// Headers are the names of the request headers removed from the request
+	// header maps given to the rules. The values of the single headers are no
+	// longer given either.
+	Headers []string `json:"headers"`
+	// Paths are the URL paths of the requests the rules don't apply to,
+	// including their sub-paths.
+	Paths []string `json:"paths"`
+}
+
+// NewWAFExclusions parses the given JSON array of WAF exclusions. Exclusions
+// without name are named after their index in the array.
+func NewWAFExclusions(buf []byte) ([]WAFExclusion, error) {
+	var exclusions []WAFExclusion
+	if err := json.Unmarshal(buf, &exclusions); err != nil {
+		return nil, sqerrors.Wrap(err, "json unmarshaling error")
+	}
+	for i := range exclusions {
+		e := &exclusions[i]
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("exclusion %d", i)
+		}
+		if !e.Disabled && !e.MonitorOnly && len(e.Params) == 0 && len(e.Headers) == 0 && len(e.Paths) == 0 {
+			return nil, sqerrors.Errorf("waf exclusion `%s`: nothing is excluded", e.Name)
+		}
+	}
+	return exclusions, nil
+}
+
+func (e *WAFExclusion) appliesTo(ruleID string) bool {
+	if len(e.RuleIDs) == 0 {
+		return true
+	}
+	for _, id := range e.RuleIDs {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *WAFExclusion) excludesInputs() bool {
+	return len(e.Params) > 0 || len(e.Headers) > 0 || len(e.Paths) > 0
+}
+
+// wafExclusionsConfig is the interface of the rule contexts having local WAF
+// exclusions.
+type wafExclusionsConfig interface {
+	WAFExclusions() []WAFExclusion
+}
+
+func getWAFExclusions(rule RuleContext) []WAFExclusion {
+	if r, ok := rule.(wafExclusionsConfig); ok {
+		return r.WAFExclusions()
+	}
+	return nil
+}
+
+// wafExclusions are the local WAF exclusions applied to a WAF ruleset. The
+// inputs excluded from the rules are given to the WAF under addresses derived
+// from their binding accessor expressions, which the filters of the rules
+// target instead.
+type wafExclusions struct {
+	// rules are the names of the exclusions applied to the rules, by rule ID.
+	rules map[string][]string
+	// monitorOnly is the set of monitor-only rule IDs.
+	monitorOnly map[string]struct{}
+	// addresses are the addresses of the excluded inputs.
+	addresses map[string]wafExcludedInput
+}
+
+// wafExcludedInput is the value of a binding accessor expression without the
+// inputs excluded by a filter.
+type wafExcludedInput struct {
+	expr   string
+	filter *wafInputFilter
+	// headers is true when the expression is a request header map, whose keys
+	// are header names rather than parameter names.
+	headers bool
+	// header is the name of the request header of the expression, if any.
+	header string
+}
+
+// wafHeaderExpr matches the binding accessor expressions of the request
+// headers: the header map, or the value of a single header when indexed or
+// called with its name.
+var wafHeaderExpr = regexp.MustCompile(`^#\.Request\.Headers?\s*(?:[\[(]\s*['"]([^'"]*)['"]\s*[\])])?$`)
+
+func newWAFExcludedInput(expr string, filter *wafInputFilter) wafExcludedInput {
+	input := wafExcludedInput{expr: expr, filter: filter}
+	if m := wafHeaderExpr.FindStringSubmatch(strings.TrimSpace(expr)); m != nil {
+		if m[1] == "" {
+			input.headers = true
+		} else {
+			input.header = m[1]
+		}
+	}
+	return input
+}
+
+type wafInputFilter struct {
+	params  map[string]struct{}
+	headers map[string]struct{}
+	paths   []string
+}
+
+// JSON definition of the WAF ruleset parts modified by the exclusions. The
+// other fields are kept as-is.
+type (
+	jsonWAFRuleset = map[string]json.RawMessage
+	jsonWAFEntry   = map[string]json.RawMessage
+)
+
+// applyWAFExclusions applies the WAF exclusions to the given JSON WAF ruleset
+// and returns the resulting ruleset along with the exclusions to apply when
+// running it. The returned exclusions are nil when none applies to the
+// ruleset.
+func applyWAFExclusions(ruleset string, exclusions []WAFExclusion) (string, *wafExclusions, error) {
+	if len(exclusions) == 0 {
+		return ruleset, nil, nil
+	}
+
+	var def jsonWAFRuleset
+	if err := json.Unmarshal([]byte(ruleset), &def); err != nil {
+		return "", nil, sqerrors.Wrap(err, "json unmarshaling error")
+	}
+	var rules, flows []jsonWAFEntry
+	if err := unmarshalWAFField(def, "rules", &rules); err != nil {
+		return "", nil, err
+	}
+	if err := unmarshalWAFField(def, "flows", &flows); err != nil {
+		return "", nil, err
+	}
+
+	e := &wafExclusions{
+		rules:       make(map[string][]string),
+		monitorOnly: make(map[string]struct{}),
+		addresses:   make(map[string]wafExcludedInput),
+	}
+	disabled := make(map[string]struct{})
+	filters := make(map[string]*wafInputFilter)
+	keptRules := make([]jsonWAFEntry, 0, len(rules))
+	for _, r := range rules {
+		var id string
+		if err := unmarshalWAFField(r, "rule_id", &id); err != nil {
+			return "", nil, err
+		}
+
+		var names, inputExclusions []string
+		filter := &wafInputFilter{}
+		for i := range exclusions {
+			exclusion := &exclusions[i]
+			if !exclusion.appliesTo(id) {
+				continue
+			}
+			names = append(names, exclusion.Name)
+			if exclusion.Disabled {
+				disabled[id] = struct{}{}
+			}
+			if exclusion.MonitorOnly {
+				e.monitorOnly[id] = struct{}{}
+			}
+			if exclusion.excludesInputs() {
+				inputExclusions = append(inputExclusions, exclusion.Name)
+				filter.add(exclusion)
+			}
+		}
+		if _, isDisabled := disabled[id]; isDisabled {
+			continue
+		}
+		if len(names) > 0 {
+			e.rules[id] = names
+		}
+
+		if len(inputExclusions) > 0 {
+			// Rules excluding the same inputs share the same derived addresses
+			suffix := " [" + strings.Join(inputExclusions, ", ") + "]"
+			if f, exists := filters[suffix]; exists {
+				filter = f
+			} else {
+				filters[suffix] = filter
+			}
+			if err := e.retargetRule(r, suffix, filter); err != nil {
+				return "", nil, sqerrors.Wrapf(err, "rule `%s`", id)
+			}
+		}
+		keptRules = append(keptRules, r)
+	}
+
+	if len(e.rules) == 0 && len(disabled) == 0 {
+		// None of the exclusions apply to this ruleset
+		return ruleset, nil, nil
+	}
+
+	if len(disabled) > 0 {
+		keptFlows := make([]jsonWAFEntry, 0, len(flows))
+		for _, f := range flows {
+			keep, err := disableWAFFlowRules(f, disabled)
+			if err != nil {
+				return "", nil, err
+			}
+			if keep {
+				keptFlows = append(keptFlows, f)
+			}
+		}
+		if len(keptFlows) == 0 {
+			return "", nil, sqerrors.New("every flow of the waf ruleset is disabled by the waf exclusions")
+		}
+		flows = keptFlows
+	}
+
+	if err := marshalWAFField(def, "rules", keptRules); err != nil {
+		return "", nil, err
+	}
+	if err := marshalWAFField(def, "flows", flows); err != nil {
+		return "", nil, err
+	}
+	buf, err := json.Marshal(def)
+	if err != nil {
+		return "", nil, sqerrors.Wrap(err, "json marshaling error")
+	}
+	return string(buf), e, nil
+}
+
+// retargetRule replaces the targets of the rule filters with their addresses
+// derived with the given suffix and input filter.
+func (e *wafExclusions) retargetRule(r jsonWAFEntry, suffix string, filter *wafInputFilter) error {
+	var filters []jsonWAFEntry
+	if err := unmarshalWAFField(r, "filters", &filters); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		var targets []string
+		if err := unmarshalWAFField(f, "targets", &targets); err != nil {
+			return err
+		}
+		for i, expr := range targets {
+			addr := expr + suffix
+			e.addresses[addr] = newWAFExcludedInput(expr, filter)
+			targets[i] = addr
+		}
+		if err := marshalWAFField(f, "targets", targets); err != nil {
+			return err
+		}
+	}
+	return marshalWAFField(r, "filters", filters)
+}
+
+// disableWAFFlowRules removes the disabled rules from the flow steps. Steps
+// left without rules are removed and the jumps to them are replaced by their
+// no-match jump, as a step without rules never matches. It returns false when
+// no step is left in the flow.
+func disableWAFFlowRules(f jsonWAFEntry, disabled map[string]struct{}) (keep bool, err error) {
+	type jsonStep struct {
+		ID        string   `json:"id"`
+		RuleIDs   []string `json:"rule_ids"`
+		OnMatch   string   `json:"on_match"`
+		OnNoMatch string   `json:"on_no_match"`
+	}
+
+	var steps []jsonWAFEntry
+	if err := unmarshalWAFField(f, "steps", &steps); err != nil {
+		return false, err
+	}
+	defs := make([]jsonStep, len(steps))
+	for i, s := range steps {
+		buf, err := json.Marshal(s)
+		if err != nil {
+			return false, sqerrors.Wrap(err, "json marshaling error")
+		}
+		if err := json.Unmarshal(buf, &defs[i]); err != nil {
+			return false, sqerrors.Wrap(err, "json unmarshaling error")
+		}
+	}
+
+	// Remove the disabled rules and find the removed steps
+	removed := make(map[string]string)
+	for i := range defs {
+		s := &defs[i]
+		ruleIDs := make([]string, 0, len(s.RuleIDs))
+		for _, id := range s.RuleIDs {
+			if _, isDisabled := disabled[id]; !isDisabled {
+				ruleIDs = append(ruleIDs, id)
+			}
+		}
+		s.RuleIDs = ruleIDs
+		if len(ruleIDs) == 0 {
+			removed[s.ID] = s.OnNoMatch
+		}
+	}
+
+	// resolve returns the jump replacing the jump to a removed step.
+	resolve := func(next string) string {
+		for n := 0; n <= len(removed); n++ {
+			replacement, isRemoved := removed[next]
+			if !isRemoved {
+				return next
+			}
+			next = replacement
+		}
+		// Loop of removed steps
+		return ""
+	}
+
+	kept := make([]jsonWAFEntry, 0, len(steps))
+	for i, s := range steps {
+		def := &defs[i]
+		if _, isRemoved := removed[def.ID]; isRemoved {
+			continue
+		}
+		if err := marshalWAFField(s, "rule_ids", def.RuleIDs); err != nil {
+			return false, err
+		}
+		if _, exists := s["on_match"]; exists {
+			if err := marshalWAFField(s, "on_match", resolve(def.OnMatch)); err != nil {
+				return false, err
+			}
+		}
+		if _, exists := s["on_no_match"]; exists {
+			if err := marshalWAFField(s, "on_no_match", resolve(def.OnNoMatch)); err != nil {
+				return false, err
+			}
+		}
+		kept = append(kept, s)
+	}
+	if len(kept) == 0 {
+		return false, nil
+	}
+	return true, marshalWAFField(f, "steps", kept)
+}
+
+func unmarshalWAFField(entry jsonWAFEntry, field string, v interface{}) error {
+	raw, exists := entry[field]
+	if !exists {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return sqerrors.Wrapf(err, "json unmarshaling error of field `%s`", field)
+	}
+	return nil
+}
+
+func marshalWAFField(entry jsonWAFEntry, field string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return sqerrors.Wrapf(err, "json marshaling error of field `%s`", field)
+	}
+	entry[field] = buf
+	return nil
+}
+
+func (f *wafInputFilter) add(e *WAFExclusion) {
+	for _, p := range e.Params {
+		if f.params == nil {
+			f.params = make(map[string]struct{})
+		}
+		f.params[p] = struct{}{}
+	}
+	for _, h := range e.Headers {
+		if f.headers == nil {
+			f.headers = make(map[string]struct{})
+		}
+		f.headers[strings.ToLower(h)] = struct{}{}
+	}
+	f.paths = append(f.paths, e.Paths...)
+}
+
+// excludesPath returns true when the given request path is one of the
+// excluded paths or one of their sub-paths.
+func (f *wafInputFilter) excludesPath(path string) bool {
+	for _, excluded := range f.paths {
+		excluded = strings.TrimSuffix(excluded, "/")
+		if path == excluded || strings.HasPrefix(path, excluded+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesHeader returns true when the given header name is excluded.
+func (f *wafInputFilter) excludesHeader(name string) bool {
+	_, excluded := f.headers[strings.ToLower(name)]
+	return excluded
+}
+
+// excludesParam returns true when the given parameter name is excluded.
+func (f *wafInputFilter) excludesParam(name string) bool {
+	_, excluded := f.params[name]
+	return excluded
+}
+
+// value returns the value of the input without the excluded headers or
+// parameters, according to its kind. It returns false when the value is
+// excluded as a whole.
+func (i *wafExcludedInput) value(v interface{}) (interface{}, bool) {
+	switch {
+	case i.header != "":
+		return v, !i.filter.excludesHeader(i.header)
+	case i.headers:
+		if len(i.filter.headers) == 0 {
+			return v, true
+		}
+		// Only the top-level keys are header names
+		return filterWAFValue(v, i.filter.excludesHeader, maxWAFExclusionDepth-1), true
+	default:
+		if len(i.filter.params) == 0 {
+			return v, true
+		}
+		return filterWAFValue(v, i.filter.excludesParam, 0), true
+	}
+}
+
+// Maximum depth of the values walked to remove the excluded parameters and
+// headers.
+const maxWAFExclusionDepth = 20
+
+// filterWAFValue returns a copy of the given value without the map entries
+// whose keys are excluded, down to the maximum depth. Maps and slices are
+// copied into generic map and slice values.
+func filterWAFValue(v interface{}, excluded func(key string) bool, depth int) interface{} {
+	if depth >= maxWAFExclusionDepth {
+		return v
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		m := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			if excluded(key) {
+				continue
+			}
+			m[key] = filterWAFValue(iter.Value().Interface(), excluded, depth+1)
+		}
+		return m
+
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			// Byte slice
+			return v
+		}
+		s := make([]interface{}, rv.Len())
+		for i := range s {
+			s[i] = filterWAFValue(rv.Index(i).Interface(), excluded, depth+1)
+		}
+		return s
+
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return v
+		}
+		return filterWAFValue(rv.Elem().Interface(), excluded, depth)
+
+	default:
+		return v
+	}
+}
+
+// addExcludedInputs adds to the data set the values of the excluded inputs
+// addresses, derived from the binding accessor values of the data set. They
+// are not added when the request path is excluded.
+func (e *wafExclusions) addExcludedInputs(c CallbackContext, args waf_types.DataSet, path string) {
+	for addr, input := range e.addresses {
+		value, exists := args[input.expr]
+		if !exists || input.filter.excludesPath(path) {
+			continue
+		}
+		value, exists = input.value(value)
+		if !exists {
+			continue
+		}
+		TraceValue(c, addr, value)
+		args[addr] = value
+	}
+}
+
+// matchedRuleExclusions returns the names of the exclusions applied to the
+// rule of the given WAF match information, and whether the rule is
+// monitor-only.
+func (e *wafExclusions) matchedRuleExclusions(info []byte) (names []string, monitorOnly bool) {
+	var matches []struct {
+		Rule string `json:"rule"`
+	}
+	if err := json.Unmarshal(info, &matches); err != nil {
+		return nil, false
+	}
+	for _, m := range matches {
+		names = append(names, e.rules[m.Rule]...)
+		if _, exists := e.monitorOnly[m.Rule]; exists {
+			monitorOnly = true
+		}
+	}
+	return names, monitorOnly
+}
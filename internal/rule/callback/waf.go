@@ -7,6 +7,7 @@
 package callback
 
 import (
+	"crypto/sha256"
 	"errors"
 	"reflect"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"github.com/sqreen/go-agent/internal/sqlib/sqassert"
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
 	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	"github.com/sqreen/go-agent/internal/sqlib/sqwaf"
 	sdk_types "github.com/sqreen/go-agent/sdk/types"
 	"github.com/sqreen/go-libsqreen/waf"
 	waf_types "github.com/sqreen/go-libsqreen/waf/types"
@@ -39,30 +41,38 @@ func (o *wafCallbackObject) Close() error {
 	return o.wafRule.Close()
 }
 
-func prepareWAF(cfg NativeCallbackConfig) (waf_types.Rule, map[string]bindingaccessor.BindingAccessorFunc, time.Duration, error) {
+// prepareWAF returns the WAF rule of the callback configuration, along with
+// its binding accessors, its timeout and the local WAF exclusions applied to
+// it, nil when none.
+func prepareWAF(cfg NativeCallbackConfig, exclusions []WAFExclusion) (waf_types.Rule, map[string]bindingaccessor.BindingAccessorFunc, time.Duration, *wafExclusions, error) {
 	data, ok := cfg.Data().(*api.WAFRuleDataEntry)
 	if !ok {
-		return nil, nil, 0, sqerrors.Errorf("unexpected callback data type: got `%T` instead of `%T`", cfg.Data(), data)
+		return nil, nil, 0, nil, sqerrors.Errorf("unexpected callback data type: got `%T` instead of `%T`", cfg.Data(), data)
 	}
 
 	id, err := uuid.NewRandom()
 	if err != nil {
-		return nil, nil, 0, sqerrors.New("could not generate a uuid")
+		return nil, nil, 0, nil, sqerrors.New("could not generate a uuid")
 	}
 
-	wafRule, err := waf.NewRule(id.String(), data.WAFRules, bindingaccessor.NewValueMaxElements, bindingaccessor.MaxExecutionDepth)
+	ruleset, wafExclusions, err := applyWAFExclusions(data.WAFRules, exclusions)
 	if err != nil {
-		return nil, nil, 0, sqerrors.Wrap(err, "could not instantiate the in-app waf rule")
+		return nil, nil, 0, nil, sqerrors.Wrap(err, "could not apply the waf exclusions")
+	}
+
+	wafRule, err := newWAFRule(id.String(), ruleset, bindingaccessor.NewValueMaxElements, bindingaccessor.MaxExecutionDepth)
+	if err != nil {
+		return nil, nil, 0, nil, sqerrors.Wrap(err, "could not instantiate the in-app waf rule")
 	}
 
 	if len(data.BindingAccessors) == 0 {
-		return nil, nil, 0, sqerrors.New("unexpected empty list of binding accessors")
+		return nil, nil, 0, nil, sqerrors.New("unexpected empty list of binding accessors")
 	}
 	bindingAccessors := make(map[string]bindingaccessor.BindingAccessorFunc, len(data.BindingAccessors))
 	for _, expr := range data.BindingAccessors {
 		ba, err := bindingaccessor.Compile(expr)
 		if err != nil {
-			return nil, nil, 0, sqerrors.Wrapf(err, "could not compile binding accessor expression `%s`", expr)
+			return nil, nil, 0, nil, sqerrors.Wrapf(err, "could not compile binding accessor expression `%s`", expr)
 		}
 		bindingAccessors[expr] = ba
 	}
@@ -74,15 +84,118 @@ func prepareWAF(cfg NativeCallbackConfig) (waf_types.Rule, map[string]bindingacc
 		timeout = defaultMaxWAFTimeBudget
 	}
 
-	return wafRule, bindingAccessors, timeout, nil
+	return wafRule, bindingAccessors, timeout, wafExclusions, nil
+}
+
+// newWAFRule returns the in-app waf rule of the native waf library, or of the
+// pure-Go one when the native one is not available because cgo was disabled.
+func newWAFRule(id, rule string, maxLen, maxDepth uint64) (waf_types.Rule, error) {
+	if waf.Version() == nil {
+		return sqwaf.NewRule(id, rule, maxLen, maxDepth)
+	}
+	return waf.NewRule(id, rule, maxLen, maxDepth)
+}
+
+// Static assert that `newWAFRule` has the expected signature
+var _ waf_types.NewRuleFunc = newWAFRule
+
+// wafStateKey is the key of the request WAF state (cf. CallbackState()). It is
+// shared by the WAF callbacks of the same rulespack and WAF ruleset, such as
+// the ones of the request and request body phases.
+type wafStateKey struct {
+	rulespackID string
+	ruleset     [sha256.Size]byte
+}
+
+func newWAFStateKey(rule RuleContext, cfg NativeCallbackConfig) wafStateKey {
+	var key wafStateKey
+	if r, ok := rule.(interface{ RulespackID() string }); ok {
+		key.rulespackID = r.RulespackID()
+	}
+	if data, ok := cfg.Data().(*api.WAFRuleDataEntry); ok {
+		key.ruleset = sha256.Sum256([]byte(data.WAFRules))
+	}
+	return key
+}
+
+// wafState is the request WAF state remembering the binding accessor values
+// already given to the WAF, the result of the last WAF run and the monitored
+// matches already reported, so that the WAF is only run again in the later
+// request phases when new data is available, such as the body parameters, the
+// identified user or the response status. The WAF is always given the full
+// data set since the filters of a rule can target values of different phases.
+type wafState struct {
+	args waf_types.DataSet
+	// action and info are the result of the last WAF run with args.
+	action waf_types.Action
+	info   []byte
+	// monitored are the matches already reported without blocking.
+	monitored map[string]struct{}
+	// partial are the partial evaluation flags of the request, telling why
+	// some request data may not have been given to the WAF.
+	partial []string
+}
+
+func newWAFState() interface{} {
+	return &wafState{
+		args:      make(waf_types.DataSet),
+		monitored: make(map[string]struct{}),
+	}
+}
+
+// mergeArgs returns the full data set made of the values already given to the
+// WAF and of the given ones, along with whether some of the given values are
+// new or changed since then.
+func (s *wafState) mergeArgs(args waf_types.DataSet) (merged waf_types.DataSet, changed bool) {
+	merged = make(waf_types.DataSet, len(s.args)+len(args))
+	for expr, value := range s.args {
+		merged[expr] = value
+	}
+	for expr, value := range args {
+		if prev, exists := s.args[expr]; !exists || !reflect.DeepEqual(prev, value) {
+			changed = true
+		}
+		merged[expr] = value
+	}
+	return merged, changed
+}
+
+// setResult remembers the data set given to the WAF and its result.
+func (s *wafState) setResult(args waf_types.DataSet, action waf_types.Action, info []byte) {
+	s.args = args
+	s.action = action
+	s.info = info
+}
+
+// addPartial adds the given partial evaluation flag.
+func (s *wafState) addPartial(flag string) {
+	for _, f := range s.partial {
+		if f == flag {
+			return
+		}
+	}
+	s.partial = append(s.partial, flag)
+}
+
+// reported returns true when the given WAF match was already reported without
+// blocking the request. Blocking matches are never considered as reported so
+// that they keep blocking, for example a retried SQL query.
+func (s *wafState) reported(info []byte) bool {
+	_, exists := s.monitored[string(info)]
+	return exists
+}
+
+// addMonitored remembers the given WAF match reported without blocking.
+func (s *wafState) addMonitored(info []byte) {
+	s.monitored[string(info)] = struct{}{}
 }
 
 func NewWAFCallback(rule RuleContext, cfg NativeCallbackConfig) (sqhook.PrologCallback, error) {
-	wafRule, bindingAccessors, timeout, err := prepareWAF(cfg)
+	wafRule, bindingAccessors, timeout, exclusions, err := prepareWAF(cfg, getWAFExclusions(rule))
 	if err != nil {
 		return nil, sqerrors.Wrap(err, "unexpected configuration error")
 	}
-	return newWAFPrologCallback(rule, wafRule, bindingAccessors, timeout), nil
+	return newWAFPrologCallback(rule, newWAFStateKey(rule, cfg), wafRule, exclusions, bindingAccessors, timeout), nil
 }
 
 type (
@@ -92,18 +205,67 @@ type (
 
 var ErrWAFProtection = errors.New("waf protection triggered")
 
-func newWAFPrologCallback(rule RuleContext, wafRule waf_types.Rule, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration) *wafCallbackObject {
+// Reasons of the skipped WAF executions, recorded into the WAF skips metrics
+// and into the partial evaluation flags of the WAF attacks.
+const (
+	// The time budget was exhausted before running the WAF.
+	wafSkipBudgetExhausted = "budget_exhausted"
+	// The time budget was exhausted while evaluating the binding accessors.
+	wafSkipBindingAccessorsBudgetExhausted = "binding_accessors_budget_exhausted"
+	// The WAF execution timed out.
+	wafSkipTimeout = "timeout"
+)
+
+// wafPartialBindingAccessorError is the partial evaluation flag of the WAF
+// executions whose binding accessors failed.
+const wafPartialBindingAccessorError = "binding_accessor_error"
+
+// wafMonitor is the interface of the rule contexts monitoring the WAF
+// executions.
+type wafMonitor interface {
+	Phase() string
+	AddWAFSkip(reason string)
+}
+
+// wafPhase returns the request phase of the WAF rule.
+func wafPhase(rule RuleContext) string {
+	if m, ok := rule.(wafMonitor); ok {
+		return m.Phase()
+	}
+	return ""
+}
+
+// skipWAF records the skipped WAF execution into the rule metrics, the request
+// trace and the partial evaluation flags of the request.
+func skipWAF(rule RuleContext, c CallbackContext, state *wafState, reason string) {
+	if m, ok := rule.(wafMonitor); ok {
+		m.AddWAFSkip(reason)
+	}
+	TraceValue(c, "waf skipped", reason)
+	state.addPartial(wafPartialFlag(rule, reason))
+}
+
+func wafPartialFlag(rule RuleContext, reason string) string {
+	if phase := wafPhase(rule); phase != "" {
+		return phase + "/" + reason
+	}
+	return reason
+}
+
+func newWAFPrologCallback(rule RuleContext, stateKey wafStateKey, wafRule waf_types.Rule, exclusions *wafExclusions, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration) *wafCallbackObject {
 	return &wafCallbackObject{
 		wafRule: wafRule,
-		prolog:  makeWAFPrologCallback(rule, wafRule, bindingAccessors, timeout),
+		prolog:  makeWAFPrologCallback(rule, stateKey, wafRule, exclusions, bindingAccessors, timeout),
 	}
 }
 
-func runWAF(c CallbackContext, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, wafRule waf_types.Rule, timeout time.Duration) (blocked bool, err error) {
+func runWAF(c CallbackContext, rule RuleContext, stateKey wafStateKey, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, wafRule waf_types.Rule, exclusions *wafExclusions, timeout time.Duration) (blocked bool, err error) {
 	p := c.ProtectionContext()
+	state := CallbackState(c, stateKey, newWAFState).(*wafState)
 
 	// Check that we have `timeout` amount of time available
 	if p.DeadlineExceeded(timeout) {
+		skipWAF(rule, c, state, wafSkipBudgetExhausted)
 		return false, nil
 	}
 
@@ -120,8 +282,10 @@ func runWAF(c CallbackContext, bindingAccessors map[string]bindingaccessor.Bindi
 			// Log the error and continue
 			type errKey string
 			c.Logger().Error(sqerrors.WithKey(sqerrors.Wrapf(err, "binding accessor execution error `%s`", expr), errKey(expr)))
+			state.addPartial(wafPartialFlag(rule, wafPartialBindingAccessorError))
 			continue
 		}
+		TraceValue(c, expr, value)
 		if value == nil {
 			// Skip unset values
 			continue
@@ -130,39 +294,80 @@ func runWAF(c CallbackContext, bindingAccessors map[string]bindingaccessor.Bindi
 
 		// Check we haven't exceeded the time deadline if any
 		if p.DeadlineExceeded(0) {
+			skipWAF(rule, c, state, wafSkipBindingAccessorsBudgetExhausted)
 			return false, nil
 		}
 	}
 
+	if exclusions != nil {
+		exclusions.addExcludedInputs(c, args, wafRequestPath(baCtx))
+	}
+
 	// Check that we still have `timeout` amount of time available
 	if p.DeadlineExceeded(timeout) {
+		skipWAF(rule, c, state, wafSkipBindingAccessorsBudgetExhausted)
 		return false, nil
 	}
 
-	// TODO: args caching
-	action, info, err := wafRule.Run(args, timeout)
-	if err != nil {
-		if err == waf_types.ErrTimeout {
+	// Only run the WAF again when new values are available since a previous
+	// request phase, otherwise its last result still applies.
+	args, changed := state.mergeArgs(args)
+	action, info := state.action, state.info
+	if changed {
+		action, info, err = wafRule.Run(args, timeout)
+		if err != nil {
+			if err == waf_types.ErrTimeout {
+				// Skipped like when the budget is exhausted, rather than failed
+				skipWAF(rule, c, state, wafSkipTimeout)
+				return false, nil
+			}
 			type errKey struct{}
-			return false, sqerrors.WithKey(sqerrors.New("WAF timeout"), errKey{})
+			return false, sqerrors.WithKey(newWAFRunError(err, args, timeout), errKey{})
 		}
-		type errKey struct{}
-		return false, sqerrors.WithKey(newWAFRunError(err, args, timeout), errKey{})
+		state.setResult(args, action, info)
 	}
 
-	if action == waf_types.NoAction {
+	if action == waf_types.NoAction || state.reported(info) {
 		return false, nil
 	}
 
 	attackInfo := api.WAFAttackInfo{WAFData: info}
+	if len(state.partial) > 0 {
+		attackInfo.PartialEvaluation = append([]string(nil), state.partial...)
+	}
+	if exclusions != nil {
+		names, monitorOnly := exclusions.matchedRuleExclusions(info)
+		if monitorOnly {
+			action = waf_types.MonitorAction
+		}
+		if len(names) > 0 {
+			TraceValue(c, "waf exclusions", names)
+			attackInfo.Exclusions = names
+		}
+	}
 
-	return c.HandleAttack(action == waf_types.BlockAction, event.WithAttackInfo(attackInfo)), nil
+	blocked = c.HandleAttack(action == waf_types.BlockAction, event.WithAttackInfo(attackInfo))
+	if !blocked {
+		state.addMonitored(info)
+	}
+	return blocked, nil
+}
+
+// wafRequestPath returns the URL path of the request of the binding accessor
+// context.
+func wafRequestPath(baCtx WAFBindingAccessorContextType) string {
+	if r := baCtx.Request; r != nil && r.RequestReader != nil {
+		if u := r.URL(); u != nil {
+			return u.Path
+		}
+	}
+	return ""
 }
 
-func makeWAFPrologCallback(rule RuleContext, wafRule waf_types.Rule, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration) sqhook.PrologCallback {
+func makeWAFPrologCallback(rule RuleContext, stateKey wafStateKey, wafRule waf_types.Rule, exclusions *wafExclusions, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration) sqhook.PrologCallback {
 	return func(**http_protection.ProtectionContext) (epilog http_protection.BlockingEpilogCallbackType, prologErr error) {
 		rule.Pre(func(c CallbackContext) error {
-			blocked, err := runWAF(c, bindingAccessors, wafRule, timeout)
+			blocked, err := runWAF(c, rule, stateKey, bindingAccessors, wafRule, exclusions, timeout)
 			if err != nil {
 				return sqerrors.Wrap(err, "WAF execution error")
 			}
@@ -204,7 +409,7 @@ func NewFunctionWAFCallback(r RuleContext, cfg ReflectedCallbackConfig, function
 		return nil, sqerrors.New("unexpected empty pre and post list of binding accessors")
 	}
 
-	wafRule, bindingAccessors, timeout, err := prepareWAF(cfg)
+	wafRule, bindingAccessors, timeout, exclusions, err := prepareWAF(cfg, getWAFExclusions(r))
 	if err != nil {
 		return nil, sqerrors.Wrap(err, "unexpected configuration error")
 	}
@@ -219,7 +424,7 @@ func NewFunctionWAFCallback(r RuleContext, cfg ReflectedCallbackConfig, function
 		return nil, sqerrors.Wrap(err, "could not compile the post binding accessors")
 	}
 
-	return newFunctionWAFPrologCallback(r, wafRule, bindingAccessors, timeout, cfg.Strategy(), pre, post), nil
+	return newFunctionWAFPrologCallback(r, newWAFStateKey(r, cfg), wafRule, exclusions, bindingAccessors, timeout, cfg.Strategy(), pre, post), nil
 }
 
 type functionWAFBindingAccessorMap map[*bindingaccessor.BindingAccessorFunc]bindingaccessor.BindingAccessorFunc
@@ -246,14 +451,14 @@ func compileFunctionWAFBindingAccessors(bas map[string]string) (functionWAFBindi
 	return r, nil
 }
 
-func newFunctionWAFPrologCallback(r RuleContext, wafRule waf_types.Rule, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration, strategy *api.ReflectedCallbackConfig, pre, post functionWAFBindingAccessorMap) *wafCallbackObject {
+func newFunctionWAFPrologCallback(r RuleContext, stateKey wafStateKey, wafRule waf_types.Rule, exclusions *wafExclusions, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration, strategy *api.ReflectedCallbackConfig, pre, post functionWAFBindingAccessorMap) *wafCallbackObject {
 	return &wafCallbackObject{
 		wafRule: wafRule,
-		prolog:  makeFunctionWAFPrologCallback(r, wafRule, bindingAccessors, timeout, strategy, pre, post),
+		prolog:  makeFunctionWAFPrologCallback(r, stateKey, wafRule, exclusions, bindingAccessors, timeout, strategy, pre, post),
 	}
 }
 
-func makeFunctionWAFPrologCallback(r RuleContext, wafRule waf_types.Rule, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration, strategy *api.ReflectedCallbackConfig, pre, post functionWAFBindingAccessorMap) sqhook.ReflectedPrologCallback {
+func makeFunctionWAFPrologCallback(r RuleContext, stateKey wafStateKey, wafRule waf_types.Rule, exclusions *wafExclusions, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, timeout time.Duration, strategy *api.ReflectedCallbackConfig, pre, post functionWAFBindingAccessorMap) sqhook.ReflectedPrologCallback {
 	sqassert.True(len(pre) > 0 || len(post) > 0)
 
 	return func(params []reflect.Value) (epilog sqhook.ReflectedEpilogCallback, prologErr error) {
@@ -264,7 +469,7 @@ func makeFunctionWAFPrologCallback(r RuleContext, wafRule waf_types.Rule, bindin
 					preErr = err
 				}()
 
-				blocked, err := runFunctionWAF(c, bindingAccessors, wafRule, timeout, pre, strategy, params, nil)
+				blocked, err := runFunctionWAF(c, r, stateKey, bindingAccessors, wafRule, exclusions, timeout, pre, strategy, params, nil)
 				if err != nil {
 					return sqerrors.Wrap(err, "function waf error: pre")
 				}
@@ -287,7 +492,7 @@ func makeFunctionWAFPrologCallback(r RuleContext, wafRule waf_types.Rule, bindin
 		if l := len(post); l > 0 {
 			epilog = func(results []reflect.Value) {
 				r.Post(func(c CallbackContext) error {
-					blocked, err := runFunctionWAF(c, bindingAccessors, wafRule, timeout, post, strategy, params, results)
+					blocked, err := runFunctionWAF(c, r, stateKey, bindingAccessors, wafRule, exclusions, timeout, post, strategy, params, results)
 					if err != nil {
 						type keyErr struct{}
 						return sqerrors.WithKey(sqerrors.Wrap(err, "function waf error: post"), keyErr{})
@@ -309,7 +514,7 @@ func makeFunctionWAFPrologCallback(r RuleContext, wafRule waf_types.Rule, bindin
 	}
 }
 
-func runFunctionWAF(c CallbackContext, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, wafRule waf_types.Rule, timeout time.Duration, extraParamAccessors functionWAFBindingAccessorMap, strategy *api.ReflectedCallbackConfig, params []reflect.Value, results []reflect.Value) (blocked bool, err error) {
+func runFunctionWAF(c CallbackContext, r RuleContext, stateKey wafStateKey, bindingAccessors map[string]bindingaccessor.BindingAccessorFunc, wafRule waf_types.Rule, exclusions *wafExclusions, timeout time.Duration, extraParamAccessors functionWAFBindingAccessorMap, strategy *api.ReflectedCallbackConfig, params []reflect.Value, results []reflect.Value) (blocked bool, err error) {
 	baCtx, err := NewReflectedCallbackBindingAccessorContext(strategy.BindingAccessor.Capabilities, c.ProtectionContext(), params, results, nil)
 	if err != nil {
 		type errKey struct{}
@@ -353,5 +558,5 @@ func runFunctionWAF(c CallbackContext, bindingAccessors map[string]bindingaccess
 		return false, nil
 	}
 
-	return runWAF(c, bindingAccessors, wafRule, timeout)
+	return runWAF(c, r, stateKey, bindingAccessors, wafRule, exclusions, timeout)
 }
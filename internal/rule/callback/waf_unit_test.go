@@ -0,0 +1,232 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqwaf"
+	waf_types "github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAFState(t *testing.T) {
+	t.Run("args", func(t *testing.T) {
+		state := newWAFState().(*wafState)
+
+		// First request phase: everything is new
+		args, changed := state.mergeArgs(waf_types.DataSet{
+			"#.Request.UserAgent":      "Arachni",
+			"#.Request.FilteredParams": map[string][]interface{}{"QueryForm": {"a"}},
+		})
+		require.True(t, changed)
+		require.Len(t, args, 2)
+		state.setResult(args, waf_types.MonitorAction, []byte(`[{"rule":"ua"}]`))
+
+		// Body phase: the full data set is given, with the changed params and
+		// the new body
+		args, changed = state.mergeArgs(waf_types.DataSet{
+			"#.Request.FilteredParams": map[string][]interface{}{"QueryForm": {"a"}, "PostForm": {"b"}},
+			"#.Request.Body":           "body",
+		})
+		require.True(t, changed)
+		require.Equal(t, waf_types.DataSet{
+			"#.Request.UserAgent":      "Arachni",
+			"#.Request.FilteredParams": map[string][]interface{}{"QueryForm": {"a"}, "PostForm": {"b"}},
+			"#.Request.Body":           "body",
+		}, args)
+		state.setResult(args, waf_types.NoAction, nil)
+
+		// Nothing new
+		_, changed = state.mergeArgs(waf_types.DataSet{
+			"#.Request.UserAgent": "Arachni",
+			"#.Request.Body":      "body",
+		})
+		require.False(t, changed)
+		require.Equal(t, waf_types.NoAction, state.action)
+	})
+
+	t.Run("matches", func(t *testing.T) {
+		state := newWAFState().(*wafState)
+		require.False(t, state.reported([]byte(`[{"rule":"1"}]`)))
+		state.addMonitored([]byte(`[{"rule":"1"}]`))
+		require.True(t, state.reported([]byte(`[{"rule":"1"}]`)))
+		require.False(t, state.reported([]byte(`[{"rule":"2"}]`)))
+	})
+}
+
+func TestWAFExclusions(t *testing.T) {
+	const ruleset = `{
+  "rules": [
+    { "rule_id": "ua", "filters": [ { "operator": "@rx", "targets": [ "#.Request.UserAgent" ], "value": "Arachni" } ] },
+    { "rule_id": "sqli", "filters": [ { "operator": "@rx", "targets": [ "#.Request.FilteredParams", "#.Request.Header", "#.Request.Header('X-Other')" ], "value": "select" } ] }
+  ],
+  "flows": [
+    { "name": "attacks", "steps": [
+      { "id": "start", "rule_ids": [ "ua" ], "on_match": "exit_block", "on_no_match": "sqli" },
+      { "id": "sqli", "rule_ids": [ "sqli" ], "on_match": "exit_block" }
+    ] }
+  ]
+}`
+
+	newRule := func(t *testing.T, exclusions []WAFExclusion) (waf_types.Rule, *wafExclusions) {
+		r, e, err := applyWAFExclusions(ruleset, exclusions)
+		require.NoError(t, err)
+		wafRule, err := sqwaf.NewRule("id", r, 100, 10)
+		require.NoError(t, err)
+		return wafRule, e
+	}
+
+	run := func(t *testing.T, wafRule waf_types.Rule, e *wafExclusions, args waf_types.DataSet, path string) (waf_types.Action, []byte) {
+		if e != nil {
+			e.addExcludedInputs(nil, args, path)
+		}
+		action, info, err := wafRule.Run(args, time.Second)
+		require.NoError(t, err)
+		return action, info
+	}
+
+	t.Run("parsing", func(t *testing.T) {
+		exclusions, err := NewWAFExclusions([]byte(`[{"rule_ids":["ua"],"disabled":true},{"name":"search","params":["q"]}]`))
+		require.NoError(t, err)
+		require.Equal(t, []WAFExclusion{
+			{Name: "exclusion 0", RuleIDs: []string{"ua"}, Disabled: true},
+			{Name: "search", Params: []string{"q"}},
+		}, exclusions)
+
+		_, err = NewWAFExclusions([]byte(`[{"name":"nothing","rule_ids":["ua"]}]`))
+		require.Error(t, err)
+
+		_, err = NewWAFExclusions([]byte(`{}`))
+		require.Error(t, err)
+	})
+
+	t.Run("no exclusions", func(t *testing.T) {
+		r, e, err := applyWAFExclusions(ruleset, nil)
+		require.NoError(t, err)
+		require.Nil(t, e)
+		require.Equal(t, ruleset, r)
+
+		r, e, err = applyWAFExclusions(ruleset, []WAFExclusion{{Name: "other", RuleIDs: []string{"other"}, Disabled: true}})
+		require.NoError(t, err)
+		require.Nil(t, e)
+		require.Equal(t, ruleset, r)
+	})
+
+	t.Run("disabled rule", func(t *testing.T) {
+		wafRule, e := newRule(t, []WAFExclusion{{Name: "no ua", RuleIDs: []string{"ua"}, Disabled: true}})
+		action, _ := run(t, wafRule, e, waf_types.DataSet{"#.Request.UserAgent": "Arachni"}, "/")
+		require.Equal(t, waf_types.NoAction, action)
+
+		// The flow continues with the next step
+		action, _ = run(t, wafRule, e, waf_types.DataSet{"#.Request.FilteredParams": map[string]interface{}{"q": "select"}}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+	})
+
+	t.Run("every rule disabled", func(t *testing.T) {
+		_, _, err := applyWAFExclusions(ruleset, []WAFExclusion{{Name: "all", Disabled: true}})
+		require.Error(t, err)
+	})
+
+	t.Run("monitor-only rule", func(t *testing.T) {
+		wafRule, e := newRule(t, []WAFExclusion{{Name: "monitor sqli", RuleIDs: []string{"sqli"}, MonitorOnly: true}})
+		action, info := run(t, wafRule, e, waf_types.DataSet{"#.Request.FilteredParams": map[string]interface{}{"q": "select"}}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+		names, monitorOnly := e.matchedRuleExclusions(info)
+		require.True(t, monitorOnly)
+		require.Equal(t, []string{"monitor sqli"}, names)
+
+		action, info = run(t, wafRule, e, waf_types.DataSet{"#.Request.UserAgent": "Arachni"}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+		names, monitorOnly = e.matchedRuleExclusions(info)
+		require.False(t, monitorOnly)
+		require.Empty(t, names)
+	})
+
+	t.Run("excluded params and headers", func(t *testing.T) {
+		wafRule, e := newRule(t, []WAFExclusion{{Name: "search", RuleIDs: []string{"sqli"}, Params: []string{"q"}, Headers: []string{"x-query", "x-other"}}})
+
+		params := map[string][]interface{}{
+			"QueryForm": {map[string][]string{"q": {"select"}}},
+		}
+		headers := map[string][]string{"X-Query": {"select"}}
+		args := waf_types.DataSet{
+			"#.Request.FilteredParams":    params,
+			"#.Request.Header":            headers,
+			"#.Request.Header('X-Other')": "select",
+		}
+		action, _ := run(t, wafRule, e, args, "/")
+		require.Equal(t, waf_types.NoAction, action)
+
+		params["QueryForm"] = append(params["QueryForm"], map[string][]string{"other": {"select"}})
+		action, info := run(t, wafRule, e, args, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+		require.Contains(t, string(info), `"binding_accessor":"#.Request.FilteredParams [search]"`)
+		names, monitorOnly := e.matchedRuleExclusions(info)
+		require.False(t, monitorOnly)
+		require.Equal(t, []string{"search"}, names)
+	})
+
+	t.Run("excluded keys are scoped to their input", func(t *testing.T) {
+		wafRule, e := newRule(t, []WAFExclusion{{Name: "search", RuleIDs: []string{"sqli"}, Params: []string{"q"}, Headers: []string{"x-query"}}})
+
+		// A header named after an excluded parameter
+		action, _ := run(t, wafRule, e, waf_types.DataSet{"#.Request.Header": map[string][]string{"q": {"select"}}}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+
+		// A parameter named after an excluded header
+		params := map[string][]interface{}{
+			"QueryForm": {map[string][]string{"x-query": {"select"}}},
+		}
+		action, _ = run(t, wafRule, e, waf_types.DataSet{"#.Request.FilteredParams": params}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+
+		// A single header that is not excluded
+		action, _ = run(t, wafRule, e, waf_types.DataSet{"#.Request.Header('X-Other')": "select"}, "/")
+		require.Equal(t, waf_types.BlockAction, action)
+	})
+
+	t.Run("excluded paths", func(t *testing.T) {
+		wafRule, e := newRule(t, []WAFExclusion{{Name: "admin", RuleIDs: []string{"sqli"}, Paths: []string{"/admin/", "/internal"}}})
+		args := waf_types.DataSet{"#.Request.FilteredParams": map[string]interface{}{"q": "select"}}
+
+		for _, path := range []string{"/admin", "/admin/", "/admin/queries", "/internal", "/internal/queries"} {
+			action, _ := run(t, wafRule, e, args, path)
+			require.Equal(t, waf_types.NoAction, action, path)
+		}
+
+		for _, path := range []string{"/search", "/administrator", "/internals", "/"} {
+			action, _ := run(t, wafRule, e, args, path)
+			require.Equal(t, waf_types.BlockAction, action, path)
+		}
+	})
+}
+
+type wafMonitorMockup struct {
+	RuleContext
+	skips []string
+}
+
+func (m *wafMonitorMockup) Phase() string { return "bodyWAF" }
+
+func (m *wafMonitorMockup) AddWAFSkip(reason string) {
+	m.skips = append(m.skips, reason)
+}
+
+func TestSkipWAF(t *testing.T) {
+	state := newWAFState().(*wafState)
+	rule := &wafMonitorMockup{}
+	skipWAF(rule, nil, state, wafSkipTimeout)
+	skipWAF(rule, nil, state, wafSkipTimeout)
+	state.addPartial(wafPartialFlag(rule, wafPartialBindingAccessorError))
+	require.Equal(t, []string{wafSkipTimeout, wafSkipTimeout}, rule.skips)
+	require.Equal(t, []string{"bodyWAF/timeout", "bodyWAF/binding_accessor_error"}, state.partial)
+
+	// Rule contexts not monitoring the WAF
+	state = newWAFState().(*wafState)
+	skipWAF(nil, nil, state, wafSkipBudgetExhausted)
+	require.Equal(t, []string{"budget_exhausted"}, state.partial)
+}
@@ -6,9 +6,14 @@ package rule
 
 import (
 	"errors"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/event"
+	"github.com/sqreen/go-agent/internal/metrics"
+	"github.com/sqreen/go-agent/internal/plog"
 	"github.com/sqreen/go-agent/internal/rule/callback"
 	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
 	"github.com/sqreen/go-agent/internal/sqlib/sqsafe"
@@ -103,7 +108,7 @@ func TestCallbackMiddlewares(t *testing.T) {
 			timeHist := &testmock.TimeHistogramMockup{}
 			defer timeHist.AssertExpectations(t)
 
-			m := withPerformanceCap("rule", timeHist)
+			m := withPerformanceCap("rule", timeHist, nil, nil)
 			var called bool
 			cb := m(func(c callback.CallbackContext) error {
 				called = true
@@ -130,7 +135,7 @@ func TestCallbackMiddlewares(t *testing.T) {
 				timeHist.ExpectAdd("rule/before", 1).Return(nil).Once()
 				defer timeHist.AssertExpectations(t)
 
-				m := withPerformanceCap("rule", timeHist)
+				m := withPerformanceCap("rule", timeHist, nil, nil)
 				var called bool
 				cb := m(func(c callback.CallbackContext) error {
 					called = true
@@ -158,7 +163,7 @@ func TestCallbackMiddlewares(t *testing.T) {
 				timeHist.ExpectAdd("rule/after", 1).Return(nil).Once()
 				defer timeHist.AssertExpectations(t)
 
-				m := withPerformanceCap("rule", timeHist)
+				m := withPerformanceCap("rule", timeHist, nil, nil)
 				var called bool
 				cb := m(func(c callback.CallbackContext) error {
 					called = true
@@ -193,7 +198,7 @@ func TestCallbackMiddlewares(t *testing.T) {
 			return v >= 1.0 // v is in ms - so >= sleep is equivalent to >= 1.0
 		})).Return(nil).Once()
 
-		m := withPerformanceMonitoring(perfHist)
+		m := withPerformanceMonitoring(perfHist, nil)
 		var called bool
 		cb := m(func(c callback.CallbackContext) error {
 			called = true
@@ -206,4 +211,133 @@ func TestCallbackMiddlewares(t *testing.T) {
 		require.True(t, called)
 		require.Equal(t, perf, float64(sqreenTime.Duration().Nanoseconds())/float64(time.Millisecond))
 	})
+
+	t.Run("withPerformanceMonitoring of shadow rules", func(t *testing.T) {
+		c := &mockups.CallbackContextMockup{}
+		defer c.AssertExpectations(t)
+
+		// The sqreen time of the protection context is not expected to be used
+		p := &mockups.ProtectionContextMockup{}
+		defer p.AssertExpectations(t)
+
+		c.ExpectProtectionContext().Return(p)
+
+		perfHist := &testmock.PerfHistogramMockup{}
+		defer perfHist.AssertExpectations(t)
+
+		perfHist.ExpectAdd(mock.MatchedBy(func(v float64) bool {
+			return v >= 1.0
+		})).Return(nil).Once()
+
+		m := withPerformanceMonitoring(perfHist, &shadowMode{})
+		cb := m(func(c callback.CallbackContext) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+
+		require.NoError(t, cb(c))
+	})
+}
+
+func TestTracedCallback(t *testing.T) {
+	// Middleware tracing its decision, like the rule condition.
+	withDecision := func(call bool) NativeCallbackMiddlewareFunc {
+		return func(cb NativeCallbackFunc) NativeCallbackFunc {
+			return func(c callback.CallbackContext) error {
+				callback.TraceValue(c, "decision", call)
+				if !call {
+					return nil
+				}
+				return cb(c)
+			}
+		}
+	}
+
+	t.Run("executed", func(t *testing.T) {
+		trace := event.NewTrace("my trace")
+		entry := trace.Start("my rule", "pre")
+		errOops := errors.New("oops")
+		cb := wrapTracedCallback(func(c callback.CallbackContext) error {
+			callback.TraceValue(c, "#.Method", "GET")
+			return errOops
+		}, []NativeCallbackMiddlewareFunc{withDecision(true)}, entry)
+
+		require.Equal(t, errOops, cb(&mockups.CallbackContextMockup{}))
+		entries, truncated := trace.Entries()
+		require.False(t, truncated)
+		require.Len(t, entries, 1)
+		require.Equal(t, "my rule", entries[0].Rule)
+		require.Equal(t, "pre", entries[0].Callback)
+		require.True(t, entries[0].Executed)
+		require.Equal(t, "oops", entries[0].Error)
+		require.Equal(t, []event.TraceValue{{Name: "decision", Value: "true"}, {Name: "#.Method", Value: "GET"}}, entries[0].Values)
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		trace := event.NewTrace("my trace")
+		entry := trace.Start("my rule", "post")
+		cb := wrapTracedCallback(func(c callback.CallbackContext) error {
+			panic("unexpected call")
+		}, []NativeCallbackMiddlewareFunc{withDecision(false)}, entry)
+
+		require.NoError(t, cb(&mockups.CallbackContextMockup{}))
+		require.False(t, entry.Executed)
+		require.Empty(t, entry.Error)
+		require.Equal(t, []event.TraceValue{{Name: "decision", Value: "false"}}, entry.Values)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		trace := event.NewTrace("my trace")
+		for i := 0; i < event.MaxTraceEntries; i++ {
+			require.NotNil(t, trace.Start("my rule", "pre"))
+		}
+		require.Nil(t, trace.Start("my rule", "pre"))
+		entries, truncated := trace.Entries()
+		require.True(t, truncated)
+		require.Len(t, entries, event.MaxTraceEntries)
+	})
+}
+
+func TestWAFSkips(t *testing.T) {
+	require.Equal(t, "bodyWAF", hookpointPhase("github.com/sqreen/go-agent/internal/protection/http.(*ProtectionContext).bodyWAF"))
+	require.Equal(t, "QueryContext", hookpointPhase("database/sql.(*DB).QueryContext"))
+	require.Equal(t, "main", hookpointPhase("main"))
+
+	r, err := newNativeRuleContext(&api.Rule{
+		Name: "my rule",
+		Hookpoint: api.Hookpoint{
+			Method: "github.com/sqreen/go-agent/internal/protection/http.(*ProtectionContext).waf",
+		},
+	}, newTestRuleContextOptions(plog.NewLogger(plog.Debug, os.Stderr, nil), time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, "waf", r.Phase())
+
+	r.AddWAFSkip("timeout")
+	r.AddWAFSkip("timeout")
+	r.AddWAFSkip("budget_exhausted")
+	time.Sleep(10 * time.Millisecond)
+
+	skips := metrics.ReadyStoreMap{}
+	for _, ready := range r.wafSkipsStore.Flush() {
+		for k, v := range ready.Metrics() {
+			skips[k] += v
+		}
+	}
+	require.Equal(t, metrics.ReadyStoreMap{
+		"my rule/waf/timeout":          2,
+		"my rule/waf/budget_exhausted": 1,
+	}, skips)
+}
+
+// newTestRuleContextOptions returns the rule context options of the tests,
+// with a new metrics engine and the given metrics period.
+func newTestRuleContextOptions(logger plog.DebugLevelLogger, period time.Duration) nativeRuleContextOptions {
+	return nativeRuleContextOptions{
+		rulepackID:          "my pack",
+		metricsEngine:       metrics.NewEngine(),
+		logger:              logger,
+		perfHistogramUnit:   1,
+		perfHistogramBase:   1,
+		perfHistogramPeriod: period,
+	}
 }
@@ -0,0 +1,406 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package rule
+
+import (
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/binding-accessor"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// Rule condition operators. Logical operators take nested conditions as
+// operands, while the others take values which can be either binding
+// accessor expressions or literal JSON values.
+const (
+	// `{ "%and": [ cond1, cond2, ... ] }` holds when every condition holds.
+	conditionAnd = "%and"
+	// `{ "%or": [ cond1, cond2, ... ] }` holds when at least one condition
+	// holds.
+	conditionOr = "%or"
+	// `{ "%not": [ cond ] }` holds when the condition doesn't.
+	conditionNot = "%not"
+	// `{ "%equals": [ a, b ] }` holds when both values are equal.
+	conditionEquals = "%equals"
+	// `{ "%not_equals": [ a, b ] }` holds when both values are different.
+	conditionNotEquals = "%not_equals"
+	// `{ "%include": [ a, b ] }` holds when the string a contains the string
+	// b, or when the array or map a contains the value or key b.
+	conditionInclude = "%include"
+	// `{ "%prefix": [ a, b ] }` holds when the string a starts with the string
+	// b.
+	conditionPrefix = "%prefix"
+	// `{ "%exists": [ a ] }` holds when the value is not nil, such as a
+	// request header value.
+	conditionExists = "%exists"
+	// `{ "%ip_in_cidr": [ ip, [ cidr1, cidr2, ... ] ] }` holds when the IP
+	// address belongs to at least one of the literal CIDR networks.
+	conditionIPInCIDR = "%ip_in_cidr"
+)
+
+// A ruleCondition value is a compiled rule condition evaluated with the
+// binding accessor context of the protection context.
+type ruleCondition func(ctx bindingaccessor.Context) (bool, error)
+
+// A conditionOperand value is a compiled operand value of a rule condition.
+type conditionOperand func(ctx bindingaccessor.Context) (interface{}, error)
+
+// compileRuleCondition returns the compiled rule condition, or nil when it is
+// empty as it always holds.
+func compileRuleCondition(cond api.RuleCondition) (ruleCondition, error) {
+	if len(cond) == 0 {
+		return nil, nil
+	}
+	generic := make(map[string]interface{}, len(cond))
+	for op, operands := range cond {
+		generic[op] = operands
+	}
+	return compileCondition(generic, 0)
+}
+
+// Maximum nesting level of rule conditions.
+const maxConditionDepth = 10
+
+func compileCondition(v interface{}, depth int) (ruleCondition, error) {
+	if depth >= maxConditionDepth {
+		return nil, sqerrors.Errorf("maximum rule condition depth %d reached", maxConditionDepth)
+	}
+
+	cond, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, sqerrors.Errorf("unexpected rule condition type `%T`", v)
+	}
+	if len(cond) != 1 {
+		return nil, sqerrors.Errorf("unexpected number of rule condition operators: got %d instead of 1", len(cond))
+	}
+
+	for op, v := range cond {
+		operands, ok := v.([]interface{})
+		if !ok {
+			return nil, sqerrors.Errorf("rule condition operator `%s`: unexpected operand list type `%T`", op, v)
+		}
+		c, err := compileOperator(op, operands, depth)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "rule condition operator `%s`", op)
+		}
+		return c, nil
+	}
+	return nil, nil // unreachable
+}
+
+func compileOperator(op string, operands []interface{}, depth int) (ruleCondition, error) {
+	switch op {
+	case conditionAnd, conditionOr:
+		if len(operands) == 0 {
+			return nil, sqerrors.New("unexpected empty list of conditions")
+		}
+		conds, err := compileConditions(operands, depth)
+		if err != nil {
+			return nil, err
+		}
+		if op == conditionAnd {
+			return andCondition(conds), nil
+		}
+		return orCondition(conds), nil
+
+	case conditionNot:
+		if err := expectOperands(operands, 1); err != nil {
+			return nil, err
+		}
+		cond, err := compileCondition(operands[0], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx bindingaccessor.Context) (bool, error) {
+			holds, err := cond(ctx)
+			return !holds, err
+		}, nil
+
+	case conditionEquals, conditionNotEquals, conditionInclude, conditionPrefix:
+		if err := expectOperands(operands, 2); err != nil {
+			return nil, err
+		}
+		a, err := compileOperand(operands[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := compileOperand(operands[1])
+		if err != nil {
+			return nil, err
+		}
+		var test func(a, b interface{}) bool
+		switch op {
+		case conditionEquals:
+			test = conditionValuesEqual
+		case conditionNotEquals:
+			test = func(a, b interface{}) bool { return !conditionValuesEqual(a, b) }
+		case conditionInclude:
+			test = conditionValueIncludes
+		case conditionPrefix:
+			test = conditionValueHasPrefix
+		}
+		return binaryCondition(a, b, test), nil
+
+	case conditionExists:
+		if err := expectOperands(operands, 1); err != nil {
+			return nil, err
+		}
+		a, err := compileOperand(operands[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx bindingaccessor.Context) (bool, error) {
+			v, err := a(ctx)
+			if err != nil {
+				return false, err
+			}
+			return normalizeConditionValue(v) != nil, nil
+		}, nil
+
+	case conditionIPInCIDR:
+		if err := expectOperands(operands, 2); err != nil {
+			return nil, err
+		}
+		ip, err := compileOperand(operands[0])
+		if err != nil {
+			return nil, err
+		}
+		networks, err := parseConditionNetworks(operands[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx bindingaccessor.Context) (bool, error) {
+			v, err := ip(ctx)
+			if err != nil {
+				return false, err
+			}
+			return conditionIPInNetworks(v, networks), nil
+		}, nil
+
+	default:
+		return nil, sqerrors.New("unknown operator")
+	}
+}
+
+func expectOperands(operands []interface{}, n int) error {
+	if len(operands) != n {
+		return sqerrors.Errorf("unexpected number of operands: got %d instead of %d", len(operands), n)
+	}
+	return nil
+}
+
+func compileConditions(operands []interface{}, depth int) ([]ruleCondition, error) {
+	conds := make([]ruleCondition, len(operands))
+	for i, operand := range operands {
+		cond, err := compileCondition(operand, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		conds[i] = cond
+	}
+	return conds, nil
+}
+
+func andCondition(conds []ruleCondition) ruleCondition {
+	return func(ctx bindingaccessor.Context) (bool, error) {
+		for _, cond := range conds {
+			if holds, err := cond(ctx); err != nil || !holds {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+func orCondition(conds []ruleCondition) ruleCondition {
+	return func(ctx bindingaccessor.Context) (bool, error) {
+		for _, cond := range conds {
+			if holds, err := cond(ctx); err != nil || holds {
+				return holds, err
+			}
+		}
+		return false, nil
+	}
+}
+
+func binaryCondition(a, b conditionOperand, test func(a, b interface{}) bool) ruleCondition {
+	return func(ctx bindingaccessor.Context) (bool, error) {
+		va, err := a(ctx)
+		if err != nil {
+			return false, err
+		}
+		vb, err := b(ctx)
+		if err != nil {
+			return false, err
+		}
+		return test(va, vb), nil
+	}
+}
+
+// compileOperand returns the compiled operand value. Strings starting with
+// `#.` are binding accessor expressions while other values are literal
+// values.
+func compileOperand(v interface{}) (conditionOperand, error) {
+	if expr, ok := v.(string); ok && strings.HasPrefix(expr, "#.") {
+		ba, err := bindingaccessor.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return conditionOperand(ba), nil
+	}
+	return func(bindingaccessor.Context) (interface{}, error) { return v, nil }, nil
+}
+
+func parseConditionNetworks(v interface{}) ([]*net.IPNet, error) {
+	cidrs, ok := v.([]interface{})
+	if !ok {
+		return nil, sqerrors.Errorf("unexpected CIDR list type `%T`", v)
+	}
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		str, ok := cidr.(string)
+		if !ok {
+			return nil, sqerrors.Errorf("unexpected CIDR type `%T`", cidr)
+		}
+		_, network, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "could not parse CIDR `%s`", str)
+		}
+		networks[i] = network
+	}
+	return networks, nil
+}
+
+// normalizeConditionValue returns the bare Go value of the given value so that
+// values returned by binding accessors can be compared to literal JSON
+// values: pointers are dereferenced, strings and numbers are converted to
+// their bare types, and IP addresses are converted to strings.
+func normalizeConditionValue(v interface{}) interface{} {
+	if ip, ok := v.(net.IP); ok {
+		if ip == nil {
+			return nil
+		}
+		return ip.String()
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Slice, reflect.Map:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return rv.Interface()
+}
+
+func conditionValuesEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeConditionValue(a), normalizeConditionValue(b))
+}
+
+func conditionValueIncludes(a, b interface{}) bool {
+	a = normalizeConditionValue(a)
+	if str, ok := a.(string); ok {
+		substr, ok := normalizeConditionValue(b).(string)
+		return ok && strings.Contains(str, substr)
+	}
+
+	rv := reflect.ValueOf(a)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if conditionValuesEqual(rv.Index(i).Interface(), b) {
+				return true
+			}
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			if conditionValuesEqual(k.Interface(), b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func conditionValueHasPrefix(a, b interface{}) bool {
+	str, ok := normalizeConditionValue(a).(string)
+	if !ok {
+		return false
+	}
+	prefix, ok := normalizeConditionValue(b).(string)
+	return ok && strings.HasPrefix(str, prefix)
+}
+
+func conditionIPInNetworks(v interface{}, networks []*net.IPNet) bool {
+	var ip net.IP
+	switch actual := v.(type) {
+	case net.IP:
+		ip = actual
+	default:
+		str, ok := normalizeConditionValue(v).(string)
+		if !ok {
+			return false
+		}
+		ip = net.ParseIP(str)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCondition returns the callback middleware only calling the callback
+// when the rule condition holds. The condition is evaluated with the request
+// binding accessor context of the protection context. The callback is not
+// called when the evaluation fails, and the evaluation error is returned.
+func withCondition(cond ruleCondition) NativeCallbackMiddlewareFunc {
+	return func(cb NativeCallbackFunc) NativeCallbackFunc {
+		return func(c callback.CallbackContext) error {
+			ctx, err := callback.NewRequestBindingAccessorContext(c.ProtectionContext())
+			if err != nil {
+				return sqerrors.Wrap(err, "could not create the rule condition binding accessor context")
+			}
+			holds, err := cond(ctx)
+			if err != nil {
+				return sqerrors.Wrap(err, "rule condition evaluation")
+			}
+			callback.TraceValue(c, "condition", holds)
+			if !holds {
+				return nil
+			}
+			return cb(c)
+		}
+	}
+}
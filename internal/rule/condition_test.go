@@ -0,0 +1,148 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	http_protection_mockups "github.com/sqreen/go-agent/internal/protection/http/_testlib/mockups"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleConditions(t *testing.T) {
+	newProtectionContext := func(t *testing.T) *http_protection.ProtectionContext {
+		u, err := url.Parse("http://sqreen.com/api/v1/users?id=1")
+		require.NoError(t, err)
+		apiKey := "my-key"
+		req := &http_protection_mockups.RequestReaderMockup{}
+		req.ExpectMethod().Return("POST")
+		req.ExpectURL().Return(u)
+		req.ExpectHeader("X-Api-Key").Return(&apiKey)
+		req.ExpectHeader("X-Other").Return((*string)(nil))
+		return http_protection.NewTestProtectionContext(nil, net.ParseIP("10.1.2.3"), nil, req)
+	}
+
+	parse := func(t *testing.T, cond string) api.RuleCondition {
+		var c api.RuleCondition
+		require.NoError(t, json.Unmarshal([]byte(cond), &c))
+		return c
+	}
+
+	t.Run("evaluation", func(t *testing.T) {
+		for _, tc := range []struct {
+			cond     string
+			expected bool
+		}{
+			{cond: `{}`, expected: true},
+			{cond: `{"%equals": ["#.Request.Method", "POST"]}`, expected: true},
+			{cond: `{"%equals": ["GET", "#.Request.Method"]}`, expected: false},
+			{cond: `{"%not_equals": ["#.Request.Method", "GET"]}`, expected: true},
+			{cond: `{"%prefix": ["#.Request.URL.Path", "/api/"]}`, expected: true},
+			{cond: `{"%prefix": ["#.Request.URL.Path", "/admin/"]}`, expected: false},
+			{cond: `{"%include": ["#.Request.URL.Path", "users"]}`, expected: true},
+			{cond: `{"%include": [["PUT", "POST"], "#.Request.Method"]}`, expected: true},
+			{cond: `{"%include": [["GET", "HEAD"], "#.Request.Method"]}`, expected: false},
+			{cond: `{"%exists": ["#.Request.Header('X-Api-Key')"]}`, expected: true},
+			{cond: `{"%exists": ["#.Request.Header('X-Other')"]}`, expected: false},
+			{cond: `{"%equals": ["#.Request.Header('X-Api-Key')", "my-key"]}`, expected: true},
+			{cond: `{"%ip_in_cidr": ["#.Request.ClientIP", ["192.168.0.0/16", "10.0.0.0/8"]]}`, expected: true},
+			{cond: `{"%ip_in_cidr": ["#.Request.ClientIP", ["192.168.0.0/16"]]}`, expected: false},
+			{cond: `{"%ip_in_cidr": ["10.0.0.1", ["10.0.0.0/24"]]}`, expected: true},
+			{cond: `{"%not": [{"%equals": ["#.Request.Method", "POST"]}]}`, expected: false},
+			{cond: `{"%and": [{"%equals": ["#.Request.Method", "POST"]}, {"%prefix": ["#.Request.URL.Path", "/api/"]}]}`, expected: true},
+			{cond: `{"%and": [{"%equals": ["#.Request.Method", "POST"]}, {"%prefix": ["#.Request.URL.Path", "/admin/"]}]}`, expected: false},
+			{cond: `{"%or": [{"%equals": ["#.Request.Method", "GET"]}, {"%prefix": ["#.Request.URL.Path", "/api/"]}]}`, expected: true},
+			{cond: `{"%or": [{"%equals": ["#.Request.Method", "GET"]}, {"%prefix": ["#.Request.URL.Path", "/admin/"]}]}`, expected: false},
+		} {
+			tc := tc
+			t.Run(tc.cond, func(t *testing.T) {
+				cond, err := compileRuleCondition(parse(t, tc.cond))
+				require.NoError(t, err)
+				if cond == nil {
+					require.True(t, tc.expected)
+					return
+				}
+				ctx, err := callback.NewRequestBindingAccessorContext(newProtectionContext(t))
+				require.NoError(t, err)
+				holds, err := cond(ctx)
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, holds)
+			})
+		}
+	})
+
+	t.Run("evaluation error", func(t *testing.T) {
+		cond, err := compileRuleCondition(parse(t, `{"%equals": ["#.Request.Oops", "POST"]}`))
+		require.NoError(t, err)
+		ctx, err := callback.NewRequestBindingAccessorContext(newProtectionContext(t))
+		require.NoError(t, err)
+		_, err = cond(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("compilation errors", func(t *testing.T) {
+		for _, cond := range []string{
+			`{"%oops": ["a", "b"]}`,
+			`{"%equals": ["a"]}`,
+			`{"%equals": ["a", "b"], "%prefix": ["a", "b"]}`,
+			`{"%and": []}`,
+			`{"%and": ["a"]}`,
+			`{"%not": [{"%equals": ["#.Request.Method"]}]}`,
+			`{"%exists": ["#.Request.Header("]}`,
+			`{"%ip_in_cidr": ["#.Request.ClientIP", ["oops"]]}`,
+			`{"%ip_in_cidr": ["#.Request.ClientIP", "10.0.0.0/8"]}`,
+			`{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%not":[{"%exists":["a"]}]}]}]}]}]}]}]}]}]}]}`,
+		} {
+			cond := cond
+			t.Run(cond, func(t *testing.T) {
+				_, err := compileRuleCondition(parse(t, cond))
+				require.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("middleware", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			cond   string
+			called bool
+			err    bool
+		}{
+			{name: "holding condition", cond: `{"%equals": ["#.Request.Method", "POST"]}`, called: true},
+			{name: "not holding condition", cond: `{"%equals": ["#.Request.Method", "GET"]}`},
+			{name: "evaluation error", cond: `{"%equals": ["#.Request.Oops", "GET"]}`, err: true},
+		} {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				cond, err := compileRuleCondition(parse(t, tc.cond))
+				require.NoError(t, err)
+
+				c := &mockups.CallbackContextMockup{}
+				defer c.AssertExpectations(t)
+				c.ExpectProtectionContext().Return(newProtectionContext(t)).Once()
+
+				var called bool
+				cb := withCondition(cond)(func(callback.CallbackContext) error {
+					called = true
+					return nil
+				})
+				err = cb(c)
+				if tc.err {
+					require.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+				require.Equal(t, tc.called, called)
+			})
+		}
+	})
+}
@@ -13,38 +13,58 @@ import (
 
 // NewCallback returns the callback object or function for the given callback
 // name. An error is returned if the callback name is unknown or an error
-// occurred during the constructor call.
+// occurred during the constructor call. Built-in callbacks take precedence over
+// the callbacks registered by the application (cf. RegisterNativeCallback()).
 func NewNativeCallback(name string, ctx *nativeRuleContext, cfg callback.NativeCallbackConfig) (prolog sqhook.PrologCallback, err error) {
-	var callbackCtor callback.NativeCallbackConstructorFunc
+	callbackCtor, critical := builtinNativeCallback(name)
+	if callbackCtor == nil {
+		callbackCtor = registeredNativeCallback(name)
+		if callbackCtor == nil {
+			return nil, sqerrors.Errorf("undefined native callback name `%s`", name)
+		}
+	}
+	if critical {
+		ctx.SetCritical(true)
+	}
+	return callbackCtor(ctx, cfg)
+}
+
+// builtinNativeCallback returns the constructor of the given built-in callback
+// name, nil if it doesn't exist. Critical callbacks are required by the
+// protection and must always be executed.
+func builtinNativeCallback(name string) (callbackCtor callback.NativeCallbackConstructorFunc, critical bool) {
 	switch name {
 	default:
-		return nil, sqerrors.Errorf("undefined native callback name `%s`", name)
+		return nil, false
 	case "WriteCustomErrorPage", "WriteBlockingHTMLPage":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewWriteBlockingHTMLPageCallback
+		return callback.NewWriteBlockingHTMLPageCallback, true
 	case "WriteHTTPRedirection":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewWriteHTTPRedirectionCallbacks
+		return callback.NewWriteHTTPRedirectionCallbacks, true
 	case "AddSecurityHeaders":
-		callbackCtor = callback.NewAddSecurityHeadersCallback
+		return callback.NewAddSecurityHeadersCallback, false
 	case "MonitorHTTPStatusCode":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewMonitorHTTPStatusCodeCallback
+		return callback.NewMonitorHTTPStatusCodeCallback, true
 	case "WAF":
-		callbackCtor = callback.NewWAFCallback
+		return callback.NewWAFCallback, false
 	case "IPSecurityResponse":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewIPSecurityResponseCallback
+		return callback.NewIPSecurityResponseCallback, true
 	case "UserSecurityResponse":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewUserSecurityResponseCallback
+		return callback.NewUserSecurityResponseCallback, true
 	case "IPBlockList", "IPDenyList":
-		ctx.SetCritical(true)
-		callbackCtor = callback.NewIPDenyListCallback
+		return callback.NewIPDenyListCallback, true
 	case "Shellshock":
-		callbackCtor = callback.NewShellshockCallback
+		return callback.NewShellshockCallback, false
+	case "ReflectedXSS":
+		return callback.NewReflectedXSSCallback, false
+	case "ReflectedXSSTemplate":
+		return callback.NewReflectedXSSTemplateCallback, false
+	case "SensitiveDataLeak":
+		return callback.NewSensitiveDataLeakCallback, false
+	case "GraphQL":
+		return callback.NewGraphQLCallback, false
+	case "FileUpload":
+		return callback.NewFileUploadCallback, false
 	}
-	return callbackCtor(ctx, cfg)
 }
 
 // NewReflectedCallback returns the callback object or function of the given
@@ -0,0 +1,276 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// Number of rulespacks kept by the engine, including the current one, so that
+// they can be diffed and rolled back to.
+const rulespackHistoryLength = 5
+
+// AutoRollbackConfig is the configuration of the automatic rollback of a new
+// rulespack to the previous one when it causes a spike of callback errors or
+// over-budget callbacks right after its activation. It is disabled by default
+// as the thresholds are absolute numbers which depend on the application
+// traffic.
+type AutoRollbackConfig struct {
+	// Window is the duration after the activation of a rulespack during which
+	// it is watched. The automatic rollback is disabled when zero.
+	Window time.Duration
+	// MaxErrors is the number of callback errors in the window triggering the
+	// rollback. Errors caused by the performance budget, such as interrupted JS
+	// executions, are over-budget callbacks instead. Ignored when zero.
+	MaxErrors uint64
+	// MaxOverBudget is the number of callbacks skipped or interrupted because
+	// of the performance budget in the window triggering the rollback. Ignored
+	// when zero.
+	MaxOverBudget uint64
+}
+
+// rulespackVersion is a rulespack kept in the engine history.
+type rulespackVersion struct {
+	id    string
+	rules []api.Rule
+	// rolledBack is true when the rulespack was rolled back, so that it is not
+	// restored by later rollbacks to the previous rulespack.
+	rolledBack bool
+}
+
+// RulespackDiff is the difference between two rulespacks. Rules are identified
+// by their name, and hooks by the function they hook.
+type RulespackDiff struct {
+	From         string   `json:"from"`
+	To           string   `json:"to"`
+	AddedRules   []string `json:"added_rules,omitempty"`
+	RemovedRules []string `json:"removed_rules,omitempty"`
+	ChangedRules []string `json:"changed_rules,omitempty"`
+	AddedHooks   []string `json:"added_hooks,omitempty"`
+	RemovedHooks []string `json:"removed_hooks,omitempty"`
+}
+
+// Empty returns true when both rulespacks have the same rules.
+func (d *RulespackDiff) Empty() bool {
+	return len(d.AddedRules) == 0 && len(d.RemovedRules) == 0 && len(d.ChangedRules) == 0
+}
+
+func diffRulespacks(from, to *rulespackVersion) *RulespackDiff {
+	diff := &RulespackDiff{From: from.id, To: to.id}
+
+	fromRules := make(map[string]*api.Rule, len(from.rules))
+	fromHooks := make(map[string]struct{}, len(from.rules))
+	for i := range from.rules {
+		r := &from.rules[i]
+		fromRules[r.Name] = r
+		fromHooks[r.Hookpoint.Method] = struct{}{}
+	}
+
+	toHooks := make(map[string]struct{}, len(to.rules))
+	for i := range to.rules {
+		r := &to.rules[i]
+		toHooks[r.Hookpoint.Method] = struct{}{}
+		prev, exists := fromRules[r.Name]
+		if !exists {
+			diff.AddedRules = append(diff.AddedRules, r.Name)
+			continue
+		}
+		delete(fromRules, r.Name)
+		if !reflect.DeepEqual(prev, r) {
+			diff.ChangedRules = append(diff.ChangedRules, r.Name)
+		}
+	}
+	for name := range fromRules {
+		diff.RemovedRules = append(diff.RemovedRules, name)
+	}
+
+	for hook := range toHooks {
+		if _, exists := fromHooks[hook]; !exists {
+			diff.AddedHooks = append(diff.AddedHooks, hook)
+		}
+	}
+	for hook := range fromHooks {
+		if _, exists := toHooks[hook]; !exists {
+			diff.RemovedHooks = append(diff.RemovedHooks, hook)
+		}
+	}
+
+	sort.Strings(diff.AddedRules)
+	sort.Strings(diff.RemovedRules)
+	sort.Strings(diff.ChangedRules)
+	sort.Strings(diff.AddedHooks)
+	sort.Strings(diff.RemovedHooks)
+	return diff
+}
+
+// SetAutoRollback sets the configuration of the automatic rollback of the
+// rulespacks. It applies to the next rules set.
+func (e *Engine) SetAutoRollback(cfg AutoRollbackConfig) {
+	e.autoRollback = cfg
+}
+
+// RollbackRequests returns the channel of the IDs of the rulespacks whose
+// automatic rollback was triggered. The rollback itself must be performed by
+// the caller with Rollback() so that it is not concurrent with the other rules
+// modifications.
+func (e *Engine) RollbackRequests() <-chan string {
+	return e.rollbackRequests
+}
+
+// History returns the IDs of the rulespacks kept by the engine, from the oldest
+// to the current one.
+func (e *Engine) History() []string {
+	ids := make([]string, len(e.history))
+	for i, v := range e.history {
+		ids[i] = v.id
+	}
+	return ids
+}
+
+// Diff returns the difference between the two given rulespacks of the history.
+// The current rulespack is used when `to` is empty, and the rulespack before
+// `to` when `from` is empty.
+func (e *Engine) Diff(from, to string) (*RulespackDiff, error) {
+	toIndex := len(e.history) - 1
+	if to != "" {
+		toIndex = e.findRulespack(to)
+	}
+	if toIndex < 0 {
+		return nil, sqerrors.Errorf("unknown rulespack `%s`", to)
+	}
+
+	fromIndex := toIndex - 1
+	if from != "" {
+		fromIndex = e.findRulespack(from)
+		if fromIndex < 0 {
+			return nil, sqerrors.Errorf("unknown rulespack `%s`", from)
+		}
+	} else if fromIndex < 0 {
+		return nil, sqerrors.Errorf("no rulespack before `%s`", e.history[toIndex].id)
+	}
+
+	return diffRulespacks(&e.history[fromIndex], &e.history[toIndex]), nil
+}
+
+// Rollback sets the rules of the given rulespack of the history, or of the
+// previous one not rolled back when empty, and returns its ID. The current
+// rulespack is marked as rolled back, and the restored one is not watched for
+// an automatic rollback.
+func (e *Engine) Rollback(packID string) (string, error) {
+	current := len(e.history) - 1
+	var i int
+	if packID != "" {
+		i = e.findRulespack(packID)
+		if i < 0 {
+			return "", sqerrors.Errorf("unknown rulespack `%s`", packID)
+		}
+		if i == current {
+			return "", sqerrors.Errorf("rulespack `%s` is already the current one", packID)
+		}
+	} else {
+		for i = current - 1; i >= 0 && e.history[i].rolledBack; i-- {
+		}
+		if i < 0 {
+			return "", sqerrors.New("no previous rulespack")
+		}
+	}
+
+	e.history[current].rolledBack = true
+	v := e.history[i]
+	e.logger.Infof("security rules: rolling back from rulespack `%s` to `%s`", e.packID, v.id)
+	e.setRulespack(v.id, v.rules, nil)
+	return v.id, nil
+}
+
+func (e *Engine) findRulespack(packID string) int {
+	for i := len(e.history) - 1; i >= 0; i-- {
+		if e.history[i].id == packID {
+			return i
+		}
+	}
+	return -1
+}
+
+// addToHistory adds the rulespack to the history as the current one, removing
+// the oldest ones above rulespackHistoryLength.
+func (e *Engine) addToHistory(packID string, rules []api.Rule) {
+	if i := e.findRulespack(packID); i >= 0 {
+		e.history = append(e.history[:i], e.history[i+1:]...)
+	}
+	e.history = append(e.history, rulespackVersion{id: packID, rules: rules})
+	if n := len(e.history) - rulespackHistoryLength; n > 0 {
+		e.history = append(e.history[:0], e.history[n:]...)
+	}
+}
+
+// newRulespackHealth returns the health monitor of the given new rulespack, or
+// nil when it is not watched for an automatic rollback because it is disabled
+// or there is no previous rulespack to roll back to.
+func (e *Engine) newRulespackHealth(packID string) *rulespackHealth {
+	cfg := e.autoRollback
+	if cfg.Window <= 0 || (cfg.MaxErrors == 0 && cfg.MaxOverBudget == 0) {
+		return nil
+	}
+	if len(e.history) == 0 || e.history[len(e.history)-1].id == packID {
+		return nil
+	}
+	return &rulespackHealth{
+		packID:   packID,
+		deadline: time.Now().Add(cfg.Window),
+		cfg:      cfg,
+		requests: e.rollbackRequests,
+	}
+}
+
+// rulespackHealth counts the callback errors and over-budget callbacks of the
+// rules of a rulespack during the window following its activation, and
+// requests its rollback when one of them reaches its maximum.
+type rulespackHealth struct {
+	packID   string
+	deadline time.Time
+	cfg      AutoRollbackConfig
+	requests chan<- string
+
+	// Atomically accessed counters
+	errors, overBudget uint64
+	triggered          uint32
+}
+
+func (h *rulespackHealth) addError() {
+	if h == nil {
+		return
+	}
+	h.add(&h.errors, h.cfg.MaxErrors)
+}
+
+func (h *rulespackHealth) addOverBudget() {
+	if h == nil {
+		return
+	}
+	h.add(&h.overBudget, h.cfg.MaxOverBudget)
+}
+
+func (h *rulespackHealth) add(counter *uint64, max uint64) {
+	if max == 0 || time.Now().After(h.deadline) {
+		return
+	}
+	if atomic.AddUint64(counter, 1) < max {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&h.triggered, 0, 1) {
+		return
+	}
+	select {
+	case h.requests <- h.packID:
+	default:
+		// A rollback is already pending
+	}
+}
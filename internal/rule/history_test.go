@@ -0,0 +1,202 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/metrics"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulespackHistory(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+
+	newRule := func(name, fn string, block bool) api.Rule {
+		return api.Rule{
+			Name:      name,
+			Block:     block,
+			Hookpoint: api.Hookpoint{Method: "my/pkg." + fn},
+		}
+	}
+	packs := []struct {
+		id    string
+		rules []api.Rule
+	}{
+		{id: "pack 1", rules: []api.Rule{newRule("rule 1", "f1", false), newRule("rule 2", "f2", false)}},
+		{id: "pack 2", rules: []api.Rule{newRule("rule 1", "f1", true), newRule("rule 3", "f3", false)}},
+		{id: "pack 3", rules: []api.Rule{newRule("rule 1", "f1", true)}},
+	}
+
+	newEngine := func() *Engine {
+		e := NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		for _, p := range packs {
+			e.SetRules(p.id, p.rules)
+		}
+		return e
+	}
+
+	t.Run("history", func(t *testing.T) {
+		e := newEngine()
+		require.Equal(t, []string{"pack 1", "pack 2", "pack 3"}, e.History())
+
+		// Setting an existing rulespack moves it to the current one
+		e.SetRules("pack 1", packs[0].rules)
+		require.Equal(t, []string{"pack 2", "pack 3", "pack 1"}, e.History())
+
+		// Limited length
+		for i := 0; i < rulespackHistoryLength; i++ {
+			e.SetRules(string(rune('a'+i)), nil)
+		}
+		require.Equal(t, []string{"a", "b", "c", "d", "e"}, e.History())
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		e := newEngine()
+
+		// Current and previous rulespacks by default
+		diff, err := e.Diff("", "")
+		require.NoError(t, err)
+		require.Equal(t, &RulespackDiff{
+			From:         "pack 2",
+			To:           "pack 3",
+			RemovedRules: []string{"rule 3"},
+			RemovedHooks: []string{"my/pkg.f3"},
+		}, diff)
+
+		diff, err = e.Diff("pack 1", "pack 2")
+		require.NoError(t, err)
+		require.Equal(t, &RulespackDiff{
+			From:         "pack 1",
+			To:           "pack 2",
+			AddedRules:   []string{"rule 3"},
+			RemovedRules: []string{"rule 2"},
+			ChangedRules: []string{"rule 1"},
+			AddedHooks:   []string{"my/pkg.f3"},
+			RemovedHooks: []string{"my/pkg.f2"},
+		}, diff)
+
+		diff, err = e.Diff("pack 3", "pack 3")
+		require.NoError(t, err)
+		require.True(t, diff.Empty())
+
+		_, err = e.Diff("", "pack 1")
+		require.Error(t, err)
+		_, err = e.Diff("oops", "")
+		require.Error(t, err)
+		_, err = e.Diff("", "oops")
+		require.Error(t, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		e := newEngine()
+
+		// Previous rulespack by default
+		id, err := e.Rollback("")
+		require.NoError(t, err)
+		require.Equal(t, "pack 2", id)
+		require.Equal(t, "pack 2", e.PackID())
+		require.Equal(t, []string{"pack 1", "pack 3", "pack 2"}, e.History())
+
+		// Rolled back rulespacks are skipped
+		id, err = e.Rollback("")
+		require.NoError(t, err)
+		require.Equal(t, "pack 1", id)
+		require.Equal(t, "pack 1", e.PackID())
+		_, err = e.Rollback("")
+		require.Error(t, err)
+
+		// Unless explicitly restored
+		id, err = e.Rollback("pack 3")
+		require.NoError(t, err)
+		require.Equal(t, "pack 3", id)
+		id, err = e.Rollback("pack 1")
+		require.NoError(t, err)
+		require.Equal(t, "pack 1", id)
+
+		_, err = e.Rollback("pack 1")
+		require.Error(t, err)
+		_, err = e.Rollback("oops")
+		require.Error(t, err)
+
+		e = NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		_, err = e.Rollback("")
+		require.Error(t, err)
+		e.SetRules("pack 1", nil)
+		_, err = e.Rollback("")
+		require.Error(t, err)
+	})
+}
+
+func TestRulespackHealth(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+
+	t.Run("not watched", func(t *testing.T) {
+		e := NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		// No previous rulespack
+		require.Nil(t, e.newRulespackHealth("pack 1"))
+		e.SetRules("pack 1", nil)
+		// Disabled by default
+		require.Nil(t, e.newRulespackHealth("pack 2"))
+		e.SetAutoRollback(AutoRollbackConfig{Window: time.Minute, MaxErrors: 1})
+		// Same rulespack
+		require.Nil(t, e.newRulespackHealth("pack 1"))
+		require.NotNil(t, e.newRulespackHealth("pack 2"))
+		// Disabled
+		e.SetAutoRollback(AutoRollbackConfig{})
+		require.Nil(t, e.newRulespackHealth("pack 2"))
+
+		// Nil health monitors are ignored
+		var h *rulespackHealth
+		h.addError()
+		h.addOverBudget()
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		e := NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		e.SetAutoRollback(AutoRollbackConfig{Window: time.Minute, MaxErrors: 3})
+		e.SetRules("pack 1", nil)
+		h := e.newRulespackHealth("pack 2")
+		require.NotNil(t, h)
+
+		// Over-budget callbacks are ignored
+		for i := 0; i < 10; i++ {
+			h.addOverBudget()
+		}
+		h.addError()
+		h.addError()
+		require.Len(t, e.RollbackRequests(), 0)
+		h.addError()
+		require.Len(t, e.RollbackRequests(), 1)
+		require.Equal(t, "pack 2", <-e.RollbackRequests())
+		// Requested once
+		h.addError()
+		require.Len(t, e.RollbackRequests(), 0)
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		e := NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		e.SetAutoRollback(AutoRollbackConfig{Window: time.Minute, MaxOverBudget: 2})
+		e.SetRules("pack 1", nil)
+		h := e.newRulespackHealth("pack 2")
+		h.addOverBudget()
+		h.addOverBudget()
+		require.Equal(t, "pack 2", <-e.RollbackRequests())
+	})
+
+	t.Run("after the window", func(t *testing.T) {
+		e := NewEngine(logger, nil, metrics.NewEngine(), nil, 1, 1, time.Minute)
+		e.SetAutoRollback(AutoRollbackConfig{Window: time.Minute, MaxErrors: 1})
+		e.SetRules("pack 1", nil)
+		h := e.newRulespackHealth("pack 2")
+		h.deadline = time.Now().Add(-time.Second)
+		h.addError()
+		require.Len(t, e.RollbackRequests(), 0)
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"sync"
+
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// nativeCallbackRegistry is the set of native callbacks registered by the
+// application in addition to the built-in ones.
+var nativeCallbackRegistry struct {
+	lock  sync.RWMutex
+	ctors map[string]callback.NativeCallbackConstructorFunc
+}
+
+// RegisterNativeCallback registers the native callback constructor of the
+// given name so that rules can reference it as their native callback class.
+// Built-in callback names cannot be registered, and a name can only be
+// registered once. Callbacks must be registered before the rules using them
+// are loaded.
+func RegisterNativeCallback(name string, ctor callback.NativeCallbackConstructorFunc) error {
+	if name == "" {
+		return sqerrors.New("unexpected empty native callback name")
+	}
+	if ctor == nil {
+		return sqerrors.Errorf("unexpected nil constructor of native callback `%s`", name)
+	}
+	if builtin, _ := builtinNativeCallback(name); builtin != nil {
+		return sqerrors.Errorf("native callback `%s` is a built-in callback", name)
+	}
+
+	nativeCallbackRegistry.lock.Lock()
+	defer nativeCallbackRegistry.lock.Unlock()
+	if _, exists := nativeCallbackRegistry.ctors[name]; exists {
+		return sqerrors.Errorf("native callback `%s` already registered", name)
+	}
+	if nativeCallbackRegistry.ctors == nil {
+		nativeCallbackRegistry.ctors = make(map[string]callback.NativeCallbackConstructorFunc)
+	}
+	nativeCallbackRegistry.ctors[name] = ctor
+	return nil
+}
+
+// registeredNativeCallback returns the constructor of the registered native
+// callback of the given name, nil if it doesn't exist.
+func registeredNativeCallback(name string) callback.NativeCallbackConstructorFunc {
+	nativeCallbackRegistry.lock.RLock()
+	defer nativeCallbackRegistry.lock.RUnlock()
+	return nativeCallbackRegistry.ctors[name]
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterNativeCallback(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	defer func() {
+		nativeCallbackRegistry.lock.Lock()
+		defer nativeCallbackRegistry.lock.Unlock()
+		delete(nativeCallbackRegistry.ctors, "MyCallback")
+	}()
+
+	type prologType = func(*string) (func(*error), error)
+	var (
+		ctorRule callback.RuleContext
+		ctorCfg  callback.NativeCallbackConfig
+	)
+	ctor := func(r callback.RuleContext, cfg callback.NativeCallbackConfig) (sqhook.PrologCallback, error) {
+		ctorRule, ctorCfg = r, cfg
+		return prologType(func(*string) (func(*error), error) { return nil, nil }), nil
+	}
+
+	t.Run("bad registrations", func(t *testing.T) {
+		require.Error(t, RegisterNativeCallback("", ctor))
+		require.Error(t, RegisterNativeCallback("MyCallback", nil))
+		// Built-in callbacks
+		require.Error(t, RegisterNativeCallback("WAF", ctor))
+		require.Error(t, RegisterNativeCallback("IPDenyList", ctor))
+	})
+
+	t.Run("undefined callback", func(t *testing.T) {
+		r, err := newNativeRuleContext(&api.Rule{Name: "my rule"}, newTestRuleContextOptions(logger, time.Minute))
+		require.NoError(t, err)
+		cfg, err := newNativeCallbackConfig(&api.Rule{})
+		require.NoError(t, err)
+		prolog, err := NewNativeCallback("MyCallback", r, cfg)
+		require.Error(t, err)
+		require.Nil(t, prolog)
+	})
+
+	t.Run("registered callback", func(t *testing.T) {
+		require.NoError(t, RegisterNativeCallback("MyCallback", ctor))
+		// Only once
+		require.Error(t, RegisterNativeCallback("MyCallback", ctor))
+
+		r, err := newNativeRuleContext(&api.Rule{Name: "my rule"}, newTestRuleContextOptions(logger, time.Minute))
+		require.NoError(t, err)
+		cfg, err := newNativeCallbackConfig(&api.Rule{Block: true})
+		require.NoError(t, err)
+		prolog, err := NewNativeCallback("MyCallback", r, cfg)
+		require.NoError(t, err)
+		require.IsType(t, prologType(nil), prolog)
+		require.Equal(t, r, ctorRule)
+		require.Equal(t, cfg, ctorCfg)
+		// Registered callbacks are not critical
+		require.False(t, r.critical)
+	})
+}
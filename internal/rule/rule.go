@@ -20,13 +20,16 @@ package rule
 
 import (
 	"crypto/ecdsa"
+	"fmt"
 	"io"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/sqreen/go-agent/internal/backend/api"
 	"github.com/sqreen/go-agent/internal/metrics"
 	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule/callback"
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
 	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
 )
@@ -45,6 +48,24 @@ type Engine struct {
 	instrumentationEngine                InstrumentationFace
 	perfHistogramUnit, perfHistogramBase float64
 	perfHistogramPeriod                  time.Duration
+	// Hooks of the shadow rules, evaluated along with the live rules (cf.
+	// SetShadowRules()).
+	shadowHooks  hookDescriptorMap
+	shadowPackID string
+	// Additional public keys trusted to verify rule signatures, configured
+	// locally (cf. SetLocalPublicKeys()).
+	localPublicKeys []PublicKey
+	// Configuration of the rule circuit breakers (cf. SetCircuitBreaker()).
+	circuitBreaker        CircuitBreakerConfig
+	circuitBreakerChanges chan struct{}
+	// Local exclusions of the in-app WAF rules (cf. SetWAFExclusions()).
+	wafExclusions []callback.WAFExclusion
+	// Last rulespacks set, from the oldest to the current one.
+	history []rulespackVersion
+	// Configuration of the automatic rollback of the rulespacks (cf.
+	// SetAutoRollback()).
+	autoRollback     AutoRollbackConfig
+	rollbackRequests chan string
 }
 
 // NewEngine returns a new rule engine.
@@ -61,9 +82,71 @@ func NewEngine(logger plog.DebugLevelLogger, instrumentationEngine Instrumentati
 		perfHistogramBase:     perfHistogramBase,
 		perfHistogramUnit:     perfHistogramUnit,
 		perfHistogramPeriod:   perfHistogramPeriod,
+		circuitBreaker: CircuitBreakerConfig{
+			CoolDown: DefaultCircuitBreakerCoolDown,
+		},
+		circuitBreakerChanges: make(chan struct{}, 1),
+		rollbackRequests:      make(chan string, 1),
 	}
 }
 
+// SetLocalPublicKeys sets the additional public keys trusted to verify the
+// rule signatures, so that rules can be signed locally. Rules are still
+// verified against the Sqreen public key first. It applies to the next rules
+// set.
+func (e *Engine) SetLocalPublicKeys(keys []PublicKey) {
+	e.localPublicKeys = keys
+}
+
+// SetCircuitBreaker sets the configuration of the rule circuit breakers,
+// disabling the callbacks of the rules failing too many times in a row. It
+// applies to the next rules set.
+func (e *Engine) SetCircuitBreaker(cfg CircuitBreakerConfig) {
+	e.circuitBreaker = cfg
+}
+
+// CircuitBreakerChanges returns the channel signaled when circuit breakers
+// opened or reached the end of their cool-down. The callbacks must then be
+// detached or attached back by the caller with ApplyCircuitBreakers() so that
+// it is not concurrent with the other rules modifications.
+func (e *Engine) CircuitBreakerChanges() <-chan struct{} {
+	return e.circuitBreakerChanges
+}
+
+// ApplyCircuitBreakers detaches the callbacks of the rules whose circuit
+// breaker is open from their hook, and attaches back those whose cool-down is
+// over.
+func (e *Engine) ApplyCircuitBreakers() {
+	if !e.enabled {
+		return
+	}
+	for _, hook := range e.allHooks() {
+		live, shadow := e.hooks[hook], e.shadowHooks[hook]
+		if len(live.breakers) == 0 && len(shadow.breakers) == 0 {
+			continue
+		}
+		if err := attachHook(hook, live, shadow); err != nil {
+			e.logger.Error(sqerrors.Wrapf(err, "security rules: could not apply the circuit breakers of hook `%v`", hook))
+		}
+	}
+}
+
+// SetWAFExclusions sets the local exclusions of the in-app WAF rules, applied
+// to the WAF rulesets of the rulespacks. It applies to the next rules set.
+func (e *Engine) SetWAFExclusions(exclusions []callback.WAFExclusion) {
+	e.wafExclusions = exclusions
+}
+
+// trustedPublicKeys returns the list of public keys trusted to verify the rule
+// signatures, starting with the Sqreen one.
+func (e *Engine) trustedPublicKeys() []PublicKey {
+	keys := make([]PublicKey, 0, 1+len(e.localPublicKeys))
+	if e.publicKey != nil {
+		keys = append(keys, PublicKey{ID: SqreenPublicKeyID, Key: e.publicKey})
+	}
+	return append(keys, e.localPublicKeys...)
+}
+
 // Health returns a detailed error when the
 func (e *Engine) Health(expectedVersion string) error {
 	return e.instrumentationEngine.Health(expectedVersion)
@@ -75,15 +158,29 @@ func (e *Engine) PackID() string {
 }
 
 // SetRules set the currents rules. If rules were already set, it will replace
-// them by atomically modifying the hooks, and removing what is left.
+// them by atomically modifying the hooks, and removing what is left. The
+// rulespack is added to the history of rulespacks and watched for an automatic
+// rollback (cf. SetAutoRollback()).
 func (e *Engine) SetRules(packID string, rules []api.Rule) {
+	e.setRulespack(packID, rules, e.newRulespackHealth(packID))
+}
+
+func (e *Engine) setRulespack(packID string, rules []api.Rule, health *rulespackHealth) {
 	// Create the new rule descriptors and replace the existing ones
 	var ruleDescriptors hookDescriptorMap
 	if len(rules) > 0 {
 		e.logger.Debugf("security rules: loading rules from pack `%s`", packID)
-		ruleDescriptors = newHookDescriptors(e, packID, rules)
+		ruleDescriptors = newHookDescriptors(e, packID, rules, nil, health)
 	}
 	e.setRules(packID, ruleDescriptors)
+
+	if len(e.history) > 0 {
+		if prev := &e.history[len(e.history)-1]; prev.id != packID {
+			diff := diffRulespacks(prev, &rulespackVersion{id: packID, rules: rules})
+			e.logger.Infof("security rules: rulespack `%s` replaced by `%s`: %d rules added, %d removed and %d changed", prev.id, packID, len(diff.AddedRules), len(diff.RemovedRules), len(diff.ChangedRules))
+		}
+	}
+	e.addToHistory(packID, rules)
 }
 
 func (e *Engine) setRules(packID string, descriptors hookDescriptorMap) {
@@ -92,10 +189,11 @@ func (e *Engine) setRules(packID string, descriptors hookDescriptorMap) {
 	// when a rule is updated.
 	disabledDescriptors := e.hooks
 	for hook, descr := range descriptors {
+		e.logger.Debugf("security rules: hook `%s`: rule callbacks in priority order: %s", hook, descr)
 		if e.enabled {
 			// Attach the callback to the hook, possibly overwriting the previous one.
 			e.logger.Debugf("security rules: attaching callback to `%s`", hook)
-			err := hook.Attach(descr.callbacks...)
+			err := attachHook(hook, descr, e.shadowHooks[hook])
 			if err != nil {
 				e.logger.Error(sqerrors.Wrapf(err, "security rules: could not attach the prolog callback to `%s`", hook))
 				continue
@@ -116,7 +214,12 @@ func (e *Engine) setRules(packID string, descriptors hookDescriptorMap) {
 	// Close the previous descriptors that are now disabled.
 	for hook, descr := range disabledDescriptors {
 		e.logger.Debugf("security rules: disabling no longer needed hook `%s`", hook)
-		err := hook.Attach(nil)
+		// The shadow callbacks of the hook, if any, are kept attached.
+		var shadow hookDescriptor
+		if e.enabled {
+			shadow = e.shadowHooks[hook]
+		}
+		err := attachHook(hook, hookDescriptor{}, shadow)
 		if err != nil {
 			e.logger.Error(sqerrors.Wrapf(err, "security rules: could not disable hook `%v`", hook))
 			continue
@@ -134,18 +237,53 @@ func (e *Engine) setRules(packID string, descriptors hookDescriptorMap) {
 // newHookDescriptors walks the list of received rules and creates the map of
 // hook descriptors indexed by their hook pointer. A hook descriptor contains
 // all it takes to enable and disable rules at run time.
-func newHookDescriptors(e *Engine, rulepackID string, rules []api.Rule) hookDescriptorMap {
+// Shadow rules are created in shadow mode when non-nil. The callback errors
+// and over-budget callbacks are reported to the rulespack health monitor when
+// non-nil.
+func newHookDescriptors(e *Engine, rulepackID string, rules []api.Rule, shadow *shadowMode, health *rulespackHealth) hookDescriptorMap {
 	logger := e.logger
 
+	publicKeys := e.trustedPublicKeys()
+
+	ruleCtxOpts := nativeRuleContextOptions{
+		rulepackID:            rulepackID,
+		shadow:                shadow,
+		health:                health,
+		circuitBreaker:        e.circuitBreaker,
+		circuitBreakerChanges: e.circuitBreakerChanges,
+		metricsEngine:         e.metricsEngine,
+		logger:                logger,
+		perfHistogramUnit:     e.perfHistogramUnit,
+		perfHistogramBase:     e.perfHistogramBase,
+		perfHistogramPeriod:   e.perfHistogramPeriod,
+	}
+
 	// Create and configure the list of callbacks according to the given rules
 	var hookDescriptors = make(hookDescriptorMap)
 	for i := len(rules) - 1; i >= 0; i-- {
 		r := rules[i]
+		if shadow != nil && r.AttackType == "" {
+			// Only rules detecting attacks can be forced into test mode. Other
+			// rules, such as security headers, have side effects.
+			logger.Debugf("security rules: shadow rule `%s`: ignoring rule without attack type", r.Name)
+			continue
+		}
 		// Verify the signature
-		if err := VerifyRuleSignature(&r, e.publicKey); err != nil {
+		keyID, err := verifyRuleSignature(&r, publicKeys)
+		if err != nil {
 			logger.Error(sqerrors.Wrapf(err, "security rules: rule `%s`: signature verification", r.Name))
 			continue
 		}
+		if keyID == SqreenPublicKeyID {
+			logger.Debugf("security rules: rule `%s`: signature verified by the sqreen public key", r.Name)
+		} else {
+			logger.Infof("security rules: rule `%s`: signature verified by the local public key `%s`", r.Name, keyID)
+		}
+		if shadow != nil {
+			// Shadow rules never block and their attacks are test attacks.
+			r.Test = true
+			r.Block = false
+		}
 		// Find the symbol
 		hookpoint := r.Hookpoint
 		symbol := hookpoint.Method
@@ -162,11 +300,12 @@ func newHookDescriptors(e *Engine, rulepackID string, rules []api.Rule) hookDesc
 		}
 
 		// Create the rule context
-		ruleCtx, err := newNativeRuleContext(&r, rulepackID, e.metricsEngine, logger, e.perfHistogramUnit, e.perfHistogramBase, e.perfHistogramPeriod)
+		ruleCtx, err := newNativeRuleContext(&r, ruleCtxOpts)
 		if err != nil {
 			logger.Error(sqerrors.Wrapf(err, "security rules: rule `%s`: callback configuration", r.Name))
 			continue
 		}
+		ruleCtx.wafExclusions = e.wafExclusions
 
 		// Create the prolog callback
 		var prolog sqhook.PrologCallback
@@ -194,7 +333,10 @@ func newHookDescriptors(e *Engine, rulepackID string, rules []api.Rule) hookDesc
 
 		// Create the descriptor with everything required to be able to enable or
 		// disable it afterwards.
-		hookDescriptors.Add(hook, prolog, r.Priority)
+		hookDescriptors.Add(hook, r.Name, prolog, r.Priority)
+		if ruleCtx.breaker != nil {
+			hookDescriptors.addCircuitBreaker(hook, r.Name, ruleCtx.breaker)
+		}
 	}
 	// Nothing in the end
 	if len(hookDescriptors) == 0 {
@@ -205,9 +347,9 @@ func newHookDescriptors(e *Engine, rulepackID string, rules []api.Rule) hookDesc
 
 // Enable the hooks of the ongoing configured rules.
 func (e *Engine) Enable() {
-	for hook, descr := range e.hooks {
+	for _, hook := range e.allHooks() {
 		e.logger.Debugf("security rules: attaching callback to hook `%s`", hook)
-		if err := hook.Attach(descr.callbacks...); err != nil {
+		if err := attachHook(hook, e.hooks[hook], e.shadowHooks[hook]); err != nil {
 			e.logger.Error(sqerrors.Wrapf(err, "security rules: could not attach the callback to hook `%v`", hook))
 		}
 	}
@@ -218,7 +360,7 @@ func (e *Engine) Enable() {
 // Disable the hooks currently attached to callbacks.
 func (e *Engine) Disable() {
 	e.enabled = false
-	for hook := range e.hooks {
+	for _, hook := range e.allHooks() {
 		err := hook.Attach(nil)
 		if err != nil {
 			e.logger.Error(sqerrors.Wrapf(err, "security rules: error while disabling hook `%v`", hook))
@@ -233,17 +375,65 @@ func (e *Engine) Count() int {
 	return len(e.hooks)
 }
 
+// allHooks returns the hooks of both the live and shadow rules.
+func (e *Engine) allHooks() []HookFace {
+	hooks := make([]HookFace, 0, len(e.hooks)+len(e.shadowHooks))
+	for hook := range e.hooks {
+		hooks = append(hooks, hook)
+	}
+	for hook := range e.shadowHooks {
+		if _, exists := e.hooks[hook]; !exists {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// attachHook attaches the callbacks of the live rules to the hook, followed by
+// the callbacks of the shadow rules as shadow prologs (cf. sqhook.Shadow()).
+// Shadow callbacks are therefore called after the live ones, in their own chain
+// that a blocking live rule cannot short-circuit, while the epilogs of the live
+// rules keep the final say on the function results. The hook is disabled when
+// there are no callbacks. Callbacks detached by their circuit breaker are left
+// out.
+func attachHook(hook HookFace, live, shadow hookDescriptor) error {
+	now := time.Now()
+	live, shadow = live.attached(now), shadow.attached(now)
+	if len(shadow.callbacks) == 0 {
+		if len(live.callbacks) == 0 {
+			return hook.Attach(nil)
+		}
+		return hook.Attach(live.callbacks...)
+	}
+	callbacks := make([]sqhook.PrologCallback, 0, len(live.callbacks)+len(shadow.callbacks))
+	callbacks = append(callbacks, live.callbacks...)
+	for _, cb := range shadow.callbacks {
+		callbacks = append(callbacks, sqhook.Shadow(cb))
+	}
+	return hook.Attach(callbacks...)
+}
+
 type (
 	hookDescriptorMap map[HookFace]hookDescriptor
 
+	// hookDescriptor is the list of callbacks of a hook, sorted by priority. A
+	// callback returning an error, such as a blocking one returning
+	// sqhook.AbortError, short-circuits the callbacks having a lower priority
+	// (cf. sqhook.Hook.Attach()).
 	hookDescriptor struct {
+		rules      []string
 		priorities []int
 		callbacks  []sqhook.PrologCallback
 		closers    []io.Closer
+		// breakers are the circuit breakers of the rules having one.
+		breakers map[string]*circuitBreaker
 	}
 )
 
-func (m hookDescriptorMap) Add(hook HookFace, callback sqhook.PrologCallback, priority int) {
+// Add adds the callback of the given rule to the hook descriptor. Callbacks are
+// ordered by ascending priority value, and then by rule name, so that the
+// order is deterministic whatever the order of the rules in the rulespack.
+func (m hookDescriptorMap) Add(hook HookFace, rule string, callback sqhook.PrologCallback, priority int) {
 	d, exists := m[hook]
 	closer, _ := callback.(io.Closer)
 
@@ -254,6 +444,7 @@ func (m hookDescriptorMap) Add(hook HookFace, callback sqhook.PrologCallback, pr
 			closers = []io.Closer{closer}
 		}
 		m[hook] = hookDescriptor{
+			rules:      []string{rule},
 			priorities: []int{priority},
 			callbacks:  []sqhook.PrologCallback{callback},
 			closers:    closers,
@@ -262,11 +453,19 @@ func (m hookDescriptorMap) Add(hook HookFace, callback sqhook.PrologCallback, pr
 	}
 
 	// Not the first insertion.
-	// Look for the callback position i per ascending priority order
+	// Look for the callback position i per ascending priority and rule name order
 	i := sort.Search(len(d.priorities), func(i int) bool {
+		if d.priorities[i] == priority {
+			return d.rules[i] > rule
+		}
 		return d.priorities[i] > priority
 	})
 
+	// Update the list of rules
+	d.rules = append(d.rules, "")
+	copy(d.rules[i+1:], d.rules[i:])
+	d.rules[i] = rule
+
 	// Update the list of priorities
 	d.priorities = append(d.priorities, 0)
 	copy(d.priorities[i+1:], d.priorities[i:])
@@ -286,6 +485,47 @@ func (m hookDescriptorMap) Add(hook HookFace, callback sqhook.PrologCallback, pr
 	m[hook] = d
 }
 
+// addCircuitBreaker adds the circuit breaker of the given rule, whose callback
+// was added to the hook descriptor.
+func (m hookDescriptorMap) addCircuitBreaker(hook HookFace, rule string, b *circuitBreaker) {
+	d := m[hook]
+	if d.breakers == nil {
+		d.breakers = make(map[string]*circuitBreaker)
+	}
+	d.breakers[rule] = b
+	m[hook] = d
+}
+
+// attached returns the hook descriptor without the callbacks detached by their
+// circuit breaker.
+func (d hookDescriptor) attached(now time.Time) hookDescriptor {
+	if len(d.breakers) == 0 {
+		return d
+	}
+	attached := d
+	attached.callbacks = make([]sqhook.PrologCallback, 0, len(d.callbacks))
+	for i, cb := range d.callbacks {
+		if b := d.breakers[d.rules[i]]; b != nil && b.detached(now) {
+			continue
+		}
+		attached.callbacks = append(attached.callbacks, cb)
+	}
+	return attached
+}
+
+// String returns the rules of the hook descriptor in the order their callbacks
+// are called.
+func (d hookDescriptor) String() string {
+	var b strings.Builder
+	for i, rule := range d.rules {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "`%s` (priority %d)", rule, d.priorities[i])
+	}
+	return b.String()
+}
+
 func (d hookDescriptor) Close() error {
 	var errs sqerrors.ErrorCollection
 	for _, c := range d.closers {
@@ -508,6 +508,158 @@ func TestEngineUsage(t *testing.T) {
 	})
 }
 
+func TestShadowRules(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	publicKey := &privateKey.PublicKey
+
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	metrics := metrics.NewEngine()
+
+	newRule := func(name, fn, attackType string) api.Rule {
+		return api.Rule{
+			Name: name,
+			Hookpoint: api.Hookpoint{
+				Method:   thisPkgPath + "." + fn,
+				Callback: "WriteCustomErrorPage",
+			},
+			Data: api.RuleData{
+				Values: []api.RuleDataEntry{
+					{Value: &api.CustomErrorPageRuleDataEntry{}},
+				},
+			},
+			AttackType: attackType,
+			Signature:  MakeSignature(privateKey, `{"name":"`+name+`"}`),
+		}
+	}
+
+	prologs := func(n int) interface{} {
+		return mock.MatchedBy(func(prologs []sqhook.PrologCallback) bool {
+			return len(prologs) == n
+		})
+	}
+
+	t.Run("bad arguments", func(t *testing.T) {
+		engine := rule.NewEngine(logger, &instrumentationMockup{}, metrics, publicKey, 1, 1, time.Minute)
+		engine.SetRules("my pack id", nil)
+		require.Error(t, engine.SetShadowRules("", nil, 0.5))
+		require.Error(t, engine.SetShadowRules("my pack id", nil, 0.5))
+		require.Error(t, engine.SetShadowRules("my shadow pack id", nil, 0))
+		require.Error(t, engine.SetShadowRules("my shadow pack id", nil, 1.5))
+		require.Empty(t, engine.ShadowPackID())
+	})
+
+	t.Run("shadow callbacks are attached along with the live ones", func(t *testing.T) {
+		instrumentation := &instrumentationMockup{}
+		hook1 := &hookMockup{}
+		hook2 := &hookMockup{}
+
+		engine := rule.NewEngine(logger, instrumentation, metrics, publicKey, 1, 1, time.Minute)
+		instrumentation.ExpectFind(thisPkgPath+".func1").Return(hook1, nil).Once()
+		engine.SetRules("my pack id", []api.Rule{newRule("live rule", "func1", "xss")})
+		hook1.ExpectAttach(mock.Anything).Return(nil).Once()
+		engine.Enable()
+		instrumentation.AssertExpectations(t)
+		hook1.AssertExpectations(t)
+
+		// The shadow rule without attack type is ignored
+		instrumentation.ExpectFind(thisPkgPath+".func1").Return(hook1, nil).Once()
+		instrumentation.ExpectFind(thisPkgPath+".func2").Return(hook2, nil).Once()
+		hook1.On("Attach", prologs(2)).Return(nil).Once()
+		hook2.On("Attach", prologs(1)).Return(nil).Once()
+		err := engine.SetShadowRules("my shadow pack id", []api.Rule{
+			newRule("shadow rule 1", "func1", "xss"),
+			newRule("shadow rule 2", "func2", "sqli"),
+			newRule("shadow rule 3", "func3", ""),
+		}, 0.5)
+		require.NoError(t, err)
+		require.Equal(t, "my shadow pack id", engine.ShadowPackID())
+		require.Equal(t, "my pack id", engine.PackID())
+		require.Equal(t, 1, engine.Count())
+		instrumentation.AssertExpectations(t)
+		hook1.AssertExpectations(t)
+		hook2.AssertExpectations(t)
+
+		// Disabling the rules removes both live and shadow callbacks
+		hook1.ExpectAttach(nil).Return(nil).Once()
+		hook2.ExpectAttach(nil).Return(nil).Once()
+		engine.Disable()
+		hook1.AssertExpectations(t)
+		hook2.AssertExpectations(t)
+
+		// Enabling them sets back both live and shadow callbacks
+		hook1.On("Attach", prologs(2)).Return(nil).Once()
+		hook2.On("Attach", prologs(1)).Return(nil).Once()
+		engine.Enable()
+		hook1.AssertExpectations(t)
+		hook2.AssertExpectations(t)
+
+		// Removing the live rules keeps the shadow callbacks
+		hook1.On("Attach", prologs(1)).Return(nil).Once()
+		engine.SetRules("my other pack id", nil)
+		hook1.AssertExpectations(t)
+
+		// Clearing the shadow rules removes the shadow callbacks
+		hook1.ExpectAttach(nil).Return(nil).Once()
+		hook2.ExpectAttach(nil).Return(nil).Once()
+		engine.ClearShadowRules()
+		require.Empty(t, engine.ShadowPackID())
+		hook1.AssertExpectations(t)
+		hook2.AssertExpectations(t)
+	})
+}
+
+func TestLocalPublicKeys(t *testing.T) {
+	sqreenPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	localPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+	metrics := metrics.NewEngine()
+
+	newRule := func(name, fn string, privateKey *ecdsa.PrivateKey) api.Rule {
+		return api.Rule{
+			Name: name,
+			Hookpoint: api.Hookpoint{
+				Method:   thisPkgPath + "." + fn,
+				Callback: "WriteCustomErrorPage",
+			},
+			Data: api.RuleData{
+				Values: []api.RuleDataEntry{
+					{Value: &api.CustomErrorPageRuleDataEntry{}},
+				},
+			},
+			Signature: MakeSignature(privateKey, `{"name":"`+name+`"}`),
+		}
+	}
+	rules := []api.Rule{
+		newRule("sqreen rule", "func1", sqreenPrivateKey),
+		newRule("local rule", "func2", localPrivateKey),
+	}
+
+	t.Run("without local public keys", func(t *testing.T) {
+		instrumentation := &instrumentationMockup{}
+		engine := rule.NewEngine(logger, instrumentation, metrics, &sqreenPrivateKey.PublicKey, 1, 1, time.Minute)
+		// Only the rule signed by sqreen is looked up
+		instrumentation.ExpectFind(thisPkgPath+".func1").Return(&hookMockup{}, nil).Once()
+		engine.SetRules("my pack id", rules)
+		require.Equal(t, 1, engine.Count())
+		instrumentation.AssertExpectations(t)
+	})
+
+	t.Run("with local public keys", func(t *testing.T) {
+		instrumentation := &instrumentationMockup{}
+		engine := rule.NewEngine(logger, instrumentation, metrics, &sqreenPrivateKey.PublicKey, 1, 1, time.Minute)
+		engine.SetLocalPublicKeys([]rule.PublicKey{{ID: "my key", Key: &localPrivateKey.PublicKey}})
+		instrumentation.ExpectFind(thisPkgPath+".func1").Return(&hookMockup{}, nil).Once()
+		instrumentation.ExpectFind(thisPkgPath+".func2").Return(&hookMockup{}, nil).Once()
+		engine.SetRules("my pack id", rules)
+		require.Equal(t, 2, engine.Count())
+		instrumentation.AssertExpectations(t)
+	})
+}
+
 func MakeSignature(privateKey *ecdsa.PrivateKey, message string) api.RuleSignature {
 	hash := sha512.Sum512([]byte(message))
 	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
@@ -27,26 +27,41 @@ func TestHookDescriptors(t *testing.T) {
 	t.Run("multiple callbacks having the same priority", func(t *testing.T) {
 		var m = hookDescriptorMap{}
 		key := hookMockup{}
-		m.Add(key, 1, 1)
-		m.Add(key, 2, 1)
-		m.Add(key, 3, 1)
-		m.Add(key, 4, 1)
+		m.Add(key, "rule 1", 1, 1)
+		m.Add(key, "rule 2", 2, 1)
+		m.Add(key, "rule 3", 3, 1)
+		m.Add(key, "rule 4", 4, 1)
 		d := m[key]
+		require.Equal(t, []string{"rule 1", "rule 2", "rule 3", "rule 4"}, d.rules)
 		require.Equal(t, []int{1, 1, 1, 1}, d.priorities)
 		require.Equal(t, []sqhook.PrologCallback{1, 2, 3, 4}, d.callbacks)
 		require.Nil(t, d.closers)
 	})
 
+	t.Run("multiple callbacks having the same priority are sorted by rule name", func(t *testing.T) {
+		var m = hookDescriptorMap{}
+		key := hookMockup{}
+		m.Add(key, "rule c", 3, 1)
+		m.Add(key, "rule a", 1, 1)
+		m.Add(key, "rule d", 4, 2)
+		m.Add(key, "rule b", 2, 1)
+		d := m[key]
+		require.Equal(t, []string{"rule a", "rule b", "rule c", "rule d"}, d.rules)
+		require.Equal(t, []int{1, 1, 1, 2}, d.priorities)
+		require.Equal(t, []sqhook.PrologCallback{1, 2, 3, 4}, d.callbacks)
+		require.Equal(t, "`rule a` (priority 1), `rule b` (priority 1), `rule c` (priority 1), `rule d` (priority 2)", d.String())
+	})
+
 	t.Run("multiple callbacks having distinct priorities", func(t *testing.T) {
 		var m = hookDescriptorMap{}
 		key := hookMockup{}
 
-		m.Add(key, 3, 2)
-		m.Add(key, 5, 3)
-		m.Add(key, 4, 2)
-		m.Add(key, 1, 1)
-		m.Add(key, 6, 3)
-		m.Add(key, 2, 1)
+		m.Add(key, "rule 3", 3, 2)
+		m.Add(key, "rule 5", 5, 3)
+		m.Add(key, "rule 4", 4, 2)
+		m.Add(key, "rule 1", 1, 1)
+		m.Add(key, "rule 6", 6, 3)
+		m.Add(key, "rule 2", 2, 1)
 		d := m[key]
 		require.Equal(t, []int{1, 1, 2, 2, 3, 3}, d.priorities)
 		require.Equal(t, []sqhook.PrologCallback{1, 2, 3, 4, 5, 6}, d.callbacks)
@@ -56,13 +71,13 @@ func TestHookDescriptors(t *testing.T) {
 	t.Run("multiple callbacks with close methods", func(t *testing.T) {
 		var m = hookDescriptorMap{}
 		key := hookMockup{}
-		m.Add(key, myFakeCallback(7), 10)
-		m.Add(key, 3, 2)
-		m.Add(key, myFakeCallback(1), 1)
-		m.Add(key, 2, 1)
-		m.Add(key, myFakeCallback(5), 3)
-		m.Add(key, 4, 2)
-		m.Add(key, 6, 3)
+		m.Add(key, "rule 7", myFakeCallback(7), 10)
+		m.Add(key, "rule 3", 3, 2)
+		m.Add(key, "rule 1", myFakeCallback(1), 1)
+		m.Add(key, "rule 2", 2, 1)
+		m.Add(key, "rule 5", myFakeCallback(5), 3)
+		m.Add(key, "rule 4", 4, 2)
+		m.Add(key, "rule 6", 6, 3)
 
 		d := m[key]
 		require.Equal(t, []int{1, 1, 2, 2, 3, 3, 10}, d.priorities)
@@ -0,0 +1,233 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"hash/fnv"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+)
+
+// Default adjustment period of the adaptive sampling rates.
+const defaultAdaptiveSamplingPeriod = 10 * time.Second
+
+// ruleSampler decides the protection contexts the callbacks of a rule are
+// executed in. The decision is derived from the identity of the protection
+// context and the rule name so that the pre and post callbacks of a rule are
+// executed in the same protection contexts, while different rules sample
+// different ones.
+type ruleSampler struct {
+	// threshold is the current sampling threshold, atomically accessed.
+	threshold uint64
+	salt      uint64
+	// adaptive is non-nil when the sampling rate is adjusted under load.
+	adaptive *adaptiveSampler
+}
+
+// adaptiveSampler adjusts the sampling rate of a rule according to the average
+// execution time of its callbacks and the CPU usage of the program.
+type adaptiveSampler struct {
+	rule             string
+	maxRate, minRate float64
+	maxLatency       time.Duration
+	maxCPU           float64
+	period           time.Duration
+	logger           plog.DebugLogger
+	// Execution times observed since the last adjustment, atomically accessed.
+	calls, duration uint64
+	// nextAdjustment is the time of the next adjustment in nanoseconds since the
+	// Unix epoch, atomically accessed so that observations don't take the lock
+	// until it is due.
+	nextAdjustment int64
+
+	lock           sync.Mutex
+	rate           float64
+	lastAdjustment time.Time
+	lastCPUTime    time.Duration
+}
+
+// newRuleSampler returns the sampler of the given rule sampling configuration,
+// or nil when the rule is always executed.
+func newRuleSampler(rule string, cfg *api.RuleSampling, logger plog.DebugLogger) (*ruleSampler, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	rate := cfg.Rate
+	if math.IsNaN(rate) || rate <= 0 || rate > 1 {
+		return nil, sqerrors.Errorf("unexpected sampling rate `%v` out of ]0, 1]", rate)
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(rule))
+	s := &ruleSampler{
+		threshold: samplingThreshold(rate),
+		salt:      h.Sum64(),
+	}
+
+	a := cfg.Adaptive
+	if a == nil {
+		if rate == 1 {
+			return nil, nil
+		}
+		return s, nil
+	}
+	if math.IsNaN(a.MinRate) || a.MinRate <= 0 || a.MinRate > rate {
+		return nil, sqerrors.Errorf("unexpected adaptive sampling minimum rate `%v` out of ]0, %v]", a.MinRate, rate)
+	}
+	if math.IsNaN(a.MaxLatency) || a.MaxLatency < 0 {
+		return nil, sqerrors.Errorf("unexpected adaptive sampling maximum latency `%v`", a.MaxLatency)
+	}
+	if math.IsNaN(a.MaxCPU) || a.MaxCPU < 0 || a.MaxCPU > 1 {
+		return nil, sqerrors.Errorf("unexpected adaptive sampling maximum cpu usage `%v` out of [0, 1]", a.MaxCPU)
+	}
+	if a.MaxLatency == 0 && a.MaxCPU == 0 {
+		return nil, sqerrors.New("adaptive sampling without maximum latency nor cpu usage")
+	}
+	period := defaultAdaptiveSamplingPeriod
+	if a.Period > 0 {
+		period = time.Duration(a.Period) * time.Second
+	}
+
+	s.adaptive = &adaptiveSampler{
+		rule:       rule,
+		maxRate:    rate,
+		minRate:    a.MinRate,
+		maxLatency: time.Duration(a.MaxLatency * float64(time.Millisecond)),
+		maxCPU:     a.MaxCPU,
+		period:     period,
+		logger:     logger,
+		rate:       rate,
+	}
+	s.adaptive.setLastAdjustment(time.Now())
+	s.adaptive.lastCPUTime, _ = sqtime.ProcessCPUTime()
+	return s, nil
+}
+
+// sample returns true when the callbacks must be executed in the given
+// protection context.
+func (s *ruleSampler) sample(p callback.ProtectionContext) bool {
+	return sampledProtectionContext(p, s.salt, atomic.LoadUint64(&s.threshold))
+}
+
+// observe records the execution time of a sampled callback and adjusts the
+// sampling rate when the adjustment period is over. The lock is only taken
+// when the adjustment is due.
+func (s *ruleSampler) observe(d time.Duration, now time.Time) {
+	a := s.adaptive
+	atomic.AddUint64(&a.calls, 1)
+	atomic.AddUint64(&a.duration, uint64(d))
+
+	if now.UnixNano() < atomic.LoadInt64(&a.nextAdjustment) {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// Check again in case of concurrent adjustments
+	elapsed := now.Sub(a.lastAdjustment)
+	if elapsed < a.period {
+		return
+	}
+	a.setLastAdjustment(now)
+
+	rate := a.rate
+	overloaded := false
+
+	calls := atomic.SwapUint64(&a.calls, 0)
+	duration := atomic.SwapUint64(&a.duration, 0)
+	if a.maxLatency > 0 && calls > 0 {
+		if avg := time.Duration(duration / calls); avg > a.maxLatency {
+			rate *= float64(a.maxLatency) / float64(avg)
+			overloaded = true
+		}
+	}
+
+	if a.maxCPU > 0 {
+		if cpuTime, ok := sqtime.ProcessCPUTime(); ok {
+			usage := float64(cpuTime-a.lastCPUTime) / (float64(elapsed) * float64(runtime.NumCPU()))
+			a.lastCPUTime = cpuTime
+			if usage > a.maxCPU {
+				rate = math.Min(rate, a.rate*a.maxCPU/usage)
+				overloaded = true
+			}
+		}
+	}
+
+	if !overloaded {
+		// Progressively go back to the static rate
+		rate *= 2
+	}
+	rate = math.Max(a.minRate, math.Min(a.maxRate, rate))
+	if rate == a.rate {
+		return
+	}
+	a.logger.Debugf("security rules: rule `%s`: adaptive sampling rate changed from %g to %g", a.rule, a.rate, rate)
+	a.rate = rate
+	atomic.StoreUint64(&s.threshold, samplingThreshold(rate))
+}
+
+// setLastAdjustment sets the time of the last adjustment, along with the time
+// of the next one.
+func (a *adaptiveSampler) setLastAdjustment(now time.Time) {
+	a.lastAdjustment = now
+	atomic.StoreInt64(&a.nextAdjustment, now.Add(a.period).UnixNano())
+}
+
+// rate returns the current sampling rate.
+func (s *ruleSampler) rate() float64 {
+	if s.adaptive == nil {
+		return float64(atomic.LoadUint64(&s.threshold)) / (1 << 64)
+	}
+	s.adaptive.lock.Lock()
+	defer s.adaptive.lock.Unlock()
+	return s.adaptive.rate
+}
+
+// withRuleSampling returns the callback middleware only calling the callback
+// in the protection contexts sampled by the rule sampler. The sampling
+// decisions are counted in the given time histogram.
+func withRuleSampling(rulepackID, rule, cb string, s *ruleSampler, decisions timeHistogram) NativeCallbackMiddlewareFunc {
+	var (
+		sampledKey = rulepackID + "/" + rule + "/" + cb + "/sampled"
+		skippedKey = rulepackID + "/" + rule + "/" + cb + "/skipped"
+	)
+	return func(cb NativeCallbackFunc) NativeCallbackFunc {
+		return func(c callback.CallbackContext) error {
+			sampled := s.sample(c.ProtectionContext())
+			callback.TraceValue(c, "sampled", sampled)
+
+			key := skippedKey
+			if sampled {
+				key = sampledKey
+			}
+			if err := decisions.Add(key, 1); err != nil {
+				type errKey struct{}
+				c.Logger().Error(sqerrors.WithKey(err, errKey{}))
+			}
+
+			if !sampled {
+				return nil
+			}
+			if s.adaptive == nil {
+				return cb(c)
+			}
+			start := time.Now()
+			defer func() {
+				now := time.Now()
+				s.observe(now.Sub(start), now)
+			}()
+			return cb(c)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/plog"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/stretchr/testify/require"
+)
+
+type timeHistogramMockup map[interface{}]uint64
+
+func (h timeHistogramMockup) Add(key interface{}, delta uint64) error {
+	h[key] += delta
+	return nil
+}
+
+func TestRuleSampling(t *testing.T) {
+	logger := plog.NewLogger(plog.Debug, os.Stderr, nil)
+
+	t.Run("configuration", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			cfg      *api.RuleSampling
+			expected bool
+			err      bool
+		}{
+			{name: "no sampling", cfg: nil},
+			{name: "rate 1", cfg: &api.RuleSampling{Rate: 1}},
+			{name: "rate 0", cfg: &api.RuleSampling{Rate: 0}, err: true},
+			{name: "rate 1.5", cfg: &api.RuleSampling{Rate: 1.5}, err: true},
+			{name: "rate 0.5", cfg: &api.RuleSampling{Rate: 0.5}, expected: true},
+			{name: "adaptive without limits", cfg: &api.RuleSampling{Rate: 1, Adaptive: &api.RuleAdaptiveSampling{MinRate: 0.1}}, err: true},
+			{name: "adaptive without min rate", cfg: &api.RuleSampling{Rate: 1, Adaptive: &api.RuleAdaptiveSampling{MaxLatency: 1}}, err: true},
+			{name: "adaptive min rate above rate", cfg: &api.RuleSampling{Rate: 0.5, Adaptive: &api.RuleAdaptiveSampling{MinRate: 0.6, MaxLatency: 1}}, err: true},
+			{name: "adaptive max cpu above 1", cfg: &api.RuleSampling{Rate: 1, Adaptive: &api.RuleAdaptiveSampling{MinRate: 0.1, MaxCPU: 2}}, err: true},
+			{name: "adaptive", cfg: &api.RuleSampling{Rate: 1, Adaptive: &api.RuleAdaptiveSampling{MinRate: 0.1, MaxLatency: 1}}, expected: true},
+		} {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				s, err := newRuleSampler("my rule", tc.cfg, logger)
+				if tc.err {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, s != nil)
+			})
+		}
+	})
+
+	t.Run("sample rate", func(t *testing.T) {
+		for _, rate := range []float64{0.1, 0.5, 0.9} {
+			s, err := newRuleSampler("my rule", &api.RuleSampling{Rate: rate}, logger)
+			require.NoError(t, err)
+
+			decisions := timeHistogramMockup{}
+			var sampled int
+			cb := withRuleSampling("my pack", "my rule", "pre", s, decisions)(func(callback.CallbackContext) error {
+				sampled++
+				return nil
+			})
+			const n = 10000
+			for i := 0; i < n; i++ {
+				c := &mockups.CallbackContextMockup{}
+				c.ExpectProtectionContext().Return(new(http_protection.ProtectionContext))
+				require.NoError(t, cb(c))
+			}
+			require.InDelta(t, rate, float64(sampled)/n, 0.05)
+			require.Equal(t, uint64(sampled), decisions["my pack/my rule/pre/sampled"])
+			require.Equal(t, uint64(n-sampled), decisions["my pack/my rule/pre/skipped"])
+		}
+	})
+
+	t.Run("independent decisions per rule", func(t *testing.T) {
+		s1, err := newRuleSampler("rule 1", &api.RuleSampling{Rate: 0.5}, logger)
+		require.NoError(t, err)
+		s2, err := newRuleSampler("rule 2", &api.RuleSampling{Rate: 0.5}, logger)
+		require.NoError(t, err)
+
+		var same int
+		const n = 1000
+		for i := 0; i < n; i++ {
+			p := new(http_protection.ProtectionContext)
+			// Same decision in a given protection context for a given rule
+			require.Equal(t, s1.sample(p), s1.sample(p))
+			if s1.sample(p) == s2.sample(p) {
+				same++
+			}
+		}
+		require.InDelta(t, 0.5, float64(same)/n, 0.1)
+	})
+
+	t.Run("adaptive latency", func(t *testing.T) {
+		s, err := newRuleSampler("my rule", &api.RuleSampling{
+			Rate: 1,
+			Adaptive: &api.RuleAdaptiveSampling{
+				MinRate:    0.1,
+				MaxLatency: 1,
+				Period:     1,
+			},
+		}, logger)
+		require.NoError(t, err)
+		require.Equal(t, 1.0, s.rate())
+
+		now := time.Now()
+		// Not adjusted before the end of the period, nor locked
+		s.adaptive.lock.Lock()
+		s.observe(4*time.Millisecond, now)
+		s.adaptive.lock.Unlock()
+		require.Equal(t, 1.0, s.rate())
+
+		// Average latency of 4ms for a maximum of 1ms
+		now = now.Add(time.Second)
+		s.observe(4*time.Millisecond, now)
+		require.InDelta(t, 0.25, s.rate(), 0.001)
+
+		// Down to the minimum rate
+		now = now.Add(time.Second)
+		s.observe(100*time.Millisecond, now)
+		require.Equal(t, 0.1, s.rate())
+
+		// Progressively back to the static rate
+		now = now.Add(time.Second)
+		s.observe(time.Microsecond, now)
+		require.InDelta(t, 0.2, s.rate(), 0.001)
+		for i := 0; i < 4; i++ {
+			now = now.Add(time.Second)
+			s.observe(time.Microsecond, now)
+		}
+		require.Equal(t, 1.0, s.rate())
+	})
+
+	t.Run("blocking rules are never sampled", func(t *testing.T) {
+		r, err := newNativeRuleContext(&api.Rule{
+			Name:     "my rule",
+			Block:    true,
+			Sampling: &api.RuleSampling{Rate: 0.1},
+		}, newTestRuleContextOptions(logger, time.Minute))
+		require.NoError(t, err)
+		require.Nil(t, r.sampler)
+
+		r, err = newNativeRuleContext(&api.Rule{
+			Name:     "my rule",
+			Block:    true,
+			Test:     true,
+			Sampling: &api.RuleSampling{Rate: 0.1},
+		}, newTestRuleContextOptions(logger, time.Minute))
+		require.NoError(t, err)
+		require.NotNil(t, r.sampler)
+		require.NotNil(t, r.samplingHistogram())
+
+		// Nor critical rules
+		r.SetCritical(true)
+		require.Nil(t, r.samplingHistogram())
+	})
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"math"
+	"reflect"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-agent/internal/sqlib/sqtime"
+)
+
+// shadowMode is the configuration of the rules of a shadow rulespack.
+type shadowMode struct {
+	// sampleRate is the fraction of protection contexts, within ]0, 1], the
+	// shadow rules are evaluated in.
+	sampleRate float64
+}
+
+// metricsName returns the name of the metrics store of shadow rules so that
+// they don't mix with the metrics of the live rules.
+func (s *shadowMode) metricsName(name string) string {
+	if s == nil {
+		return name
+	}
+	return "shadow." + name
+}
+
+// shadowSqreenTimeKey is the callback state key of the execution time of the
+// shadow rules in a request (cf. callback.CallbackState()).
+type shadowSqreenTimeKey struct{}
+
+func newShadowSqreenTime() interface{} {
+	return sqtime.NewSharedStopWatch()
+}
+
+// sqreenTime returns the stopwatch the execution time of the rule callbacks is
+// charged to. Shadow rules have their own one per request so that they don't
+// use the time budget of the live rules.
+func (s *shadowMode) sqreenTime(c callback.CallbackContext) *sqtime.SharedStopWatch {
+	if s == nil {
+		return c.ProtectionContext().SqreenTime()
+	}
+	return callback.CallbackState(c, shadowSqreenTimeKey{}, newShadowSqreenTime).(*sqtime.SharedStopWatch)
+}
+
+// deadlineExceeded returns true when the time budget of the request is
+// exhausted. Shadow rules have a budget of the same size as the live rules,
+// which is compared to their own execution time.
+func (s *shadowMode) deadlineExceeded(c callback.CallbackContext) bool {
+	p := c.ProtectionContext()
+	if s == nil {
+		return p.DeadlineExceeded(0)
+	}
+	// The protection context compares its execution time to the budget, so the
+	// difference with the execution time of the shadow rules is the time they
+	// need.
+	return p.DeadlineExceeded(s.sqreenTime(c).Duration() - p.SqreenTime().Duration())
+}
+
+// SetShadowRules sets a candidate rulespack evaluated along with the live one,
+// on the given fraction of the protection contexts, in order to compare their
+// results before promoting it with SetRules(). Shadow rules are forced into
+// test mode, so that their attacks are only reported under the shadow
+// rulespack ID, and their metrics are stored separately. Rules without attack
+// type are ignored as they may have side effects, such as security headers or
+// security responses. The previous shadow rulespack, if any, is replaced.
+func (e *Engine) SetShadowRules(packID string, rules []api.Rule, sampleRate float64) error {
+	if packID == "" {
+		return sqerrors.New("unexpected empty shadow rulespack id")
+	}
+	if packID == e.packID {
+		return sqerrors.Errorf("the shadow rulespack id `%s` is the live one", packID)
+	}
+	if math.IsNaN(sampleRate) || sampleRate <= 0 || sampleRate > 1 {
+		return sqerrors.Errorf("unexpected shadow rulespack sample rate `%v` out of ]0, 1]", sampleRate)
+	}
+	e.setShadowRules(packID, newHookDescriptors(e, packID, rules, &shadowMode{sampleRate: sampleRate}, nil))
+	e.logger.Debugf("security rules: shadow rulespack `%s` evaluated on %g%% of the requests", packID, sampleRate*100)
+	return nil
+}
+
+// ClearShadowRules removes the current shadow rulespack, if any.
+func (e *Engine) ClearShadowRules() {
+	e.setShadowRules("", nil)
+}
+
+// ShadowPackID returns the ID of the current shadow rulespack, empty when
+// there is none.
+func (e *Engine) ShadowPackID() string {
+	return e.shadowPackID
+}
+
+func (e *Engine) setShadowRules(packID string, descriptors hookDescriptorMap) {
+	previous := e.shadowHooks
+	e.shadowHooks = descriptors
+	e.shadowPackID = packID
+
+	if e.enabled {
+		// Re-attach the hooks of both the previous and new shadow rules so that
+		// removed shadow rules are detached while the live ones are kept.
+		reattached := make(map[HookFace]struct{}, len(previous)+len(descriptors))
+		for _, m := range []hookDescriptorMap{previous, descriptors} {
+			for hook := range m {
+				if _, done := reattached[hook]; done {
+					continue
+				}
+				reattached[hook] = struct{}{}
+				if err := attachHook(hook, e.hooks[hook], e.shadowHooks[hook]); err != nil {
+					e.logger.Error(sqerrors.Wrapf(err, "security rules: could not attach the shadow callbacks to hook `%v`", hook))
+				}
+			}
+		}
+	}
+
+	// Close the previous shadow callbacks
+	for hook, descr := range previous {
+		if err := descr.Close(); err != nil {
+			e.logger.Error(sqerrors.Wrapf(err, "security rules: error while closing the shadow callback of hook `%v`", hook))
+		}
+	}
+}
+
+// withSampling returns the callback middleware only calling the callback for
+// the given fraction of the protection contexts. The decision is derived from
+// the identity of the protection context so that it is the same for every
+// callback called in a given protection context.
+func withSampling(sampleRate float64) NativeCallbackMiddlewareFunc {
+	threshold := samplingThreshold(sampleRate)
+	return func(cb NativeCallbackFunc) NativeCallbackFunc {
+		return func(c callback.CallbackContext) error {
+			if !sampledProtectionContext(c.ProtectionContext(), 0, threshold) {
+				return nil
+			}
+			return cb(c)
+		}
+	}
+}
+
+// samplingThreshold returns the threshold of the hashed protection contexts
+// below which they are sampled with the given sample rate.
+func samplingThreshold(sampleRate float64) uint64 {
+	if t := sampleRate * (1 << 64); t < 1<<64 {
+		return uint64(t)
+	}
+	return math.MaxUint64
+}
+
+// sampledProtectionContext returns true when the protection context hashed
+// with the given salt is below the sampling threshold. Different salts allow
+// independent sampling decisions for a given protection context.
+func sampledProtectionContext(p callback.ProtectionContext, salt, threshold uint64) bool {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false
+	}
+	return mixPointer(uint64(v.Pointer())^salt) < threshold
+}
+
+// mixPointer uniformly distributes the given pointer value over the uint64
+// range, using the SplitMix64 finalizer.
+func mixPointer(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package rule
+
+import (
+	"testing"
+
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowSampling(t *testing.T) {
+	t.Run("sample rate", func(t *testing.T) {
+		for _, rate := range []float64{0.1, 0.5, 0.9} {
+			var sampled int
+			cb := withSampling(rate)(func(callback.CallbackContext) error {
+				sampled++
+				return nil
+			})
+			const n = 10000
+			for i := 0; i < n; i++ {
+				c := &mockups.CallbackContextMockup{}
+				c.ExpectProtectionContext().Return(new(http_protection.ProtectionContext))
+				require.NoError(t, cb(c))
+			}
+			require.InDelta(t, rate, float64(sampled)/n, 0.05)
+		}
+	})
+
+	t.Run("same decision in a protection context", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			p := new(http_protection.ProtectionContext)
+			threshold := uint64(1) << 63
+			expected := sampledProtectionContext(p, 0, threshold)
+			for j := 0; j < 10; j++ {
+				require.Equal(t, expected, sampledProtectionContext(p, 0, threshold))
+			}
+		}
+	})
+
+	t.Run("nil protection context", func(t *testing.T) {
+		require.False(t, sampledProtectionContext(nil, 0, ^uint64(0)))
+		require.False(t, sampledProtectionContext((*http_protection.ProtectionContext)(nil), 0, ^uint64(0)))
+	})
+}
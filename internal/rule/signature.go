@@ -6,12 +6,17 @@ package rule
 
 import (
 	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"math/big"
+	"sort"
 
 	"github.com/sqreen/go-agent/internal/backend/api"
 	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
@@ -35,6 +40,70 @@ func NewECDSAPublicKey(PEMPublicKey string) (*ecdsa.PublicKey, error) {
 	return publicKey, nil
 }
 
+// PublicKey is a trusted public key of rule signatures.
+type PublicKey struct {
+	// ID identifies the public key in the logs.
+	ID  string
+	Key *ecdsa.PublicKey
+}
+
+// SqreenPublicKeyID is the ID of the public key of the rules signed by Sqreen.
+const SqreenPublicKeyID = "sqreen"
+
+// NewECDSAPublicKeys creates the list of ECDSA public keys found in the given
+// PEM data, in order. Their IDs are their fingerprints.
+func NewECDSAPublicKeys(PEMPublicKeys []byte) ([]PublicKey, error) {
+	var keys []PublicKey
+	for rest := PEMPublicKeys; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, sqerrors.Errorf("public key %d: unexpected PEM block type `%s`", len(keys)+1, block.Type)
+		}
+		publicKey, err := NewECDSAPublicKey(string(pem.EncodeToMemory(block)))
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "public key %d", len(keys)+1)
+		}
+		keys = append(keys, PublicKey{ID: PublicKeyFingerprint(block.Bytes), Key: publicKey})
+	}
+	if len(keys) == 0 {
+		return nil, sqerrors.New("no PEM public key found")
+	}
+	return keys, nil
+}
+
+// PublicKeyFingerprint returns the fingerprint of the given DER-encoded PKIX
+// public key, which is the hexadecimal encoding of the first 8 bytes of its
+// SHA-256 checksum.
+func PublicKeyFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewECDSAPrivateKey creates a ECDSA private key from a PEM private key, either
+// in the SEC 1 or PKCS #8 format.
+func NewECDSAPrivateKey(PEMPrivateKey string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(PEMPrivateKey))
+	if block == nil {
+		return nil, sqerrors.New("failed to decode the PEM private key")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "failed to parse ECDSA private key")
+	}
+	privateKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, sqerrors.Errorf("unexpected private key type `%T`", key)
+	}
+	return privateKey, nil
+}
+
 // Verify returns a non-nil error when message verification against the public
 // key failed, nil otherwise.
 func Verify(publicKey *ecdsa.PublicKey, hash []byte, signature []byte) error {
@@ -71,3 +140,69 @@ func VerifyRuleSignature(r *api.Rule, publicKey *ecdsa.PublicKey) error {
 	hash := sha512.Sum512(signature.Message)
 	return Verify(publicKey, hash[:], der)
 }
+
+// verifyRuleSignature returns the ID of the first public key successfully
+// verifying the rule signature, or a non-nil error when none does.
+func verifyRuleSignature(r *api.Rule, publicKeys []PublicKey) (keyID string, err error) {
+	var errs sqerrors.ErrorCollection
+	for _, key := range publicKeys {
+		err := VerifyRuleSignature(r, key.Key)
+		if err == nil {
+			return key.ID, nil
+		}
+		errs.Add(sqerrors.Wrapf(err, "public key `%s`", key.ID))
+	}
+	if len(errs) == 0 {
+		return "", sqerrors.New("no public key")
+	}
+	return "", errs.ToError()
+}
+
+// SignRule signs the given JSON rule object with the private key. The signed
+// message is made of the values of the given rule keys, or of every rule key
+// but the signature itself when empty, the same way the backend does.
+func SignRule(rule map[string]json.RawMessage, keys []string, privateKey *ecdsa.PrivateKey) (*api.RuleSignature, error) {
+	if len(keys) == 0 {
+		for k := range rule {
+			if k != "signature" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	}
+
+	kv := make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		rawValue, exists := rule[k]
+		if !exists {
+			return nil, sqerrors.Errorf("signed key `%s` not found in the rule", k)
+		}
+		var v interface{}
+		if err := json.Unmarshal(rawValue, &v); err != nil {
+			return nil, sqerrors.Wrapf(err, "rule key `%s`: json decoding", k)
+		}
+		kv[k] = v
+	}
+	message, err := api.LexicographicalOrderJSONMarshal(kv)
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "signed message")
+	}
+
+	hash := sha512.Sum512(message)
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "ecdsa signature")
+	}
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{R: r, S: s})
+	if err != nil {
+		return nil, sqerrors.Wrap(err, "ecdsa signature: asn1 encoding")
+	}
+
+	return &api.RuleSignature{
+		ECDSASignature: api.ECDSASignature{
+			Keys:    keys,
+			Value:   base64.StdEncoding.EncodeToString(der),
+			Message: message,
+		},
+	}, nil
+}
@@ -9,10 +9,14 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha512"
+	"crypto/x509"
 	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
 	"math/big"
 	"testing"
 
+	"github.com/sqreen/go-agent/internal/backend/api"
 	"github.com/sqreen/go-agent/internal/config"
 	"github.com/sqreen/go-agent/internal/rule"
 	"github.com/sqreen/go-agent/tools/testlib"
@@ -87,3 +91,123 @@ func TestVerify(t *testing.T) {
 		require.NoError(t, err)
 	})
 }
+
+func TestNewECDSAPublicKeys(t *testing.T) {
+	newPEMPublicKey := func(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), privateKey
+	}
+
+	t.Run("no pem public key", func(t *testing.T) {
+		_, err := rule.NewECDSAPublicKeys([]byte(testlib.RandPrintableUSASCIIString(0, 100)))
+		require.Error(t, err)
+	})
+
+	t.Run("unexpected pem block type", func(t *testing.T) {
+		buf, _ := newPEMPublicKey(t)
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("oops")})...)
+		_, err := rule.NewECDSAPublicKeys(buf)
+		require.Error(t, err)
+	})
+
+	t.Run("multiple public keys", func(t *testing.T) {
+		buf1, privateKey1 := newPEMPublicKey(t)
+		buf2, privateKey2 := newPEMPublicKey(t)
+		keys, err := rule.NewECDSAPublicKeys(append(append(buf1, '\n'), buf2...))
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		require.Equal(t, &privateKey1.PublicKey, keys[0].Key)
+		require.Equal(t, &privateKey2.PublicKey, keys[1].Key)
+		require.Len(t, keys[0].ID, 16)
+		require.NotEqual(t, keys[0].ID, keys[1].ID)
+
+		// The ID is stable
+		again, err := rule.NewECDSAPublicKeys(buf1)
+		require.NoError(t, err)
+		require.Equal(t, keys[0].ID, again[0].ID)
+	})
+}
+
+func TestNewECDSAPrivateKey(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("invalid pem private key", func(t *testing.T) {
+		_, err := rule.NewECDSAPrivateKey(testlib.RandPrintableUSASCIIString(0, 100))
+		require.Error(t, err)
+	})
+
+	t.Run("sec1 private key", func(t *testing.T) {
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		require.NoError(t, err)
+		key, err := rule.NewECDSAPrivateKey(string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+		require.NoError(t, err)
+		require.Equal(t, privateKey.D, key.D)
+		require.Equal(t, privateKey.PublicKey, key.PublicKey)
+	})
+
+	t.Run("pkcs8 private key", func(t *testing.T) {
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		require.NoError(t, err)
+		key, err := rule.NewECDSAPrivateKey(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+		require.NoError(t, err)
+		require.Equal(t, privateKey.D, key.D)
+		require.Equal(t, privateKey.PublicKey, key.PublicKey)
+	})
+}
+
+func TestSignRule(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ruleJSON := `{"name":"my rule","hookpoint":{"klass":"","method":"func1","callback_class":"WriteCustomErrorPage"},"attack_type":"xss","test":true}`
+
+	sign := func(t *testing.T, keys []string) *api.Rule {
+		var r map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal([]byte(ruleJSON), &r))
+		signature, err := rule.SignRule(r, keys, privateKey)
+		require.NoError(t, err)
+		r["signature"], err = json.Marshal(signature)
+		require.NoError(t, err)
+		signed, err := json.Marshal(r)
+		require.NoError(t, err)
+
+		// Decode it the same way rules are received
+		var decoded api.Rule
+		require.NoError(t, json.Unmarshal(signed, &decoded))
+		return &decoded
+	}
+
+	t.Run("every rule key", func(t *testing.T) {
+		r := sign(t, nil)
+		require.Equal(t, []string{"attack_type", "hookpoint", "name", "test"}, r.Signature.ECDSASignature.Keys)
+		require.NoError(t, rule.VerifyRuleSignature(r, &privateKey.PublicKey))
+
+		// Modifying the rule breaks the signature
+		r.Signature.ECDSASignature.Message = []byte(`{"name":"my other rule"}`)
+		require.Error(t, rule.VerifyRuleSignature(r, &privateKey.PublicKey))
+	})
+
+	t.Run("given rule keys", func(t *testing.T) {
+		r := sign(t, []string{"name", "hookpoint"})
+		require.Equal(t, []string{"name", "hookpoint"}, r.Signature.ECDSASignature.Keys)
+		require.NoError(t, rule.VerifyRuleSignature(r, &privateKey.PublicKey))
+	})
+
+	t.Run("unknown rule key", func(t *testing.T) {
+		var r map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal([]byte(ruleJSON), &r))
+		_, err := rule.SignRule(r, []string{"oops"}, privateKey)
+		require.Error(t, err)
+	})
+
+	t.Run("another key", func(t *testing.T) {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		r := sign(t, nil)
+		require.Error(t, rule.VerifyRuleSignature(r, &otherKey.PublicKey))
+	})
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package sqgraphql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// MaxWalkedSelections is the maximum number of selections - fields, fragment
+// spreads and inline fragments - the analysis walks through. Fragments being
+// expanded every time they are spread, a small document can otherwise lead to
+// an exponential number of selections. The analysis stops once this limit is
+// reached.
+const MaxWalkedSelections = 10000
+
+// Operation returns the operation to execute according to the given operation
+// name, which can be empty when the document has a single operation.
+func (d *Document) Operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(d.Operations) != 1 {
+			return nil, sqerrors.New("an operation name is required when the document has several operations")
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, sqerrors.Errorf("unknown operation `%s`", name)
+}
+
+// Depth returns the maximum nesting level of the fields selected by the
+// operation, top-level fields being at depth 1.
+func (d *Document) Depth(op *Operation) (depth int) {
+	d.walk(op, func(_ *Field, _ []string, fieldDepth int) bool {
+		if fieldDepth > depth {
+			depth = fieldDepth
+		}
+		return true
+	})
+	return depth
+}
+
+// Complexity returns the number of fields selected by the operation, fragments
+// being counted every time they are spread. When the walk stops because of
+// MaxWalkedSelections, the actual complexity is unknown and MaxComplexity is
+// returned so that it is greater than any complexity limit not above
+// MaxWalkedSelections.
+func (d *Document) Complexity(op *Operation) (complexity int) {
+	complete := d.walk(op, func(*Field, []string, int) bool {
+		complexity++
+		return true
+	})
+	if !complete {
+		return MaxComplexity
+	}
+	return complexity
+}
+
+// MaxComplexity is the complexity of the operations whose selections exceed
+// MaxWalkedSelections.
+const MaxComplexity = MaxWalkedSelections + 1
+
+// HasIntrospection returns true when the operation selects one of the
+// introspection fields `__schema` or `__type`. The meta-field `__typename` is
+// not considered as it is commonly used by client libraries.
+func (d *Document) HasIntrospection(op *Operation) (found bool) {
+	d.walk(op, func(f *Field, _ []string, _ int) bool {
+		found = f.Name == "__schema" || f.Name == "__type"
+		return !found
+	})
+	return found
+}
+
+// Arguments returns the literal argument values of the fields selected by the
+// operation, indexed by field path then by argument name. The field path is
+// the dot-separated list of response keys of the field and of its parents.
+// Variable references are not resolved as variable values are provided
+// separately in the request.
+func (d *Document) Arguments(op *Operation) map[string]interface{} {
+	args := map[string]interface{}{}
+	d.walk(op, func(f *Field, path []string, _ int) bool {
+		if len(f.Arguments) == 0 {
+			return true
+		}
+		key := strings.Join(append(path[:len(path):len(path)], f.ResponseKey()), ".")
+		values, _ := args[key].(map[string]interface{})
+		if values == nil {
+			values = make(map[string]interface{}, len(f.Arguments))
+			args[key] = values
+		}
+		for _, arg := range f.Arguments {
+			values[arg.Name] = arg.Value.Interface()
+		}
+		return true
+	})
+	return args
+}
+
+// ResponseKey returns the key of the field in the response, ie. its alias when
+// set or its name otherwise.
+func (f *Field) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// Interface returns the Go value of the GraphQL value: int64 for ints (or the
+// literal string when it overflows), float64 for floats, string for strings
+// and enums, bool for booleans, nil for null values and variable references,
+// []interface{} for lists and map[string]interface{} for objects.
+func (v *Value) Interface() interface{} {
+	switch v.Kind {
+	case IntValue:
+		if i, err := strconv.ParseInt(v.Raw, 10, 64); err == nil {
+			return i
+		}
+		return v.Raw
+	case FloatValue:
+		if f, err := strconv.ParseFloat(v.Raw, 64); err == nil {
+			return f
+		}
+		return v.Raw
+	case StringValue, EnumValue:
+		return v.Raw
+	case BooleanValue:
+		return v.Raw == "true"
+	case ListValue:
+		list := make([]interface{}, len(v.List))
+		for i, elt := range v.List {
+			list[i] = elt.Interface()
+		}
+		return list
+	case ObjectValue:
+		obj := make(map[string]interface{}, len(v.Object))
+		for _, field := range v.Object {
+			obj[field.Name] = field.Value.Interface()
+		}
+		return obj
+	default:
+		return nil
+	}
+}
+
+// walk calls fn with every field selected by the operation, along with the
+// response keys of its parents and its depth, until fn returns false. It
+// returns false when the walk was stopped by MaxWalkedSelections.
+func (d *Document) walk(op *Operation, fn func(f *Field, path []string, depth int) bool) (complete bool) {
+	w := walker{
+		doc:      d,
+		fn:       fn,
+		visiting: map[string]bool{},
+	}
+	w.walkSelectionSet(op.SelectionSet, nil, 1)
+	return w.walked <= MaxWalkedSelections
+}
+
+type walker struct {
+	doc *Document
+	fn  func(f *Field, path []string, depth int) bool
+	// Fragments being spread in the current walk path, so that fragment cycles
+	// are not followed.
+	visiting map[string]bool
+	walked   int
+	stopped  bool
+}
+
+func (w *walker) walkSelectionSet(set SelectionSet, path []string, depth int) {
+	for _, selection := range set {
+		if w.stopped {
+			return
+		}
+
+		// Every selection counts so that fragments spreading other fragments
+		// without selecting fields are also bounded.
+		w.walked++
+		if w.walked > MaxWalkedSelections {
+			w.stopped = true
+			return
+		}
+
+		switch s := selection.(type) {
+		case *Field:
+			if !w.fn(s, path, depth) {
+				w.stopped = true
+				return
+			}
+			if len(s.SelectionSet) > 0 {
+				w.walkSelectionSet(s.SelectionSet, append(path[:len(path):len(path)], s.ResponseKey()), depth+1)
+			}
+
+		case *InlineFragment:
+			w.walkSelectionSet(s.SelectionSet, path, depth)
+
+		case *FragmentSpread:
+			f, exists := w.doc.Fragments[s.Name]
+			if !exists || w.visiting[s.Name] || len(w.visiting) >= MaxParsingDepth {
+				continue
+			}
+			w.visiting[s.Name] = true
+			w.walkSelectionSet(f.SelectionSet, path, depth)
+			delete(w.visiting, s.Name)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package sqgraphql
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of document"
+	case tokenPunctuator:
+		return "punctuator"
+	case tokenName:
+		return "name"
+	case tokenInt:
+		return "int"
+	case tokenFloat:
+		return "float"
+	case tokenString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+const unicodeBOM = "\uFEFF"
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lexer splits a GraphQL document into tokens according to the GraphQL
+// specification. Insignificant characters (white spaces, line terminators,
+// commas, comments and unicode BOM) are skipped.
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipIgnored()
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case strings.IndexByte("!$&():=@[]{}|", c) != -1:
+		l.pos++
+		return token{kind: tokenPunctuator, value: l.src[start:l.pos], pos: start}, nil
+
+	case c == '.':
+		if strings.HasPrefix(l.src[l.pos:], "...") {
+			l.pos += 3
+			return token{kind: tokenPunctuator, value: "...", pos: start}, nil
+		}
+		return token{}, sqerrors.Errorf("unexpected character `.` at position %d", start)
+
+	case isNameStart(c):
+		l.pos++
+		for l.pos < len(l.src) && isNameContinue(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokenName, value: l.src[start:l.pos], pos: start}, nil
+
+	case c == '-' || isDigit(c):
+		return l.number()
+
+	case c == '"':
+		if strings.HasPrefix(l.src[l.pos:], `"""`) {
+			return l.blockString()
+		}
+		return l.string()
+
+	default:
+		r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+		return token{}, sqerrors.Errorf("unexpected character `%c` at position %d", r, start)
+	}
+}
+
+func (l *lexer) skipIgnored() {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; c {
+		case ' ', '\t', '\n', '\r', ',':
+			l.pos++
+		case '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' && l.src[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			if strings.HasPrefix(l.src[l.pos:], unicodeBOM) {
+				l.pos += len(unicodeBOM)
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	kind := tokenInt
+	if l.src[l.pos] == '-' {
+		l.pos++
+	}
+	if !l.digits() {
+		return token{}, sqerrors.Errorf("invalid number at position %d", start)
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '.' {
+		kind = tokenFloat
+		l.pos++
+		if !l.digits() {
+			return token{}, sqerrors.Errorf("invalid number at position %d", start)
+		}
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		kind = tokenFloat
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if !l.digits() {
+			return token{}, sqerrors.Errorf("invalid number at position %d", start)
+		}
+	}
+	if l.pos < len(l.src) && (isNameStart(l.src[l.pos]) || l.src[l.pos] == '.') {
+		return token{}, sqerrors.Errorf("invalid number at position %d", start)
+	}
+	return token{kind: kind, value: l.src[start:l.pos], pos: start}, nil
+}
+
+func (l *lexer) digits() bool {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos > start
+}
+
+func (l *lexer) string() (token, error) {
+	start := l.pos
+	l.pos++ // opening quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, value: b.String(), pos: start}, nil
+		case '\n', '\r':
+			return token{}, sqerrors.Errorf("unterminated string at position %d", start)
+		case '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, sqerrors.Errorf("unterminated string at position %d", start)
+			}
+			esc := l.src[l.pos+1]
+			l.pos += 2
+			switch esc {
+			case '"', '\\', '/':
+				b.WriteByte(esc)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if l.pos+4 > len(l.src) {
+					return token{}, sqerrors.Errorf("invalid unicode escape sequence at position %d", l.pos-2)
+				}
+				r, ok := parseHexRune(l.src[l.pos : l.pos+4])
+				if !ok {
+					return token{}, sqerrors.Errorf("invalid unicode escape sequence at position %d", l.pos-2)
+				}
+				b.WriteRune(r)
+				l.pos += 4
+			default:
+				return token{}, sqerrors.Errorf("invalid escape sequence at position %d", l.pos-2)
+			}
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+	return token{}, sqerrors.Errorf("unterminated string at position %d", start)
+}
+
+func (l *lexer) blockString() (token, error) {
+	start := l.pos
+	l.pos += 3 // opening triple-quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		switch {
+		case strings.HasPrefix(l.src[l.pos:], `"""`):
+			l.pos += 3
+			return token{kind: tokenString, value: b.String(), pos: start}, nil
+		case strings.HasPrefix(l.src[l.pos:], `\"""`):
+			b.WriteString(`"""`)
+			l.pos += 4
+		default:
+			b.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+	}
+	return token{}, sqerrors.Errorf("unterminated block string at position %d", start)
+}
+
+func parseHexRune(s string) (rune, bool) {
+	var r rune
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		r <<= 4
+		switch {
+		case '0' <= c && c <= '9':
+			r |= rune(c - '0')
+		case 'a' <= c && c <= 'f':
+			r |= rune(c-'a') + 10
+		case 'A' <= c && c <= 'F':
+			r |= rune(c-'A') + 10
+		default:
+			return 0, false
+		}
+	}
+	return r, true
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isNameContinue(c byte) bool { return isNameStart(c) || isDigit(c) }
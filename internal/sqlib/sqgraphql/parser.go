@@ -0,0 +1,578 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package sqgraphql implements a parser of GraphQL executable documents, ie.
+// the queries sent by GraphQL clients, along with the helpers required to
+// analyze them in order to protect GraphQL APIs. Type system definitions are
+// not supported as they are not expected in client requests.
+package sqgraphql
+
+import (
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+)
+
+// MaxParsingDepth is the maximum nesting level of selection sets and values
+// the parser accepts. It protects the parser against stack exhaustion with
+// maliciously nested documents.
+const MaxParsingDepth = 128
+
+type OperationType string
+
+const (
+	Query        OperationType = "query"
+	Mutation     OperationType = "mutation"
+	Subscription OperationType = "subscription"
+)
+
+// Document is a GraphQL executable document.
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+// Operation is a GraphQL operation definition. The name of anonymous
+// operations is empty.
+type Operation struct {
+	Type         OperationType
+	Name         string
+	Variables    []*VariableDefinition
+	SelectionSet SelectionSet
+}
+
+type VariableDefinition struct {
+	Name         string
+	DefaultValue *Value
+}
+
+// Fragment is a named fragment definition.
+type Fragment struct {
+	Name          string
+	TypeCondition string
+	SelectionSet  SelectionSet
+}
+
+type SelectionSet []Selection
+
+// Selection is either a *Field, a *FragmentSpread or an *InlineFragment.
+type Selection interface {
+	isSelection()
+}
+
+type Field struct {
+	Alias        string
+	Name         string
+	Arguments    []*Argument
+	SelectionSet SelectionSet
+}
+
+type FragmentSpread struct {
+	Name string
+}
+
+type InlineFragment struct {
+	TypeCondition string
+	SelectionSet  SelectionSet
+}
+
+func (*Field) isSelection()          {}
+func (*FragmentSpread) isSelection() {}
+func (*InlineFragment) isSelection() {}
+
+type Argument struct {
+	Name  string
+	Value *Value
+}
+
+type ValueKind int
+
+const (
+	VariableValue ValueKind = iota
+	IntValue
+	FloatValue
+	StringValue
+	BooleanValue
+	NullValue
+	EnumValue
+	ListValue
+	ObjectValue
+)
+
+// Value is a GraphQL input value. Raw is the literal of scalar values, the
+// variable name of variables, and the enum value name of enums. List values
+// are stored into List, while object values are stored into Object.
+type Value struct {
+	Kind   ValueKind
+	Raw    string
+	List   []*Value
+	Object []*ObjectField
+}
+
+type ObjectField struct {
+	Name  string
+	Value *Value
+}
+
+// Parse parses the given GraphQL executable document.
+func Parse(query string) (*Document, error) {
+	p := &parser{lexer: lexer{src: query}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return p.parseDocument()
+}
+
+type parser struct {
+	lexer lexer
+	tok   token
+	depth int
+}
+
+func (p *parser) advance() (err error) {
+	p.tok, err = p.lexer.next()
+	return err
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) peekPunctuator(value string) bool {
+	return p.peek(tokenPunctuator, value)
+}
+
+// skip advances to the next token when the current one is the given
+// punctuator. It returns true when it was.
+func (p *parser) skip(value string) (bool, error) {
+	if !p.peekPunctuator(value) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *parser) expect(value string) error {
+	if !p.peekPunctuator(value) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+func (p *parser) expectName() (string, error) {
+	if p.tok.kind != tokenName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokenEOF {
+		return sqerrors.New("unexpected end of document")
+	}
+	return sqerrors.Errorf("unexpected %s `%s` at position %d", p.tok.kind, p.tok.value, p.tok.pos)
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > MaxParsingDepth {
+		return sqerrors.Errorf("maximum parsing depth of %d reached at position %d", MaxParsingDepth, p.tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) parseDocument() (*Document, error) {
+	doc := &Document{Fragments: map[string]*Fragment{}}
+	for {
+		switch {
+		case p.tok.kind == tokenEOF:
+			if len(doc.Operations) == 0 {
+				return nil, sqerrors.New("the document has no operation")
+			}
+			return doc, nil
+
+		case p.peekPunctuator("{"):
+			set, err := p.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &Operation{Type: Query, SelectionSet: set})
+
+		case p.peek(tokenName, string(Query)), p.peek(tokenName, string(Mutation)), p.peek(tokenName, string(Subscription)):
+			op, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+
+		case p.peek(tokenName, "fragment"):
+			f, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := doc.Fragments[f.Name]; exists {
+				return nil, sqerrors.Errorf("fragment `%s` is defined more than once", f.Name)
+			}
+			doc.Fragments[f.Name] = f
+
+		default:
+			return nil, p.unexpected()
+		}
+	}
+}
+
+func (p *parser) parseOperation() (op *Operation, err error) {
+	op = &Operation{Type: OperationType(p.tok.value)}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokenName {
+		op.Name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if op.Variables, err = p.parseVariableDefinitions(); err != nil {
+		return nil, err
+	}
+	if err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if op.SelectionSet, err = p.parseSelectionSet(); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (p *parser) parseVariableDefinitions() (defs []*VariableDefinition, err error) {
+	if ok, err := p.skip("("); err != nil || !ok {
+		return nil, err
+	}
+	for {
+		if ok, err := p.skip(")"); err != nil {
+			return nil, err
+		} else if ok {
+			return defs, nil
+		}
+
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		def := &VariableDefinition{}
+		if def.Name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if err := p.parseType(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.skip("="); err != nil {
+			return nil, err
+		} else if ok {
+			if def.DefaultValue, err = p.parseValue(true); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.parseDirectives(); err != nil {
+			return nil, err
+		}
+		defs = append(defs, def)
+	}
+}
+
+// parseType parses a variable type. The type is not retained as it is not
+// needed by the analysis.
+func (p *parser) parseType() error {
+	if err := p.enter(); err != nil {
+		return err
+	}
+	defer p.leave()
+
+	if ok, err := p.skip("["); err != nil {
+		return err
+	} else if ok {
+		if err := p.parseType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return err
+	}
+	_, err := p.skip("!")
+	return err
+}
+
+// parseDirectives parses directives. They are not retained as they are not
+// needed by the analysis.
+func (p *parser) parseDirectives() error {
+	for p.peekPunctuator("@") {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.expectName(); err != nil {
+			return err
+		}
+		if _, err := p.parseArguments(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseFragment() (f *Fragment, err error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	f = &Fragment{}
+	if f.Name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if f.Name == "on" {
+		return nil, sqerrors.Errorf("unexpected fragment name `on` at position %d", p.tok.pos)
+	}
+	if !p.peek(tokenName, "on") {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if f.TypeCondition, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if f.SelectionSet, err = p.parseSelectionSet(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *parser) parseSelectionSet() (set SelectionSet, err error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		if ok, err := p.skip("}"); err != nil {
+			return nil, err
+		} else if ok {
+			if len(set) == 0 {
+				return nil, sqerrors.Errorf("empty selection set at position %d", p.tok.pos)
+			}
+			return set, nil
+		}
+
+		selection, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, selection)
+	}
+}
+
+func (p *parser) parseSelection() (Selection, error) {
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		return p.parseFragmentSelection()
+	}
+	return p.parseField()
+}
+
+func (p *parser) parseFragmentSelection() (Selection, error) {
+	if p.tok.kind == tokenName && p.tok.value != "on" {
+		spread := &FragmentSpread{Name: p.tok.value}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.parseDirectives(); err != nil {
+			return nil, err
+		}
+		return spread, nil
+	}
+
+	inline := &InlineFragment{}
+	if p.peek(tokenName, "on") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		inline.TypeCondition = name
+	}
+	if err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	set, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	inline.SelectionSet = set
+	return inline, nil
+}
+
+func (p *parser) parseField() (f *Field, err error) {
+	f = &Field{}
+	if f.Name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		f.Alias = f.Name
+		if f.Name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Arguments, err = p.parseArguments(); err != nil {
+		return nil, err
+	}
+	if err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if p.peekPunctuator("{") {
+		if f.SelectionSet, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *parser) parseArguments() (args []*Argument, err error) {
+	if ok, err := p.skip("("); err != nil || !ok {
+		return nil, err
+	}
+	for {
+		if ok, err := p.skip(")"); err != nil {
+			return nil, err
+		} else if ok {
+			if len(args) == 0 {
+				return nil, sqerrors.Errorf("empty argument list at position %d", p.tok.pos)
+			}
+			return args, nil
+		}
+
+		arg := &Argument{}
+		if arg.Name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if arg.Value, err = p.parseValue(false); err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+}
+
+// parseValue parses an input value. Variables are not allowed in constant
+// values, such as variable default values.
+func (p *parser) parseValue(constant bool) (v *Value, err error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	tok := p.tok
+	switch tok.kind {
+	case tokenInt:
+		v = &Value{Kind: IntValue, Raw: tok.value}
+	case tokenFloat:
+		v = &Value{Kind: FloatValue, Raw: tok.value}
+	case tokenString:
+		v = &Value{Kind: StringValue, Raw: tok.value}
+	case tokenName:
+		switch tok.value {
+		case "true", "false":
+			v = &Value{Kind: BooleanValue, Raw: tok.value}
+		case "null":
+			v = &Value{Kind: NullValue, Raw: tok.value}
+		default:
+			v = &Value{Kind: EnumValue, Raw: tok.value}
+		}
+	case tokenPunctuator:
+		switch tok.value {
+		case "$":
+			if constant {
+				return nil, p.unexpected()
+			}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			return &Value{Kind: VariableValue, Raw: name}, nil
+		case "[":
+			return p.parseList(constant)
+		case "{":
+			return p.parseObject(constant)
+		default:
+			return nil, p.unexpected()
+		}
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.advance()
+}
+
+func (p *parser) parseList(constant bool) (*Value, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	v := &Value{Kind: ListValue}
+	for {
+		if ok, err := p.skip("]"); err != nil {
+			return nil, err
+		} else if ok {
+			return v, nil
+		}
+		elt, err := p.parseValue(constant)
+		if err != nil {
+			return nil, err
+		}
+		v.List = append(v.List, elt)
+	}
+}
+
+func (p *parser) parseObject(constant bool) (*Value, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	v := &Value{Kind: ObjectValue}
+	for {
+		if ok, err := p.skip("}"); err != nil {
+			return nil, err
+		} else if ok {
+			return v, nil
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		fieldValue, err := p.parseValue(constant)
+		if err != nil {
+			return nil, err
+		}
+		v.Object = append(v.Object, &ObjectField{Name: name, Value: fieldValue})
+	}
+}
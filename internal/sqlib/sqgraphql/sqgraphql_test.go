@@ -0,0 +1,248 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package sqgraphql_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqgraphql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("valid documents", func(t *testing.T) {
+		for _, query := range []string{
+			`{ me { name } }`,
+			`query { me { name } }`,
+			`query Me { me { name } }`,
+			"\uFEFF# comment\nquery Me { me, { name, }, }",
+			`query User($id: ID! = "1", $tags: [String!]! @deprecated) { user(id: $id, tags: $tags) @include(if: true) { ...UserFields ... on Admin { level } ... @skip(if: false) { email } } } fragment UserFields on User { id name }`,
+			`mutation M { a: createUser(input: {name: "x\"yé", age: 42, ratio: -1.5e3, admin: false, role: ADMIN, tags: ["a", "b"], ref: null}) { id } }`,
+			`subscription S { events { id } }`,
+			`query Q { text(value: """block "string" \""" end""") }`,
+			`query A { a } query B { b }`,
+		} {
+			query := query
+			t.Run(query, func(t *testing.T) {
+				doc, err := sqgraphql.Parse(query)
+				require.NoError(t, err)
+				require.NotEmpty(t, doc.Operations)
+			})
+		}
+	})
+
+	t.Run("invalid documents", func(t *testing.T) {
+		for _, query := range []string{
+			``,
+			`   `,
+			`{}`,
+			`{ me { name }`,
+			`{ me( ) }`,
+			`query Q($id: ID = $other) { me }`,
+			`{ me(id: "unterminated) }`,
+			`{ me(id: 1a) }`,
+			`{ me(id: .5) }`,
+			`fragment F on User { id }`,
+			`fragment on on User { id } { me }`,
+			`fragment F on User { id } fragment F on User { id } { me }`,
+			`type User { id: ID }`,
+			`{ me(id: "\x") }`,
+			`{ me ; }`,
+			strings.Repeat("{ a ", sqgraphql.MaxParsingDepth+1) + strings.Repeat("}", sqgraphql.MaxParsingDepth+1),
+			`{ a(v: ` + strings.Repeat("[", sqgraphql.MaxParsingDepth+1) + strings.Repeat("]", sqgraphql.MaxParsingDepth+1) + `) }`,
+		} {
+			query := query
+			t.Run(query, func(t *testing.T) {
+				doc, err := sqgraphql.Parse(query)
+				require.Error(t, err)
+				require.Nil(t, doc)
+			})
+		}
+	})
+
+	t.Run("ast", func(t *testing.T) {
+		doc, err := sqgraphql.Parse(`query Q($id: ID) { u: user(id: $id) { ... on User { name } ...F } } fragment F on User { email }`)
+		require.NoError(t, err)
+		require.Len(t, doc.Operations, 1)
+
+		op := doc.Operations[0]
+		require.Equal(t, sqgraphql.Query, op.Type)
+		require.Equal(t, "Q", op.Name)
+		require.Equal(t, []*sqgraphql.VariableDefinition{{Name: "id"}}, op.Variables)
+		require.Len(t, op.SelectionSet, 1)
+
+		user := op.SelectionSet[0].(*sqgraphql.Field)
+		require.Equal(t, "u", user.Alias)
+		require.Equal(t, "user", user.Name)
+		require.Equal(t, []*sqgraphql.Argument{{Name: "id", Value: &sqgraphql.Value{Kind: sqgraphql.VariableValue, Raw: "id"}}}, user.Arguments)
+		require.Equal(t, sqgraphql.SelectionSet{
+			&sqgraphql.InlineFragment{TypeCondition: "User", SelectionSet: sqgraphql.SelectionSet{&sqgraphql.Field{Name: "name"}}},
+			&sqgraphql.FragmentSpread{Name: "F"},
+		}, user.SelectionSet)
+
+		require.Equal(t, map[string]*sqgraphql.Fragment{
+			"F": {Name: "F", TypeCondition: "User", SelectionSet: sqgraphql.SelectionSet{&sqgraphql.Field{Name: "email"}}},
+		}, doc.Fragments)
+	})
+}
+
+func TestOperation(t *testing.T) {
+	single, err := sqgraphql.Parse(`{ a }`)
+	require.NoError(t, err)
+	op, err := single.Operation("")
+	require.NoError(t, err)
+	require.Equal(t, single.Operations[0], op)
+
+	multiple, err := sqgraphql.Parse(`query A { a } query B { b }`)
+	require.NoError(t, err)
+	op, err = multiple.Operation("B")
+	require.NoError(t, err)
+	require.Equal(t, multiple.Operations[1], op)
+
+	_, err = multiple.Operation("")
+	require.Error(t, err)
+	_, err = multiple.Operation("C")
+	require.Error(t, err)
+}
+
+func TestAnalysis(t *testing.T) {
+	for _, tc := range []struct {
+		query              string
+		expectedDepth      int
+		expectedComplexity int
+		expectedIntrospect bool
+		expectedArguments  map[string]interface{}
+	}{
+		{
+			query:              `{ a }`,
+			expectedDepth:      1,
+			expectedComplexity: 1,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `{ a { b { c } d } e }`,
+			expectedDepth:      3,
+			expectedComplexity: 5,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `{ a { ...F ... on T { d { e } } } } fragment F on T { b { c } }`,
+			expectedDepth:      3,
+			expectedComplexity: 5,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `{ a { ...F } } fragment F on T { b { ...F } }`,
+			expectedDepth:      2,
+			expectedComplexity: 2,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `{ __typename a }`,
+			expectedDepth:      1,
+			expectedComplexity: 2,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `query IntrospectionQuery { __schema { types { name } } }`,
+			expectedDepth:      3,
+			expectedComplexity: 3,
+			expectedIntrospect: true,
+			expectedArguments:  map[string]interface{}{},
+		},
+		{
+			query:              `{ ...F } fragment F on Query { __type(name: "User") { name } }`,
+			expectedDepth:      2,
+			expectedComplexity: 2,
+			expectedIntrospect: true,
+			expectedArguments: map[string]interface{}{
+				"__type": map[string]interface{}{"name": "User"},
+			},
+		},
+		{
+			query:              `query Q($id: ID) { u: user(id: $id, filter: {name: "' OR 1=1--", age: 42, tags: [A, "b"], ratio: 1.5, admin: true, ref: null}) { posts(first: 99999999999999999999) { id } } }`,
+			expectedDepth:      3,
+			expectedComplexity: 3,
+			expectedArguments: map[string]interface{}{
+				"u": map[string]interface{}{
+					"id": nil,
+					"filter": map[string]interface{}{
+						"name":  "' OR 1=1--",
+						"age":   int64(42),
+						"tags":  []interface{}{"A", "b"},
+						"ratio": 1.5,
+						"admin": true,
+						"ref":   nil,
+					},
+				},
+				"u.posts": map[string]interface{}{
+					"first": "99999999999999999999",
+				},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.query, func(t *testing.T) {
+			doc, err := sqgraphql.Parse(tc.query)
+			require.NoError(t, err)
+			op := doc.Operations[0]
+			require.Equal(t, tc.expectedDepth, doc.Depth(op))
+			require.Equal(t, tc.expectedComplexity, doc.Complexity(op))
+			require.Equal(t, tc.expectedIntrospect, doc.HasIntrospection(op))
+			require.Equal(t, tc.expectedArguments, doc.Arguments(op))
+		})
+	}
+
+	t.Run("fragment bomb", func(t *testing.T) {
+		// Every fragment spreads the next one ten times, leading to 10^10 fields
+		// if the walk was not bounded.
+		var b strings.Builder
+		b.WriteString(`{ ...F0 }`)
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(&b, ` fragment F%d on T { a%d: a `, i, i)
+			for j := 0; j < 10; j++ {
+				fmt.Fprintf(&b, `...F%d `, i+1)
+			}
+			b.WriteString(`}`)
+		}
+		b.WriteString(` fragment F10 on T { a }`)
+
+		doc, err := sqgraphql.Parse(b.String())
+		require.NoError(t, err)
+		require.Equal(t, sqgraphql.MaxComplexity, doc.Complexity(doc.Operations[0]))
+	})
+
+	t.Run("fragment tree bomb", func(t *testing.T) {
+		// Every fragment spreads the next one twice without selecting fields,
+		// leading to 2^40 spreads if the walk was not bounded.
+		var b strings.Builder
+		b.WriteString(`{ ...F0 }`)
+		for i := 0; i < 40; i++ {
+			fmt.Fprintf(&b, ` fragment F%d on T { ...F%d ...F%d }`, i, i+1, i+1)
+		}
+		b.WriteString(` fragment F40 on T { a }`)
+
+		doc, err := sqgraphql.Parse(b.String())
+		require.NoError(t, err)
+		op := doc.Operations[0]
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			require.Equal(t, sqgraphql.MaxComplexity, doc.Complexity(op))
+			doc.Depth(op)
+			doc.HasIntrospection(op)
+			doc.Arguments(op)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the analysis of the fragment tree did not stop")
+		}
+	})
+}
@@ -247,7 +247,12 @@ func (h *Hook) String() string {
 }
 
 // Attach atomically attaches a prolog function to the hook. The hook can be
-// disabled with a `nil` prolog value.
+// disabled with a `nil` prolog value. When several prologs are given, they are
+// called in the given order until one of them returns an error, such as
+// AbortError, and the remaining ones are skipped. The epilogs returned by the
+// called prologs are then called in the same order, so that the epilog of the
+// prolog returning the error is the last one and has the final say on the
+// function results. Shadow prologs (cf. Shadow()) are not part of this chain.
 func (h *Hook) Attach(prologs ...PrologCallback) error {
 	addr := h.prologVarAddr
 	if l := len(prologs); l == 0 || (l == 1 && prologs[0] == nil) {
@@ -256,8 +261,13 @@ func (h *Hook) Attach(prologs ...PrologCallback) error {
 		return nil
 	}
 
-	prologCallbacks := make([]PrologCallback, len(prologs))
-	for i, prolog := range prologs {
+	var prologCallbacks, shadowCallbacks []PrologCallback
+	for _, prolog := range prologs {
+		shadow, isShadow := prolog.(shadowPrologCallback)
+		if isShadow {
+			prolog = shadow.PrologCallback
+		}
+
 		// Loop until the prolog type is not one of the above
 	loop:
 		for {
@@ -276,16 +286,20 @@ func (h *Hook) Attach(prologs ...PrologCallback) error {
 			return sqerrors.Errorf("unexpected prolog type for hook `%s`: got `%T`, wanted `%s`", h, prolog, h.prologFuncType)
 		}
 
-		prologCallbacks[i] = prolog
+		if isShadow {
+			shadowCallbacks = append(shadowCallbacks, prolog)
+		} else {
+			prologCallbacks = append(prologCallbacks, prolog)
+		}
 	}
 
 	// Create the prolog out of the prologCallbacks
 	var prolog PrologCallback
-	if l := len(prologCallbacks); l == 1 {
+	if l := len(prologCallbacks); l == 1 && len(shadowCallbacks) == 0 {
 		prolog = prologCallbacks[0]
 	} else {
 		// Create a dynamic function calling the prolog
-		prolog = makeMultiPrologCallback(h, prologCallbacks)
+		prolog = makeMultiPrologCallback(h, prologCallbacks, shadowCallbacks)
 	}
 
 	// Create a value having type "pointer to the prolog function"
@@ -297,19 +311,38 @@ func (h *Hook) Attach(prologs ...PrologCallback) error {
 	return nil
 }
 
-func makeMultiPrologCallback(h *Hook, prologs []PrologCallback) PrologCallback {
+// Shadow returns the given prolog marked as a shadow prolog for Attach().
+// Shadow prologs are called after the other prologs, even when one of them
+// short-circuited the others, and their errors are ignored. Their epilogs are
+// called before the epilogs of the other prologs, which therefore keep the
+// final say on the function results.
+func Shadow(prolog PrologCallback) PrologCallback {
+	return shadowPrologCallback{prolog}
+}
+
+type shadowPrologCallback struct {
+	PrologCallback
+}
+
+// makeMultiPrologCallback returns the prolog calling the given prologs in order
+// and then the shadow prologs (cf. Attach()).
+func makeMultiPrologCallback(h *Hook, prologs, shadowPrologs []PrologCallback) PrologCallback {
 	return makePrologCallback(h, func(params []reflect.Value) (epilog ReflectedEpilogCallback, err error) {
-		safeCallErr := sqsafe.Call(func() error {
-			epilogs := make([]reflect.Value, 0, len(prologs))
-			defer func() {
-				if len(epilogs) > 0 {
-					epilog = func(results []reflect.Value) {
-						for _, epilog := range epilogs {
-							epilog.Call(results)
-						}
+		var epilogs, shadowEpilogs []reflect.Value
+		defer func() {
+			if len(epilogs) > 0 || len(shadowEpilogs) > 0 {
+				epilog = func(results []reflect.Value) {
+					for _, epilog := range shadowEpilogs {
+						epilog.Call(results)
+					}
+					for _, epilog := range epilogs {
+						epilog.Call(results)
 					}
 				}
-			}()
+			}
+		}()
+
+		safeCallErr := sqsafe.Call(func() error {
 			for _, prolog := range prologs {
 				prologValue := reflect.ValueOf(prolog)
 				results := prologValue.Call(params)
@@ -317,6 +350,7 @@ func makeMultiPrologCallback(h *Hook, prologs []PrologCallback) PrologCallback {
 					epilogs = append(epilogs, r0)
 				}
 				if r1 := results[1]; !r1.IsNil() {
+					// Short-circuit the remaining prologs
 					err = r1.Interface().(error)
 					return nil
 				}
@@ -326,6 +360,22 @@ func makeMultiPrologCallback(h *Hook, prologs []PrologCallback) PrologCallback {
 		if safeCallErr != nil {
 			// TODO: log this error once
 		}
+
+		// The shadow prologs are called in their own chain so that the prologs
+		// above cannot short-circuit them.
+		safeCallErr = sqsafe.Call(func() error {
+			for _, prolog := range shadowPrologs {
+				prologValue := reflect.ValueOf(prolog)
+				results := prologValue.Call(params)
+				if r0 := results[0]; !r0.IsNil() {
+					shadowEpilogs = append(shadowEpilogs, r0)
+				}
+			}
+			return nil
+		})
+		if safeCallErr != nil {
+			// TODO: log this error once
+		}
 		return epilog, err
 	})
 }
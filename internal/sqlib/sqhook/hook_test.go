@@ -347,6 +347,17 @@ func TestAttach(t *testing.T) {
 					// Read back the prolog variable
 					checkPrologAddrNotNil(t)
 				})
+
+				t.Run("shadow prolog callbacks", func(t *testing.T) {
+					native := expectedProlog.Interface()
+					err = hook.Attach(native, sqhook.Shadow(native))
+					require.NoError(t, err)
+					checkPrologAddrNotNil(t)
+
+					err = hook.Attach(sqhook.Shadow(native))
+					require.NoError(t, err)
+					checkPrologAddrNotNil(t)
+				})
 			})
 
 			t.Run("not expected prolog types", func(t *testing.T) {
@@ -372,6 +383,11 @@ func TestAttach(t *testing.T) {
 						require.Error(t, err)
 						//checkPrologAddr(t, 0)
 					})
+
+					t.Run(fmt.Sprintf("%T as shadow prolog callback", invalidProlog), func(t *testing.T) {
+						err = hook.Attach(expectedProlog.Interface(), sqhook.Shadow(invalidProlog))
+						require.Error(t, err)
+					})
 				}
 			})
 		})
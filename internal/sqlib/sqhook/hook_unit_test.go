@@ -293,6 +293,7 @@ func TestMultiCallback(t *testing.T) {
 
 	for _, tc := range []struct {
 		Prologs       []PrologCallback
+		ShadowPrologs []PrologCallback
 		ExpectedOrder []int
 		ExpectedError error
 	}{
@@ -383,10 +384,44 @@ func TestMultiCallback(t *testing.T) {
 			ExpectedOrder: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 15, 16, 18, 20, 21},
 			ExpectedError: errors.New("my error"),
 		},
+
+		{
+			// An aborting prolog skips the next ones, and its epilog is called last
+			Prologs: []PrologCallback{
+				makePrologFunc(t, 0, makeEpilogFunc(t, 10), nil),
+				makePrologFunc(t, 1, makeEpilogFunc(t, 11), AbortError),
+				makePrologFunc(t, 2, makeEpilogFunc(t, 12), nil),
+			},
+			ExpectedOrder: []int{0, 1, 10, 11},
+			ExpectedError: AbortError,
+		},
+
+		{
+			// Shadow prologs are called after the others, even when aborted, and
+			// their epilogs are called first
+			Prologs: []PrologCallback{
+				makePrologFunc(t, 0, makeEpilogFunc(t, 10), nil),
+				makePrologFunc(t, 1, makeEpilogFunc(t, 11), AbortError),
+				makePrologFunc(t, 2, makeEpilogFunc(t, 12), nil),
+			},
+			ShadowPrologs: []PrologCallback{
+				makePrologFunc(t, 3, makeEpilogFunc(t, 13), errors.New("ignored")),
+				makePrologFunc(t, 4, makeEpilogFunc(t, 14), nil),
+			},
+			ExpectedOrder: []int{0, 1, 3, 4, 13, 14, 10, 11},
+			ExpectedError: AbortError,
+		},
+
+		{
+			ShadowPrologs: []PrologCallback{
+				makePrologFunc(t, 0, makeEpilogFunc(t, 10), nil),
+			},
+			ExpectedOrder: []int{0, 10},
+		},
 	} {
 		tc := tc
 		t.Run("", func(t *testing.T) {
-			prolog, ok := makeMultiPrologCallback(hook, tc.Prologs).(prologType)
+			prolog, ok := makeMultiPrologCallback(hook, tc.Prologs, tc.ShadowPrologs).(prologType)
 			require.True(t, ok)
 			require.NotNil(t, prolog)
 
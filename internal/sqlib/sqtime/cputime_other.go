@@ -0,0 +1,14 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package sqtime
+
+import "time"
+
+// ProcessCPUTime is not available on this platform.
+func ProcessCPUTime() (t time.Duration, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package sqtime
+
+import (
+	"syscall"
+	"time"
+)
+
+// ProcessCPUTime returns the user and system CPU time consumed by the current
+// process so far. ok is false when it is not available.
+func ProcessCPUTime() (t time.Duration, ok bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
@@ -0,0 +1,346 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package sqwaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// operator is a filter operator applied to the string values of the targets.
+type operator interface {
+	// match returns the part of the value matched by the operator. Operators
+	// whose cost is not negligible check the deadline while matching and return
+	// types.ErrTimeout when it is exceeded.
+	match(value string, deadline time.Time) (matched string, ok bool, err error)
+}
+
+// maxStringLength is the maximum length of the string values the operators are
+// applied to, longer ones being truncated, as the native WAF library does.
+const maxStringLength = 4096
+
+// newOperator returns the operator of the given name and value, along with the
+// value to report in the matches. The returned operator is nil for `@exist`
+// which doesn't apply to the target values.
+func newOperator(name string, value json.RawMessage, opts jsonFilterOptions) (operator, interface{}, error) {
+	switch name {
+	case "@rx":
+		var expr string
+		if err := json.Unmarshal(value, &expr); err != nil {
+			return nil, nil, sqerrors.Wrap(err, "unexpected regular expression value")
+		}
+		op, err := newRegexpOperator(expr, opts.CaseSensitive)
+		return op, expr, err
+
+	case "@pm":
+		var phrases []string
+		if err := json.Unmarshal(value, &phrases); err != nil {
+			return nil, nil, sqerrors.Wrap(err, "unexpected phrase list value")
+		}
+		return newPhraseMatchOperator(phrases, opts.CaseSensitive), phrases, nil
+
+	case "@ipMatch":
+		var ips []string
+		if err := json.Unmarshal(value, &ips); err != nil {
+			return nil, nil, sqerrors.Wrap(err, "unexpected ip list value")
+		}
+		op, err := newIPMatchOperator(ips)
+		return op, ips, err
+
+	case "@beginsWith", "@endsWith", "@contains", "@eq":
+		var str string
+		if err := json.Unmarshal(value, &str); err != nil {
+			return nil, nil, sqerrors.Wrap(err, "unexpected string value")
+		}
+		return newStringOperator(name, str, opts.CaseSensitive), str, nil
+
+	case "@exist":
+		return nil, nil, nil
+
+	case "@detectSQLi":
+		return sqliOperator{}, nil, nil
+
+	case "@detectXSS":
+		return xssOperator{}, nil, nil
+
+	default:
+		return nil, nil, sqerrors.New("unsupported operator")
+	}
+}
+
+type regexpOperator struct {
+	re *regexp.Regexp
+}
+
+func newRegexpOperator(expr string, caseSensitive bool) (regexpOperator, error) {
+	if !caseSensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return regexpOperator{}, sqerrors.Wrap(err, "regular expression compilation")
+	}
+	return regexpOperator{re: re}, nil
+}
+
+func (o regexpOperator) match(value string, _ time.Time) (string, bool, error) {
+	loc := o.re.FindStringIndex(value)
+	if loc == nil {
+		return "", false, nil
+	}
+	return value[loc[0]:loc[1]], true, nil
+}
+
+type phraseMatchOperator struct {
+	// phrases and their lowercase versions when case-insensitive
+	phrases       []string
+	patterns      []string
+	caseSensitive bool
+}
+
+func newPhraseMatchOperator(phrases []string, caseSensitive bool) phraseMatchOperator {
+	patterns := phrases
+	if !caseSensitive {
+		patterns = make([]string, len(phrases))
+		for i, p := range phrases {
+			patterns[i] = strings.ToLower(p)
+		}
+	}
+	return phraseMatchOperator{
+		phrases:       phrases,
+		patterns:      patterns,
+		caseSensitive: caseSensitive,
+	}
+}
+
+func (o phraseMatchOperator) match(value string, _ time.Time) (string, bool, error) {
+	if !o.caseSensitive {
+		value = strings.ToLower(value)
+	}
+	for i, p := range o.patterns {
+		if p != "" && strings.Contains(value, p) {
+			return o.phrases[i], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+type ipMatchOperator struct {
+	networks []*net.IPNet
+}
+
+func newIPMatchOperator(ips []string) (ipMatchOperator, error) {
+	networks := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		if !strings.Contains(ip, "/") {
+			parsed := net.ParseIP(ip)
+			if parsed == nil {
+				return ipMatchOperator{}, sqerrors.Errorf("unexpected ip address `%s`", ip)
+			}
+			bits := 8 * net.IPv6len
+			if v4 := parsed.To4(); v4 != nil {
+				parsed, bits = v4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: parsed, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			return ipMatchOperator{}, sqerrors.Wrapf(err, "unexpected cidr `%s`", ip)
+		}
+		networks = append(networks, network)
+	}
+	return ipMatchOperator{networks: networks}, nil
+}
+
+func (o ipMatchOperator) match(value string, _ time.Time) (string, bool, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", false, nil
+	}
+	for _, network := range o.networks {
+		if network.Contains(ip) {
+			return network.String(), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+type stringOperator struct {
+	name string
+	str  string
+	// pattern is the lowercase version of str when case-insensitive
+	pattern       string
+	caseSensitive bool
+}
+
+func newStringOperator(name, str string, caseSensitive bool) stringOperator {
+	pattern := str
+	if !caseSensitive {
+		pattern = strings.ToLower(str)
+	}
+	return stringOperator{name: name, str: str, pattern: pattern, caseSensitive: caseSensitive}
+}
+
+func (o stringOperator) match(value string, _ time.Time) (string, bool, error) {
+	if !o.caseSensitive {
+		value = strings.ToLower(value)
+	}
+	var matched bool
+	switch o.name {
+	case "@beginsWith":
+		matched = strings.HasPrefix(value, o.pattern)
+	case "@endsWith":
+		matched = strings.HasSuffix(value, o.pattern)
+	case "@contains":
+		matched = strings.Contains(value, o.pattern)
+	case "@eq":
+		matched = value == o.pattern
+	}
+	return o.str, matched, nil
+}
+
+type sqliOperator struct{}
+
+func (sqliOperator) match(value string, deadline time.Time) (string, bool, error) {
+	return detectSQLi(value, deadline)
+}
+
+type xssOperator struct{}
+
+func (xssOperator) match(value string, deadline time.Time) (string, bool, error) {
+	return detectXSS(value, deadline)
+}
+
+// deadlineChecker checks the deadline in the loops of the detection
+// heuristics, reading the clock every deadlineCheckInterval iterations only.
+type deadlineChecker struct {
+	deadline time.Time
+	n        int
+}
+
+const deadlineCheckInterval = 64
+
+// exceeded returns true when the deadline is exceeded.
+func (d *deadlineChecker) exceeded() bool {
+	d.n++
+	if d.n%deadlineCheckInterval != 0 {
+		return false
+	}
+	return time.Now().After(d.deadline)
+}
+
+// walker walks a target value in order to apply the operator to the strings it
+// contains, within the depth and length limits of the WAF rule.
+type walker struct {
+	op       operator
+	minLen   int
+	maxLen   int
+	maxDepth int
+	deadline time.Time
+}
+
+// walk returns the match of the first matching string of the value, nil if none
+// of them match. types.ErrTimeout is returned when the deadline is exceeded.
+func (w *walker) walk(value interface{}, keyPath []interface{}, depth int) (*filterMatch, error) {
+	if time.Now().After(w.deadline) {
+		return nil, types.ErrTimeout
+	}
+
+	switch actual := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return w.match(actual, keyPath)
+	case []byte:
+		return w.match(string(actual), keyPath)
+	case fmt.Stringer:
+		return w.match(actual.String(), keyPath)
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return w.walk(v.Elem().Interface(), keyPath, depth)
+
+	case reflect.String:
+		return w.match(v.String(), keyPath)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return w.match(strconv.FormatInt(v.Int(), 10), keyPath)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return w.match(strconv.FormatUint(v.Uint(), 10), keyPath)
+
+	case reflect.Float32, reflect.Float64:
+		return w.match(strconv.FormatFloat(v.Float(), 'g', -1, 64), keyPath)
+
+	case reflect.Slice, reflect.Array:
+		if depth >= w.maxDepth {
+			return nil, nil
+		}
+		l := v.Len()
+		if l > w.maxLen {
+			l = w.maxLen
+		}
+		for i := 0; i < l; i++ {
+			m, err := w.walk(v.Index(i).Interface(), append(keyPath, i), depth+1)
+			if m != nil || err != nil {
+				return m, err
+			}
+		}
+
+	case reflect.Map:
+		if depth >= w.maxDepth {
+			return nil, nil
+		}
+		n := 0
+		iter := v.MapRange()
+		for iter.Next() && n < w.maxLen {
+			n++
+			var key interface{} = fmt.Sprint(iter.Key().Interface())
+			m, err := w.walk(iter.Value().Interface(), append(keyPath, key), depth+1)
+			if m != nil || err != nil {
+				return m, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (w *walker) match(value string, keyPath []interface{}) (*filterMatch, error) {
+	if len(value) < w.minLen {
+		return nil, nil
+	}
+	if len(value) > maxStringLength {
+		value = value[:maxStringLength]
+	}
+	matched, ok, err := w.op.match(value, w.deadline)
+	if !ok || err != nil {
+		return nil, err
+	}
+	path := make([]interface{}, len(keyPath))
+	copy(path, keyPath)
+	return &filterMatch{
+		KeyPath:       path,
+		ResolvedValue: value,
+		MatchStatus:   matched,
+	}, nil
+}
@@ -0,0 +1,473 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package sqwaf
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// SQL injection detection in the spirit of libinjection: the value is
+// tokenized as SQL in the contexts it could be injected in (as-is, or within a
+// single-quoted or double-quoted string), and the resulting fingerprints of
+// token types are checked against the structures of SQL injections, such as a
+// closed string followed by a logical operator and a comparison. Token types:
+//
+//	s: string
+//	1: number
+//	n: bareword
+//	v: variable
+//	f: function
+//	k: keyword
+//	E: select statement
+//	U: union
+//	&: logical operator
+//	o: operator
+//	c: comment
+//	(, ), ,, ;: punctuation
+//
+// The returned match is the fingerprint of the injection.
+
+// Maximum number of tokens of a fingerprint.
+const maxSQLiTokens = 8
+
+func detectSQLi(value string, deadline time.Time) (string, bool, error) {
+	if value == "" {
+		return "", false, nil
+	}
+	for _, quote := range [...]byte{0, '\'', '"'} {
+		if time.Now().After(deadline) {
+			return "", false, types.ErrTimeout
+		}
+		fingerprint := sqliFingerprint(value, quote)
+		if isSQLiFingerprint(fingerprint, quote) {
+			return fingerprint, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// isSQLiFingerprint returns true when the fingerprint of a value tokenized in
+// the given quote context has the structure of an SQL injection.
+func isSQLiFingerprint(fp string, quote byte) bool {
+	if len(fp) < 2 {
+		return false
+	}
+
+	// UNION [ALL|DISTINCT] SELECT in any context
+	if i := strings.IndexByte(fp, 'U'); i >= 0 {
+		rest := fp[i+1:]
+		if strings.HasPrefix(rest, "E") || strings.HasPrefix(rest, "kE") || strings.HasPrefix(rest, "(E") {
+			return true
+		}
+	}
+
+	// The first token must be the one breaking out of the context: the end of
+	// the string the value is in, or a number in the as-is context. The
+	// remaining tokens start after the possibly closing parenthesis.
+	first := fp[0]
+	switch {
+	case quote != 0 && first == 's':
+	case quote == 0 && first == '1':
+	default:
+		return false
+	}
+	rest := strings.TrimLeft(fp[1:], ")")
+
+	switch {
+	case strings.HasPrefix(rest, "&"):
+		// Logical operator followed by a comparison or a function call
+		return isSQLiCondition(rest[1:], quote != 0)
+	case strings.HasPrefix(rest, ";"):
+		// Stacked query
+		return len(rest) > 1 && (rest[1] == 'k' || rest[1] == 'E')
+	case quote != 0 && strings.HasPrefix(rest, "c"):
+		// Closed string followed by a comment discarding the end of the query
+		return len(rest) == 1 && len(fp) == 2
+	case quote != 0 && strings.HasPrefix(rest, "o"):
+		// Closed string followed by an operator and another value, which is a
+		// tautology when the injection closes the string again.
+		return len(rest) > 1 && strings.IndexByte("s1nv", rest[1]) >= 0 && (len(rest) == 2 || strings.IndexByte("&co;", rest[2]) >= 0)
+	}
+	return false
+}
+
+// isSQLiCondition returns true when the tokens following a logical operator
+// are a comparison or a function call.
+func isSQLiCondition(fp string, closedString bool) bool {
+	if fp == "" {
+		return false
+	}
+	switch fp[0] {
+	case 'f':
+		return len(fp) > 1 && fp[1] == '('
+	case '(':
+		return isSQLiCondition(fp[1:], closedString)
+	case 's', '1', 'n', 'v':
+		if len(fp) == 1 {
+			// Truthy value alone, which ends the query in the string context
+			return closedString && fp[0] != 'n'
+		}
+		return fp[1] == 'o' || fp[1] == 'c'
+	}
+	return false
+}
+
+// sqliFingerprint returns the fingerprint of the value tokenized in the given
+// quote context, 0 for the as-is context.
+func sqliFingerprint(value string, quote byte) string {
+	t := sqliTokenizer{s: value, dialect: &genericSQLDialect}
+	var fp [maxSQLiTokens]byte
+	n := 0
+	if quote != 0 {
+		// The value starts within a string literal
+		if !t.skipString(quote) {
+			// The string is not closed: nothing is injected
+			return "s"
+		}
+		fp[0] = 's'
+		n++
+	}
+	for n < maxSQLiTokens {
+		tok, ok := t.next()
+		if !ok {
+			break
+		}
+		fp[n] = tok
+		n++
+	}
+	return string(fp[:n])
+}
+
+// SQLToken is a token of an SQL query.
+type SQLToken struct {
+	// Type is the token type, using the same characters as the fingerprints of
+	// the SQL injection detection (eg. `s` for strings, `k` for keywords).
+	Type string
+	// Value is the token as written in the query.
+	Value string
+}
+
+// TokenizeSQL returns at most maxTokens tokens of the SQL query according to
+// the syntax of the given dialect: `mysql`, `postgresql`, `sqlite` or `mssql`.
+// The empty dialect is a generic SQL dialect accepting most of their syntax and
+// is the one used by the SQL injection detection.
+func TokenizeSQL(query, dialect string, maxTokens int) ([]SQLToken, error) {
+	d, exists := sqlDialects[dialect]
+	if !exists {
+		return nil, sqerrors.Errorf("unexpected sql dialect `%s`", dialect)
+	}
+	t := sqliTokenizer{s: query, dialect: d}
+	var tokens []SQLToken
+	for len(tokens) < maxTokens {
+		t.skipSpaces()
+		start := t.pos
+		tok, ok := t.next()
+		if !ok {
+			break
+		}
+		tokens = append(tokens, SQLToken{Type: string(tok), Value: query[start:t.pos]})
+	}
+	return tokens, nil
+}
+
+// sqlDialect is the set of syntax features of an SQL dialect that change the
+// way values are tokenized.
+type sqlDialect struct {
+	// Backslashes escape characters in strings
+	backslashEscapes bool
+	// `#` starts a comment until the end of the line
+	hashComments bool
+	// Backquotes quote identifiers
+	backquotedIdentifiers bool
+	// Double quotes quote identifiers instead of strings
+	doubleQuotedIdentifiers bool
+	// Brackets quote identifiers
+	bracketedIdentifiers bool
+	// Dollar-quoted strings such as `$$string$$` or `$tag$string$tag$`
+	dollarQuotedStrings bool
+}
+
+var genericSQLDialect = sqlDialect{
+	backslashEscapes:      true,
+	hashComments:          true,
+	backquotedIdentifiers: true,
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"":      &genericSQLDialect,
+	"mysql": &genericSQLDialect,
+	"postgresql": {
+		doubleQuotedIdentifiers: true,
+		dollarQuotedStrings:     true,
+	},
+	"sqlite": {
+		backquotedIdentifiers:   true,
+		doubleQuotedIdentifiers: true,
+		bracketedIdentifiers:    true,
+	},
+	"mssql": {
+		doubleQuotedIdentifiers: true,
+		bracketedIdentifiers:    true,
+	},
+}
+
+type sqliTokenizer struct {
+	s       string
+	pos     int
+	dialect *sqlDialect
+}
+
+// skipString skips the string literal ending with the given quote, starting at
+// the current position. It returns false when the end of the value is reached.
+func (t *sqliTokenizer) skipString(quote byte) bool {
+	for t.pos < len(t.s) {
+		c := t.s[t.pos]
+		t.pos++
+		switch c {
+		case '\\':
+			if t.dialect.backslashEscapes {
+				t.pos++
+			}
+		case quote:
+			if t.pos < len(t.s) && t.s[t.pos] == quote {
+				// Escaped quote
+				t.pos++
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the type of the next token.
+func (t *sqliTokenizer) next() (byte, bool) {
+	t.skipSpaces()
+	if t.pos >= len(t.s) {
+		return 0, false
+	}
+
+	c := t.s[t.pos]
+	switch {
+	case c == '"' && t.dialect.doubleQuotedIdentifiers:
+		// Quoted identifier
+		t.pos++
+		t.skipString(c)
+		return 'n', true
+
+	case c == '\'' || c == '"':
+		t.pos++
+		t.skipString(c)
+		return 's', true
+
+	case c == '`' && t.dialect.backquotedIdentifiers:
+		// Quoted identifier
+		t.pos++
+		t.skipString(c)
+		return 'n', true
+
+	case c == '[' && t.dialect.bracketedIdentifiers:
+		// Quoted identifier
+		t.pos++
+		t.skipString(']')
+		return 'n', true
+
+	case c == '$' && t.dialect.dollarQuotedStrings && t.dollarQuoteTag() != "":
+		tag := t.dollarQuoteTag()
+		t.pos += len(tag)
+		if end := strings.Index(t.s[t.pos:], tag); end >= 0 {
+			t.pos += end + len(tag)
+		} else {
+			t.pos = len(t.s)
+		}
+		return 's', true
+
+	case c == '#' && t.dialect.hashComments:
+		t.pos = len(t.s)
+		return 'c', true
+
+	case c == '-' && t.peek(1) == '-':
+		t.pos = len(t.s)
+		return 'c', true
+
+	case c == '/' && t.peek(1) == '*':
+		if end := strings.Index(t.s[t.pos+2:], "*/"); end >= 0 {
+			t.pos += 2 + end + 2
+		} else {
+			t.pos = len(t.s)
+		}
+		return 'c', true
+
+	case c == '(' || c == ')' || c == ',' || c == ';':
+		t.pos++
+		return c, true
+
+	case c == '&' && t.peek(1) == '&', c == '|' && t.peek(1) == '|':
+		t.pos += 2
+		return '&', true
+
+	case strings.IndexByte("=<>!+-*/%^|&~", c) >= 0:
+		t.pos++
+		for t.pos < len(t.s) && strings.IndexByte("=<>", t.s[t.pos]) >= 0 {
+			t.pos++
+		}
+		return 'o', true
+
+	case c == '@':
+		t.pos++
+		if t.peek(0) == '@' {
+			t.pos++
+		}
+		t.word()
+		return 'v', true
+
+	case isDigit(c) || (c == '.' && isDigit(t.peek(1))):
+		t.word()
+		return '1', true
+
+	case isWordChar(c):
+		word := strings.ToLower(t.word())
+		if tok, exists := sqlKeywords[word]; exists {
+			return tok, true
+		}
+		if t.peekNonSpace() == '(' {
+			return 'f', true
+		}
+		return 'n', true
+
+	default:
+		// Unknown character
+		t.pos++
+		return 'o', true
+	}
+}
+
+// skipSpaces skips the whitespaces at the current position.
+func (t *sqliTokenizer) skipSpaces() {
+	for t.pos < len(t.s) && isSQLSpace(t.s[t.pos]) {
+		t.pos++
+	}
+}
+
+// dollarQuoteTag returns the dollar-quoted string tag at the current position,
+// such as `$$` or `$tag$`, or the empty string when there is none. Positional
+// parameters such as `$1` are not tags.
+func (t *sqliTokenizer) dollarQuoteTag() string {
+	start := t.pos
+	if isDigit(t.peek(1)) {
+		return ""
+	}
+	for i := start + 1; i < len(t.s); i++ {
+		switch c := t.s[i]; {
+		case c == '$':
+			return t.s[start : i+1]
+		case !isWordChar(c):
+			return ""
+		}
+	}
+	return ""
+}
+
+func (t *sqliTokenizer) peek(offset int) byte {
+	if i := t.pos + offset; i < len(t.s) {
+		return t.s[i]
+	}
+	return 0
+}
+
+func (t *sqliTokenizer) peekNonSpace() byte {
+	for i := t.pos; i < len(t.s); i++ {
+		if !isSQLSpace(t.s[i]) {
+			return t.s[i]
+		}
+	}
+	return 0
+}
+
+// word reads the word at the current position.
+func (t *sqliTokenizer) word() string {
+	start := t.pos
+	for t.pos < len(t.s) && (isWordChar(t.s[t.pos]) || t.s[t.pos] == '.') {
+		t.pos++
+	}
+	return t.s[start:t.pos]
+}
+
+func isSQLSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f', 0xa0:
+		return true
+	}
+	return false
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
+
+// sqlKeywords are the token types of the SQL keywords.
+var sqlKeywords = map[string]byte{
+	"select": 'E',
+	"union":  'U',
+
+	"and": '&',
+	"or":  '&',
+	"xor": '&',
+
+	"like":    'o',
+	"rlike":   'o',
+	"regexp":  'o',
+	"is":      'o',
+	"not":     'o',
+	"in":      'o',
+	"between": 'o',
+	"div":     'o',
+	"mod":     'o',
+	"sounds":  'o',
+
+	"all":      'k',
+	"distinct": 'k',
+	"from":     'k',
+	"where":    'k',
+	"insert":   'k',
+	"update":   'k',
+	"delete":   'k',
+	"drop":     'k',
+	"create":   'k',
+	"alter":    'k',
+	"truncate": 'k',
+	"exec":     'k',
+	"execute":  'k',
+	"declare":  'k',
+	"shutdown": 'k',
+	"waitfor":  'k',
+	"into":     'k',
+	"values":   'k',
+	"table":    'k',
+	"having":   'k',
+	"group":    'k',
+	"order":    'k',
+	"by":       'k',
+	"limit":    'k',
+	"offset":   'k',
+	"case":     'k',
+	"when":     'k',
+	"then":     'k',
+	"else":     'k',
+	"end":      'k',
+	"null":     '1',
+	"true":     '1',
+	"false":    '1',
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+// Package sqwaf is a pure-Go implementation of the in-app WAF. It evaluates
+// the same WAF rules as the native WAF library of go-libsqreen, which requires
+// cgo, so that programs compiled without cgo are still protected by the in-app
+// WAF rules. It implements the WAF rule interface of go-libsqreen and supports
+// the operators used by the rulesets:
+//
+//   - `@rx`: regular expression match.
+//   - `@pm`: phrase match of a list of strings.
+//   - `@ipMatch`: IP address match of a list of IP addresses and CIDRs.
+//   - `@beginsWith`, `@endsWith`, `@contains`, `@eq`: string comparisons.
+//   - `@exist`: target existence.
+//   - `@detectSQLi`, `@detectXSS`: SQL injection and XSS detection heuristics
+//     in the spirit of libinjection.
+//
+// A WAF rule is made of rules and flows. Rules are lists of filters applying an
+// operator to targets, which are the binding accessor expressions of the data
+// set given to Run(). A rule matches when all its filters match. Flows are
+// lists of steps evaluating a list of rules and jumping to another step or
+// exiting the flow according to the result.
+package sqwaf
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqerrors"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// version is the version of the WAF rule format implemented by this package.
+const version = "0.7.0-go"
+
+// Version returns the version of the pure-Go WAF.
+func Version() *string {
+	v := version
+	return &v
+}
+
+// Static assert that `Version` has the expected signature
+var _ types.VersionFunc = Version
+
+// Flow step exits.
+const (
+	exitOK      = "exit_ok"
+	exitMonitor = "exit_monitor"
+	exitBlock   = "exit_block"
+)
+
+// Maximum number of steps executed by a flow in order to stop flows looping
+// between steps.
+const maxFlowSteps = 100
+
+type (
+	// Rule is a WAF rule compiled from its JSON definition.
+	Rule struct {
+		id       string
+		rules    map[string]*rule
+		flows    []flow
+		maxLen   int
+		maxDepth int
+	}
+
+	rule struct {
+		id      string
+		filters []filter
+	}
+
+	filter struct {
+		operator string
+		value    interface{}
+		op       operator
+		targets  []string
+		minLen   int
+	}
+
+	flow struct {
+		name  string
+		steps []step
+		// index of the steps by ID
+		index map[string]int
+	}
+
+	step struct {
+		id        string
+		ruleIDs   []string
+		onMatch   string
+		onNoMatch string
+	}
+)
+
+// Static assert that `*Rule` implements the WAF rule interface
+var _ types.Rule = (*Rule)(nil)
+
+// JSON definition of a WAF rule.
+type (
+	jsonRule struct {
+		Rules []jsonRuleEntry `json:"rules"`
+		Flows []jsonFlow      `json:"flows"`
+	}
+
+	jsonRuleEntry struct {
+		ID      string       `json:"rule_id"`
+		Filters []jsonFilter `json:"filters"`
+	}
+
+	jsonFilter struct {
+		Operator string            `json:"operator"`
+		Targets  []string          `json:"targets"`
+		Value    json.RawMessage   `json:"value"`
+		Options  jsonFilterOptions `json:"options"`
+	}
+
+	jsonFilterOptions struct {
+		CaseSensitive bool `json:"case_sensitive"`
+		MinLength     int  `json:"min_length"`
+	}
+
+	jsonFlow struct {
+		Name  string     `json:"name"`
+		Steps []jsonStep `json:"steps"`
+	}
+
+	jsonStep struct {
+		ID        string   `json:"id"`
+		RuleIDs   []string `json:"rule_ids"`
+		OnMatch   string   `json:"on_match"`
+		OnNoMatch string   `json:"on_no_match"`
+	}
+)
+
+// NewRule compiles the given JSON WAF rule. Values of the data sets are walked
+// up to maxDepth levels of nested values and maxLen elements per level.
+func NewRule(id, ruleJSON string, maxLen, maxDepth uint64) (types.Rule, error) {
+	var def jsonRule
+	if err := json.Unmarshal([]byte(ruleJSON), &def); err != nil {
+		return nil, sqerrors.Wrap(err, "json unmarshaling error")
+	}
+	if len(def.Flows) == 0 {
+		return nil, sqerrors.New("no flows")
+	}
+
+	r := &Rule{
+		id:       id,
+		rules:    make(map[string]*rule, len(def.Rules)),
+		flows:    make([]flow, 0, len(def.Flows)),
+		maxLen:   clampLimit(maxLen),
+		maxDepth: clampLimit(maxDepth),
+	}
+
+	for i := range def.Rules {
+		entry := &def.Rules[i]
+		compiled, err := compileRule(entry)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "rule `%s`", entry.ID)
+		}
+		if _, exists := r.rules[entry.ID]; exists {
+			return nil, sqerrors.Errorf("rule `%s`: duplicate rule id", entry.ID)
+		}
+		r.rules[entry.ID] = compiled
+	}
+
+	for i := range def.Flows {
+		f, err := compileFlow(&def.Flows[i], r.rules)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "flow `%s`", def.Flows[i].Name)
+		}
+		r.flows = append(r.flows, f)
+	}
+
+	return r, nil
+}
+
+// Static assert that `NewRule` has the expected signature
+var _ types.NewRuleFunc = NewRule
+
+func clampLimit(v uint64) int {
+	const maxInt = int(^uint(0) >> 1)
+	if v == 0 || v > uint64(maxInt) {
+		return maxInt
+	}
+	return int(v)
+}
+
+func compileRule(entry *jsonRuleEntry) (*rule, error) {
+	if len(entry.Filters) == 0 {
+		return nil, sqerrors.New("no filters")
+	}
+	r := &rule{
+		id:      entry.ID,
+		filters: make([]filter, len(entry.Filters)),
+	}
+	for i := range entry.Filters {
+		f := &entry.Filters[i]
+		if len(f.Targets) == 0 {
+			return nil, sqerrors.Errorf("filter %d: no targets", i)
+		}
+		op, value, err := newOperator(f.Operator, f.Value, f.Options)
+		if err != nil {
+			return nil, sqerrors.Wrapf(err, "filter %d: operator `%s`", i, f.Operator)
+		}
+		r.filters[i] = filter{
+			operator: f.Operator,
+			value:    value,
+			op:       op,
+			targets:  f.Targets,
+			minLen:   f.Options.MinLength,
+		}
+	}
+	return r, nil
+}
+
+func compileFlow(def *jsonFlow, rules map[string]*rule) (flow, error) {
+	if len(def.Steps) == 0 {
+		return flow{}, sqerrors.New("no steps")
+	}
+	f := flow{
+		name:  def.Name,
+		steps: make([]step, len(def.Steps)),
+		index: make(map[string]int, len(def.Steps)),
+	}
+	for i, s := range def.Steps {
+		for _, id := range s.RuleIDs {
+			if _, exists := rules[id]; !exists {
+				return flow{}, sqerrors.Errorf("step `%s`: unknown rule id `%s`", s.ID, id)
+			}
+		}
+		f.steps[i] = step{
+			id:        s.ID,
+			ruleIDs:   s.RuleIDs,
+			onMatch:   s.OnMatch,
+			onNoMatch: s.OnNoMatch,
+		}
+		f.index[s.ID] = i
+	}
+	// Validate the step jumps
+	for _, s := range f.steps {
+		for _, next := range []string{s.onMatch, s.onNoMatch} {
+			if err := f.validateJump(next); err != nil {
+				return flow{}, sqerrors.Wrapf(err, "step `%s`", s.id)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (f *flow) validateJump(next string) error {
+	switch next {
+	case "", exitOK, exitMonitor, exitBlock:
+		return nil
+	}
+	if _, exists := f.index[next]; !exists {
+		return sqerrors.Errorf("unknown step id `%s`", next)
+	}
+	return nil
+}
+
+// Close releases the WAF rule. It is a no-op as the pure-Go WAF rule doesn't
+// hold any resources.
+func (r *Rule) Close() error { return nil }
+
+// Run runs the flows of the WAF rule on the given data set and returns the
+// action of the first flow exiting with a monitoring or blocking action along
+// with the JSON description of the match. types.ErrTimeout is returned when the
+// execution exceeds the given timeout.
+func (r *Rule) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	if timeout <= 0 {
+		return types.NoAction, nil, types.ErrTimeout
+	}
+
+	run := runContext{
+		rule:     r,
+		data:     data,
+		deadline: time.Now().Add(timeout),
+		matches:  make(map[string]*ruleMatch),
+	}
+
+	for i := range r.flows {
+		f := &r.flows[i]
+		action, match, err := run.runFlow(f)
+		if err != nil {
+			return types.NoAction, nil, err
+		}
+		if action == types.NoAction {
+			continue
+		}
+		info, err := json.Marshal([]*flowMatch{match})
+		if err != nil {
+			return types.NoAction, nil, types.ErrInternal
+		}
+		return action, info, nil
+	}
+
+	return types.NoAction, nil, nil
+}
+
+// runContext is the state of a WAF rule execution.
+type runContext struct {
+	rule     *Rule
+	data     types.DataSet
+	deadline time.Time
+	// matches caches the rule results as several steps and flows can evaluate
+	// the same rules. A nil value means no match.
+	matches map[string]*ruleMatch
+}
+
+type (
+	// flowMatch is the JSON description of a match, following the format of
+	// the native WAF library.
+	flowMatch struct {
+		RetCode int            `json:"ret_code"`
+		Flow    string         `json:"flow"`
+		Step    string         `json:"step"`
+		Rule    string         `json:"rule"`
+		Filter  []*filterMatch `json:"filter"`
+	}
+
+	ruleMatch struct {
+		rule    string
+		filters []*filterMatch
+	}
+
+	filterMatch struct {
+		Operator        string        `json:"operator"`
+		OperatorValue   interface{}   `json:"operator_value"`
+		BindingAccessor string        `json:"binding_accessor"`
+		KeyPath         []interface{} `json:"key_path"`
+		ResolvedValue   string        `json:"resolved_value"`
+		MatchStatus     string        `json:"match_status"`
+	}
+)
+
+// Return code of the matches
+const (
+	retCodeMonitor = 1
+	retCodeBlock   = 2
+)
+
+func (c *runContext) runFlow(f *flow) (types.Action, *flowMatch, error) {
+	i := 0
+	for n := 0; n < maxFlowSteps; n++ {
+		s := &f.steps[i]
+		match, err := c.runStep(s)
+		if err != nil {
+			return types.NoAction, nil, err
+		}
+
+		next := s.onNoMatch
+		if match != nil {
+			next = s.onMatch
+		}
+
+		switch next {
+		case "", exitOK:
+			return types.NoAction, nil, nil
+		case exitMonitor, exitBlock:
+			if match == nil {
+				// Exiting with an action without any match
+				return types.NoAction, nil, nil
+			}
+			action, retCode := types.MonitorAction, retCodeMonitor
+			if next == exitBlock {
+				action, retCode = types.BlockAction, retCodeBlock
+			}
+			return action, &flowMatch{
+				RetCode: retCode,
+				Flow:    f.name,
+				Step:    s.id,
+				Rule:    match.rule,
+				Filter:  match.filters,
+			}, nil
+		default:
+			i = f.index[next]
+		}
+	}
+	return types.NoAction, nil, types.ErrInvalidFlow
+}
+
+// runStep returns the match of the first matching rule of the step, nil if
+// none of them match.
+func (c *runContext) runStep(s *step) (*ruleMatch, error) {
+	for _, id := range s.ruleIDs {
+		match, cached := c.matches[id]
+		if !cached {
+			var err error
+			match, err = c.runRule(c.rule.rules[id])
+			if err != nil {
+				return nil, err
+			}
+			c.matches[id] = match
+		}
+		if match != nil {
+			return match, nil
+		}
+	}
+	return nil, nil
+}
+
+// runRule returns the match of the rule when all its filters match, nil
+// otherwise.
+func (c *runContext) runRule(r *rule) (*ruleMatch, error) {
+	match := &ruleMatch{
+		rule:    r.id,
+		filters: make([]*filterMatch, 0, len(r.filters)),
+	}
+	for i := range r.filters {
+		m, err := c.runFilter(&r.filters[i])
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			return nil, nil
+		}
+		match.filters = append(match.filters, m)
+	}
+	return match, nil
+}
+
+// runFilter returns the match of the filter on the first matching value of
+// its targets, nil if none of them match.
+func (c *runContext) runFilter(f *filter) (*filterMatch, error) {
+	for _, target := range f.targets {
+		value, exists := c.data[target]
+		if !exists {
+			continue
+		}
+
+		if f.op == nil {
+			// The existence operator only needs the target to exist.
+			return &filterMatch{
+				Operator:        f.operator,
+				BindingAccessor: target,
+				KeyPath:         []interface{}{},
+			}, nil
+		}
+
+		w := walker{
+			op:       f.op,
+			minLen:   f.minLen,
+			maxLen:   c.rule.maxLen,
+			maxDepth: c.rule.maxDepth,
+			deadline: c.deadline,
+		}
+		m, err := w.walk(value, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			m.Operator = f.operator
+			m.OperatorValue = f.value
+			m.BindingAccessor = target
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// String returns the ID of the WAF rule.
+func (r *Rule) String() string {
+	return fmt.Sprintf("pure-Go waf rule `%s`", r.id)
+}
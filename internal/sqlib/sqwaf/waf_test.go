@@ -0,0 +1,473 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package sqwaf_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-agent/internal/sqlib/sqwaf"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	defaultMaxDepth  = 5
+	defaultMaxLength = 100
+)
+
+const userAgent = "#._server['HTTP_USER_AGENT']"
+
+// newSingleFilterRule returns the WAF rule having a single rule with the given
+// filter, and a single flow exiting with the given action when it matches.
+func newSingleFilterRule(t *testing.T, operator string, value interface{}, onMatch string, targets ...string) types.Rule {
+	if len(targets) == 0 {
+		targets = []string{userAgent}
+	}
+	filter := map[string]interface{}{
+		"operator": operator,
+		"targets":  targets,
+	}
+	if value != nil {
+		filter["value"] = value
+	}
+	def, err := json.Marshal(map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"rule_id": "1",
+				"filters": []interface{}{filter},
+			},
+		},
+		"flows": []interface{}{
+			map[string]interface{}{
+				"name": "my flow",
+				"steps": []interface{}{
+					map[string]interface{}{"id": "start", "rule_ids": []string{"1"}, "on_match": onMatch},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	r, err := sqwaf.NewRule("my rule", string(def), defaultMaxLength, defaultMaxDepth)
+	require.NoError(t, err)
+	return r
+}
+
+func TestUsage(t *testing.T) {
+	t.Run("version", func(t *testing.T) {
+		require.NotNil(t, sqwaf.Version())
+	})
+
+	t.Run("monitor", func(t *testing.T) {
+		r, err := sqwaf.NewRule("my rule", "{\"rules\": [{\"rule_id\": \"1\",\"filters\": [{\"operator\": \"@rx\",\"targets\": [\"#._server['HTTP_USER_AGENT']\"],\"value\": \"Arachni\"}]}],\"flows\": [{\"name\": \"arachni_detection\",\"steps\": [{\"id\": \"start\",\"rule_ids\": [\"1\"],\"on_match\": \"exit_monitor\"}]}]}", defaultMaxLength, defaultMaxDepth)
+		require.NoError(t, err)
+		defer r.Close()
+		action, info, err := r.Run(types.DataSet{userAgent: "Arachni/v1"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+		require.JSONEq(t, `[{"ret_code":1,"flow":"arachni_detection","step":"start","rule":"1","filter":[{"operator":"@rx","operator_value":"Arachni","binding_accessor":"#._server['HTTP_USER_AGENT']","key_path":[],"resolved_value":"Arachni/v1","match_status":"Arachni"}]}]`, string(info))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		r := newSingleFilterRule(t, "@rx", "Arachni", "exit_block")
+		action, info, err := r.Run(types.DataSet{userAgent: "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+		require.NotEmpty(t, info)
+	})
+
+	t.Run("no action", func(t *testing.T) {
+		r := newSingleFilterRule(t, "@rx", "Arachni", "exit_block")
+		action, info, err := r.Run(types.DataSet{userAgent: "go client"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+		require.Empty(t, info)
+
+		// Missing target
+		action, info, err = r.Run(types.DataSet{}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+		require.Empty(t, info)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r := newSingleFilterRule(t, "@rx", "Arachni", "exit_block")
+		action, info, err := r.Run(types.DataSet{userAgent: "Arachni"}, 0)
+		require.Equal(t, types.ErrTimeout, err)
+		require.Equal(t, types.NoAction, action)
+		require.Empty(t, info)
+	})
+
+	t.Run("bad rules", func(t *testing.T) {
+		for _, def := range []string{
+			``,
+			`{}`,
+			`{"rules": [], "flows": []}`,
+			// Unknown operator
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@oops","targets": ["a"],"value": "a"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`,
+			// Bad regular expression
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["a"],"value": "("}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`,
+			// Bad IP address
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@ipMatch","targets": ["a"],"value": ["oops"]}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`,
+			// No targets
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": [],"value": "a"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`,
+			// Unknown rule id
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["a"],"value": "a"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["2"],"on_match": "exit_block"}]}]}`,
+			// Unknown step
+			`{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["a"],"value": "a"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "oops"}]}]}`,
+		} {
+			def := def
+			t.Run(def, func(t *testing.T) {
+				r, err := sqwaf.NewRule("my rule", def, defaultMaxLength, defaultMaxDepth)
+				require.Error(t, err)
+				require.Nil(t, r)
+			})
+		}
+	})
+}
+
+func TestOperators(t *testing.T) {
+	for _, tc := range []struct {
+		operator string
+		value    interface{}
+		matching []interface{}
+		others   []interface{}
+	}{
+		{
+			operator: "@rx",
+			value:    "^arachni",
+			matching: []interface{}{"Arachni/v1", "arachni"},
+			others:   []interface{}{"my arachni", ""},
+		},
+		{
+			operator: "@pm",
+			value:    []string{"bla", "blo", "Toto"},
+			matching: []interface{}{"Toto", "tOTO", "a blob"},
+			others:   []interface{}{"Tata", ""},
+		},
+		{
+			operator: "@ipMatch",
+			value:    []string{"1.2.3.4", "10.0.0.0/8", "2001:db8::/32"},
+			matching: []interface{}{"1.2.3.4", "10.1.2.3", "2001:db8::1"},
+			others:   []interface{}{"1.2.3.5", "11.0.0.1", "2001:db9::1", "oops"},
+		},
+		{
+			operator: "@beginsWith",
+			value:    "/admin",
+			matching: []interface{}{"/admin/users", "/ADMIN"},
+			others:   []interface{}{"/users/admin"},
+		},
+		{
+			operator: "@endsWith",
+			value:    ".php",
+			matching: []interface{}{"/index.php"},
+			others:   []interface{}{"/index.php.html"},
+		},
+		{
+			operator: "@contains",
+			value:    "../",
+			matching: []interface{}{"/a/../../etc/passwd"},
+			others:   []interface{}{"/a/b"},
+		},
+		{
+			operator: "@eq",
+			value:    "admin",
+			matching: []interface{}{"Admin"},
+			others:   []interface{}{"admins"},
+		},
+		{
+			operator: "@exist",
+			matching: []interface{}{"", "anything", 33},
+		},
+		{
+			operator: "@detectSQLi",
+			matching: []interface{}{
+				"' OR '1'='1",
+				"1 OR 1=1",
+				"admin'--",
+				"1 UNION SELECT password FROM users",
+				"x' UNION ALL SELECT NULL--",
+				"1; DROP TABLE users",
+				"'; waitfor delay '0:0:5'--",
+				"1' AND sleep(5)#",
+				"\" or \"\"=\"",
+				"') or ('a'='a",
+				"1 AND 1=1",
+				"' or 1 --",
+			},
+			others: []interface{}{
+				"O'Reilly",
+				"it's a nice day",
+				"rock 'n' roll",
+				"Bob's and Alice's cats",
+				"1 or 2 cats",
+				"select the best option",
+				"hello world",
+				"42",
+				"john.doe@example.com",
+				"SELECT",
+			},
+		},
+		{
+			operator: "@detectXSS",
+			matching: []interface{}{
+				"<script>alert(1)</script>",
+				"<ScRiPt src=//evil.com/x.js>",
+				"<img src=x onerror=alert(1)>",
+				"<svg/onload=alert(1)>",
+				"<a href=\"javascript:alert(1)\">x</a>",
+				"<a href=\"jav&#x09;ascript:alert(1)\">x</a>",
+				"\" onmouseover=\"alert(1)",
+				"' onfocus='alert(1)' autofocus='",
+				"javascript:alert(document.cookie)",
+				"<iframe src=//evil.com>",
+				"<div style=\"width: expression(alert(1))\">",
+			},
+			others: []interface{}{
+				"hello world",
+				"1 < 2 and 3 > 2",
+				"<b>bold</b>",
+				"<a href=\"https://sqreen.com\">sqreen</a>",
+				"I'm online",
+				"a<b online",
+				"once=upon a time",
+				"&lt;script&gt;",
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.operator, func(t *testing.T) {
+			r := newSingleFilterRule(t, tc.operator, tc.value, "exit_block")
+			for _, v := range tc.matching {
+				v := v
+				t.Run(fmt.Sprint(v), func(t *testing.T) {
+					action, info, err := r.Run(types.DataSet{userAgent: v}, time.Second)
+					require.NoError(t, err)
+					require.Equal(t, types.BlockAction, action)
+					require.NotEmpty(t, info)
+				})
+			}
+			for _, v := range tc.others {
+				v := v
+				t.Run(fmt.Sprint(v), func(t *testing.T) {
+					action, info, err := r.Run(types.DataSet{userAgent: v}, time.Second)
+					require.NoError(t, err)
+					require.Equal(t, types.NoAction, action)
+					require.Empty(t, info)
+				})
+			}
+		})
+	}
+}
+
+func TestValues(t *testing.T) {
+	t.Run("nested values", func(t *testing.T) {
+		const target = "#.QueryParams"
+		r := newSingleFilterRule(t, "@rx", "attack", "exit_monitor", target)
+
+		action, info, err := r.Run(types.DataSet{target: url.Values{"a": {"ok", "my attack"}}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+		var matches []struct {
+			Filter []struct {
+				KeyPath       []interface{} `json:"key_path"`
+				ResolvedValue string        `json:"resolved_value"`
+			} `json:"filter"`
+		}
+		require.NoError(t, json.Unmarshal(info, &matches))
+		require.Len(t, matches, 1)
+		require.Len(t, matches[0].Filter, 1)
+		require.Equal(t, []interface{}{"a", float64(1)}, matches[0].Filter[0].KeyPath)
+		require.Equal(t, "my attack", matches[0].Filter[0].ResolvedValue)
+	})
+
+	t.Run("max depth", func(t *testing.T) {
+		const target = "#.Body"
+		def := `{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["#.Body"],"value": "attack"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`
+		r, err := sqwaf.NewRule("my rule", def, defaultMaxLength, 2)
+		require.NoError(t, err)
+
+		action, _, err := r.Run(types.DataSet{target: []interface{}{[]interface{}{"attack"}}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		action, _, err = r.Run(types.DataSet{target: []interface{}{[]interface{}{[]interface{}{"attack"}}}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+	})
+
+	t.Run("max length", func(t *testing.T) {
+		const target = "#.Body"
+		def := `{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["#.Body"],"value": "attack"}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`
+		r, err := sqwaf.NewRule("my rule", def, 2, defaultMaxDepth)
+		require.NoError(t, err)
+
+		action, _, err := r.Run(types.DataSet{target: []string{"a", "attack"}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		action, _, err = r.Run(types.DataSet{target: []string{"a", "b", "attack"}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+	})
+
+	t.Run("max string length", func(t *testing.T) {
+		r := newSingleFilterRule(t, "@rx", "attack", "exit_block")
+
+		action, _, err := r.Run(types.DataSet{userAgent: strings.Repeat("a", 4090) + "attack"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		action, _, err = r.Run(types.DataSet{userAgent: strings.Repeat("a", 4091) + "attack"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+	})
+
+	t.Run("detection heuristics cost", func(t *testing.T) {
+		for _, operator := range []string{"@detectXSS", "@detectSQLi"} {
+			r := newSingleFilterRule(t, operator, nil, "exit_block")
+			for _, v := range []string{
+				strings.Repeat("<a ", 40000),
+				strings.Repeat("<a ", 40000) + ">",
+				strings.Repeat("' or ", 30000),
+			} {
+				start := time.Now()
+				_, _, err := r.Run(types.DataSet{userAgent: v}, time.Second)
+				require.NoError(t, err)
+				require.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+			}
+		}
+	})
+
+	t.Run("min length", func(t *testing.T) {
+		def := `{"rules": [{"rule_id": "1","filters": [{"operator": "@rx","targets": ["a"],"value": "a","options": {"min_length": 3}}]}],"flows": [{"name": "f","steps": [{"id": "start","rule_ids": ["1"],"on_match": "exit_block"}]}]}`
+		r, err := sqwaf.NewRule("my rule", def, defaultMaxLength, defaultMaxDepth)
+		require.NoError(t, err)
+
+		action, _, err := r.Run(types.DataSet{"a": "aa"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, action)
+
+		action, _, err = r.Run(types.DataSet{"a": "aaa"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+	})
+}
+
+func TestFlows(t *testing.T) {
+	// Rule 1 and 2 must both match in order to block, while rule 3 is only
+	// monitored.
+	def := `{
+  "rules": [
+    {"rule_id": "1", "filters": [{"operator": "@rx", "targets": ["a"], "value": "^x"}]},
+    {"rule_id": "2", "filters": [{"operator": "@rx", "targets": ["b"], "value": "^y"}, {"operator": "@exist", "targets": ["c"]}]},
+    {"rule_id": "3", "filters": [{"operator": "@rx", "targets": ["d"], "value": "^z"}]}
+  ],
+  "flows": [
+    {
+      "name": "and",
+      "steps": [
+        {"id": "start", "rule_ids": ["1"], "on_match": "second"},
+        {"id": "second", "rule_ids": ["2"], "on_match": "exit_block"}
+      ]
+    },
+    {
+      "name": "monitor",
+      "steps": [
+        {"id": "start", "rule_ids": ["3"], "on_match": "exit_monitor", "on_no_match": "exit_ok"}
+      ]
+    }
+  ]
+}`
+	r, err := sqwaf.NewRule("my rule", def, defaultMaxLength, defaultMaxDepth)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		data     types.DataSet
+		expected types.Action
+	}{
+		{data: types.DataSet{"a": "x", "b": "y", "c": ""}, expected: types.BlockAction},
+		{data: types.DataSet{"a": "x", "b": "y"}, expected: types.NoAction},
+		{data: types.DataSet{"a": "x", "c": ""}, expected: types.NoAction},
+		{data: types.DataSet{"b": "y", "c": ""}, expected: types.NoAction},
+		{data: types.DataSet{"a": "x", "b": "y", "d": "z"}, expected: types.MonitorAction},
+		{data: types.DataSet{"a": "x", "b": "y", "c": "", "d": "z"}, expected: types.BlockAction},
+	} {
+		tc := tc
+		t.Run(fmt.Sprint(tc.data), func(t *testing.T) {
+			action, _, err := r.Run(tc.data, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, action)
+		})
+	}
+}
+
+func TestTokenizeSQL(t *testing.T) {
+	for _, tc := range []struct {
+		dialect, query string
+		expectedTypes  string
+		expectedValues []string
+	}{
+		{
+			dialect:        "",
+			query:          `SELECT * FROM users WHERE name = 'a\'b' # comment`,
+			expectedTypes:  "Eoknknosc",
+			expectedValues: []string{"SELECT", "*", "FROM", "users", "WHERE", "name", "=", `'a\'b'`, "# comment"},
+		},
+		{
+			dialect:        "mysql",
+			query:          "select `id` from t where id=1",
+			expectedTypes:  "Enknkno1",
+			expectedValues: []string{"select", "`id`", "from", "t", "where", "id", "=", "1"},
+		},
+		{
+			dialect:        "postgresql",
+			query:          `select "id", $$a'b$$ from t where id = $1 # 2`,
+			expectedTypes:  "En,sknknono1",
+			expectedValues: []string{"select", `"id"`, ",", "$$a'b$$", "from", "t", "where", "id", "=", "$1", "#", "2"},
+		},
+		{
+			dialect:        "sqlite",
+			query:          `select [id], "name" from t`,
+			expectedTypes:  "En,nkn",
+			expectedValues: []string{"select", "[id]", ",", `"name"`, "from", "t"},
+		},
+		{
+			dialect:        "mssql",
+			query:          `select [a]]b] from t where x = 'a\'`,
+			expectedTypes:  "Enknknos",
+			expectedValues: []string{"select", "[a]]b]", "from", "t", "where", "x", "=", `'a\'`},
+		},
+	} {
+		tc := tc
+		t.Run(tc.dialect, func(t *testing.T) {
+			tokens, err := sqwaf.TokenizeSQL(tc.query, tc.dialect, 100)
+			require.NoError(t, err)
+			var types string
+			var values []string
+			for _, tok := range tokens {
+				types += tok.Type
+				values = append(values, tok.Value)
+			}
+			require.Equal(t, tc.expectedTypes, types)
+			require.Equal(t, tc.expectedValues, values)
+		})
+	}
+
+	t.Run("max tokens", func(t *testing.T) {
+		tokens, err := sqwaf.TokenizeSQL("select a from b", "", 2)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2)
+	})
+
+	t.Run("unknown dialect", func(t *testing.T) {
+		_, err := sqwaf.TokenizeSQL("select a from b", "oops", 2)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package sqwaf
+
+import (
+	"html"
+	"strings"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// XSS detection in the spirit of libinjection: the value is parsed as HTML in
+// the contexts it could be injected in (HTML text, or within an attribute
+// value), and the resulting tags and attributes are checked against the ones
+// allowing to execute scripts, such as script tags, event handler attributes
+// or URL attributes having a script scheme. The returned match is the
+// offending tag, attribute or URL.
+
+func detectXSS(value string, deadline time.Time) (string, bool, error) {
+	if value == "" {
+		return "", false, nil
+	}
+	lower := strings.ToLower(value)
+	d := deadlineChecker{deadline: deadline}
+
+	// URL attribute context
+	if isScriptURL(lower) {
+		return value, true, nil
+	}
+
+	// HTML text context
+	if match, ok, err := detectXSSInText(lower, &d); ok || err != nil {
+		return match, ok, err
+	}
+
+	// Attribute value contexts: the value ends the attribute value and adds
+	// new attributes.
+	for _, quote := range [...]byte{'"', '\''} {
+		if i := strings.IndexByte(lower, quote); i >= 0 {
+			if match, ok, err := detectXSSInAttributes(lower[i+1:], false, &d); ok || err != nil {
+				return match, ok, err
+			}
+		}
+	}
+	if i := strings.IndexAny(lower, " \t\n\r\f/"); i >= 0 {
+		if match, ok, err := detectXSSInAttributes(lower[i+1:], false, &d); ok || err != nil {
+			return match, ok, err
+		}
+	}
+
+	return "", false, nil
+}
+
+// detectXSSInText looks for the dangerous tags and attributes of the HTML text.
+// The attributes of a tag are the characters up to the next `>`, or up to the
+// end of the text when the tag is not closed. Since the following tags until
+// that point share the same end, their attributes were already scanned as part
+// of the previous ones and are skipped so that the text is scanned linearly.
+func detectXSSInText(s string, d *deadlineChecker) (string, bool, error) {
+	scannedTo := 0
+	for pos := 0; ; {
+		if d.exceeded() {
+			return "", false, types.ErrTimeout
+		}
+		i := strings.IndexByte(s[pos:], '<')
+		if i < 0 {
+			return "", false, nil
+		}
+		pos += i + 1
+		if strings.HasPrefix(s[pos:], "/") {
+			pos++
+		}
+		name := readHTMLName(s[pos:])
+		if name == "" {
+			continue
+		}
+		if _, dangerous := xssTags[name]; dangerous {
+			return "<" + name, true, nil
+		}
+		pos += len(name)
+		if pos < scannedTo {
+			continue
+		}
+		attrsEnd := len(s)
+		if end := strings.IndexByte(s[pos:], '>'); end >= 0 {
+			attrsEnd = pos + end
+		}
+		if match, ok, err := detectXSSInAttributes(s[pos:attrsEnd], true, d); ok || err != nil {
+			return match, ok, err
+		}
+		scannedTo = attrsEnd
+	}
+}
+
+// detectXSSInAttributes looks for the dangerous attributes of the given list of
+// attributes. Any event handler attribute is considered as dangerous when in a
+// tag, otherwise only the ones of the list of known event handlers are in
+// order to avoid false positives on regular text.
+func detectXSSInAttributes(s string, inTag bool, d *deadlineChecker) (string, bool, error) {
+	for s != "" {
+		if d.exceeded() {
+			return "", false, types.ErrTimeout
+		}
+		s = strings.TrimLeft(s, " \t\n\r\f/\"'")
+		name := readHTMLAttributeName(s)
+		if name == "" {
+			if s == "" {
+				break
+			}
+			// Skip the unexpected character
+			s = s[1:]
+			continue
+		}
+		s = strings.TrimLeft(s[len(name):], " \t\n\r\f")
+
+		var value string
+		hasValue := strings.HasPrefix(s, "=")
+		if hasValue {
+			s = strings.TrimLeft(s[1:], " \t\n\r\f")
+			value, s = readHTMLAttributeValue(s)
+		}
+
+		if hasValue && isEventHandler(name, inTag) {
+			return name, true, nil
+		}
+		if _, isURL := xssURLAttributes[name]; isURL && isScriptURL(value) {
+			return name, true, nil
+		}
+		if name == "style" && (strings.Contains(value, "expression(") || strings.Contains(value, "javascript:")) {
+			return name, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func isEventHandler(name string, inTag bool) bool {
+	if !strings.HasPrefix(name, "on") || len(name) <= 2 {
+		return false
+	}
+	if inTag {
+		return true
+	}
+	_, known := xssEventHandlers[name[2:]]
+	return known
+}
+
+// isScriptURL returns true when the URL has a scheme executing scripts, once
+// decoded from its HTML entities and stripped from the characters browsers
+// ignore.
+func isScriptURL(url string) bool {
+	if url == "" {
+		return false
+	}
+	url = strings.ToLower(html.UnescapeString(url))
+	url = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, url)
+	url = strings.Trim(url, "\"'")
+	return strings.HasPrefix(url, "javascript:") ||
+		strings.HasPrefix(url, "vbscript:") ||
+		strings.HasPrefix(url, "livescript:") ||
+		strings.HasPrefix(url, "data:text/html")
+}
+
+func readHTMLName(s string) string {
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || i > 0 && (isDigit(c) || c == '-' || c == ':') {
+			i++
+			continue
+		}
+		break
+	}
+	return s[:i]
+}
+
+func readHTMLAttributeName(s string) string {
+	i := 0
+	for i < len(s) && strings.IndexByte(" \t\n\r\f/>=\"'<", s[i]) < 0 {
+		i++
+	}
+	return s[:i]
+}
+
+func readHTMLAttributeValue(s string) (value, rest string) {
+	if s == "" {
+		return "", ""
+	}
+	if quote := s[0]; quote == '"' || quote == '\'' {
+		s = s[1:]
+		if end := strings.IndexByte(s, quote); end >= 0 {
+			return s[:end], s[end+1:]
+		}
+		return s, ""
+	}
+	end := strings.IndexAny(s, " \t\n\r\f>")
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// xssTags are the tags allowing to execute scripts or load external content.
+var xssTags = map[string]struct{}{
+	"script":   {},
+	"iframe":   {},
+	"frame":    {},
+	"frameset": {},
+	"object":   {},
+	"embed":    {},
+	"applet":   {},
+	"base":     {},
+	"link":     {},
+	"meta":     {},
+	"style":    {},
+	"xml":      {},
+	"import":   {},
+}
+
+// xssURLAttributes are the attributes whose value is a URL.
+var xssURLAttributes = map[string]struct{}{
+	"href":       {},
+	"src":        {},
+	"action":     {},
+	"formaction": {},
+	"data":       {},
+	"xlink:href": {},
+	"background": {},
+	"dynsrc":     {},
+	"lowsrc":     {},
+	"poster":     {},
+}
+
+// xssEventHandlers are the most common event handler names, without their
+// `on` prefix.
+var xssEventHandlers = map[string]struct{}{
+	"abort":          {},
+	"animationstart": {},
+	"animationend":   {},
+	"blur":           {},
+	"change":         {},
+	"click":          {},
+	"contextmenu":    {},
+	"dblclick":       {},
+	"drag":           {},
+	"drop":           {},
+	"error":          {},
+	"focus":          {},
+	"focusin":        {},
+	"hashchange":     {},
+	"input":          {},
+	"keydown":        {},
+	"keypress":       {},
+	"keyup":          {},
+	"load":           {},
+	"mousedown":      {},
+	"mouseenter":     {},
+	"mouseleave":     {},
+	"mousemove":      {},
+	"mouseout":       {},
+	"mouseover":      {},
+	"mouseup":        {},
+	"pageshow":       {},
+	"pointerdown":    {},
+	"pointerenter":   {},
+	"pointerover":    {},
+	"resize":         {},
+	"scroll":         {},
+	"select":         {},
+	"submit":         {},
+	"toggle":         {},
+	"transitionend":  {},
+	"unload":         {},
+	"wheel":          {},
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+)
+
+// Maximum number of request traces kept by the agent for the trace handler.
+const maxStoredTraces = 100
+
+// traceStore keeps the most recent request traces so that they can be
+// retrieved by their ID. The oldest trace is dropped when the store is full.
+type traceStore struct {
+	lock   sync.Mutex
+	traces map[string]*api.RequestRecord_Observed_Trace
+	// ids is the ring buffer of the stored trace IDs in insertion order.
+	ids  []string
+	next int
+}
+
+func newTraceStore(size int) *traceStore {
+	return &traceStore{
+		traces: make(map[string]*api.RequestRecord_Observed_Trace, size),
+		ids:    make([]string, size),
+	}
+}
+
+func (s *traceStore) add(trace *api.RequestRecord_Observed_Trace) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, exists := s.traces[trace.Id]; exists {
+		s.traces[trace.Id] = trace
+		return
+	}
+	if old := s.ids[s.next]; old != "" {
+		delete(s.traces, old)
+	}
+	s.ids[s.next] = trace.Id
+	s.next = (s.next + 1) % len(s.ids)
+	s.traces[trace.Id] = trace
+}
+
+func (s *traceStore) get(id string) *api.RequestRecord_Observed_Trace {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.traces[id]
+}
+
+// TraceHandler returns the HTTP handler responding with the JSON request trace
+// whose ID is given by the `id` query parameter.
+func TraceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent := agentInstance.get()
+		if agent == nil || agent.traces == nil {
+			http.Error(w, "agent not running", http.StatusServiceUnavailable)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "missing trace id", http.StatusBadRequest)
+			return
+		}
+		trace := agent.traces.get(id)
+		if trace == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(trace); err != nil {
+			agent.logger.Debugf("trace handler: could not write trace `%s`: %v", id, err)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+// Package callback allows applications to register native Go callbacks that
+// security rules can reference by name in their native callback class, along
+// with the built-in ones. They are much faster than JavaScript callbacks and
+// allow to write custom protections of the functions instrumented by Sqreen.
+//
+// A callback constructor is called for every rule referencing it, with the
+// rule context and configuration, and returns the prolog function of the
+// hooked function. Given a hooked function F:
+//
+//	func F(A, B, C) (R, S, T)
+//
+// The expected prolog signature is:
+//
+//	func(*A, *B, *C) (epilog, error)
+//
+// The expected epilog signature is:
+//
+//	func(*R, *S, *T)
+//
+// The returned epilog value can be nil when there is no need for epilog. The
+// prolog and epilog must execute the callback code through the rule context
+// methods Pre() and Post() so that the rule middlewares, such as the rule
+// conditions, sampling and performance monitoring, are applied.
+package callback
+
+import (
+	"net"
+
+	"github.com/sqreen/go-agent/internal/event"
+	"github.com/sqreen/go-agent/internal/rule"
+	internal_callback "github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/sqlib/sqhook"
+)
+
+type (
+	// RuleContext is the context of the rule the callback is created for.
+	RuleContext interface {
+		// Pre executes the given function, from a prolog, with the rule
+		// middlewares.
+		Pre(pre CallbackFunc)
+		// Post executes the given function, from an epilog, with the rule
+		// middlewares.
+		Post(post CallbackFunc)
+	}
+
+	CallbackFunc = func(c CallbackContext) error
+
+	// CallbackContext is the context of a callback execution in a request.
+	CallbackContext interface {
+		// HandleAttack reports an attack of the rule with the given information
+		// which is sent along with the attack. The returned value is true when
+		// the rule is in blocking mode and the request should be blocked. In this
+		// case, the prolog should return AbortError.
+		HandleAttack(shouldBlock bool, info interface{}) (blocked bool)
+		// AddMetricsValue adds the value to the given key of the first metrics
+		// store of the rule.
+		AddMetricsValue(key interface{}, value uint64) (added bool)
+		// ClientIP returns the IP address of the client of the request.
+		ClientIP() net.IP
+		// AddRequestParam adds a request parameter seen by the callback so that
+		// it can be inspected by the other protections, such as the WAF.
+		AddRequestParam(name string, v interface{})
+		// TraceValue adds the given value to the execution trace of the request
+		// when it is traced.
+		TraceValue(name string, v interface{})
+		// Logger returns the logger of the rule.
+		Logger() Logger
+	}
+
+	Logger interface {
+		Debug(v ...interface{})
+		Debugf(format string, v ...interface{})
+		Error(err error)
+	}
+
+	// Config is the configuration of the rule the callback is created for.
+	Config interface {
+		// BlockingMode returns true when the rule is in blocking mode.
+		BlockingMode() bool
+		// Data returns the data entries of the rule.
+		Data() interface{}
+	}
+
+	// ConstructorFunc returns the prolog function of the given rule.
+	ConstructorFunc func(r RuleContext, cfg Config) (prolog interface{}, err error)
+)
+
+// AbortError is the error a prolog can return in order to abort the execution
+// of the hooked function by returning from it with the results set by its
+// epilog.
+const AbortError = sqhook.AbortError
+
+// Register registers the native callback constructor of the given name so that
+// rules can reference it as their native callback class. Built-in callback
+// names cannot be registered, and a name can only be registered once.
+// Callbacks should be registered in an `init()` function so that they are
+// available before the rules are loaded.
+//
+// Usage example:
+//
+//	func init() {
+//		err := callback.Register("MyProtection", func(r callback.RuleContext, cfg callback.Config) (interface{}, error) {
+//			return func(query *string) (func(*error), error) {
+//				var blocked bool
+//				r.Pre(func(c callback.CallbackContext) error {
+//					if isAttack(*query) {
+//						blocked = c.HandleAttack(true, map[string]string{"query": *query})
+//					}
+//					return nil
+//				})
+//				if blocked {
+//					return func(err *error) { *err = errors.New("blocked") }, callback.AbortError
+//				}
+//				return nil, nil
+//			}, nil
+//		})
+//		if err != nil {
+//			panic(err)
+//		}
+//	}
+//
+func Register(name string, ctor ConstructorFunc) error {
+	if ctor == nil {
+		return rule.RegisterNativeCallback(name, nil)
+	}
+	return rule.RegisterNativeCallback(name, func(r internal_callback.RuleContext, cfg internal_callback.NativeCallbackConfig) (sqhook.PrologCallback, error) {
+		return ctor(ruleContext{r}, cfg)
+	})
+}
+
+type ruleContext struct {
+	r internal_callback.RuleContext
+}
+
+func (r ruleContext) Pre(pre CallbackFunc) {
+	r.r.Pre(func(c internal_callback.CallbackContext) error {
+		return pre(callbackContext{c})
+	})
+}
+
+func (r ruleContext) Post(post CallbackFunc) {
+	r.r.Post(func(c internal_callback.CallbackContext) error {
+		return post(callbackContext{c})
+	})
+}
+
+type callbackContext struct {
+	c internal_callback.CallbackContext
+}
+
+func (c callbackContext) HandleAttack(shouldBlock bool, info interface{}) (blocked bool) {
+	return c.c.HandleAttack(shouldBlock, event.WithAttackInfo(info))
+}
+
+func (c callbackContext) AddMetricsValue(key interface{}, value uint64) (added bool) {
+	return c.c.AddMetricsValue(key, value)
+}
+
+func (c callbackContext) ClientIP() net.IP {
+	return c.c.ProtectionContext().ClientIP()
+}
+
+func (c callbackContext) AddRequestParam(name string, v interface{}) {
+	c.c.ProtectionContext().AddRequestParam(name, v)
+}
+
+func (c callbackContext) TraceValue(name string, v interface{}) {
+	internal_callback.TraceValue(c.c, name, v)
+}
+
+func (c callbackContext) Logger() Logger {
+	return c.c.Logger()
+}
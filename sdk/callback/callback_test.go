@@ -0,0 +1,69 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package callback
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sqreen/go-agent/internal/event"
+	internal_callback "github.com/sqreen/go-agent/internal/rule/callback"
+	"github.com/sqreen/go-agent/internal/rule/callback/_testlib/mockups"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	ctor := func(RuleContext, Config) (interface{}, error) { return nil, nil }
+	require.Error(t, Register("WAF", ctor))
+	require.Error(t, Register("MyCallback", nil))
+	require.NoError(t, Register("MySDKCallback", ctor))
+	require.Error(t, Register("MySDKCallback", ctor))
+}
+
+func TestRuleContext(t *testing.T) {
+	r := &mockups.NativeRuleContextMockup{}
+	defer r.AssertExpectations(t)
+	c := &mockups.CallbackContextMockup{}
+	defer c.AssertExpectations(t)
+	p := &mockups.ProtectionContextMockup{}
+	defer p.AssertExpectations(t)
+
+	// The public callback function is called with the internal callback context
+	// passed by the rule context.
+	run := func(args mock.Arguments) {
+		cb := args.Get(0).(func(internal_callback.CallbackContext) error)
+		require.NoError(t, cb(c))
+	}
+	r.ExpectPre(mock.Anything).Run(run).Once()
+	r.ExpectPost(mock.Anything).Run(run).Once()
+
+	ip := net.ParseIP("1.2.3.4")
+	c.ExpectProtectionContext().Return(p)
+	p.ExpectClientIP().Return(ip).Once()
+	p.ExpectAddRequestParam("my param", 33).Once()
+	c.ExpectAddMetricsValue("my key", uint64(1)).Return(true).Once()
+	c.ExpectHandleAttack(true, mock.MatchedBy(func(opts []event.AttackEventOption) bool {
+		var attack event.AttackEvent
+		for _, opt := range opts {
+			opt(&attack)
+		}
+		return len(opts) == 1 && attack.Info == "my info"
+	})).Return(true).Once()
+
+	rc := ruleContext{r}
+	rc.Pre(func(c CallbackContext) error {
+		require.Equal(t, ip, c.ClientIP())
+		c.AddRequestParam("my param", 33)
+		require.True(t, c.AddMetricsValue("my key", 1))
+		return nil
+	})
+	rc.Post(func(c CallbackContext) error {
+		require.True(t, c.HandleAttack(true, "my info"))
+		// Not traced
+		c.TraceValue("my value", 33)
+		return nil
+	})
+}
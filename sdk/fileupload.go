@@ -0,0 +1,32 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+//sqreen:ignore
+
+package sdk
+
+import (
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+	"github.com/sqreen/go-agent/sdk/types"
+)
+
+// SetFileUploadScanner sets the content scanner of the files uploaded in
+// multipart/form-data request bodies. It is called by the file upload
+// protection, when enabled, once the request body was entirely read by the
+// request handler. Uploaded files reported by the scanner are handled like
+// any other attack of the protection and can therefore be blocked. A nil
+// scanner removes the current one.
+//
+// Usage example:
+//
+//	sdk.SetFileUploadScanner(types.FileUploadScannerFunc(func(ctx context.Context, upload *types.FileUpload, content io.Reader) error {
+//		if virus := antivirus.Scan(ctx, content); virus != "" {
+//			return fmt.Errorf("virus `%s` found", virus)
+//		}
+//		return nil
+//	}))
+//
+func SetFileUploadScanner(scanner types.FileUploadScanner) {
+	http_protection.SetFileUploadScanner(scanner)
+}
@@ -142,6 +142,9 @@ func NewHTTPProtectionConfigMockup() *HTTPProtectionConfigMockup {
 	m := &HTTPProtectionConfigMockup{}
 	m.ExpectHTTPClientIPHeader().Return("").Maybe()
 	m.ExpectHTTPClientIPHeaderFormat().Return("").Maybe()
+	m.ExpectHTTPResponseBodyMaxSize().Return(0).Maybe()
+	m.ExpectHTTPResponseBodyContentTypes().Return(nil).Maybe()
+	m.ExpectRuleTraceSecret().Return("").Maybe()
 	return m
 }
 
@@ -160,3 +163,28 @@ func (c *HTTPProtectionConfigMockup) HTTPClientIPHeaderFormat() string {
 func (c *HTTPProtectionConfigMockup) ExpectHTTPClientIPHeaderFormat() *mock.Call {
 	return c.On("HTTPClientIPHeaderFormat")
 }
+
+func (c *HTTPProtectionConfigMockup) HTTPResponseBodyMaxSize() int {
+	return c.Called().Int(0)
+}
+
+func (c *HTTPProtectionConfigMockup) ExpectHTTPResponseBodyMaxSize() *mock.Call {
+	return c.On("HTTPResponseBodyMaxSize")
+}
+
+func (c *HTTPProtectionConfigMockup) HTTPResponseBodyContentTypes() []string {
+	v, _ := c.Called().Get(0).([]string)
+	return v
+}
+
+func (c *HTTPProtectionConfigMockup) ExpectHTTPResponseBodyContentTypes() *mock.Call {
+	return c.On("HTTPResponseBodyContentTypes")
+}
+
+func (c *HTTPProtectionConfigMockup) RuleTraceSecret() string {
+	return c.Called().String(0)
+}
+
+func (c *HTTPProtectionConfigMockup) ExpectRuleTraceSecret() *mock.Call {
+	return c.On("RuleTraceSecret")
+}
@@ -59,6 +59,22 @@ func Middleware(next http.Handler) http.Handler {
 		middlewareHandlerFromRootProtectionContext(ctx, next, w, r)
 	})
 }
+
+// TraceHandler returns the HTTP handler responding with the JSON execution
+// trace of the rules in a traced request, whose ID is given by the `id` query
+// parameter. A request is traced either with `sdk.EnableTrace()` or
+// with the request header `X-Sqreen-Trace` signed with the rule trace secret of
+// the agent configuration. The trace ID is returned in the response header
+// `X-Sqreen-Trace-Id`. The agent keeps the last 100 traces.
+//
+// Traces contain request data seen by the rules, so this handler must only be
+// mounted behind an authentication layer. For example:
+//
+//	mux.Handle("/debug/sqreen/trace", myAuth(sqhttp.TraceHandler()))
+func TraceHandler() http.Handler {
+	return internal.TraceHandler()
+}
+
 func middlewareHandlerFromRootProtectionContext(ctx types.RootProtectionContext, next http.Handler, w http.ResponseWriter, r *http.Request) {
 	// requestReader is a pointer value in order to change the inner request
 	// pointer with the new one created by http.(*Request).WithContext below
@@ -71,9 +87,18 @@ func middlewareHandlerFromRootProtectionContext(ctx types.RootProtectionContext,
 	}
 
 	defer func() {
+		responseWriterObserver.closeBody()
 		p.Close(newObservedResponse(responseWriterObserver))
 	}()
 
+	// Let the protection context observe what the handler writes
+	responseWriterObserver.bodyObserver = p
+	if cfg := p.Config(); cfg != nil {
+		if maxSize := cfg.HTTPResponseBodyMaxSize(); maxSize > 0 {
+			responseWriterObserver.bodyBuffer = newResponseBodyBuffer(p, maxSize, cfg.HTTPResponseBodyContentTypes())
+		}
+	}
+
 	middlewareHandlerFromProtectionContext(p, next, responseWriter, requestReader)
 }
 
@@ -182,8 +207,14 @@ func (r *requestReaderImpl) RemoteAddr() string {
 
 type responseWriterObserver struct {
 	http.ResponseWriter
-	status  int
-	written int
+	status       int
+	written      int
+	bodyObserver responseBodyObserver
+	bodyBuffer   *responseBodyBuffer
+}
+
+type responseBodyObserver interface {
+	ObserveResponseWrite(body []byte) error
 }
 
 // response observed by the response writer
@@ -233,6 +264,22 @@ func (w *responseWriterObserver) Header() http.Header {
 }
 
 func (w *responseWriterObserver) Write(b []byte) (int, error) {
+	if w.bodyObserver != nil {
+		if err := w.bodyObserver.ObserveResponseWrite(b); err != nil {
+			// Do not write the body chunk rejected by the protection
+			return 0, err
+		}
+	}
+	if w.bodyBuffer != nil {
+		buffered, err := w.bodyBuffer.write(w.ResponseWriter, b)
+		if err != nil {
+			return 0, err
+		}
+		if buffered {
+			w.written += len(b)
+			return len(b), nil
+		}
+	}
 	written, err := w.ResponseWriter.Write(b)
 	if err == nil {
 		w.written += written
@@ -242,5 +289,29 @@ func (w *responseWriterObserver) Write(b []byte) (int, error) {
 
 func (w *responseWriterObserver) WriteHeader(statusCode int) {
 	w.status = statusCode
+	if w.bodyBuffer != nil && w.bodyBuffer.writeHeader(statusCode) {
+		return
+	}
 	w.ResponseWriter.WriteHeader(statusCode)
 }
+
+// flush writes the response body buffered, if any, before the response gets
+// flushed.
+func (w *responseWriterObserver) flush() {
+	if w.bodyBuffer == nil {
+		return
+	}
+	_ = w.bodyBuffer.flush(w.ResponseWriter)
+}
+
+// closeBody inspects and writes the response body buffered, if any.
+func (w *responseWriterObserver) closeBody() {
+	if w.bodyBuffer == nil {
+		return
+	}
+	// The buffered bytes were accounted as written, while the actual amount of
+	// written bytes is only known once closed.
+	buffered := w.bodyBuffer.buf.Len()
+	written, _ := w.bodyBuffer.close(w.ResponseWriter)
+	w.written += written - buffered
+}
@@ -6,6 +6,7 @@ package sqhttp
 
 import (
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -417,3 +418,260 @@ func TestRequestReaderImpl(t *testing.T) {
 		})
 	})
 }
+
+type responseBodyObserverFunc func(body []byte) error
+
+func (f responseBodyObserverFunc) ObserveResponseWrite(body []byte) error { return f(body) }
+
+func TestResponseWriterObserver(t *testing.T) {
+	t.Run("no body observer", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := &responseWriterObserver{ResponseWriter: rec}
+
+		n, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+		require.Equal(t, 5, w.written)
+		require.Equal(t, "hello", rec.Body.String())
+	})
+
+	t.Run("allowed body write", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		var observed []byte
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyObserver: responseBodyObserverFunc(func(body []byte) error {
+				observed = body
+				return nil
+			}),
+		}
+
+		n, err := w.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+		require.Equal(t, []byte("hello"), observed)
+		require.Equal(t, "hello", rec.Body.String())
+	})
+
+	t.Run("rejected body write", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		expectedErr := errors.New("rejected")
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyObserver: responseBodyObserverFunc(func([]byte) error {
+				return expectedErr
+			}),
+		}
+
+		n, err := w.Write([]byte("hello"))
+		require.Equal(t, expectedErr, err)
+		require.Equal(t, 0, n)
+		require.Equal(t, 0, w.written)
+		require.Empty(t, rec.Body.String())
+	})
+
+	t.Run("string and reader writes", func(t *testing.T) {
+		var observed []string
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			w, observer := wrapResponseWriter(rw)
+			observer.bodyObserver = responseBodyObserverFunc(func(body []byte) error {
+				observed = append(observed, string(body))
+				return nil
+			})
+			_, err := io.WriteString(w, "hello")
+			require.NoError(t, err)
+			// The limit reader has no WriteTo method so that io.Copy() uses the
+			// ReadFrom method of the response writer.
+			_, err = io.Copy(w, io.LimitReader(strings.NewReader(" world"), 6))
+			require.NoError(t, err)
+			require.Equal(t, 11, observer.written)
+		}))
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(body))
+		require.Equal(t, "hello world", strings.Join(observed, ""))
+	})
+}
+
+type responseBodyInspectorFunc func(body []byte) ([]byte, error)
+
+func (f responseBodyInspectorFunc) InspectResponseBody(body []byte) ([]byte, error) {
+	return f(body)
+}
+
+func TestResponseBodyBuffer(t *testing.T) {
+	contentTypes := []string{"text/html", "application/json"}
+
+	t.Run("inspected response body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		var inspected []byte
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyBuffer: newResponseBodyBuffer(responseBodyInspectorFunc(func(body []byte) ([]byte, error) {
+				inspected = append([]byte(nil), body...)
+				return []byte(`{"masked":true}`), nil
+			}), 1024, contentTypes),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "22")
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"secret":`))
+		require.NoError(t, err)
+		_, err = w.Write([]byte(`"my secret"}`))
+		require.NoError(t, err)
+
+		// Nothing should have been written yet
+		require.False(t, rec.Flushed)
+		require.Empty(t, rec.Body.String())
+		require.Equal(t, 22, w.written)
+
+		w.closeBody()
+		require.Equal(t, `{"secret":"my secret"}`, string(inspected))
+		require.Equal(t, http.StatusCreated, rec.Code)
+		require.Equal(t, `{"masked":true}`, rec.Body.String())
+		require.Equal(t, "15", rec.Header().Get("Content-Length"))
+		require.Equal(t, 15, w.written)
+	})
+
+	t.Run("blocked response body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := &responseWriterObserver{ResponseWriter: rec}
+		w.bodyBuffer = newResponseBodyBuffer(responseBodyInspectorFunc(func(body []byte) ([]byte, error) {
+			// Write a blocking response the same way the protection does
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("blocked"))
+			return nil, errors.New("blocked")
+		}), 1024, contentTypes)
+
+		_, err := w.Write([]byte(`<html>leak</html>`))
+		require.NoError(t, err)
+		w.closeBody()
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+		require.Equal(t, "blocked", rec.Body.String())
+		require.Equal(t, 7, w.written)
+	})
+
+	t.Run("not inspected content type", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyBuffer: newResponseBodyBuffer(responseBodyInspectorFunc(func([]byte) ([]byte, error) {
+				t.Fatal("unexpected call")
+				return nil, nil
+			}), 1024, contentTypes),
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusAccepted)
+		_, err := w.Write([]byte("png"))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.Equal(t, "png", rec.Body.String())
+		w.closeBody()
+		require.Equal(t, "png", rec.Body.String())
+	})
+
+	t.Run("too large response body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyBuffer: newResponseBodyBuffer(responseBodyInspectorFunc(func([]byte) ([]byte, error) {
+				t.Fatal("unexpected call")
+				return nil, nil
+			}), 8, contentTypes),
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		_, err := w.Write([]byte("<html>"))
+		require.NoError(t, err)
+		require.Empty(t, rec.Body.String())
+		_, err = w.Write([]byte("</html>"))
+		require.NoError(t, err)
+		require.Equal(t, "<html></html>", rec.Body.String())
+		w.closeBody()
+		require.Equal(t, "<html></html>", rec.Body.String())
+		require.Equal(t, 13, w.written)
+	})
+
+	t.Run("flushed response", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w, observer := wrapResponseWriter(rec)
+		observer.bodyBuffer = newResponseBodyBuffer(responseBodyInspectorFunc(func([]byte) ([]byte, error) {
+			t.Fatal("unexpected call")
+			return nil, nil
+		}), 1024, contentTypes)
+
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte("<html>"))
+		require.NoError(t, err)
+		require.Empty(t, rec.Body.String())
+
+		flusher, ok := w.(http.Flusher)
+		require.True(t, ok)
+		flusher.Flush()
+		require.True(t, rec.Flushed)
+		require.Equal(t, http.StatusCreated, rec.Code)
+		require.Equal(t, "<html>", rec.Body.String())
+
+		// No longer buffered
+		_, err = w.Write([]byte("</html>"))
+		require.NoError(t, err)
+		require.Equal(t, "<html></html>", rec.Body.String())
+		observer.closeBody()
+		require.Equal(t, "<html></html>", rec.Body.String())
+		require.Equal(t, 13, observer.written)
+	})
+
+	t.Run("string and reader writes", func(t *testing.T) {
+		var inspected []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			w, observer := wrapResponseWriter(rw)
+			observer.bodyBuffer = newResponseBodyBuffer(responseBodyInspectorFunc(func(body []byte) ([]byte, error) {
+				inspected = append([]byte(nil), body...)
+				return body, nil
+			}), 1024, contentTypes)
+
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusCreated)
+			_, err := w.Write([]byte("<html>"))
+			require.NoError(t, err)
+			_, err = io.WriteString(w, "<body>")
+			require.NoError(t, err)
+			// The limit reader has no WriteTo method so that io.Copy() uses the
+			// ReadFrom method of the response writer.
+			_, err = io.Copy(w, io.LimitReader(strings.NewReader("</body></html>"), 14))
+			require.NoError(t, err)
+			observer.closeBody()
+		}))
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+		require.Equal(t, "<html><body></body></html>", string(body))
+		require.Equal(t, "<html><body></body></html>", string(inspected))
+	})
+
+	t.Run("no response body", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := &responseWriterObserver{
+			ResponseWriter: rec,
+			bodyBuffer:     newResponseBodyBuffer(nil, 8, contentTypes),
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		w.closeBody()
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.Empty(t, rec.Body.String())
+	})
+}
@@ -1092,3 +1092,408 @@ func adaptResponseWriter(wrapper, wrapped http.ResponseWriter) http.ResponseWrit
 		return wrapper
 	}
 }
+
+// The flush methods of the adapters let the wrapper write what it held back
+// before flushing the wrapped response writer.
+
+type flushObserver interface {
+	flush()
+}
+
+func flushResponseWriter(wrapper http.ResponseWriter, flusher http.Flusher) {
+	if w, ok := wrapper.(flushObserver); ok {
+		w.flush()
+	}
+	flusher.Flush()
+}
+
+func (w flusherPusherCloseNotifierHijackerReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierHijackerReaderFromStringWriter)
+}
+
+func (w flusherCloseNotifierHijackerReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierHijackerReaderFromStringWriter)
+}
+
+func (w flusherPusherCloseNotifierHijackerStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierHijackerStringWriter)
+}
+
+func (w flusherPusherHijackerReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherHijackerReaderFromStringWriter)
+}
+
+func (w flusherPusherCloseNotifierReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierReaderFromStringWriter)
+}
+
+func (w flusherPusherCloseNotifierHijackerReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierHijackerReaderFrom)
+}
+
+func (w flusherPusherCloseNotifierReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierReaderFrom)
+}
+
+func (w flusherHijackerReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherHijackerReaderFromStringWriter)
+}
+
+func (w flusherPusherCloseNotifierHijacker) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierHijacker)
+}
+
+func (w flusherPusherHijackerStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherHijackerStringWriter)
+}
+
+func (w flusherCloseNotifierReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierReaderFromStringWriter)
+}
+
+func (w flusherPusherReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherReaderFromStringWriter)
+}
+
+func (w flusherCloseNotifierHijackerReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierHijackerReaderFrom)
+}
+
+func (w flusherPusherHijackerReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherHijackerReaderFrom)
+}
+
+func (w flusherCloseNotifierHijackerStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierHijackerStringWriter)
+}
+
+func (w flusherPusherCloseNotifierStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifierStringWriter)
+}
+
+func (w flusherCloseNotifierReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierReaderFrom)
+}
+
+func (w flusherReaderFromStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherReaderFromStringWriter)
+}
+
+func (w flusherPusherReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherReaderFrom)
+}
+
+func (w flusherHijackerStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherHijackerStringWriter)
+}
+
+func (w flusherHijackerReaderFrom) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherHijackerReaderFrom)
+}
+
+func (w flusherCloseNotifierHijacker) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierHijacker)
+}
+
+func (w flusherPusherStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherStringWriter)
+}
+
+func (w flusherPusherHijacker) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherHijacker)
+}
+
+func (w flusherCloseNotifierStringWriter) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifierStringWriter)
+}
+
+func (w flusherPusherCloseNotifier) Flush() {
+	flushResponseWriter(w.ResponseWriter, w.FlusherPusherCloseNotifier)
+}
+
+func (w flusherPusher) Flush() { flushResponseWriter(w.ResponseWriter, w.FlusherPusher) }
+
+func (w flusherStringWriter) Flush() { flushResponseWriter(w.ResponseWriter, w.FlusherStringWriter) }
+
+func (w flusherReaderFrom) Flush() { flushResponseWriter(w.ResponseWriter, w.FlusherReaderFrom) }
+
+func (w flusherCloseNotifier) Flush() { flushResponseWriter(w.ResponseWriter, w.FlusherCloseNotifier) }
+
+func (w flusherHijacker) Flush() { flushResponseWriter(w.ResponseWriter, w.FlusherHijacker) }
+
+func (w flusher) Flush() { flushResponseWriter(w.ResponseWriter, w.Flusher) }
+
+// The string writer and reader-from methods of the adapters write through the
+// wrapper so that the response body is observed. Otherwise, the methods of the
+// wrapped response writer would write the response body behind the wrapper's
+// back.
+
+func writeStringResponseWriter(wrapper http.ResponseWriter, s string) (int, error) {
+	return wrapper.Write([]byte(s))
+}
+
+// writerOnly hides the ReadFrom method of the wrapper so that io.Copy() calls
+// its Write method.
+type writerOnly struct {
+	io.Writer
+}
+
+func readFromResponseWriter(wrapper http.ResponseWriter, r io.Reader) (int64, error) {
+	return io.Copy(writerOnly{wrapper}, r)
+}
+
+func (w flusherPusherCloseNotifierHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherCloseNotifierHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherCloseNotifierHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherCloseNotifierHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherCloseNotifierReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherCloseNotifierHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w closeNotifierHijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherCloseNotifierReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherCloseNotifierReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherCloseNotifierHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherCloseNotifierStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w closeNotifierReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherCloseNotifierStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherCloseNotifierStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w closeNotifierHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherHijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w hijackerReaderFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w closeNotifierStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w pusherStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w readerFromStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w hijackerStringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w stringWriter) WriteString(s string) (int, error) {
+	return writeStringResponseWriter(w.ResponseWriter, s)
+}
+
+func (w flusherPusherCloseNotifierHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherCloseNotifierHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherCloseNotifierHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherCloseNotifierReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherCloseNotifierHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherCloseNotifierReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w closeNotifierHijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherCloseNotifierReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherCloseNotifierReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherCloseNotifierHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherCloseNotifierHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherCloseNotifierReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherCloseNotifierReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w closeNotifierHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherPusherReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w closeNotifierReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherHijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w hijackerReaderFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w readerFromStringWriter) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w hijackerReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w closeNotifierReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w pusherReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w flusherReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
+
+func (w readerFrom) ReadFrom(r io.Reader) (int64, error) {
+	return readFromResponseWriter(w.ResponseWriter, r)
+}
@@ -5,7 +5,10 @@
 package sqhttp
 
 import (
+	"bytes"
+	"mime"
 	"net/http"
+	"strconv"
 )
 
 func wrapResponseWriter(w http.ResponseWriter) (http.ResponseWriter, *responseWriterObserver) {
@@ -13,3 +16,166 @@ func wrapResponseWriter(w http.ResponseWriter) (http.ResponseWriter, *responseWr
 	w = adaptResponseWriter(wrapper, w)
 	return w, wrapper
 }
+
+type responseBodyInspector interface {
+	InspectResponseBody(body []byte) ([]byte, error)
+}
+
+type responseBodyBufferState int
+
+const (
+	// The response body buffering is not decided yet until the first body
+	// write.
+	responseBodyBufferUndecided responseBodyBufferState = iota
+	// The response body is being buffered.
+	responseBodyBuffering
+	// The response body is not buffered because of its content type or size.
+	responseBodyPassthrough
+)
+
+// responseBodyBuffer holds back the response body written by the handler so
+// that it can be inspected as a whole before being actually sent. The response
+// status code is also held back as the response header can no longer be
+// modified once written.
+// Flushing the response using the http.Flusher interface stops the buffering
+// and writes what was held back so far, as the handler expects the response to
+// be sent. The string writer and reader-from methods of the response writer
+// adapters also write through the buffer (cf. adaptResponseWriter()).
+type responseBodyBuffer struct {
+	inspector    responseBodyInspector
+	maxSize      int
+	contentTypes []string
+
+	state  responseBodyBufferState
+	buf    bytes.Buffer
+	status int
+}
+
+func newResponseBodyBuffer(inspector responseBodyInspector, maxSize int, contentTypes []string) *responseBodyBuffer {
+	return &responseBodyBuffer{
+		inspector:    inspector,
+		maxSize:      maxSize,
+		contentTypes: contentTypes,
+	}
+}
+
+// writeHeader holds back the status code while the response body can be
+// buffered. It returns false when the status code should be written instead.
+func (b *responseBodyBuffer) writeHeader(statusCode int) (held bool) {
+	if b.state == responseBodyPassthrough {
+		return false
+	}
+	b.status = statusCode
+	return true
+}
+
+// write buffers the given response body chunk when possible. It returns false
+// when the chunk should be written instead.
+func (b *responseBodyBuffer) write(w http.ResponseWriter, body []byte) (buffered bool, err error) {
+	if b.state == responseBodyBufferUndecided {
+		b.state = b.decide(w.Header(), body)
+	}
+
+	if b.state == responseBodyBuffering {
+		if b.buf.Len()+len(body) <= b.maxSize {
+			b.buf.Write(body)
+			return true, nil
+		}
+		// Too large to be inspected: write what was held back so far and let the
+		// rest pass through.
+		b.state = responseBodyPassthrough
+		if _, err := b.writeHeldBack(w, b.buf.Bytes()); err != nil {
+			return false, err
+		}
+		b.buf = bytes.Buffer{}
+		return false, nil
+	}
+
+	b.writeHeldBackHeader(w)
+	return false, nil
+}
+
+// flush writes what was held back so far and lets the rest of the response pass
+// through, without inspecting it.
+func (b *responseBodyBuffer) flush(w http.ResponseWriter) error {
+	buffered := b.state == responseBodyBuffering
+	b.state = responseBodyPassthrough
+	if !buffered {
+		b.writeHeldBackHeader(w)
+		return nil
+	}
+	_, err := b.writeHeldBack(w, b.buf.Bytes())
+	b.buf = bytes.Buffer{}
+	return err
+}
+
+func (b *responseBodyBuffer) decide(header http.Header, body []byte) responseBodyBufferState {
+	if cl := header.Get("Content-Length"); cl != "" {
+		if l, err := strconv.ParseInt(cl, 10, 0); err == nil && l > int64(b.maxSize) {
+			return responseBodyPassthrough
+		}
+	}
+
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		// Same as net/http when no content-type was set
+		ct = http.DetectContentType(body)
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return responseBodyPassthrough
+	}
+	for _, expected := range b.contentTypes {
+		if mt == expected {
+			return responseBodyBuffering
+		}
+	}
+	return responseBodyPassthrough
+}
+
+// close inspects the buffered response body, if any, and writes what was held
+// back. It returns the number of response body bytes written. Nothing is
+// written when the response got blocked by the inspection, as the blocking
+// response was written instead.
+func (b *responseBodyBuffer) close(w http.ResponseWriter) (written int, err error) {
+	if b.state != responseBodyBuffering {
+		b.state = responseBodyPassthrough
+		b.writeHeldBackHeader(w)
+		return 0, nil
+	}
+
+	// From now on, writes are no longer held back, including those of the
+	// protections, such as blocking responses.
+	b.state = responseBodyPassthrough
+
+	// The content-length may no longer be valid after the inspection.
+	header := w.Header()
+	contentLength := header.Get("Content-Length")
+	header.Del("Content-Length")
+
+	body, err := b.inspector.InspectResponseBody(b.buf.Bytes())
+	b.buf = bytes.Buffer{}
+	if err != nil {
+		return 0, err
+	}
+
+	if contentLength != "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return b.writeHeldBack(w, body)
+}
+
+func (b *responseBodyBuffer) writeHeldBackHeader(w http.ResponseWriter) {
+	if status := b.status; status != 0 {
+		b.status = 0
+		w.WriteHeader(status)
+	}
+}
+
+func (b *responseBodyBuffer) writeHeldBack(w http.ResponseWriter, body []byte) (written int, err error) {
+	b.writeHeldBackHeader(w)
+	if len(body) == 0 {
+		return 0, nil
+	}
+	return w.Write(body)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package sqwebsocket provides the protection of the WebSocket connections
+// upgraded from requests protected by one of Sqreen's middleware functions.
+// Every inbound data message is inspected by the security protections, such
+// as the In-App WAF, for the lifetime of the connection. When a message gets
+// blocked, the connection is closed with the policy violation close status.
+//
+// Connections of github.com/gorilla/websocket can be directly wrapped using
+// WrapGorillaConn(), while any other WebSocket library can be protected using
+// NewConn() and Conn.InspectMessage(). For example, with nhooyr.io/websocket:
+//
+//	c, err := websocket.Accept(w, r, nil)
+//	if err != nil {
+//		return
+//	}
+//	protection := sqwebsocket.NewConn(r.Context(), c.Subprotocol(), func(code int, reason string) error {
+//		return c.Close(websocket.StatusCode(code), reason)
+//	})
+//	for {
+//		typ, msg, err := c.Read(ctx)
+//		if err != nil {
+//			return
+//		}
+//		if err := protection.InspectMessage(int(typ), msg); err != nil {
+//			// Blocked message: the connection was closed.
+//			return
+//		}
+//		// ...
+//	}
+//
+package sqwebsocket
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	protection_context "github.com/sqreen/go-agent/internal/protection/context"
+	http_protection "github.com/sqreen/go-agent/internal/protection/http"
+)
+
+// Conn is the protection of a WebSocket connection. Its methods are no-ops when
+// nil, ie. when the connection is not protected.
+type Conn struct {
+	p *http_protection.WebSocketProtectionContext
+}
+
+// NewConn returns the protection of the WebSocket connection upgraded from the
+// request whose context is given. The subprotocol is the one negotiated during
+// the upgrade, and the close function must close the connection with the given
+// close status code and reason. Nil is returned when the request is not
+// protected by Sqreen.
+func NewConn(ctx context.Context, subprotocol string, close func(code int, reason string) error) *Conn {
+	p := fromContext(ctx)
+	if p == nil {
+		return nil
+	}
+	ws, err := p.NewWebSocketProtectionContext(subprotocol, close)
+	if err != nil {
+		return nil
+	}
+	return &Conn{p: ws}
+}
+
+func fromContext(ctx context.Context) *http_protection.ProtectionContext {
+	if ctx == nil {
+		return nil
+	}
+	v := ctx.Value(protection_context.ContextKey)
+	if v == nil {
+		// Try with a string since frameworks such as Gin implement it with keys of
+		// type string.
+		v = ctx.Value(protection_context.ContextKey.String)
+	}
+	p, _ := v.(*http_protection.ProtectionContext)
+	return p
+}
+
+// InspectMessage runs the security protections of the given inbound message.
+// The message type is the RFC 6455 opcode of the message, used by most Go
+// WebSocket libraries: 1 for text messages and 2 for binary messages. Other
+// message types are ignored. When a non-nil error is returned, the message was
+// blocked and the connection closed: the message must be dropped and the
+// connection no longer used.
+func (c *Conn) InspectMessage(messageType int, data []byte) error {
+	if c == nil {
+		return nil
+	}
+	switch t := http_protection.WebSocketMessageType(messageType); t {
+	case http_protection.WebSocketTextMessage, http_protection.WebSocketBinaryMessage:
+		return c.p.InspectMessage(t, data)
+	default:
+		return nil
+	}
+}
+
+// GorillaConn is the subset of the methods of github.com/gorilla/websocket's
+// connections used by the protection.
+type GorillaConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+	Subprotocol() string
+}
+
+// ProtectedGorillaConn is a gorilla/websocket connection whose inbound messages
+// read using ReadMessage() are inspected by the security protections. The
+// underlying connection can be retrieved using the embedded GorillaConn
+// interface value.
+type ProtectedGorillaConn struct {
+	GorillaConn
+	protection *Conn
+}
+
+// WrapGorillaConn returns the protected connection of the given
+// gorilla/websocket connection upgraded from the request whose context is
+// given.
+//
+// Usage example:
+//
+//	var upgrader = websocket.Upgrader{}
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		c, err := upgrader.Upgrade(w, r, nil)
+//		if err != nil {
+//			return
+//		}
+//		conn := sqwebsocket.WrapGorillaConn(r.Context(), c)
+//		defer conn.Close()
+//		for {
+//			typ, msg, err := conn.ReadMessage()
+//			if err != nil {
+//				// Including blocked messages
+//				return
+//			}
+//			// ...
+//		}
+//	}
+//
+func WrapGorillaConn(ctx context.Context, conn GorillaConn) *ProtectedGorillaConn {
+	return &ProtectedGorillaConn{
+		GorillaConn: conn,
+		protection: NewConn(ctx, conn.Subprotocol(), func(code int, reason string) error {
+			return closeGorillaConn(conn, code, reason)
+		}),
+	}
+}
+
+// ReadMessage reads the next message of the connection and inspects it. When a
+// message gets blocked, the connection is closed and a non-nil error is
+// returned.
+func (c *ProtectedGorillaConn) ReadMessage() (messageType int, p []byte, err error) {
+	messageType, p, err = c.GorillaConn.ReadMessage()
+	if err != nil {
+		return messageType, p, err
+	}
+	if err := c.protection.InspectMessage(messageType, p); err != nil {
+		return messageType, nil, err
+	}
+	return messageType, p, nil
+}
+
+// gorillaCloseMessage is gorilla/websocket's close control message type.
+const gorillaCloseMessage = 8
+
+// closeGorillaConn performs the WebSocket closing handshake by sending a close
+// message with the given status code and reason, before closing the connection.
+func closeGorillaConn(conn GorillaConn, code int, reason string) error {
+	// The payload of close messages is the status code as a 2-byte unsigned
+	// integer in network byte order, followed by the reason.
+	msg := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(msg, uint16(code))
+	copy(msg[2:], reason)
+	writeErr := conn.WriteControl(gorillaCloseMessage, msg, time.Now().Add(time.Second))
+	if err := conn.Close(); err != nil {
+		return err
+	}
+	return writeErr
+}
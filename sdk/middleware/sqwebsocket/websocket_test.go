@@ -0,0 +1,82 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package sqwebsocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type gorillaConnMockup struct {
+	mock.Mock
+}
+
+func (c *gorillaConnMockup) ReadMessage() (int, []byte, error) {
+	ret := c.Called()
+	p, _ := ret.Get(1).([]byte)
+	return ret.Int(0), p, ret.Error(2)
+}
+
+func (c *gorillaConnMockup) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	return c.Called(messageType, data, deadline).Error(0)
+}
+
+func (c *gorillaConnMockup) Close() error {
+	return c.Called().Error(0)
+}
+
+func (c *gorillaConnMockup) Subprotocol() string {
+	return c.Called().String(0)
+}
+
+func TestGorillaConn(t *testing.T) {
+	t.Run("unprotected connection", func(t *testing.T) {
+		conn := &gorillaConnMockup{}
+		defer conn.AssertExpectations(t)
+		conn.On("Subprotocol").Return("").Once()
+		conn.On("ReadMessage").Return(1, []byte("hello"), nil).Once()
+		conn.On("ReadMessage").Return(-1, nil, errors.New("closed")).Once()
+
+		c := WrapGorillaConn(context.Background(), conn)
+		require.Nil(t, c.protection)
+
+		typ, msg, err := c.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, 1, typ)
+		require.Equal(t, []byte("hello"), msg)
+
+		_, _, err = c.ReadMessage()
+		require.Error(t, err)
+	})
+
+	t.Run("close handshake", func(t *testing.T) {
+		conn := &gorillaConnMockup{}
+		defer conn.AssertExpectations(t)
+		conn.On("WriteControl", gorillaCloseMessage, []byte{0x03, 0xF0, 'n', 'o'}, mock.Anything).Return(nil).Once()
+		conn.On("Close").Return(nil).Once()
+
+		require.NoError(t, closeGorillaConn(conn, 1008, "no"))
+	})
+}
+
+func TestConn(t *testing.T) {
+	t.Run("unprotected request", func(t *testing.T) {
+		c := NewConn(context.Background(), "", func(int, string) error {
+			t.Fatal("unexpected connection close")
+			return nil
+		})
+		require.Nil(t, c)
+		require.NoError(t, c.InspectMessage(1, []byte("hello")))
+	})
+
+	t.Run("nil context", func(t *testing.T) {
+		require.Nil(t, NewConn(nil, "", nil))
+	})
+}
@@ -87,9 +87,17 @@ type EventUserIdentifiersMap map[string]string
 //	}
 //
 func FromContext(ctx go_context.Context) Context {
-	if ctx == nil {
+	actual := eventRecorderFromContext(ctx)
+	if actual == nil {
 		return context{events: disabledEventRecorder{}}
 	}
+	return context{events: actual}
+}
+
+func eventRecorderFromContext(ctx go_context.Context) protection_context.EventRecorder {
+	if ctx == nil {
+		return nil
+	}
 
 	v := ctx.Value(protection_context.ContextKey)
 	if v == nil {
@@ -98,13 +106,8 @@ func FromContext(ctx go_context.Context) Context {
 		v = ctx.Value(protection_context.ContextKey.String)
 	}
 
-	actual, ok := v.(protection_context.EventRecorder)
-
-	if !ok || actual == nil {
-		return context{events: disabledEventRecorder{}}
-	}
-
-	return context{events: actual}
+	actual, _ := v.(protection_context.EventRecorder)
+	return actual
 }
 
 type Request interface {
@@ -116,6 +119,25 @@ func FromRequest(r Request) Context {
 	return FromContext(r.Context())
 }
 
+// EnableTrace enables the execution trace of Sqreen's rules in the request of
+// the given Go request context, for debugging purposes, and returns its trace
+// ID. The trace is attached to the request record and can be retrieved from
+// the trace handler of the agent (cf. `sqhttp.TraceHandler()`) using this ID,
+// which is also set in the `X-Sqreen-Trace-Id` response header when the
+// response headers were not written yet. Only the rules executed after the
+// call are traced. An empty string is returned when the request is not
+// protected.
+//
+//	traceID := sdk.EnableTrace(r.Context())
+//
+func EnableTrace(ctx go_context.Context) (traceID string) {
+	tracer, ok := eventRecorderFromContext(ctx).(protection_context.Tracer)
+	if !ok {
+		return ""
+	}
+	return tracer.EnableTrace()
+}
+
 // TrackEvent allows to track a custom security events with the given event name.
 // It creates a new event whose additional options can be set using the
 // returned value's methods, such as `WithProperties()` or
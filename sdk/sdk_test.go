@@ -317,6 +317,32 @@ func TestForUser(t *testing.T) {
 	})
 }
 
+func TestEnableTrace(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		require.Empty(t, sdk.EnableTrace(context.Background()))
+		require.Empty(t, sdk.EnableTrace(nil))
+	})
+
+	t.Run("not traceable", func(t *testing.T) {
+		ctx, _ := newMockups()
+		require.Empty(t, sdk.EnableTrace(ctx))
+	})
+
+	t.Run("traceable", func(t *testing.T) {
+		traceID := testlib.RandPrintableUSASCIIString(1, 32)
+		recorder := tracerMockup{EventRecorderMockup: &_testlib.EventRecorderMockup{}, traceID: traceID}
+		ctx := context.WithValue(context.Background(), protection_context.ContextKey, recorder)
+		require.Equal(t, traceID, sdk.EnableTrace(ctx))
+	})
+}
+
+type tracerMockup struct {
+	*_testlib.EventRecorderMockup
+	traceID string
+}
+
+func (t tracerMockup) EnableTrace() string { return t.traceID }
+
 func TestEventPropertyMap(t *testing.T) {
 	key := testlib.RandPrintableUSASCIIString(1, 100)
 	value := testlib.RandPrintableUSASCIIString(1, 100)
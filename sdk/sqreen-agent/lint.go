@@ -0,0 +1,103 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/lint"
+	"github.com/sqreen/go-agent/internal/replay"
+)
+
+func lintCommand(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n\tsqreen-agent lint [options] <rules.json>\n\n")
+		fmt.Fprintf(flags.Output(), "Lint checks the binding accessor expressions of the rules of the JSON file,\neither a rulespack object or an array of rules, against the capabilities the\nrules declare and the Go types of the functions they hook. The Go packages\nare read from the source code found from the directory, which must belong to\na Go module requiring the agent. It exits with code 1 when errors are found.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	var (
+		dir        = flags.String("dir", ".", "directory of the Go module the Go packages are imported from")
+		jsonOutput = flags.Bool("json", false, "print the problems in JSON")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var rulespack *api.RulesPackResponse
+	err := readFile(flags.Arg(0), func(r io.Reader) (err error) {
+		rulespack, err = replay.ReadRulesPack(r)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	problems, err := lint.NewLinter(*dir).Lint(rulespack.Rules)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if *jsonOutput {
+		err = printLintJSON(os.Stdout, problems)
+	} else {
+		err = printLintText(os.Stdout, problems)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	for _, p := range problems {
+		if !p.Warning {
+			return 1
+		}
+	}
+	return 0
+}
+
+func printLintJSON(w io.Writer, problems []lint.Problem) error {
+	if problems == nil {
+		problems = []lint.Problem{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(problems)
+}
+
+func printLintText(w io.Writer, problems []lint.Problem) error {
+	var errors, warnings int
+	for _, p := range problems {
+		severity := "error"
+		if p.Warning {
+			severity = "warning"
+			warnings++
+		} else {
+			errors++
+		}
+		location := p.Location
+		if p.Expression != "" {
+			location += ": `" + p.Expression + "`"
+		}
+		if _, err := fmt.Fprintf(w, "%s: rule %q: %s: %s\n", severity, p.Rule, location, p.Message); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d errors, %d warnings\n", errors, warnings)
+	return err
+}
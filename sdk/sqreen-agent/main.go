@@ -0,0 +1,68 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Command sqreen-agent provides offline tools around the agent rules.
+//
+// Usage:
+//		sqreen-agent <command> [arguments]
+//
+// The commands are:
+//		lint      check the binding accessor expressions of rules
+//		replay    run a rulespack against recorded HTTP requests
+//		sign      sign rules with a local private key
+//
+// Commands running rules require the tool to be compiled with the
+// instrumentation tool, like any program protected by the agent:
+//		go build -a -toolexec $(go env GOPATH)/bin/sqreen-instrumentation-tool github.com/sqreen/go-agent/sdk/sqreen-agent
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+type command struct {
+	name  string
+	short string
+	run   func(args []string) (exitCode int)
+}
+
+var commands = []command{
+	{name: "lint", short: "check the binding accessor expressions of rules", run: lintCommand},
+	{name: "replay", short: "run a rulespack against recorded HTTP requests", run: replayCommand},
+	{name: "sign", short: "sign rules with a local private key", run: signCommand},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sqreen-agent: ")
+	log.SetOutput(os.Stderr)
+
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	name, args := os.Args[1], os.Args[2:]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
+		}
+	}
+
+	if name != "-h" && name != "-help" && name != "help" {
+		log.Printf("unknown command `%s`", name)
+	}
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n\tsqreen-agent <command> [arguments]\n\nThe commands are:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-10s%s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nUse \"sqreen-agent <command> -h\" for more information about a command.\n")
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sqreen/go-agent/internal/backend/api"
+	"github.com/sqreen/go-agent/internal/config"
+	"github.com/sqreen/go-agent/internal/plog"
+	"github.com/sqreen/go-agent/internal/replay"
+	"github.com/sqreen/go-agent/internal/rule"
+)
+
+// Exit code of the replay command when attacks were detected and the
+// `-fail-on-attack` option is set.
+const replayAttackExitCode = 3
+
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n\tsqreen-agent replay [options] -rules <rulespack.json> <capture.har|capture.jsonl>...\n\n")
+		fmt.Fprintf(flags.Output(), "Replay runs the rules of the rulespack against the requests of the HAR or\nJSON-lines captures, and prints the attacks, blocking decisions and rule\nexecution times.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	var (
+		rulesFile    = flags.String("rules", "", "rulespack JSON file, either a rulespack object or an array of rules")
+		jsonOutput   = flags.Bool("json", false, "print the results in JSON")
+		failOnAttack = flags.Bool("fail-on-attack", false, fmt.Sprintf("exit with code %d when attacks are detected", replayAttackExitCode))
+		publicKeys   = flags.String("public-keys", "", "PEM file of additional public keys trusted to verify the rule signatures")
+		verbose      = flags.Bool("v", false, "print the agent debug logs")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *rulesFile == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logLevel := plog.Error
+	if *verbose {
+		logLevel = plog.Debug
+	}
+	logger := plog.NewLogger(logLevel, os.Stderr, nil)
+
+	var rulespack *api.RulesPackResponse
+	err := readFile(*rulesFile, func(r io.Reader) (err error) {
+		rulespack, err = replay.ReadRulesPack(r)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var requests []*replay.Request
+	for _, capture := range flags.Args() {
+		err := readFile(capture, func(r io.Reader) error {
+			captured, err := replay.ReadCapture(r)
+			requests = append(requests, captured...)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	publicKey, err := rule.NewECDSAPublicKey(config.PublicKey)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var localPublicKeys []rule.PublicKey
+	if *publicKeys != "" {
+		err := readFile(*publicKeys, func(r io.Reader) error {
+			buf, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			localPublicKeys, err = rule.NewECDSAPublicKeys(buf)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	replayer, err := replay.NewReplayer(logger, rulespack, publicKey, localPublicKeys)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer replayer.Close()
+
+	results := make([]*replay.Result, 0, len(requests))
+	attacks := 0
+	for _, req := range requests {
+		result, err := replayer.Replay(req)
+		if err != nil {
+			log.Printf("%s %s: %v", req.Method, req.URL, err)
+			return 1
+		}
+		attacks += len(result.Attacks)
+		results = append(results, result)
+	}
+
+	timings, err := replayer.RuleTimings()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if *jsonOutput {
+		err = printReplayJSON(os.Stdout, results, timings)
+	} else {
+		err = printReplayText(os.Stdout, results, timings)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if *failOnAttack && attacks > 0 {
+		return replayAttackExitCode
+	}
+	return 0
+}
+
+func readFile(filename string, read func(io.Reader) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := read(f); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+func printReplayJSON(w io.Writer, results []*replay.Result, timings []replay.RuleTiming) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Results     []*replay.Result    `json:"results"`
+		RuleTimings []replay.RuleTiming `json:"rule_timings"`
+	}{
+		Results:     results,
+		RuleTimings: timings,
+	})
+}
+
+func printReplayText(w io.Writer, results []*replay.Result, timings []replay.RuleTiming) error {
+	var blocked, attacks int
+	for _, result := range results {
+		decision := "allowed"
+		if result.Blocked {
+			decision = "blocked"
+			blocked++
+		}
+		fmt.Fprintf(w, "%s %s: %s (status %d, sqreen time %s)\n", result.Request.Method, result.Request.URL, decision, result.Status, result.SqreenTime)
+		for _, attack := range result.Attacks {
+			attacks++
+			info, err := json.Marshal(attack.Info)
+			if err != nil {
+				info = []byte(fmt.Sprintf("%v", attack.Info))
+			}
+			fmt.Fprintf(w, "\tattack: rule=%q type=%q blocked=%t test=%t info=%s\n", attack.Rule, attack.AttackType, attack.Blocked, attack.Test, info)
+		}
+	}
+	fmt.Fprintf(w, "\n%d requests, %d attacks, %d blocked\n", len(results), attacks, blocked)
+
+	if len(timings) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "\nrule execution times:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tCALLBACK\tCALLS\tMAX")
+	for _, timing := range timings {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", timing.Rule, timing.Callback, timing.Calls, timing.Max)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sqreen/go-agent/internal/rule"
+)
+
+func signCommand(args []string) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n\tsqreen-agent sign [options] -key <private.pem> <rules.json>\n\n")
+		fmt.Fprintf(flags.Output(), "Sign signs the rules of the JSON file, either a rulespack object or an array\nof rules, with the ECDSA private key, and prints the signed rules. The agent\nverifies them when the corresponding public key is listed in the PEM file of\nthe `rules_public_keys` configuration.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	var (
+		keyFile = flags.String("key", "", "PEM ECDSA private key file, in the SEC 1 or PKCS #8 format")
+		keys    = flags.String("keys", "", "comma-separated list of the signed rule keys (default every rule key but the signature)")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *keyFile == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	privateKeyPEM, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	privateKey, err := rule.NewECDSAPrivateKey(string(privateKeyPEM))
+	if err != nil {
+		log.Printf("%s: %v", *keyFile, err)
+		return 1
+	}
+	keyID, err := publicKeyID(&privateKey.PublicKey)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var signedKeys []string
+	if *keys != "" {
+		signedKeys = strings.Split(*keys, ",")
+	}
+
+	var signed interface{}
+	err = readFile(flags.Arg(0), func(r io.Reader) (err error) {
+		signed, err = signRules(r, signedKeys, privateKey)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(signed); err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("rules signed with the key `%s`", keyID)
+	return 0
+}
+
+// signRules signs the rules of the given rulespack object or array of rules,
+// and returns it with the rule signatures. Rule fields are kept as-is.
+func signRules(r io.Reader, keys []string, privateKey *ecdsa.PrivateKey) (interface{}, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	isArray := false
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		isArray = true
+	}
+
+	var rulespack map[string]json.RawMessage
+	var rulesJSON json.RawMessage = buf
+	if !isArray {
+		if err := json.Unmarshal(buf, &rulespack); err != nil {
+			return nil, fmt.Errorf("rulespack: json decoding: %v", err)
+		}
+		rulesJSON = rulespack["rules"]
+	}
+
+	var rules []map[string]json.RawMessage
+	if err := json.Unmarshal(rulesJSON, &rules); err != nil {
+		return nil, fmt.Errorf("rules: json decoding: %v", err)
+	}
+	for i, r := range rules {
+		signature, err := rule.SignRule(r, keys, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		signatureJSON, err := json.Marshal(signature)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: signature json encoding: %v", i+1, err)
+		}
+		r["signature"] = signatureJSON
+	}
+
+	if isArray {
+		return rules, nil
+	}
+	rulesJSON, err = json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	rulespack["rules"] = rulesJSON
+	return rulespack, nil
+}
+
+func publicKeyID(publicKey *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return rule.PublicKeyFingerprint(der), nil
+}
@@ -200,6 +200,7 @@ var (
 	limitedInstrumentationPkgPaths = []string{
 		"os",
 		"net/http",
+		"html/template",
 		"github.com/gin-gonic/gin",
 		"github.com/labstack/echo",
 		"github.com/labstack/echo/v4",
@@ -220,6 +221,10 @@ var (
 			"client.go",
 			"request.go",
 		},
+		"html/template": {
+			// Limited to the template execution functions
+			"template.go",
+		},
 		"github.com/gin-gonic/gin": {
 			// Same comment as net/http
 			"context.go", // context.go contains the body parsers
@@ -4,7 +4,11 @@
 
 package types
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"io"
+)
 
 // SqreenError is the wrapper error type returned by every Sqreen protection.
 // It allows to implement specific error management logic when Sqreen has
@@ -24,3 +28,37 @@ type SqreenError struct {
 
 func (e SqreenError) Error() string { return fmt.Sprintf("sqreen: %s", e.Err) }
 func (e SqreenError) Unwrap() error { return e.Err }
+
+// FileUpload is a file uploaded in a multipart/form-data request body.
+type FileUpload struct {
+	// FieldName is the name of the form field of the file.
+	FieldName string
+	// Filename is the file name sent by the client, as is.
+	Filename string
+	// ContentType is the content type of the file declared by the client.
+	ContentType string
+	// SniffedContentType is the content type of the file detected from its
+	// content prefix using the algorithm of `http.DetectContentType()`.
+	SniffedContentType string
+	// Size is the size of the file in bytes.
+	Size int64
+	// Prefix is the beginning of the file content, up to 512 bytes.
+	Prefix []byte
+}
+
+// FileUploadScanner is the interface of file upload scanners allowing to plug
+// custom content scanners, such as anti-viruses, into the file upload
+// protection. ScanFileUpload is called for every uploaded file with the
+// request context and the file content, up to its first 4 MB. A non-nil error
+// reports the file as malicious, and the error message is used as the attack
+// details.
+type FileUploadScanner interface {
+	ScanFileUpload(ctx context.Context, upload *FileUpload, content io.Reader) error
+}
+
+// FileUploadScannerFunc is a function type implementing FileUploadScanner.
+type FileUploadScannerFunc func(ctx context.Context, upload *FileUpload, content io.Reader) error
+
+func (f FileUploadScannerFunc) ScanFileUpload(ctx context.Context, upload *FileUpload, content io.Reader) error {
+	return f(ctx, upload, content)
+}